@@ -48,6 +48,7 @@ type TimeEvent struct {
 	interval   int64
 	proc       TimeProc
 	clientData any
+	removed    bool // removed while it's ready to be processed
 }
 
 type EventLoop struct {
@@ -130,10 +131,11 @@ func (el *EventLoop) RemoveFileEvent(fd socket.FD, mask TypeFileEvent) error {
 	return nil
 }
 
-// AddTimeEvent adds time event to event loop
-func (el *EventLoop) AddTimeEvent(mask TypeTimeEvent, interval int64, proc TimeProc, clientData any) error {
+// AddTimeEvent adds time event to event loop, and returns the id of the time event
+func (el *EventLoop) AddTimeEvent(mask TypeTimeEvent, interval int64, proc TimeProc, clientData any) (int64, error) {
+	id := el.timeEventNextID
 	el.timeEventHead.PushFront(&TimeEvent{
-		id:         el.timeEventNextID,
+		id:         id,
 		mask:       mask,
 		when:       now() + interval,
 		interval:   interval,
@@ -143,7 +145,7 @@ func (el *EventLoop) AddTimeEvent(mask TypeTimeEvent, interval int64, proc TimeP
 
 	el.timeEventNextID++
 
-	return nil
+	return id, nil
 }
 
 // RemoveTimeEvent removes time event from event loop
@@ -151,6 +153,7 @@ func (el *EventLoop) RemoveTimeEvent(id int64) error {
 	for e := el.timeEventHead.Front(); e != nil; e = e.Next() {
 		te := e.Value.(*TimeEvent)
 		if te.id == id {
+			te.removed = true
 			el.timeEventHead.Remove(e)
 
 			return nil
@@ -188,8 +191,18 @@ func (el *EventLoop) Stop() {
 // processEvents processes time events and file events
 func (el *EventLoop) processEvents(timeEvents []*TimeEvent, fileEvents []*FileEvent) error {
 	for _, te := range timeEvents {
+		// the time event may be removed by the previous ones.
+		if te.removed {
+			continue
+		}
+
 		te.proc(el, te.id, te.clientData)
 
+		// the time event may also remove itself.
+		if te.removed {
+			continue
+		}
+
 		if te.mask == TypeTimeEventOnce {
 			if err := el.RemoveTimeEvent(te.id); err != nil {
 				return errors.Wrapf(err, "failed to remove time event: %v", te)
@@ -66,15 +66,16 @@ func TestEventLoop_Main(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, len(writeBuf), n)
 
-	err = eventLoop.AddTimeEvent(ae.TypeTimeEventOnce, 10, func(el *ae.EventLoop, id int64, clientData any) {
+	id, err := eventLoop.AddTimeEvent(ae.TypeTimeEventOnce, 10, func(el *ae.EventLoop, id int64, clientData any) {
 		require.Equal(t, int64(0), id)
 	}, nil)
 	require.NoError(t, err)
+	require.Equal(t, int64(0), id)
 
 	stop := make(chan struct{}, 10*2)
 
 	timeEventCalled := 0
-	err = eventLoop.AddTimeEvent(ae.TypeTimeEventNormal, 10, func(el *ae.EventLoop, id int64, clientData any) {
+	id, err = eventLoop.AddTimeEvent(ae.TypeTimeEventNormal, 10, func(el *ae.EventLoop, id int64, clientData any) {
 		require.Equal(t, int64(1), id)
 
 		if timeEventCalled == 10 {
@@ -85,6 +86,7 @@ func TestEventLoop_Main(t *testing.T) {
 		stop <- struct{}{}
 	}, nil)
 	require.NoError(t, err)
+	require.Equal(t, int64(1), id)
 
 	beforeSleepCalled := 0
 	eventLoop.SetBeforeSleepProc(func(el *ae.EventLoop) {
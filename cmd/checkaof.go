@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/IfanTsai/metis/server"
+	"github.com/spf13/cobra"
+)
+
+var fixAof bool
+
+var checkAofCmd = &cobra.Command{
+	Use:   "check-aof [--fix] <file.manifest|file.aof>",
+	Short: "check and repair an append only file",
+	Long: "check-aof parses an append only file, or all the files listed in an append only manifest, " +
+		"and reports the first invalid offset, the number of commands and the number of each command. " +
+		"With --fix, the last file is truncated to the last valid command.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if !checkAof(args[0], fixAof) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	checkAofCmd.Flags().BoolVar(&fixAof, "fix", false, "truncate the file to the last valid command")
+	rootCmd.AddCommand(checkAofCmd)
+}
+
+// checkAof checks the AOF file or all the AOF files in the manifest, returns true if they are valid
+// or they are fixed.
+func checkAof(filename string, fix bool) bool {
+	filenames := []string{filename}
+	if server.IsAofManifest(filename) {
+		var err error
+		if filenames, err = server.AofManifestFiles(filename); err != nil {
+			fmt.Println("Failed to read the AOF manifest:", err)
+
+			return false
+		}
+	}
+
+	for i, filename := range filenames {
+		result, err := server.CheckAppendOnlyFile(filename)
+		if err != nil {
+			fmt.Println("Failed to check the AOF file:", err)
+
+			return false
+		}
+
+		printAofCheckResult(result)
+
+		if result.IsValid() {
+			continue
+		}
+
+		if !fix {
+			fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+
+			return false
+		}
+
+		if !result.IsFixable() {
+			fmt.Printf("AOF %s can't be fixed by truncating.\n", filename)
+
+			return false
+		}
+
+		// only the last file may be truncated, the commands in the following files depend on the previous ones.
+		if i != len(filenames)-1 {
+			fmt.Printf("AOF %s is not the last file and it can't be fixed by truncating.\n", filename)
+
+			return false
+		}
+
+		if err := os.Truncate(filename, result.ValidOffset); err != nil {
+			fmt.Println("Failed to truncate AOF:", err)
+
+			return false
+		}
+
+		fmt.Printf("Successfully truncated AOF %s from %d bytes to %d bytes\n",
+			filename, result.Size, result.ValidOffset)
+	}
+
+	fmt.Println("AOF is valid")
+
+	return true
+}
+
+func printAofCheckResult(result *server.AofCheckResult) {
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n",
+		result.Filename, result.Size, result.ValidOffset, result.Size-result.ValidOffset)
+
+	if result.HasRdbPreamble {
+		fmt.Printf("RDB preamble: keys=%d\n", result.RdbKeys)
+	}
+
+	fmt.Printf("Commands: %d\n", result.Commands)
+
+	names := make([]string, 0, len(result.Histogram))
+	for name := range result.Histogram {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if result.Histogram[names[i]] != result.Histogram[names[j]] {
+			return result.Histogram[names[i]] > result.Histogram[names[j]]
+		}
+
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		fmt.Printf("  %-16s %d\n", name, result.Histogram[name])
+	}
+
+	if !result.IsValid() {
+		fmt.Printf("First invalid offset: %d, reason: %v\n", result.ValidOffset, result.Err)
+	}
+}
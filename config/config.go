@@ -2,6 +2,8 @@ package config
 
 import (
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
@@ -31,24 +33,45 @@ const (
 	LogLevelError LogLevel = "error"
 )
 
+// SaveParam is a snapshotting rule: save the DB if at least Changes writes happened in Seconds.
+type SaveParam struct {
+	Seconds int64
+	Changes int64
+}
+
 type Config struct {
-	Host              string          `mapstructure:"bind"`
-	Port              uint16          `mapstructure:"port"`
-	LogFilepath       string          `mapstructure:"logfile"`
-	LogLevel          LogLevel        `mapstructure:"loglevel"`
-	DatabaseNum       int             `mapstructure:"databases"`
-	RequirePassword   string          `mapstructure:"requirepass"`
-	AofEnable         bool            `mapstructure:"appendonly"`
-	AofFilename       string          `mapstructure:"appendfilename"`
-	AofFsync          TypeAppnedFsync `mapstructure:"appendfsync"`
-	AofRewritePercent uint            `mapstructure:"auto-aof-rewrite-percentage"`
-	AofRewriteMinSize uint            // `mapstructure:"auto-aof-rewrite-min-size"`
+	Host                 string          `mapstructure:"bind"`
+	Port                 uint16          `mapstructure:"port"`
+	LogFilepath          string          `mapstructure:"logfile"`
+	LogLevel             LogLevel        `mapstructure:"loglevel"`
+	DatabaseNum          int             `mapstructure:"databases"`
+	RequirePassword      string          `mapstructure:"requirepass"`
+	RdbFilename          string          `mapstructure:"dbfilename"`
+	SaveParams           []SaveParam     // `mapstructure:"save"`
+	AofEnable            bool            `mapstructure:"appendonly"`
+	AofFilename          string          `mapstructure:"appendfilename"`
+	AofDirname           string          `mapstructure:"appenddirname"`
+	AofFsync             TypeAppnedFsync `mapstructure:"appendfsync"`
+	AofRewritePercent    uint            `mapstructure:"auto-aof-rewrite-percentage"`
+	AofRewriteMinSize    uint            // `mapstructure:"auto-aof-rewrite-min-size"`
+	AofUseRdbPreamble    bool            `mapstructure:"aof-use-rdb-preamble"`
+	AofLoadTruncated     bool            `mapstructure:"aof-load-truncated"`
+	MasterHost           string          // `mapstructure:"replicaof"`
+	MasterPort           uint16          // `mapstructure:"replicaof"`
+	MasterAuth           string          `mapstructure:"masterauth"`
+	ReplicaReadOnly      bool            `mapstructure:"replica-read-only"`
+	ReplBacklogSize      uint            // `mapstructure:"repl-backlog-size"`
+	ClusterEnabled       bool            `mapstructure:"cluster-enabled"`
+	ClusterConfigFile    string          `mapstructure:"cluster-config-file"`
+	NotifyKeyspaceEvents string          `mapstructure:"notify-keyspace-events"`
+	HllSparseMaxBytes    int             `mapstructure:"hll-sparse-max-bytes"`
 }
 
 func LoadConfig(configFile, configType string) *Config {
 	once.Do(func() {
 		viper.SetConfigFile(configFile)
 		viper.SetConfigType(configType)
+		viper.SetDefault("replica-read-only", true)
 
 		if err := viper.ReadInConfig(); err != nil {
 			log.Fatalln("cannot read config:", err)
@@ -59,6 +82,9 @@ func LoadConfig(configFile, configType string) *Config {
 		}
 
 		config.AofRewriteMinSize = viper.GetSizeInBytes("auto-aof-rewrite-min-size")
+		config.SaveParams = parseSaveParams(viper.GetStringSlice("save"))
+		config.MasterHost, config.MasterPort = parseReplicaOf(viper.GetString("replicaof"))
+		config.ReplBacklogSize = viper.GetSizeInBytes("repl-backlog-size")
 
 		viper.WatchConfig()
 
@@ -68,8 +94,55 @@ func LoadConfig(configFile, configType string) *Config {
 			}
 
 			config.AofRewriteMinSize = viper.GetSizeInBytes("auto-aof-rewrite-min-size")
+			config.SaveParams = parseSaveParams(viper.GetStringSlice("save"))
+			config.MasterHost, config.MasterPort = parseReplicaOf(viper.GetString("replicaof"))
+			config.ReplBacklogSize = viper.GetSizeInBytes("repl-backlog-size")
 		})
 	})
 
 	return &config
 }
+
+// parseSaveParams parses the rules like "900 1", which means save after 900 seconds if at least 1 key changed.
+func parseSaveParams(rules []string) []SaveParam {
+	params := make([]SaveParam, 0, len(rules))
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			log.Fatalln("invalid save rule:", rule)
+		}
+
+		seconds, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || seconds < 1 {
+			log.Fatalln("invalid save rule seconds:", rule)
+		}
+
+		changes, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || changes < 0 {
+			log.Fatalln("invalid save rule changes:", rule)
+		}
+
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+
+	return params
+}
+
+// parseReplicaOf parses the master address like "127.0.0.1 6379", an empty string means this is a master.
+func parseReplicaOf(replicaOf string) (string, uint16) {
+	if replicaOf == "" {
+		return "", 0
+	}
+
+	fields := strings.Fields(replicaOf)
+	if len(fields) != 2 {
+		log.Fatalln("invalid replicaof:", replicaOf)
+	}
+
+	port, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		log.Fatalln("invalid replicaof port:", replicaOf)
+	}
+
+	return fields[0], uint16(port)
+}
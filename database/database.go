@@ -5,23 +5,53 @@ import (
 )
 
 type Databse struct {
-	ID     int
-	Dict   *datastruct.Dict
-	Expire *datastruct.Dict // key: string, value: int64
+	ID           int
+	Dict         *datastruct.Dict
+	Expire       *datastruct.Dict // key: string, value: int64
+	BlockingKeys *datastruct.Dict // key: string, value: *list.List of the clients blocked by the key
 }
 
 func NewDatabase(id int) *Databse {
 	return &Databse{
-		ID:     id,
-		Dict:   datastruct.NewDict(&DictType{}),
-		Expire: datastruct.NewDict(&DictType{}),
+		ID:           id,
+		Dict:         datastruct.NewDict(&DictType{}),
+		Expire:       datastruct.NewDict(&DictType{}),
+		BlockingKeys: datastruct.NewDict(&DictType{}),
 	}
 }
 
+// Empty removes all the keys of the database.
+func (db *Databse) Empty() {
+	db.Dict = datastruct.NewDict(&DictType{})
+	db.Expire = datastruct.NewDict(&DictType{})
+}
+
 func (db *Databse) DeepCopy() *Databse {
 	newDB := NewDatabase(db.ID)
 	newDB.Dict = db.Dict.DeepCopy()
 	newDB.Expire = db.Expire.DeepCopy()
 
+	// the copy is read by the background saving while the database is modified, so all the values
+	// modified in place are copied. The strings are immutable, so they are shared.
+	iter := datastruct.NewDictIterator(newDB.Dict)
+	defer iter.Release()
+
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		switch value := entry.Value.(type) {
+		case *datastruct.Quicklist:
+			entry.Value = value.DeepCopy()
+		case *datastruct.Dict:
+			entry.Value = value.DeepCopy()
+		case *datastruct.Set:
+			entry.Value = value.DeepCopy()
+		case *datastruct.Zset:
+			entry.Value = value.DeepCopy()
+		case *datastruct.Stream:
+			entry.Value = value.DeepCopy()
+		case *datastruct.Bitmap:
+			entry.Value = value.DeepCopy()
+		}
+	}
+
 	return newDB
 }
@@ -0,0 +1,36 @@
+package datastruct
+
+// Bitmap is a string modified in place by the bit commands, so that setting a bit doesn't copy the whole
+// string. It's the same as a string for the other commands, which read it by String.
+type Bitmap struct {
+	buf []byte
+}
+
+// NewBitmap returns a bitmap with a copy of the string.
+func NewBitmap(value string) *Bitmap {
+	return &Bitmap{buf: []byte(value)}
+}
+
+// Bytes returns the bytes of the bitmap, which are modified by the later writes.
+func (b *Bitmap) Bytes() []byte {
+	return b.buf
+}
+
+// Grow pads the bitmap with zero bytes to the length at least and returns the bytes to be modified.
+// The capacity grows like append, so that setting the bits one after another is amortized O(1).
+func (b *Bitmap) Grow(length int) []byte {
+	if length > len(b.buf) {
+		b.buf = append(b.buf, make([]byte, length-len(b.buf))...)
+	}
+
+	return b.buf
+}
+
+// String returns a copy of the bitmap as a string.
+func (b *Bitmap) String() string {
+	return string(b.buf)
+}
+
+func (b *Bitmap) DeepCopy() *Bitmap {
+	return &Bitmap{buf: append([]byte(nil), b.buf...)}
+}
@@ -0,0 +1,29 @@
+package datastruct_test
+
+import (
+	"testing"
+
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitmap(t *testing.T) {
+	t.Parallel()
+
+	value := "ab"
+	bitmap := datastruct.NewBitmap(value)
+
+	// the bytes are modified in place without touching the original string.
+	bitmap.Bytes()[0] = 'x'
+	require.Equal(t, "xb", bitmap.String())
+	require.Equal(t, "ab", value)
+
+	buf := bitmap.Grow(4)
+	require.Equal(t, []byte("xb\x00\x00"), buf)
+	require.Len(t, bitmap.Grow(1), 4)
+
+	copied := bitmap.DeepCopy()
+	buf[1] = 'y'
+	require.Equal(t, "xy\x00\x00", bitmap.String())
+	require.Equal(t, "xb\x00\x00", copied.String())
+}
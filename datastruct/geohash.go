@@ -0,0 +1,384 @@
+package datastruct
+
+import (
+	"math"
+)
+
+// the geohash is the same as redis, the longitude and the latitude are interleaved into 52 bits,
+// which is exactly represented by the score of the sorted set.
+const (
+	GeoStepMax   = 26 // 26 * 2 = 52 bits
+	GeoLatMin    = -85.05112878
+	GeoLatMax    = 85.05112878
+	GeoLongMin   = -180.0
+	GeoLongMax   = 180.0
+	geoEarthR    = 6372797.560856 // the earth radius in meters, which is the same as redis
+	geoMercatorM = 20037726.37    // the max distance in meters of the mercator projection
+)
+
+// GeoHashBits is a geohash of step * 2 bits, the even bits are the latitude and the odd ones are the longitude.
+type GeoHashBits struct {
+	Bits uint64
+	Step uint8
+}
+
+// GeoHashArea is the area covered by a geohash.
+type GeoHashArea struct {
+	Hash             GeoHashBits
+	LongMin, LongMax float64
+	LatMin, LatMax   float64
+}
+
+// GeoShape is the area to search, which is a circle of the radius or a box of the width and the height
+// in meters centered on the longitude and the latitude.
+type GeoShape struct {
+	Long, Lat     float64
+	Radius        float64 // the radius of the circle, 0 for the box
+	Width, Height float64 // the size of the box
+}
+
+// GeoValid reports whether the coordinates can be indexed.
+func GeoValid(long, lat float64) bool {
+	return long >= GeoLongMin && long <= GeoLongMax && lat >= GeoLatMin && lat <= GeoLatMax
+}
+
+// GeoHashEncode encodes the coordinates into the geohash of the step, the coordinates must be valid.
+func GeoHashEncode(long, lat float64, step uint8) GeoHashBits {
+	return geoHashEncodeRange(long, lat, GeoLongMin, GeoLongMax, GeoLatMin, GeoLatMax, step)
+}
+
+func geoHashEncodeRange(long, lat, longMin, longMax, latMin, latMax float64, step uint8) GeoHashBits {
+	latOffset := (lat - latMin) / (latMax - latMin) * float64(uint64(1)<<step)
+	longOffset := (long - longMin) / (longMax - longMin) * float64(uint64(1)<<step)
+
+	return GeoHashBits{Bits: interleave64(uint32(latOffset), uint32(longOffset)), Step: step}
+}
+
+// GeoHashDecode returns the area covered by the geohash.
+func GeoHashDecode(hash GeoHashBits) GeoHashArea {
+	ilat, ilong := deinterleave64(hash.Bits)
+	latScale, longScale := GeoLatMax-GeoLatMin, GeoLongMax-GeoLongMin
+	cells := float64(uint64(1) << hash.Step)
+
+	return GeoHashArea{
+		Hash:    hash,
+		LatMin:  GeoLatMin + float64(ilat)/cells*latScale,
+		LatMax:  GeoLatMin + float64(ilat+1)/cells*latScale,
+		LongMin: GeoLongMin + float64(ilong)/cells*longScale,
+		LongMax: GeoLongMin + float64(ilong+1)/cells*longScale,
+	}
+}
+
+// GeoDecodeScore returns the coordinates of the center of the area of the 52 bits geohash score.
+func GeoDecodeScore(score float64) (float64, float64) {
+	area := GeoHashDecode(GeoHashBits{Bits: uint64(score), Step: GeoStepMax})
+	long := math.Max(GeoLongMin, math.Min(GeoLongMax, (area.LongMin+area.LongMax)/2))
+	lat := math.Max(GeoLatMin, math.Min(GeoLatMax, (area.LatMin+area.LatMax)/2))
+
+	return long, lat
+}
+
+// GeoHashString returns the standard geohash of 11 characters, which is encoded in the latitude range
+// of [-90, 90] instead of the one of the mercator projection.
+func GeoHashString(long, lat float64) string {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	hash := geoHashEncodeRange(long, lat, -180, 180, -90, 90, GeoStepMax)
+	buf := make([]byte, 11)
+
+	for i := range buf {
+		// there are only 52 bits, the last character is always '0'.
+		idx := uint64(0)
+		if i < 10 {
+			idx = (hash.Bits >> (52 - (i+1)*5)) & 0x1f
+		}
+
+		buf[i] = alphabet[idx]
+	}
+
+	return string(buf)
+}
+
+// GeoScoreRange returns the range [min, max) of the 52 bits scores in the area of the geohash.
+func GeoScoreRange(hash GeoHashBits) (uint64, uint64) {
+	shift := 52 - 2*uint(hash.Step)
+
+	return hash.Bits << shift, (hash.Bits + 1) << shift
+}
+
+// GeoDistance returns the distance in meters between the coordinates by the haversine formula.
+func GeoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, long1r := degToRad(lat1), degToRad(long1)
+	lat2r, long2r := degToRad(lat2), degToRad(long2)
+
+	v := math.Sin((long2r - long1r) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+
+	return 2 * geoEarthR * math.Asin(math.Sqrt(a))
+}
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return geoEarthR * math.Abs(degToRad(lat2)-degToRad(lat1))
+}
+
+// Contains reports whether the coordinates are in the shape, and returns the distance in meters to the center.
+func (s *GeoShape) Contains(long, lat float64) (float64, bool) {
+	if s.Radius > 0 || (s.Width == 0 && s.Height == 0) {
+		distance := GeoDistance(s.Long, s.Lat, long, lat)
+
+		return distance, distance <= s.Radius
+	}
+
+	// the latitude distance is cheaper, which is checked first.
+	if geoLatDistance(lat, s.Lat) > s.Height/2 {
+		return 0, false
+	}
+
+	if GeoDistance(long, lat, s.Long, lat) > s.Width/2 {
+		return 0, false
+	}
+
+	return GeoDistance(s.Long, s.Lat, long, lat), true
+}
+
+// boundingBox returns the min longitude, the min latitude, the max longitude and the max latitude of the shape.
+func (s *GeoShape) boundingBox() (float64, float64, float64, float64) {
+	width, height := s.Width/2, s.Height/2
+	if s.Radius > 0 || (s.Width == 0 && s.Height == 0) {
+		width, height = s.Radius, s.Radius
+	}
+
+	latDelta := radToDeg(height / geoEarthR)
+	longDeltaTop := radToDeg(width / geoEarthR / math.Cos(degToRad(s.Lat+latDelta)))
+	longDeltaBottom := radToDeg(width / geoEarthR / math.Cos(degToRad(s.Lat-latDelta)))
+
+	// the directions of the northern and southern hemispheres are opposite.
+	longDelta := longDeltaTop
+	if s.Lat < 0 {
+		longDelta = longDeltaBottom
+	}
+
+	return s.Long - longDelta, s.Lat - latDelta, s.Long + longDelta, s.Lat + latDelta
+}
+
+// GeoSearchAreas returns the geohash of the center of the shape and its 8 neighbors, which cover the shape.
+// The areas which don't intersect with the shape are removed, and the duplicated ones are removed
+// when the radius is huge.
+func GeoSearchAreas(shape *GeoShape) []GeoHashBits {
+	minLong, minLat, maxLong, maxLat := shape.boundingBox()
+
+	// the distance from the center to the corner of the box.
+	radius := shape.Radius
+	if radius == 0 {
+		radius = math.Sqrt((shape.Width/2)*(shape.Width/2) + (shape.Height/2)*(shape.Height/2))
+	}
+
+	step := geoEstimateStepsByRadius(radius, shape.Lat)
+	hash := GeoHashEncode(shape.Long, shape.Lat, step)
+	neighbors := geoHashNeighbors(hash)
+
+	// the step may not be small enough when the shape is near the edge of the area.
+	north, south := GeoHashDecode(neighbors[geoNorth]), GeoHashDecode(neighbors[geoSouth])
+	east, west := GeoHashDecode(neighbors[geoEast]), GeoHashDecode(neighbors[geoWest])
+
+	if step > 1 && (north.LatMax < maxLat || south.LatMin > minLat || east.LongMax < maxLong || west.LongMin > minLong) {
+		step--
+		hash = GeoHashEncode(shape.Long, shape.Lat, step)
+		neighbors = geoHashNeighbors(hash)
+	}
+
+	// exclude the areas which are useless.
+	if step >= 2 {
+		area := GeoHashDecode(hash)
+		excluded := make(map[int]bool)
+
+		if area.LatMin < minLat {
+			excluded[geoSouth], excluded[geoSouthWest], excluded[geoSouthEast] = true, true, true
+		}
+
+		if area.LatMax > maxLat {
+			excluded[geoNorth], excluded[geoNorthEast], excluded[geoNorthWest] = true, true, true
+		}
+
+		if area.LongMin < minLong {
+			excluded[geoWest], excluded[geoSouthWest], excluded[geoNorthWest] = true, true, true
+		}
+
+		if area.LongMax > maxLong {
+			excluded[geoEast], excluded[geoSouthEast], excluded[geoNorthEast] = true, true, true
+		}
+
+		for i := range neighbors {
+			if excluded[i] {
+				neighbors[i] = GeoHashBits{}
+			}
+		}
+	}
+
+	areas := []GeoHashBits{hash}
+	last := hash
+
+	for _, neighbor := range neighbors {
+		// the adjacent neighbors may be the same when the radius is huge.
+		if neighbor == (GeoHashBits{}) || neighbor == last {
+			continue
+		}
+
+		areas = append(areas, neighbor)
+		last = neighbor
+	}
+
+	return areas
+}
+
+// geoEstimateStepsByRadius returns the step of the geohash whose area is large enough for the radius in meters.
+func geoEstimateStepsByRadius(radius, lat float64) uint8 {
+	if radius == 0 {
+		return GeoStepMax
+	}
+
+	step := 1
+	for radius < geoMercatorM {
+		radius *= 2
+		step++
+	}
+
+	// make sure the range is included in most of the base cases.
+	step -= 2
+
+	// the areas are narrower towards the poles.
+	if lat > 66 || lat < -66 {
+		step--
+
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	if step < 1 {
+		step = 1
+	}
+
+	if step > GeoStepMax {
+		step = GeoStepMax
+	}
+
+	return uint8(step)
+}
+
+// the order of the neighbors is the same as redis.
+const (
+	geoNorth = iota
+	geoSouth
+	geoEast
+	geoWest
+	geoNorthEast
+	geoNorthWest
+	geoSouthEast
+	geoSouthWest
+)
+
+func geoHashNeighbors(hash GeoHashBits) [8]GeoHashBits {
+	move := func(dx, dy int) GeoHashBits {
+		return geoHashMoveY(geoHashMoveX(hash, dx), dy)
+	}
+
+	return [8]GeoHashBits{
+		geoNorth:     move(0, 1),
+		geoSouth:     move(0, -1),
+		geoEast:      move(1, 0),
+		geoWest:      move(-1, 0),
+		geoNorthEast: move(1, 1),
+		geoNorthWest: move(-1, 1),
+		geoSouthEast: move(1, -1),
+		geoSouthWest: move(-1, -1),
+	}
+}
+
+// geoHashMoveX moves the geohash to the adjacent area in the longitude, which wraps around.
+func geoHashMoveX(hash GeoHashBits, d int) GeoHashBits {
+	if d == 0 {
+		return hash
+	}
+
+	x, y := hash.Bits&0xaaaaaaaaaaaaaaaa, hash.Bits&0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - 2*uint(hash.Step))
+
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - 2*uint(hash.Step))
+
+	return GeoHashBits{Bits: x | y, Step: hash.Step}
+}
+
+// geoHashMoveY moves the geohash to the adjacent area in the latitude, which wraps around.
+func geoHashMoveY(hash GeoHashBits, d int) GeoHashBits {
+	if d == 0 {
+		return hash
+	}
+
+	x, y := hash.Bits&0xaaaaaaaaaaaaaaaa, hash.Bits&0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - 2*uint(hash.Step))
+
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+
+	y &= uint64(0x5555555555555555) >> (64 - 2*uint(hash.Step))
+
+	return GeoHashBits{Bits: x | y, Step: hash.Step}
+}
+
+// interleave64 interleaves the bits of x into the even bits and the ones of y into the odd bits.
+func interleave64(x, y uint32) uint64 {
+	return spreadBits(x) | spreadBits(y)<<1
+}
+
+func deinterleave64(bits uint64) (uint32, uint32) {
+	return squashBits(bits), squashBits(bits >> 1)
+}
+
+// spreadBits moves the bit i of v to the bit 2*i.
+func spreadBits(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000FFFF0000FFFF
+	x = (x | x<<8) & 0x00FF00FF00FF00FF
+	x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+
+	return x
+}
+
+// squashBits moves the bit 2*i of v to the bit i, which is the reverse of spreadBits.
+func squashBits(v uint64) uint32 {
+	x := v & 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x>>4) & 0x00FF00FF00FF00FF
+	x = (x | x>>8) & 0x0000FFFF0000FFFF
+	x = (x | x>>16) & 0x00000000FFFFFFFF
+
+	return uint32(x)
+}
+
+func degToRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radToDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
@@ -0,0 +1,86 @@
+package datastruct_test
+
+import (
+	"testing"
+
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoHashEncode(t *testing.T) {
+	t.Parallel()
+
+	// the scores are the same as redis.
+	palermo := datastruct.GeoHashEncode(13.361389, 38.115556, datastruct.GeoStepMax)
+	require.Equal(t, uint64(3479099956230698), palermo.Bits)
+
+	catania := datastruct.GeoHashEncode(15.087269, 37.502669, datastruct.GeoStepMax)
+	require.Equal(t, uint64(3479447370796909), catania.Bits)
+
+	long, lat := datastruct.GeoDecodeScore(float64(palermo.Bits))
+	require.InDelta(t, 13.36138933897018433, long, 1e-12)
+	require.InDelta(t, 38.11555639549629859, lat, 1e-12)
+
+	require.True(t, datastruct.GeoValid(180, 85.05112878))
+	require.False(t, datastruct.GeoValid(180.1, 0))
+	require.False(t, datastruct.GeoValid(0, 86))
+}
+
+func TestGeoHashString(t *testing.T) {
+	t.Parallel()
+
+	long, lat := datastruct.GeoDecodeScore(3479099956230698)
+	require.Equal(t, "sqc8b49rny0", datastruct.GeoHashString(long, lat))
+
+	long, lat = datastruct.GeoDecodeScore(3479447370796909)
+	require.Equal(t, "sqdtr74hyu0", datastruct.GeoHashString(long, lat))
+}
+
+func TestGeoDistance(t *testing.T) {
+	t.Parallel()
+
+	palermoLong, palermoLat := datastruct.GeoDecodeScore(3479099956230698)
+	cataniaLong, cataniaLat := datastruct.GeoDecodeScore(3479447370796909)
+
+	require.InDelta(t, 166274.1516, datastruct.GeoDistance(palermoLong, palermoLat, cataniaLong, cataniaLat), 1e-4)
+	require.Zero(t, datastruct.GeoDistance(palermoLong, palermoLat, palermoLong, palermoLat))
+}
+
+func TestGeoSearchAreas(t *testing.T) {
+	t.Parallel()
+
+	// every point in the radius must be in one of the areas.
+	shape := &datastruct.GeoShape{Long: 15, Lat: 37, Radius: 200 * 1000}
+	areas := datastruct.GeoSearchAreas(shape)
+	require.NotEmpty(t, areas)
+
+	for long := 12.0; long <= 18; long += 0.1 {
+		for lat := 34.0; lat <= 40; lat += 0.1 {
+			if _, ok := shape.Contains(long, lat); !ok {
+				continue
+			}
+
+			score := datastruct.GeoHashEncode(long, lat, datastruct.GeoStepMax).Bits
+			found := false
+
+			for _, area := range areas {
+				min, max := datastruct.GeoScoreRange(area)
+				if score >= min && score < max {
+					found = true
+
+					break
+				}
+			}
+
+			require.True(t, found, "%f,%f", long, lat)
+		}
+	}
+
+	box := &datastruct.GeoShape{Long: 15, Lat: 37, Width: 400 * 1000, Height: 400 * 1000}
+	_, ok := box.Contains(17.2, 38.7)
+	require.True(t, ok)
+	_, ok = box.Contains(17.4, 37)
+	require.False(t, ok)
+	_, ok = box.Contains(15, 38.9)
+	require.False(t, ok)
+}
@@ -0,0 +1,365 @@
+package datastruct
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// the layout of the HyperLogLog is the same as redis, which is a string of a 16 bytes header
+// followed by the registers in the sparse or the dense representation.
+const (
+	hllP              = 14 // the number of bits of the hash to select the register
+	hllQ              = 64 - hllP
+	HLLRegisters      = 1 << hllP
+	hllBits           = 6 // the number of bits of a dense register
+	hllRegisterMax    = 1<<hllBits - 1
+	hllHeaderSize     = 16
+	hllDenseSize      = hllHeaderSize + (HLLRegisters*hllBits+7)/8
+	hllMagic          = "HYLL"
+	hllEncodingDense  = 0
+	hllEncodingSparse = 1
+	hllHashSeed       = 0xadc83b19
+	hllAlphaInf       = 0.721347520444481703680 // 1 / (2 * ln(2))
+
+	// the opcodes of the sparse representation:
+	// ZERO  00xxxxxx: 1 to 64 registers are zero.
+	// XZERO 01xxxxxx yyyyyyyy: 1 to 16384 registers are zero.
+	// VAL   1vvvvvxx: 1 to 4 registers are set to the value 1 to 32.
+	hllSparseZeroMaxLen  = 64
+	hllSparseXZeroMaxLen = 16384
+	hllSparseValMaxLen   = 4
+	hllSparseValMaxValue = 32
+
+	// HLLSparseMaxBytes is the default max size of the sparse representation, it's converted to the dense
+	// one when it grows larger.
+	HLLSparseMaxBytes = 3000
+)
+
+var ErrInvalidHyperLogLog = errors.New("invalid HyperLogLog")
+
+// HyperLogLog estimates the number of the distinct elements added in 12KB at most with an error of 0.81%.
+// The registers are decoded from the string in memory, and encoded back by Encode.
+type HyperLogLog struct {
+	registers [HLLRegisters]uint8
+	dense     bool
+	card      uint64 // the cached cardinality, which is valid if cardValid is true
+	cardValid bool
+}
+
+// NewHyperLogLog returns an empty HyperLogLog in the sparse representation.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{cardValid: true}
+}
+
+// ParseHyperLogLog decodes the HyperLogLog from the string in the format of redis.
+func ParseHyperLogLog(value string) (*HyperLogLog, error) {
+	if len(value) < hllHeaderSize || value[:len(hllMagic)] != hllMagic {
+		return nil, ErrInvalidHyperLogLog
+	}
+
+	h := &HyperLogLog{}
+
+	// the highest bit of the cached cardinality marks it invalid.
+	card := binary.LittleEndian.Uint64([]byte(value[8:hllHeaderSize]))
+	h.card, h.cardValid = card&^(1<<63), card&(1<<63) == 0
+
+	switch value[4] {
+	case hllEncodingDense:
+		if len(value) != hllDenseSize {
+			return nil, ErrInvalidHyperLogLog
+		}
+
+		h.dense = true
+		for i := range h.registers {
+			// a register is at most hllQ+1, the larger ones can only come from a corrupted string.
+			if h.registers[i] = hllDenseGetRegister(value[hllHeaderSize:], i); h.registers[i] > hllQ+1 {
+				return nil, ErrInvalidHyperLogLog
+			}
+		}
+	case hllEncodingSparse:
+		if err := h.decodeSparse(value[hllHeaderSize:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidHyperLogLog
+	}
+
+	return h, nil
+}
+
+func (h *HyperLogLog) decodeSparse(opcodes string) error {
+	index := 0
+	for i := 0; i < len(opcodes); i++ {
+		opcode := opcodes[i]
+
+		var runLen int
+		var value uint8
+
+		switch {
+		case opcode&0xc0 == 0x00: // ZERO
+			runLen = int(opcode&0x3f) + 1
+		case opcode&0xc0 == 0x40: // XZERO
+			if i+1 == len(opcodes) {
+				return ErrInvalidHyperLogLog
+			}
+
+			i++
+			runLen = (int(opcode&0x3f)<<8 | int(opcodes[i])) + 1
+		default: // VAL
+			runLen, value = int(opcode&0x03)+1, (opcode>>2)&0x1f+1
+		}
+
+		if index+runLen > HLLRegisters {
+			return ErrInvalidHyperLogLog
+		}
+
+		for j := index; j < index+runLen; j++ {
+			h.registers[j] = value
+		}
+
+		index += runLen
+	}
+
+	if index != HLLRegisters {
+		return ErrInvalidHyperLogLog
+	}
+
+	return nil
+}
+
+// Add adds the element, it returns true if a register is changed.
+func (h *HyperLogLog) Add(element string) bool {
+	hash := murmurHash64A(element, hllHashSeed)
+	index := hash & (HLLRegisters - 1)
+
+	// the number of the trailing zeros plus one of the rest bits, which is at most hllQ+1.
+	count := uint8(bits.TrailingZeros64(hash>>hllP|1<<hllQ) + 1)
+	if count <= h.registers[index] {
+		return false
+	}
+
+	h.registers[index] = count
+	h.cardValid = false
+
+	return true
+}
+
+// Merge sets the registers to the max of the ones of h and other, the result is dense if any of them is.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, value := range other.registers {
+		if value > h.registers[i] {
+			h.registers[i] = value
+		}
+	}
+
+	h.dense = h.dense || other.dense
+	h.cardValid = false
+}
+
+// Cached reports whether the cardinality is cached, it's invalidated when the registers are changed.
+func (h *HyperLogLog) Cached() bool {
+	return h.cardValid
+}
+
+// Count returns the estimated cardinality, which is cached until the registers are changed.
+func (h *HyperLogLog) Count() uint64 {
+	if h.cardValid {
+		return h.card
+	}
+
+	h.card, h.cardValid = h.estimate(), true
+
+	return h.card
+}
+
+// estimate is the improved estimator of "New cardinality estimation algorithms for HyperLogLog sketches"
+// by Otmar Ertl, which is the same as redis.
+func (h *HyperLogLog) estimate() uint64 {
+	var histogram [hllRegisterMax + 1]int
+	for _, value := range h.registers {
+		histogram[value]++
+	}
+
+	m := float64(HLLRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// Encode encodes the HyperLogLog into the string in the format of redis. The sparse representation is
+// converted to the dense one if it's larger than sparseMaxBytes or any register can't be represented,
+// the dense one is never converted back.
+func (h *HyperLogLog) Encode(sparseMaxBytes int) string {
+	header := make([]byte, hllHeaderSize, hllHeaderSize+sparseMaxBytes)
+	copy(header, hllMagic)
+
+	card := h.card
+	if !h.cardValid {
+		card |= 1 << 63
+	}
+
+	binary.LittleEndian.PutUint64(header[8:], card)
+
+	if !h.dense {
+		header[4] = hllEncodingSparse
+		if buf, ok := h.encodeSparse(header, sparseMaxBytes); ok {
+			return string(buf)
+		}
+
+		h.dense = true
+	}
+
+	buf := make([]byte, hllDenseSize)
+	copy(buf, header[:hllHeaderSize])
+	buf[4] = hllEncodingDense
+
+	for i, value := range h.registers {
+		hllDenseSetRegister(buf[hllHeaderSize:], i, value)
+	}
+
+	return string(buf)
+}
+
+func (h *HyperLogLog) encodeSparse(buf []byte, sparseMaxBytes int) ([]byte, bool) {
+	for i := 0; i < HLLRegisters; {
+		value := h.registers[i]
+		if value > hllSparseValMaxValue {
+			return nil, false
+		}
+
+		runLen := 1
+		for i+runLen < HLLRegisters && h.registers[i+runLen] == value {
+			runLen++
+		}
+
+		i += runLen
+
+		for runLen > 0 {
+			switch {
+			case value != 0:
+				n := lo.Min([]int{runLen, hllSparseValMaxLen})
+				buf = append(buf, 0x80|(value-1)<<2|byte(n-1))
+				runLen -= n
+			case runLen > hllSparseZeroMaxLen:
+				n := lo.Min([]int{runLen, hllSparseXZeroMaxLen})
+				buf = append(buf, 0x40|byte((n-1)>>8), byte(n-1))
+				runLen -= n
+			default:
+				buf = append(buf, byte(runLen-1))
+				runLen = 0
+			}
+		}
+
+		if len(buf) > sparseMaxBytes {
+			return nil, false
+		}
+	}
+
+	return buf, true
+}
+
+// the registers of 6 bits are packed from the least significant bit of the bytes.
+func hllDenseGetRegister(registers string, index int) uint8 {
+	byteIndex, shift := index*hllBits/8, uint(index*hllBits&7)
+
+	value := uint(registers[byteIndex]) >> shift
+	if byteIndex+1 < len(registers) {
+		value |= uint(registers[byteIndex+1]) << (8 - shift)
+	}
+
+	return uint8(value & hllRegisterMax)
+}
+
+func hllDenseSetRegister(registers []byte, index int, value uint8) {
+	byteIndex, shift := index*hllBits/8, uint(index*hllBits&7)
+
+	registers[byteIndex] &^= hllRegisterMax << shift
+	registers[byteIndex] |= value << shift
+
+	if byteIndex+1 < len(registers) {
+		registers[byteIndex+1] &^= hllRegisterMax >> (8 - shift)
+		registers[byteIndex+1] |= value >> (8 - shift)
+	}
+}
+
+// murmurHash64A is the 64 bits hash by Austin Appleby, the blocks are read in little endian as redis does.
+func murmurHash64A(key string, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+
+	h := seed ^ uint64(len(key))*m
+
+	data := []byte(key)
+	for ; len(data) >= 8; data = data[8:] {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
@@ -0,0 +1,113 @@
+package datastruct_test
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLog_Encode(t *testing.T) {
+	t.Parallel()
+
+	// the empty HyperLogLog is the same as the one created by redis.
+	empty := datastruct.NewHyperLogLog().Encode(datastruct.HLLSparseMaxBytes)
+	require.Equal(t, "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff", empty)
+
+	h, err := datastruct.ParseHyperLogLog(empty)
+	require.NoError(t, err)
+	require.True(t, h.Cached())
+	require.Equal(t, uint64(0), h.Count())
+
+	require.True(t, h.Add("a"))
+	require.False(t, h.Add("a"))
+	require.False(t, h.Cached())
+
+	sparse := h.Encode(datastruct.HLLSparseMaxBytes)
+	require.Equal(t, byte(1), sparse[4])
+	require.Equal(t, byte(0x80), sparse[15]&0x80, "the cached cardinality is invalid")
+
+	h, err = datastruct.ParseHyperLogLog(sparse)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), h.Count())
+
+	// the cardinality is cached in the header.
+	cached := h.Encode(datastruct.HLLSparseMaxBytes)
+	require.Equal(t, "\x01\x00\x00\x00\x00\x00\x00\x00", cached[8:16])
+	require.Equal(t, sparse[16:], cached[16:])
+
+	// the sparse representation is converted to the dense one when it grows too large.
+	for i := 0; i < 1000; i++ {
+		h.Add(strconv.Itoa(i))
+	}
+
+	require.Equal(t, byte(1), h.Encode(datastruct.HLLSparseMaxBytes)[4])
+
+	for i := 1000; i < 3000; i++ {
+		h.Add(strconv.Itoa(i))
+	}
+
+	card := h.Count()
+	dense := h.Encode(datastruct.HLLSparseMaxBytes)
+	require.Equal(t, byte(0), dense[4])
+	require.Len(t, dense, 16+16384*6/8)
+
+	parsed, err := datastruct.ParseHyperLogLog(dense)
+	require.NoError(t, err)
+	require.True(t, parsed.Cached())
+	require.Equal(t, card, parsed.Count())
+	require.Equal(t, dense, parsed.Encode(datastruct.HLLSparseMaxBytes))
+
+	// the dense one is kept even if it's small enough to be sparse.
+	require.Equal(t, dense, parsed.Encode(math.MaxInt32))
+
+	// ZERO of 64 registers, VAL of 1 register set to 2 and XZERO of the rest registers.
+	handcrafted := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x3f\x84\x7f\xbe"
+	h, err = datastruct.ParseHyperLogLog(handcrafted)
+	require.NoError(t, err)
+	require.False(t, h.Cached())
+	require.Equal(t, handcrafted, h.Encode(datastruct.HLLSparseMaxBytes))
+	require.Equal(t, uint64(1), h.Count())
+
+	for _, invalid := range []string{
+		"",
+		"HYLX\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff",
+		"HYLL\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff",
+		"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xfe",
+		"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff\x00",
+		"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f",
+		dense[:len(dense)-1],
+		// the dense registers of 63 are larger than any register can be.
+		"HYLL\x00" + strings.Repeat("\x00", 11) + strings.Repeat("\xff", 16384*6/8),
+	} {
+		_, err := datastruct.ParseHyperLogLog(invalid)
+		require.ErrorIs(t, err, datastruct.ErrInvalidHyperLogLog, "%q", invalid)
+	}
+}
+
+func TestHyperLogLog_Count(t *testing.T) {
+	t.Parallel()
+
+	h := datastruct.NewHyperLogLog()
+	other := datastruct.NewHyperLogLog()
+
+	for _, n := range []int{10, 100, 1000, 10000, 100000} {
+		for i := 0; i < n; i++ {
+			h.Add("element:" + strconv.Itoa(i))
+		}
+
+		// the error is 0.81% with the standard deviation.
+		require.InDelta(t, n, h.Count(), float64(n)*0.03, "n %d", n)
+	}
+
+	for i := 50000; i < 150000; i++ {
+		other.Add("element:" + strconv.Itoa(i))
+	}
+
+	h.Merge(other)
+	require.False(t, h.Cached())
+	require.InDelta(t, 150000, h.Count(), 150000*0.03)
+}
@@ -268,3 +268,16 @@ func (q *Quicklist) get(index int) *QuicklistIterator {
 		quicklist: q,
 	}
 }
+
+// DeepCopy returns a copy of the quicklist which can be read while the quicklist is modified.
+func (q *Quicklist) DeepCopy() *Quicklist {
+	quicklist := NewQuicklist()
+	for node := q.data.Front(); node != nil; node = node.Next() {
+		page := node.Value.(quicklistPage)
+		quicklist.data.PushBack(append(make(quicklistPage, 0, pageSize), page...))
+	}
+
+	quicklist.length = q.length
+
+	return quicklist
+}
@@ -81,3 +81,22 @@ func TestQuicklist_Range(t *testing.T) {
 	}
 
 }
+
+func TestQuicklist_DeepCopy(t *testing.T) {
+	q := datastruct.NewQuicklist()
+	for i := 0; i < 3000; i++ {
+		q.PushBack("value" + strconv.Itoa(i))
+	}
+
+	copied := q.DeepCopy()
+
+	// the copy isn't changed by the writes of the original one.
+	q.Insert(1, "inserted")
+	q.PopFront()
+	q.PushBack("pushed")
+
+	require.Equal(t, 3000, copied.Len())
+	for i, value := range copied.Range(0, -1) {
+		require.Equal(t, "value"+strconv.Itoa(i), value)
+	}
+}
@@ -86,3 +86,8 @@ func (s *Set) Difference(other *Set) *Set {
 
 	return result
 }
+
+// DeepCopy returns a copy of the set which can be read while the set is modified.
+func (s *Set) DeepCopy() *Set {
+	return &Set{dict: s.dict.DeepCopy()}
+}
@@ -121,3 +121,20 @@ func TestSet_Difference(t *testing.T) {
 		require.False(t, s3.Contains("key"+strconv.Itoa(i)))
 	}
 }
+
+func TestSet_DeepCopy(t *testing.T) {
+	t.Parallel()
+
+	s := datastruct.NewSet(&dictType{})
+	for i := 0; i < 100; i++ {
+		s.Add("key" + strconv.Itoa(i))
+	}
+
+	copied := s.DeepCopy()
+	require.NoError(t, s.Delete("key0"))
+	s.Add("added")
+
+	require.Equal(t, int64(100), copied.Size())
+	require.True(t, copied.Contains("key0"))
+	require.False(t, copied.Contains("added"))
+}
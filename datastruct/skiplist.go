@@ -160,9 +160,9 @@ func (s *Skiplist) DeleteRangeByRank(start, end int64) []*SkiplistNode {
 
 	update := make([]*SkiplistNode, maxLevel)
 	x := s.Head
+	rank := int64(0)
 
 	for i := s.Level - 1; i >= 0; i-- {
-		rank := int64(0)
 		for x.Levels[i].Forward != nil && (rank+x.Levels[i].Span) < start {
 			rank += x.Levels[i].Span
 			x = x.Levels[i].Forward
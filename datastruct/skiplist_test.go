@@ -64,7 +64,13 @@ func TestSkiplist_DeleteRangeByRank(t *testing.T) {
 	s.DeleteRangeByRank(1, 500)
 	require.Equal(t, int64(9500), s.Length)
 
-	s.DeleteRangeByRank(1, 9500)
+	deleted := s.DeleteRangeByRank(9000, 9500)
+	require.Len(t, deleted, 501)
+	require.Equal(t, "value9500", deleted[0].Member)
+	require.Equal(t, "value10000", deleted[500].Member)
+	require.Equal(t, int64(8999), s.Length)
+
+	s.DeleteRangeByRank(1, 8999)
 	require.Equal(t, int64(0), s.Length)
 }
 
@@ -0,0 +1,409 @@
+package datastruct
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+const streamPageSize = 128
+
+// StreamID is the ID of a stream entry, which is made of the milliseconds time and a sequence number.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+var (
+	StreamMinID = StreamID{Ms: 0, Seq: 0}
+	StreamMaxID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+)
+
+// Compare returns -1 if id is less than other, 1 if id is greater than other, 0 otherwise.
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq):
+		return -1
+	case id == other:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// Incr returns the smallest ID greater than id, it returns false if id is the maximum ID.
+func (id StreamID) Incr() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{Ms: id.Ms + 1, Seq: 0}, true
+	default:
+		return id, false
+	}
+}
+
+// Decr returns the greatest ID less than id, it returns false if id is the minimum ID.
+func (id StreamID) Decr() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // field and value pairs
+}
+
+// StreamNACK is a pending entry which was delivered to a consumer but not acknowledged yet.
+type StreamNACK struct {
+	DeliveryTime  int64 // the last delivery time in milliseconds
+	DeliveryCount uint64
+	Consumer      *StreamConsumer
+}
+
+type StreamConsumer struct {
+	Name     string
+	SeenTime int64                    // the last time in milliseconds the consumer was active
+	PEL      map[StreamID]*StreamNACK // the entries delivered to the consumer but not acknowledged
+}
+
+// StreamCG is a consumer group of the stream.
+type StreamCG struct {
+	LastID    StreamID                 // the last entry delivered to the consumers of the group
+	PEL       map[StreamID]*StreamNACK // the entries delivered to the group but not acknowledged
+	consumers map[string]*StreamConsumer
+}
+
+// Stream is an append only log. The entries are kept in the order of their IDs in pages,
+// so that appending and trimming from the head are cheap and ranges are found by binary search.
+type Stream struct {
+	pages  [][]*StreamEntry
+	length int64
+	LastID StreamID // the ID of the last entry ever added, even if it was trimmed
+	groups map[string]*StreamCG
+}
+
+func NewStream() *Stream {
+	return &Stream{groups: make(map[string]*StreamCG)}
+}
+
+func (s *Stream) Len() int64 {
+	return s.length
+}
+
+// Append adds an entry at the end of the stream, the ID must be greater than the last ID.
+func (s *Stream) Append(id StreamID, fields []string) {
+	entry := &StreamEntry{ID: id, Fields: fields}
+
+	if len(s.pages) == 0 || len(s.pages[len(s.pages)-1]) >= streamPageSize {
+		s.pages = append(s.pages, make([]*StreamEntry, 0, streamPageSize))
+	}
+
+	last := len(s.pages) - 1
+	s.pages[last] = append(s.pages[last], entry)
+	s.length++
+	s.LastID = id
+}
+
+// Get returns the entry with the given ID or nil if it doesn't exist.
+func (s *Stream) Get(id StreamID) *StreamEntry {
+	entries := s.Range(id, id, 1, false)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return entries[0]
+}
+
+// Range returns at most count entries with IDs between start and end (inclusive), in the reverse
+// order if reverse is true. A non positive count means no limit.
+func (s *Stream) Range(start, end StreamID, count int64, reverse bool) []*StreamEntry {
+	var entries []*StreamEntry
+	if start.Compare(end) > 0 {
+		return entries
+	}
+
+	full := func() bool {
+		return count > 0 && int64(len(entries)) >= count
+	}
+
+	if !reverse {
+		pageIndex, offset := s.seek(start)
+		for ; pageIndex < len(s.pages); pageIndex++ {
+			page := s.pages[pageIndex]
+			for ; offset < len(page); offset++ {
+				if page[offset].ID.Compare(end) > 0 || full() {
+					return entries
+				}
+
+				entries = append(entries, page[offset])
+			}
+
+			offset = 0
+		}
+
+		return entries
+	}
+
+	// seek the first entry greater than end, and walk backwards from the one before it.
+	pageIndex, offset := len(s.pages), 0
+	if next, ok := end.Incr(); ok {
+		pageIndex, offset = s.seek(next)
+	}
+
+	for !full() {
+		if offset == 0 {
+			if pageIndex == 0 {
+				break
+			}
+
+			pageIndex--
+			offset = len(s.pages[pageIndex])
+		}
+
+		offset--
+
+		entry := s.pages[pageIndex][offset]
+		if entry.ID.Compare(start) < 0 {
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// seek returns the position of the first entry whose ID is greater than or equal to id,
+// the page index is the number of pages if there is no such entry.
+func (s *Stream) seek(id StreamID) (int, int) {
+	pageIndex := sort.Search(len(s.pages), func(i int) bool {
+		page := s.pages[i]
+
+		return page[len(page)-1].ID.Compare(id) >= 0
+	})
+
+	if pageIndex == len(s.pages) {
+		return pageIndex, 0
+	}
+
+	page := s.pages[pageIndex]
+	offset := sort.Search(len(page), func(i int) bool {
+		return page[i].ID.Compare(id) >= 0
+	})
+
+	return pageIndex, offset
+}
+
+// FirstID returns the ID of the first entry, it returns false if the stream is empty.
+func (s *Stream) FirstID() (StreamID, bool) {
+	if s.length == 0 {
+		return StreamMinID, false
+	}
+
+	return s.pages[0][0].ID, true
+}
+
+// TrimMaxLen removes the oldest entries so that there are at most maxLen entries,
+// it returns the number of entries removed.
+func (s *Stream) TrimMaxLen(maxLen int64) int64 {
+	if s.length <= maxLen {
+		return 0
+	}
+
+	removed := s.length - maxLen
+	for remaining := removed; remaining > 0; {
+		page := s.pages[0]
+		if int64(len(page)) <= remaining {
+			remaining -= int64(len(page))
+			s.pages[0] = nil
+			s.pages = s.pages[1:]
+
+			continue
+		}
+
+		// copy the rest of the page so that the removed entries can be garbage collected.
+		s.pages[0] = append([]*StreamEntry(nil), page[remaining:]...)
+		remaining = 0
+	}
+
+	s.length = maxLen
+
+	return removed
+}
+
+// CreateGroup creates a consumer group which delivers the entries after lastID,
+// it returns false if the group already exists.
+func (s *Stream) CreateGroup(name string, lastID StreamID) (*StreamCG, bool) {
+	if _, ok := s.groups[name]; ok {
+		return nil, false
+	}
+
+	group := &StreamCG{
+		LastID:    lastID,
+		PEL:       make(map[StreamID]*StreamNACK),
+		consumers: make(map[string]*StreamConsumer),
+	}
+	s.groups[name] = group
+
+	return group, true
+}
+
+// Group returns the consumer group with the given name or nil if it doesn't exist.
+func (s *Stream) Group(name string) *StreamCG {
+	return s.groups[name]
+}
+
+// DestroyGroup removes the consumer group, it returns false if the group doesn't exist.
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, ok := s.groups[name]; !ok {
+		return false
+	}
+
+	delete(s.groups, name)
+
+	return true
+}
+
+// GroupNames returns the names of the consumer groups in lexicographical order.
+func (s *Stream) GroupNames() []string {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Consumer returns the consumer with the given name, the consumer is created if create is true
+// and it doesn't exist, the second return value is true if the consumer is created.
+func (g *StreamCG) Consumer(name string, create bool, now int64) (*StreamConsumer, bool) {
+	if consumer, ok := g.consumers[name]; ok {
+		return consumer, false
+	}
+
+	if !create {
+		return nil, false
+	}
+
+	consumer := &StreamConsumer{
+		Name:     name,
+		SeenTime: now,
+		PEL:      make(map[StreamID]*StreamNACK),
+	}
+	g.consumers[name] = consumer
+
+	return consumer, true
+}
+
+// ConsumerNames returns the names of the consumers in lexicographical order.
+func (g *StreamCG) ConsumerNames() []string {
+	names := make([]string, 0, len(g.consumers))
+	for name := range g.consumers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// DeleteConsumer removes the consumer with its pending entries, it returns the number of the pending
+// entries removed, or -1 if the consumer doesn't exist.
+func (g *StreamCG) DeleteConsumer(name string) int64 {
+	consumer, ok := g.consumers[name]
+	if !ok {
+		return -1
+	}
+
+	for id := range consumer.PEL {
+		delete(g.PEL, id)
+	}
+
+	delete(g.consumers, name)
+
+	return int64(len(consumer.PEL))
+}
+
+// Claim assigns the pending entry to the consumer with the delivery time, the entry is moved from
+// the previous consumer if it was delivered to another one, or it's created with a zero delivery count.
+func (g *StreamCG) Claim(id StreamID, consumer *StreamConsumer, deliveryTime int64) *StreamNACK {
+	nack, ok := g.PEL[id]
+	if !ok {
+		nack = &StreamNACK{}
+		g.PEL[id] = nack
+	} else if nack.Consumer != consumer {
+		delete(nack.Consumer.PEL, id)
+	}
+
+	nack.Consumer = consumer
+	nack.DeliveryTime = deliveryTime
+	consumer.PEL[id] = nack
+
+	return nack
+}
+
+// Ack removes the entry from the pending entries, it returns false if the entry isn't pending.
+func (g *StreamCG) Ack(id StreamID) bool {
+	nack, ok := g.PEL[id]
+	if !ok {
+		return false
+	}
+
+	delete(g.PEL, id)
+	delete(nack.Consumer.PEL, id)
+
+	return true
+}
+
+// PendingIDs returns the IDs of the pending entries in order.
+func PendingIDs(pel map[StreamID]*StreamNACK) []StreamID {
+	ids := make([]StreamID, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+
+	return ids
+}
+
+// DeepCopy returns a copy of the stream which can be read while the stream is modified. The entries are
+// shared since they are never modified, but the consumer groups are copied.
+func (s *Stream) DeepCopy() *Stream {
+	stream := &Stream{
+		pages:  append([][]*StreamEntry(nil), s.pages...),
+		length: s.length,
+		LastID: s.LastID,
+		groups: make(map[string]*StreamCG, len(s.groups)),
+	}
+
+	for name, group := range s.groups {
+		newGroup, _ := stream.CreateGroup(name, group.LastID)
+
+		for consumerName, consumer := range group.consumers {
+			newConsumer, _ := newGroup.Consumer(consumerName, true, consumer.SeenTime)
+
+			for id, nack := range consumer.PEL {
+				newNack := newGroup.Claim(id, newConsumer, nack.DeliveryTime)
+				newNack.DeliveryCount = nack.DeliveryCount
+			}
+		}
+	}
+
+	return stream
+}
@@ -0,0 +1,139 @@
+package datastruct_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+func newStream(n int) *datastruct.Stream {
+	stream := datastruct.NewStream()
+	for i := 1; i <= n; i++ {
+		stream.Append(datastruct.StreamID{Ms: uint64(i), Seq: 0}, []string{"field", strconv.Itoa(i)})
+	}
+
+	return stream
+}
+
+func TestStreamID(t *testing.T) {
+	t.Parallel()
+
+	id := datastruct.StreamID{Ms: 1, Seq: 2}
+	require.Equal(t, "1-2", id.String())
+	require.Equal(t, 0, id.Compare(datastruct.StreamID{Ms: 1, Seq: 2}))
+	require.Equal(t, -1, id.Compare(datastruct.StreamID{Ms: 2, Seq: 0}))
+	require.Equal(t, 1, id.Compare(datastruct.StreamID{Ms: 1, Seq: 1}))
+
+	next, ok := datastruct.StreamID{Ms: 1, Seq: ^uint64(0)}.Incr()
+	require.True(t, ok)
+	require.Equal(t, datastruct.StreamID{Ms: 2, Seq: 0}, next)
+
+	_, ok = datastruct.StreamMaxID.Incr()
+	require.False(t, ok)
+
+	prev, ok := datastruct.StreamID{Ms: 2, Seq: 0}.Decr()
+	require.True(t, ok)
+	require.Equal(t, datastruct.StreamID{Ms: 1, Seq: ^uint64(0)}, prev)
+
+	_, ok = datastruct.StreamMinID.Decr()
+	require.False(t, ok)
+}
+
+func TestStream_Range(t *testing.T) {
+	t.Parallel()
+
+	stream := newStream(1000)
+	require.Equal(t, int64(1000), stream.Len())
+	require.Equal(t, datastruct.StreamID{Ms: 1000, Seq: 0}, stream.LastID)
+
+	entries := stream.Range(datastruct.StreamMinID, datastruct.StreamMaxID, -1, false)
+	require.Len(t, entries, 1000)
+	for i, entry := range entries {
+		require.Equal(t, uint64(i+1), entry.ID.Ms)
+	}
+
+	entries = stream.Range(datastruct.StreamID{Ms: 100, Seq: 1}, datastruct.StreamID{Ms: 300, Seq: 0}, 10, false)
+	require.Len(t, entries, 10)
+	require.Equal(t, uint64(101), entries[0].ID.Ms)
+
+	entries = stream.Range(datastruct.StreamMinID, datastruct.StreamMaxID, -1, true)
+	require.Len(t, entries, 1000)
+	for i, entry := range entries {
+		require.Equal(t, uint64(1000-i), entry.ID.Ms)
+	}
+
+	entries = stream.Range(datastruct.StreamID{Ms: 100, Seq: 0}, datastruct.StreamID{Ms: 300, Seq: 0}, 3, true)
+	require.Len(t, entries, 3)
+	require.Equal(t, uint64(300), entries[0].ID.Ms)
+	require.Equal(t, uint64(298), entries[2].ID.Ms)
+
+	require.Empty(t, stream.Range(datastruct.StreamID{Ms: 2, Seq: 0}, datastruct.StreamID{Ms: 1, Seq: 0}, -1, false))
+	require.Empty(t, stream.Range(datastruct.StreamID{Ms: 1001, Seq: 0}, datastruct.StreamMaxID, -1, true))
+
+	require.Equal(t, "500", stream.Get(datastruct.StreamID{Ms: 500, Seq: 0}).Fields[1])
+	require.Nil(t, stream.Get(datastruct.StreamID{Ms: 500, Seq: 1}))
+}
+
+func TestStream_TrimMaxLen(t *testing.T) {
+	t.Parallel()
+
+	stream := newStream(1000)
+	require.Zero(t, stream.TrimMaxLen(1000))
+	require.Equal(t, int64(700), stream.TrimMaxLen(300))
+	require.Equal(t, int64(300), stream.Len())
+
+	firstID, ok := stream.FirstID()
+	require.True(t, ok)
+	require.Equal(t, datastruct.StreamID{Ms: 701, Seq: 0}, firstID)
+	require.Len(t, stream.Range(datastruct.StreamMinID, datastruct.StreamMaxID, -1, true), 300)
+
+	require.Equal(t, int64(300), stream.TrimMaxLen(0))
+	_, ok = stream.FirstID()
+	require.False(t, ok)
+	require.Equal(t, datastruct.StreamID{Ms: 1000, Seq: 0}, stream.LastID)
+}
+
+func TestStream_ConsumerGroup(t *testing.T) {
+	t.Parallel()
+
+	stream := newStream(10)
+
+	group, ok := stream.CreateGroup("group", datastruct.StreamMinID)
+	require.True(t, ok)
+	_, ok = stream.CreateGroup("group", datastruct.StreamMinID)
+	require.False(t, ok)
+	require.Equal(t, group, stream.Group("group"))
+
+	alice, created := group.Consumer("alice", true, 1)
+	require.True(t, created)
+	bob, _ := group.Consumer("bob", true, 1)
+	require.Equal(t, []string{"alice", "bob"}, group.ConsumerNames())
+
+	id1 := datastruct.StreamID{Ms: 1, Seq: 0}
+	id2 := datastruct.StreamID{Ms: 2, Seq: 0}
+	group.Claim(id2, alice, 10)
+	nack := group.Claim(id1, alice, 10)
+	nack.DeliveryCount++
+	require.Equal(t, []datastruct.StreamID{id1, id2}, datastruct.PendingIDs(group.PEL))
+
+	// the entry is moved to another consumer when it's claimed.
+	require.Equal(t, nack, group.Claim(id1, bob, 20))
+	require.Equal(t, uint64(1), nack.DeliveryCount)
+	require.Equal(t, int64(20), nack.DeliveryTime)
+	require.Len(t, alice.PEL, 1)
+	require.Len(t, bob.PEL, 1)
+
+	require.True(t, group.Ack(id1))
+	require.False(t, group.Ack(id1))
+	require.Empty(t, bob.PEL)
+
+	require.Equal(t, int64(1), group.DeleteConsumer("alice"))
+	require.Equal(t, int64(-1), group.DeleteConsumer("alice"))
+	require.Empty(t, group.PEL)
+
+	require.True(t, stream.DestroyGroup("group"))
+	require.False(t, stream.DestroyGroup("group"))
+	require.Empty(t, stream.GroupNames())
+}
@@ -27,9 +27,9 @@ func (z *Zset) Add(score float64, member string) bool {
 	element := z.Get(member)
 	if element != nil {
 		if score != element.Score {
-			element.Score = score
 			z.skiplist.Delete(element.Score, element.Member)
 			z.skiplist.Insert(score, member)
+			element.Score = score
 		}
 
 		return false
@@ -148,3 +148,13 @@ func (z *Zset) Size() int64 {
 func (z *Zset) Count(min, max float64) int64 {
 	return z.skiplist.Count(min, max)
 }
+
+// DeepCopy returns a copy of the zset which can be read while the zset is modified.
+func (z *Zset) DeepCopy() *Zset {
+	zset := NewZset(z.dict.DictType)
+	for node := z.skiplist.Head.Levels[0].Forward; node != nil; node = node.Levels[0].Forward {
+		zset.Add(node.Score, node.Member)
+	}
+
+	return zset
+}
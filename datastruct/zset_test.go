@@ -21,6 +21,18 @@ func TestZset_Add(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		require.False(t, zset.Add(float64(i), "value"+strconv.Itoa(i)))
 	}
+
+	// the score of the existing members are updated in order.
+	for i := 0; i < 100; i++ {
+		require.False(t, zset.Add(float64(-i), "value"+strconv.Itoa(i)))
+	}
+
+	require.Equal(t, int64(100), zset.Size())
+
+	for i, element := range zset.RangeByRank(0, 99, false) {
+		require.Equal(t, float64(i-99), element.Score)
+		require.Equal(t, "value"+strconv.Itoa(99-i), element.Member)
+	}
 }
 
 func TestZset_Get(t *testing.T) {
@@ -186,3 +198,22 @@ func TestZset_RangeByScore(t *testing.T) {
 		}
 	}
 }
+
+func TestZset_DeepCopy(t *testing.T) {
+	t.Parallel()
+
+	zset := datastruct.NewZset(&dictType{})
+	for i := 0; i < 100; i++ {
+		zset.Add(float64(i), "value"+strconv.Itoa(i))
+	}
+
+	copied := zset.DeepCopy()
+	zset.Add(-1, "value99")
+	zset.Delete("value0")
+
+	require.Equal(t, int64(100), copied.Size())
+	for i, element := range copied.RangeByRank(0, 99, false) {
+		require.Equal(t, float64(i), element.Score)
+		require.Equal(t, "value"+strconv.Itoa(i), element.Member)
+	}
+}
@@ -2,15 +2,13 @@ package server
 
 import (
 	"bufio"
-	"bytes"
 	"io"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/IfanTsai/go-lib/utils/byteutils"
 	"github.com/IfanTsai/metis/config"
 	"github.com/IfanTsai/metis/database"
 	"github.com/IfanTsai/metis/datastruct"
@@ -26,50 +24,16 @@ const (
 )
 
 // feedAppendOnlyFile is used to feed the AOF file with the command that was just executed.
-func feedAppendOnlyFile(srv *Server, cmd *command, dbID int, args []string) {
-	var aofStr string
-
+func feedAppendOnlyFile(srv *Server, dbID int, cmdStr string) {
 	if srv.aofSelectDBID != dbID {
 		srv.aofSelectDBID = dbID
-		aofStr = catAppendOnlyGenericCommand([]string{"select", strconv.Itoa(dbID)})
-	}
-
-	switch cmd.name {
-	case "expire":
-		// translate EXPIRE to EXPIREAT
-		aofStr += catAppendOnlyExpireCommand(args)
-	case "setex":
-		// translate SETEX to SET and EXPIREAT
-		aofStr += catAppendOnlyGenericCommand([]string{"set", args[1], args[3]})
-		aofStr += catAppendOnlyExpireCommand([]string{"expireat", args[1], args[2]})
-	default:
-		aofStr += catAppendOnlyGenericCommand(args)
+		srv.aofBuf.WriteString(catAppendOnlyGenericCommand([]string{"select", strconv.Itoa(dbID)}))
 	}
 
 	// append to the AOF buffer. This will be flushed on disk just before of re-entering the event loop.
-	srv.aofBuf.WriteString(aofStr)
-
-	// accumulate the differences between the tmp db and the current one in a buffer
-	// if a background aof rewriting is in progress.
-	if srv.backgroundTaskTypeAtomic.Load() == uint32(TypeBackgroundTaskAOFRewrite) {
-		srv.aofRewriteBuf.WriteString(aofStr)
-	}
-}
-
-// catAppendOnlyExpireCommand is used to create the string representation of a EXPIRE command.
-// It is translated to EXPIREAT.
-func catAppendOnlyExpireCommand(args []string) string {
-	expireInt, err := strconv.ParseInt(args[2], 10, 64)
-	if err != nil {
-		log.Fatal("failed to parse expire time", zap.Error(err))
-	}
-
-	when := time.Now().Unix() + expireInt
-
-	args[0] = "expireat"
-	args[2] = strconv.FormatInt(when, 10)
-
-	return catAppendOnlyGenericCommand(args)
+	// Note that there is no need to accumulate the differences during a background AOF rewriting,
+	// since they are written to a new incremental AOF file which is kept after the rewriting.
+	srv.aofBuf.WriteString(cmdStr)
 }
 
 // catAppendOnlyGenericCommand is used to create the string representation of a command
@@ -132,74 +96,155 @@ func aofFileSync(srv *Server) {
 	}
 }
 
-// loadAppendOnlyFile replays the AOF file.
-func loadAppendOnlyFile(srv *Server) {
-	// readline is a helper function that reads a line from the AOF file.
-	readLine := func(reader *bufio.Reader) (string, error) {
-		buf, err := reader.ReadBytes('\n')
+// aofOpenOnServerStart loads the AOF manifest and opens the last incremental AOF file for appending.
+// If there is no incremental file, a new one is created. A single AOF file of the old layout is moved
+// into the AOF directory as the base file.
+func aofOpenOnServerStart(srv *Server, legacyAofFilename string) {
+	if err := os.MkdirAll(srv.aofDirname, 0755); err != nil {
+		log.Fatal("failed to create append only dir", zap.Error(err))
+	}
+
+	am, err := loadAofManifest(srv.aofDirname, srv.aofFilename)
+	if err != nil {
+		log.Fatal("failed to load append only manifest", zap.Error(err))
+	}
+
+	if am.base == nil && len(am.incrList) == 0 {
+		aofUpgradeLegacyFile(srv, am, legacyAofFilename)
+	}
+
+	if err := deleteAofHistoryFiles(srv.aofDirname, srv.aofFilename, am); err != nil {
+		log.Error("failed to delete append only history files", zap.Error(err))
+	}
+
+	incr := am.lastIncr()
+	if incr == nil {
+		incr = am.newIncr(srv.aofFilename)
+		if err := persistAofManifest(srv.aofDirname, srv.aofFilename, am); err != nil {
+			log.Fatal("failed to persist append only manifest", zap.Error(err))
+		}
+	}
+
+	appendFile, err := os.OpenFile(filepath.Join(srv.aofDirname, incr.filename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal("failed to open append only file", zap.Error(err))
+	}
+
+	srv.aofManifest = am
+	srv.aofFile = appendFile
+	srv.aofCurrentSize = aofFilesSize(srv)
+	srv.aofRewriteBaseSize = srv.aofCurrentSize
+	// the last incremental file may end with any DB selected.
+	srv.aofSelectDBID = -1
+}
+
+// aofUpgradeLegacyFile moves the single AOF file of the old layout into the AOF directory
+// and records it as the base file.
+func aofUpgradeLegacyFile(srv *Server, am *aofManifest, legacyAofFilename string) {
+	if _, err := os.Stat(legacyAofFilename); err != nil {
+		return
+	}
+
+	am.base = &aofInfo{filename: srv.aofFilename, seq: 1, typ: aofFileTypeBase}
+	am.baseSeq = 1
+
+	if err := os.Rename(legacyAofFilename, filepath.Join(srv.aofDirname, am.base.filename)); err != nil {
+		log.Fatal("failed to move append only file into append only dir", zap.Error(err))
+	}
+
+	if err := persistAofManifest(srv.aofDirname, srv.aofFilename, am); err != nil {
+		log.Fatal("failed to persist append only manifest", zap.Error(err))
+	}
+
+	log.Info("append only file is upgraded to the multi part layout",
+		zap.String("from", legacyAofFilename), zap.String("dir", srv.aofDirname))
+}
+
+// aofFilesSize returns the total size of the AOF files in the manifest.
+func aofFilesSize(srv *Server) uint {
+	var size uint
+
+	for _, info := range srv.aofManifest.files() {
+		fileInfo, err := os.Stat(filepath.Join(srv.aofDirname, info.filename))
 		if err != nil {
-			return "", err
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			log.Fatal("failed to get append only file info", zap.Error(err))
 		}
 
-		return byteutils.B2S(bytes.TrimRight(buf, "\r\n")), nil
+		size += uint(fileInfo.Size())
 	}
 
-	aofFile, err := os.Open(srv.aofFilename)
+	return size
+}
+
+// loadAppendOnlyFiles replays the base AOF file and the incremental AOF files in order.
+func loadAppendOnlyFiles(srv *Server) {
+	files := srv.aofManifest.files()
+	for i, info := range files {
+		loadSingleAppendOnlyFile(srv, filepath.Join(srv.aofDirname, info.filename), i == len(files)-1)
+	}
+}
+
+// loadSingleAppendOnlyFile replays an AOF file. If the file ends in the middle of a command, which is
+// likely caused by a crash or power loss while writing, it is truncated to the last complete command
+// when it's the last AOF file and aof-load-truncated is enabled. An incomplete MULTI/EXEC block at the
+// end of the file is reverted in the same way, since the transaction must be applied as a whole.
+func loadSingleAppendOnlyFile(srv *Server, filename string, isLast bool) {
+	aofFile, err := os.Open(filename)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// the incremental file may not be created yet.
+			return
+		}
+
 		log.Fatal("failed to open aof file", zap.Error(err))
 	}
 	defer aofFile.Close()
 
 	fakeClient := NewClient(srv, -1)
+	fakeClient.flags |= clientFlagAofLoading
 	defer fakeClient.free()
 
-	reader := bufio.NewReaderSize(aofFile, MaxInlineSize)
-	for {
-		buf, err := readLine(reader)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+	reader := newAofCommandReader(aofFile)
 
-			log.Panic("failed to read aof file", zap.Error(err))
+	// the AOF file may start with a RDB preamble, which is followed by the commands in AOF format.
+	if reader.hasRdbPreamble() {
+		if err := rdbLoadDatabases(reader, srv.dbs); err != nil {
+			log.Panic("failed to load RDB preamble of AOF file", zap.Error(err), zap.String("filename", filename))
 		}
 
-		if buf[0] != '*' {
-			log.Panic("invalid aof file format")
-		}
+		reader.markValid()
+	}
 
-		argc, err := strconv.Atoi(buf[1:])
-		if err != nil {
-			log.Panic("invalid aof file format", zap.Error(err))
-		}
+	// the offset before the MULTI of the transaction being read.
+	var validBeforeMulti int64
 
-		args := make([]string, argc)
-		for i := 0; i < argc; i++ {
-			buf, err = readLine(reader)
-			if err != nil {
-				log.Panic("failed to read aof file", zap.Error(err))
-			}
+	for {
+		offset := reader.validOffset
 
-			if buf[0] != '$' {
-				log.Panic("invalid aof file format")
+		args, err := reader.readCommand()
+		if err != nil {
+			if errors.Is(err, io.EOF) && fakeClient.flags&clientFlagMulti == 0 {
+				break
 			}
 
-			argLen, err := strconv.Atoi(buf[1:])
-			if err != nil {
-				log.Panic("invalid aof file format", zap.Error(err))
+			if fakeClient.flags&clientFlagMulti != 0 {
+				log.Warn("revert incomplete MULTI/EXEC transaction in AOF file", zap.String("filename", filename))
+				reader.validOffset = validBeforeMulti
+				err = errAofTruncated
 			}
 
-			arg := make([]byte, argLen)
-			if _, err := reader.Read(arg); err != nil {
-				log.Panic("failed to read aof file", zap.Error(err))
-			}
+			if errors.Is(err, errAofTruncated) && isLast && srv.aofLoadTruncated {
+				aofTruncate(srv, filename, reader.validOffset)
 
-			// discard CRLF
-			if _, err := reader.Read(make([]byte, 2)); err != nil {
-				log.Panic("failed to read aof file", zap.Error(err))
+				break
 			}
 
-			args[i] = byteutils.B2S(arg)
+			log.Panic("failed to load aof file",
+				zap.Error(err), zap.String("filename", filename), zap.Int64("offset", reader.validOffset))
 		}
 
 		cmd := lookupCommand(strings.ToLower(args[0]))
@@ -209,9 +254,46 @@ func loadAppendOnlyFile(srv *Server) {
 		}
 
 		fakeClient.args = args
+
+		// the commands of a transaction are queued until EXEC, and they are replayed directly
+		// like the others instead of by execCommand, which propagates them.
+		if fakeClient.flags&clientFlagMulti != 0 {
+			if cmd.name == "exec" {
+				for _, mc := range fakeClient.multiCmds {
+					fakeClient.args = mc.args
+					_ = mc.cmd.proc(fakeClient)
+				}
+
+				discardTransaction(fakeClient)
+			} else {
+				_ = queueMultiCommand(fakeClient, cmd)
+			}
+
+			continue
+		}
+
+		if cmd.name == "multi" {
+			validBeforeMulti = offset
+		}
+
 		_ = cmd.proc(fakeClient)
 	}
+}
+
+// aofTruncate truncates the AOF file to the end of the last complete command.
+func aofTruncate(srv *Server, filename string, offset int64) {
+	log.Warn("!!! Warning: short read while loading the AOF file !!!",
+		zap.String("filename", filename), zap.Int64("offset", offset))
+
+	if err := os.Truncate(filename, offset); err != nil {
+		log.Fatal("failed to truncate AOF file", zap.Error(err), zap.String("filename", filename))
+	}
 
+	srv.aofCurrentSize = aofFilesSize(srv)
+	srv.aofRewriteBaseSize = srv.aofCurrentSize
+
+	log.Warn("AOF loaded anyway because aof-load-truncated is enabled",
+		zap.String("filename", filename), zap.Int64("truncated_to", offset))
 }
 
 // rewriteAppendOnlyFileBackground rewrites the AOF file in background.
@@ -220,22 +302,91 @@ func rewriteAppendOnlyFileBackground(srv *Server) {
 		return
 	}
 
+	srv.aofRewriteScheduled = false
+
+	// the commands executed from now on are written to a new incremental file,
+	// the current ones are covered by the new base file.
+	flushAppendOnlyFile(srv)
+	if err := aofOpenNewIncr(srv); err != nil {
+		log.Error("failed to open new incremental append only file", zap.Error(err))
+		srv.backgroundTaskTypeAtomic.Store(uint32(TypeBackgroundTaskNone))
+
+		return
+	}
+
 	tmpDBs := make([]*database.Databse, len(srv.dbs))
 	for i, db := range srv.dbs {
 		tmpDBs[i] = db.DeepCopy()
 	}
 
+	// make sure the new incremental file starts with a SELECT.
+	srv.aofSelectDBID = -1
+
 	go rewriteAppendOnlyFile(tmpDBs, srv)
 }
 
+// aofOpenNewIncr opens a new incremental AOF file for appending and persists it into the manifest.
+func aofOpenNewIncr(srv *Server) error {
+	am := srv.aofManifest.copy()
+	incr := am.newIncr(srv.aofFilename)
+	incrFilename := filepath.Join(srv.aofDirname, incr.filename)
+
+	appendFile, err := os.OpenFile(incrFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open append only file")
+	}
+
+	if err := persistAofManifest(srv.aofDirname, srv.aofFilename, am); err != nil {
+		appendFile.Close()
+		os.Remove(incrFilename)
+
+		return err
+	}
+
+	if srv.aofFile != nil {
+		if err := srv.aofFile.Sync(); err != nil {
+			log.Error("failed to fsync the AOF file", zap.Error(err))
+		}
+
+		srv.aofFile.Close()
+	}
+
+	srv.aofManifest = am
+	srv.aofFile = appendFile
+
+	return nil
+}
+
 func rewriteAppendOnlyFile(dbs []*database.Databse, srv *Server) {
-	tmpFile, err := os.CreateTemp("", AofRewriteTempFilePrefix)
+	tmpFile, err := os.CreateTemp(srv.aofDirname, AofRewriteTempFilePrefix)
 	if err != nil {
 		log.Panic("failed to create temp file", zap.Error(err))
 	}
 	defer tmpFile.Close()
 
-	// dump db from memory to AOF temp file
+	if srv.aofUseRdbPreamble {
+		writer := bufio.NewWriter(tmpFile)
+		if err := rdbSaveDatabases(writer, dbs); err != nil {
+			log.Panic("failed to write RDB preamble to AOF file", zap.Error(err))
+		}
+
+		if err := writer.Flush(); err != nil {
+			log.Panic("failed to write RDB preamble to AOF file", zap.Error(err))
+		}
+	} else {
+		rewriteAppendOnlyFileCommands(tmpFile, dbs)
+	}
+
+	// the file must be durable before it replaces the base file, since the old one is deleted then.
+	if err := tmpFile.Sync(); err != nil {
+		log.Panic("failed to fsync rewritten AOF file", zap.Error(err))
+	}
+
+	srv.aofRewriteDoneCh <- tmpFile.Name()
+}
+
+// rewriteAppendOnlyFileCommands dumps db from memory to AOF file as the commands to rebuild it.
+func rewriteAppendOnlyFileCommands(tmpFile *os.File, dbs []*database.Databse) {
 	for _, db := range dbs {
 		if db.Dict.Size() == 0 {
 			continue
@@ -254,6 +405,8 @@ func rewriteAppendOnlyFile(dbs []*database.Databse, srv *Server) {
 			switch value := entry.Value.(type) {
 			case string:
 				err = rewriteStringObject(tmpFile, key, value)
+			case *datastruct.Bitmap:
+				err = rewriteStringObject(tmpFile, key, value.String())
 			case *datastruct.Quicklist:
 				err = rewriteListObject(tmpFile, key, value)
 			case *datastruct.Dict:
@@ -262,6 +415,8 @@ func rewriteAppendOnlyFile(dbs []*database.Databse, srv *Server) {
 				err = rewriteSetObject(tmpFile, key, value)
 			case *datastruct.Zset:
 				err = rewriteZsetObject(tmpFile, key, value)
+			case *datastruct.Stream:
+				err = rewriteStreamObject(tmpFile, key, value)
 			default:
 				log.Panic("unknown object type", zap.Any("type", value))
 			}
@@ -271,15 +426,13 @@ func rewriteAppendOnlyFile(dbs []*database.Databse, srv *Server) {
 			}
 
 			if entry := db.Expire.Find(key); entry != nil {
-				when := strconv.FormatInt(entry.Value.(int64)/1000, 10)
-				if _, err := tmpFile.WriteString(catAppendOnlyGenericCommand([]string{"expireat", key, when})); err != nil {
+				when := strconv.FormatInt(entry.Value.(int64), 10)
+				if _, err := tmpFile.WriteString(catAppendOnlyGenericCommand([]string{"pexpireat", key, when})); err != nil {
 					log.Panic("failed to write to AOF file", zap.Error(err))
 				}
 			}
 		}
 	}
-
-	srv.aofRewriteDoneCh <- tmpFile.Name()
 }
 
 func rewriteStringObject(file *os.File, key string, value string) error {
@@ -365,48 +518,100 @@ func rewriteZsetObject(file *os.File, key string, value *datastruct.Zset) error
 	return nil
 }
 
-// aofRewriteDoneCallback is called when AOF rewrite is done in server cron
-func aofRewriteDoneCallback(srv *Server) {
-	defer srv.backgroundTaskTypeAtomic.Store(uint32(TypeBackgroundTaskNone))
+// rewriteStreamObject writes the entries by XADD, then the consumer groups by XGROUP and their pending
+// entries by XCLAIM with FORCE, which also restores the pending entries trimmed from the stream when the
+// AOF is loaded. An empty stream is created by XADD with MAXLEN 0 to keep its last ID, or by the
+// MKSTREAM option of XGROUP CREATE if nothing was ever added.
+func rewriteStreamObject(file *os.File, key string, value *datastruct.Stream) error {
+	var cmds []string
+
+	entries := value.Range(datastruct.StreamMinID, datastruct.StreamMaxID, -1, false)
+	for _, entry := range entries {
+		cmds = append(cmds, catAppendOnlyGenericCommand(
+			append([]string{"xadd", key, entry.ID.String()}, entry.Fields...)))
+	}
 
-	if srv.aofFile != nil {
-		srv.aofFile.Close()
+	if len(entries) == 0 && value.LastID != datastruct.StreamMinID {
+		cmds = append(cmds, catAppendOnlyGenericCommand(
+			[]string{"xadd", key, "maxlen", "0", value.LastID.String(), "x", "y"}))
+	}
+
+	for _, name := range value.GroupNames() {
+		group := value.Group(name)
+		cmds = append(cmds, catAppendOnlyGenericCommand(
+			[]string{"xgroup", "create", key, name, group.LastID.String(), "mkstream"}))
+
+		for _, consumerName := range group.ConsumerNames() {
+			cmds = append(cmds, catAppendOnlyGenericCommand([]string{"xgroup", "createconsumer", key, name, consumerName}))
+		}
+
+		for _, id := range datastruct.PendingIDs(group.PEL) {
+			nack := group.PEL[id]
+			cmds = append(cmds, catAppendOnlyGenericCommand([]string{
+				"xclaim", key, name, nack.Consumer.Name, "0", id.String(),
+				"time", strconv.FormatInt(nack.DeliveryTime, 10),
+				"retrycount", strconv.FormatUint(nack.DeliveryCount, 10),
+				"force", "justid",
+			}))
+		}
+	}
+
+	for _, cmd := range cmds {
+		if _, err := file.WriteString(cmd); err != nil {
+			return errors.Wrapf(err, "failed to write stream to AOF file, key: %s", key)
+		}
 	}
 
+	return nil
+}
+
+// aofRewriteDoneCallback is called when AOF rewrite is done in server cron.
+// The rewritten file becomes the new base file, and the old base file and incremental files
+// except the last one become history files, which are deleted after the manifest is persisted.
+func aofRewriteDoneCallback(srv *Server) {
+	defer srv.backgroundTaskTypeAtomic.Store(uint32(TypeBackgroundTaskNone))
+
 	tmpAofFilename := <-srv.aofRewriteDoneCh
 	defer os.Remove(tmpAofFilename)
 
-	// occurs error "invalid cross-device link" if use os.Rename
-	if err := exec.Command("mv", tmpAofFilename, srv.aofFilename).Run(); err != nil {
-		log.Panic("failed to mv",
+	am := srv.aofManifest.copy()
+	base := am.newBase(srv.aofFilename, srv.aofUseRdbPreamble)
+	baseFilename := filepath.Join(srv.aofDirname, base.filename)
+
+	if err := os.Rename(tmpAofFilename, baseFilename); err != nil {
+		log.Panic("failed to rename",
 			zap.Error(err),
 			zap.String("from", tmpAofFilename),
-			zap.String("to", srv.aofFilename))
+			zap.String("to", baseFilename))
 	}
 
-	aofFile, err := os.OpenFile(srv.aofFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Panic("failed to open file",
-			zap.Error(err), zap.String("filename", srv.aofFilename))
+	if err := fsyncDir(srv.aofDirname); err != nil {
+		log.Panic("failed to fsync append only dir", zap.Error(err))
 	}
 
-	//  append AOF rewrite buffer to AOF file
-	if srv.aofRewriteBuf.Len() > 0 {
-		if _, err := aofFile.WriteString(srv.aofRewriteBuf.String()); err != nil {
-			log.Panic("failed to write to AOF file", zap.Error(err))
-		}
+	am.markRewrittenIncrAsHistory()
+	if err := persistAofManifest(srv.aofDirname, srv.aofFilename, am); err != nil {
+		log.Panic("failed to persist append only manifest", zap.Error(err))
 	}
 
-	srv.aofRewriteBuf.Reset()
+	srv.aofManifest = am
+
+	if err := deleteAofHistoryFiles(srv.aofDirname, srv.aofFilename, am); err != nil {
+		log.Error("failed to delete append only history files", zap.Error(err))
+	}
 
-	fileInfo, err := aofFile.Stat()
+	baseFileInfo, err := os.Stat(baseFilename)
 	if err != nil {
 		log.Panic("failed to stat file", zap.Error(err))
 	}
 
-	srv.aofCurrentSize = uint(fileInfo.Size())
-	srv.aofRewriteBaseSize = srv.aofCurrentSize
-	srv.aofFile = aofFile
+	incrFileInfo, err := srv.aofFile.Stat()
+	if err != nil {
+		log.Panic("failed to stat file", zap.Error(err))
+	}
 
-	aofFileSync(srv)
+	srv.aofRewriteBaseSize = uint(baseFileInfo.Size())
+	srv.aofCurrentSize = srv.aofRewriteBaseSize + uint(incrFileInfo.Size())
+
+	log.Info("background AOF rewrite finished successfully")
 }
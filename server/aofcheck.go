@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errAofBadRdbPreamble = errors.New("bad RDB preamble")
+	errAofUnmatchedMulti = errors.New("reached EOF before reading EXEC for MULTI")
+)
+
+// AofCheckResult is the result of checking an AOF file.
+type AofCheckResult struct {
+	Filename       string
+	Size           int64
+	HasRdbPreamble bool
+	RdbKeys        int64            // number of keys in the RDB preamble
+	Commands       int64            // number of valid commands
+	Histogram      map[string]int64 // number of valid commands by lower case name
+	ValidOffset    int64            // offset of the end of the last valid command
+	Err            error            // the reason why the file is invalid, nil if it is valid
+}
+
+// IsValid returns true if the whole file is valid.
+func (r *AofCheckResult) IsValid() bool {
+	return r.Err == nil
+}
+
+// IsFixable returns true if the file can be fixed by truncating it to the last valid command.
+// A broken RDB preamble can't be fixed, since there is no valid command before it.
+func (r *AofCheckResult) IsFixable() bool {
+	return !errors.Is(r.Err, errAofBadRdbPreamble)
+}
+
+// CheckAppendOnlyFile parses an AOF file with the same framing used when loading it, without
+// executing the commands. An error is returned only if the file can't be read.
+func CheckAppendOnlyFile(filename string) (*AofCheckResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open aof file")
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat aof file")
+	}
+
+	result := &AofCheckResult{
+		Filename:  filename,
+		Size:      fileInfo.Size(),
+		Histogram: make(map[string]int64),
+	}
+
+	reader := newAofCommandReader(file)
+	if reader.hasRdbPreamble() {
+		result.HasRdbPreamble = true
+
+		err := rdbLoadKeys(reader, func(uint64, string, any, int64) error {
+			result.RdbKeys++
+
+			return nil
+		})
+		if err != nil {
+			result.Err = errors.Wrapf(errAofBadRdbPreamble, "%v", err)
+
+			return result, nil
+		}
+
+		reader.markValid()
+	}
+
+	// the offset before the MULTI of the transaction being read, -1 if not in a transaction.
+	multiOffset := int64(-1)
+
+	for {
+		offset := reader.validOffset
+
+		args, err := reader.readCommand()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				result.Err = err
+			}
+
+			break
+		}
+
+		name := strings.ToLower(args[0])
+		switch {
+		case name == "multi" && multiOffset >= 0:
+			result.Err = errors.Wrapf(errAofBadFormat, "unexpected MULTI at offset %d", offset)
+		case name == "multi":
+			multiOffset = offset
+		case name == "exec" && multiOffset < 0:
+			result.Err = errors.Wrapf(errAofBadFormat, "unexpected EXEC at offset %d", offset)
+		case name == "exec":
+			multiOffset = -1
+		}
+
+		if result.Err != nil {
+			reader.validOffset = offset
+
+			break
+		}
+
+		result.Commands++
+		result.Histogram[name]++
+	}
+
+	result.ValidOffset = reader.validOffset
+
+	// an incomplete transaction at the end of the file is reverted as a whole.
+	if multiOffset >= 0 {
+		result.ValidOffset = multiOffset
+		if result.Err == nil {
+			result.Err = errors.Wrapf(errAofUnmatchedMulti, "at offset %d", multiOffset)
+		}
+	}
+
+	return result, nil
+}
+
+// AofManifestFiles returns the paths of the AOF files listed in the manifest in loading order.
+func AofManifestFiles(manifestFilename string) ([]string, error) {
+	manifestFile, err := os.Open(manifestFilename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open AOF manifest")
+	}
+	defer manifestFile.Close()
+
+	am, err := parseAofManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(manifestFilename)
+	files := am.files()
+	filenames := make([]string, len(files))
+	for i, info := range files {
+		filenames[i] = filepath.Join(dir, info.filename)
+	}
+
+	return filenames, nil
+}
+
+// IsAofManifest returns true if the filename looks like an AOF manifest.
+func IsAofManifest(filename string) bool {
+	return strings.HasSuffix(filename, aofManifestSuffix)
+}
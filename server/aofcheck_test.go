@@ -0,0 +1,69 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAppendOnlyFile(t *testing.T) {
+	t.Parallel()
+
+	set := catAppendOnlyGenericCommand([]string{"SET", "key", "value"})
+	sadd := catAppendOnlyGenericCommand([]string{"sadd", "set", "a", "b"})
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	require.NoError(t, os.WriteFile(filename, []byte(set+sadd+set+sadd[:10]), 0644))
+
+	result, err := CheckAppendOnlyFile(filename)
+	require.NoError(t, err)
+	require.False(t, result.IsValid())
+	require.True(t, result.IsFixable())
+	require.ErrorIs(t, result.Err, errAofTruncated)
+	require.Equal(t, int64(3), result.Commands)
+	require.Equal(t, map[string]int64{"set": 2, "sadd": 1}, result.Histogram)
+	require.Equal(t, int64(len(set+sadd+set)), result.ValidOffset)
+	require.Equal(t, int64(len(set+sadd+set+sadd[:10])), result.Size)
+
+	require.NoError(t, os.Truncate(filename, result.ValidOffset))
+
+	result, err = CheckAppendOnlyFile(filename)
+	require.NoError(t, err)
+	require.True(t, result.IsValid())
+	require.Equal(t, int64(3), result.Commands)
+}
+
+func TestCheckAppendOnlyFileUnmatchedMulti(t *testing.T) {
+	t.Parallel()
+
+	set := catAppendOnlyGenericCommand([]string{"set", "key", "value"})
+	multi := catAppendOnlyGenericCommand([]string{"multi"})
+	exec := catAppendOnlyGenericCommand([]string{"exec"})
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	require.NoError(t, os.WriteFile(filename, []byte(set+multi+set+exec+multi+set), 0644))
+
+	result, err := CheckAppendOnlyFile(filename)
+	require.NoError(t, err)
+	require.False(t, result.IsValid())
+	require.True(t, result.IsFixable())
+	require.ErrorIs(t, result.Err, errAofUnmatchedMulti)
+	require.Equal(t, int64(len(set+multi+set+exec)), result.ValidOffset)
+
+	// the incomplete transaction is reverted even if its last command is truncated.
+	require.NoError(t, os.WriteFile(filename, []byte(set+multi+set[:5]), 0644))
+
+	result, err = CheckAppendOnlyFile(filename)
+	require.NoError(t, err)
+	require.ErrorIs(t, result.Err, errAofTruncated)
+	require.Equal(t, int64(len(set)), result.ValidOffset)
+
+	require.NoError(t, os.WriteFile(filename, []byte(set+exec), 0644))
+
+	result, err = CheckAppendOnlyFile(filename)
+	require.NoError(t, err)
+	require.ErrorIs(t, result.Err, errAofBadFormat)
+	require.Equal(t, int64(len(set)), result.ValidOffset)
+}
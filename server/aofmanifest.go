@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The AOF is made of multiple files in the AOF directory, like Redis 7:
+//
+//   - one base file, which is the snapshot of the dataset written by the last rewrite,
+//     either in RDB format (<appendfilename>.<seq>.base.rdb) or in AOF format (<appendfilename>.<seq>.base.aof).
+//   - zero or more incremental files (<appendfilename>.<seq>.incr.aof), which contain the commands executed
+//     after the base was created. Only the last one is opened for appending.
+//   - the manifest (<appendfilename>.manifest), which lists the files above in loading order and the history
+//     files that are no longer used and are waiting to be deleted.
+//
+// A rewrite opens a new incremental file when it starts and replaces the base and the old incremental files
+// by only updating the manifest when it is done. The manifest is always updated by writing a temp file and
+// renaming it, so that a crash can never leave the AOF without a valid manifest.
+const (
+	AofDefaultDirname      = "appendonlydir"
+	aofDefaultFilename     = "appendonly.aof"
+	aofManifestSuffix      = ".manifest"
+	aofBaseFileSuffix      = ".base"
+	aofIncrFileSuffix      = ".incr"
+	aofFormatSuffix        = ".aof"
+	rdbFormatSuffix        = ".rdb"
+	aofTempManifestPrefix  = "temp-"
+	aofManifestKeyFilename = "file"
+	aofManifestKeySeq      = "seq"
+	aofManifestKeyType     = "type"
+)
+
+type aofFileType string
+
+const (
+	aofFileTypeBase    aofFileType = "b"
+	aofFileTypeIncr    aofFileType = "i"
+	aofFileTypeHistory aofFileType = "h"
+)
+
+var errAofManifestBadFormat = errors.New("bad AOF manifest format")
+
+type aofInfo struct {
+	filename string
+	seq      int64
+	typ      aofFileType
+}
+
+type aofManifest struct {
+	base        *aofInfo
+	incrList    []*aofInfo
+	historyList []*aofInfo
+	baseSeq     int64 // the sequence number of the latest base file
+	incrSeq     int64 // the sequence number of the latest incremental file
+}
+
+func (info *aofInfo) String() string {
+	return fmt.Sprintf("%s %s %s %d %s %s\n",
+		aofManifestKeyFilename, info.filename,
+		aofManifestKeySeq, info.seq,
+		aofManifestKeyType, info.typ)
+}
+
+// String returns the manifest content: base file first, then history files, then incremental files.
+func (am *aofManifest) String() string {
+	var sb strings.Builder
+
+	if am.base != nil {
+		sb.WriteString(am.base.String())
+	}
+
+	for _, info := range am.historyList {
+		sb.WriteString(info.String())
+	}
+
+	for _, info := range am.incrList {
+		sb.WriteString(info.String())
+	}
+
+	return sb.String()
+}
+
+// copy returns a copy of the manifest, so that it can be updated and persisted before
+// replacing the current one.
+func (am *aofManifest) copy() *aofManifest {
+	newAm := &aofManifest{
+		base:        am.base,
+		incrList:    make([]*aofInfo, len(am.incrList)),
+		historyList: make([]*aofInfo, len(am.historyList)),
+		baseSeq:     am.baseSeq,
+		incrSeq:     am.incrSeq,
+	}
+
+	copy(newAm.incrList, am.incrList)
+	copy(newAm.historyList, am.historyList)
+
+	return newAm
+}
+
+// lastIncr returns the incremental file which is opened for appending.
+func (am *aofManifest) lastIncr() *aofInfo {
+	if len(am.incrList) == 0 {
+		return nil
+	}
+
+	return am.incrList[len(am.incrList)-1]
+}
+
+// files returns the files need to be loaded in order.
+func (am *aofManifest) files() []*aofInfo {
+	files := make([]*aofInfo, 0, len(am.incrList)+1)
+	if am.base != nil {
+		files = append(files, am.base)
+	}
+
+	return append(files, am.incrList...)
+}
+
+// newIncr adds a new incremental file into the manifest.
+func (am *aofManifest) newIncr(aofFilename string) *aofInfo {
+	am.incrSeq++
+	info := &aofInfo{
+		filename: fmt.Sprintf("%s.%d%s%s", aofFilename, am.incrSeq, aofIncrFileSuffix, aofFormatSuffix),
+		seq:      am.incrSeq,
+		typ:      aofFileTypeIncr,
+	}
+
+	am.incrList = append(am.incrList, info)
+
+	return info
+}
+
+// newBase sets a new base file in the manifest, the old base file becomes history.
+func (am *aofManifest) newBase(aofFilename string, rdbPreamble bool) *aofInfo {
+	if am.base != nil {
+		am.historyList = append(am.historyList, &aofInfo{
+			filename: am.base.filename,
+			seq:      am.base.seq,
+			typ:      aofFileTypeHistory,
+		})
+	}
+
+	formatSuffix := aofFormatSuffix
+	if rdbPreamble {
+		formatSuffix = rdbFormatSuffix
+	}
+
+	am.baseSeq++
+	am.base = &aofInfo{
+		filename: fmt.Sprintf("%s.%d%s%s", aofFilename, am.baseSeq, aofBaseFileSuffix, formatSuffix),
+		seq:      am.baseSeq,
+		typ:      aofFileTypeBase,
+	}
+
+	return am.base
+}
+
+// markRewrittenIncrAsHistory marks all the incremental files except the last one as history,
+// since they are covered by the new base file.
+func (am *aofManifest) markRewrittenIncrAsHistory() {
+	if len(am.incrList) <= 1 {
+		return
+	}
+
+	last := am.lastIncr()
+	for _, info := range am.incrList[:len(am.incrList)-1] {
+		am.historyList = append(am.historyList, &aofInfo{
+			filename: info.filename,
+			seq:      info.seq,
+			typ:      aofFileTypeHistory,
+		})
+	}
+
+	am.incrList = []*aofInfo{last}
+}
+
+// parseAofManifest parses the manifest content.
+func parseAofManifest(r io.Reader) (*aofManifest, error) {
+	am := &aofManifest{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errors.Wrapf(errAofManifestBadFormat, "invalid line %d: %s", lineNum, line)
+		}
+
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case aofManifestKeyFilename:
+				if strings.ContainsRune(fields[i+1], filepath.Separator) {
+					return nil, errors.Wrapf(errAofManifestBadFormat, "invalid filename at line %d: %s", lineNum, line)
+				}
+
+				info.filename = fields[i+1]
+			case aofManifestKeySeq:
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, errors.Wrapf(errAofManifestBadFormat, "invalid seq at line %d: %s", lineNum, line)
+				}
+
+				info.seq = seq
+			case aofManifestKeyType:
+				info.typ = aofFileType(fields[i+1])
+			}
+		}
+
+		if info.filename == "" || info.seq == 0 {
+			return nil, errors.Wrapf(errAofManifestBadFormat, "missing filename or seq at line %d: %s", lineNum, line)
+		}
+
+		switch info.typ {
+		case aofFileTypeBase:
+			if am.base != nil {
+				return nil, errors.Wrapf(errAofManifestBadFormat, "found duplicate base file at line %d", lineNum)
+			}
+
+			am.base = info
+			am.baseSeq = info.seq
+		case aofFileTypeIncr:
+			if info.seq <= am.incrSeq {
+				return nil, errors.Wrapf(errAofManifestBadFormat, "found a non-monotonic seq at line %d", lineNum)
+			}
+
+			am.incrList = append(am.incrList, info)
+			am.incrSeq = info.seq
+		case aofFileTypeHistory:
+			am.historyList = append(am.historyList, info)
+		default:
+			return nil, errors.Wrapf(errAofManifestBadFormat, "unknown file type at line %d: %s", lineNum, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read AOF manifest")
+	}
+
+	return am, nil
+}
+
+// aofManifestPath returns the path of the manifest of the AOF in dir.
+func aofManifestPath(dir, aofFilename string) string {
+	return filepath.Join(dir, aofFilename+aofManifestSuffix)
+}
+
+// loadAofManifest loads the manifest from the AOF directory. It returns an empty manifest if not exists.
+func loadAofManifest(dir, aofFilename string) (*aofManifest, error) {
+	file, err := os.Open(aofManifestPath(dir, aofFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &aofManifest{}, nil
+		}
+
+		return nil, errors.Wrap(err, "failed to open AOF manifest")
+	}
+	defer file.Close()
+
+	return parseAofManifest(file)
+}
+
+// persistAofManifest writes the manifest to a temp file and renames it, then fsyncs the directory
+// to make sure the rename is durable.
+func persistAofManifest(dir, aofFilename string, am *aofManifest) error {
+	tmpFile, err := os.CreateTemp(dir, aofTempManifestPrefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp AOF manifest")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.WriteString(am.String()); err != nil {
+		return errors.Wrap(err, "failed to write temp AOF manifest")
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		return errors.Wrap(err, "failed to fsync temp AOF manifest")
+	}
+
+	if err := os.Rename(tmpFile.Name(), aofManifestPath(dir, aofFilename)); err != nil {
+		return errors.Wrap(err, "failed to rename temp AOF manifest")
+	}
+
+	return fsyncDir(dir)
+}
+
+// deleteAofHistoryFiles removes the history files from the disk and the manifest.
+func deleteAofHistoryFiles(dir, aofFilename string, am *aofManifest) error {
+	if len(am.historyList) == 0 {
+		return nil
+	}
+
+	for _, info := range am.historyList {
+		if err := os.Remove(filepath.Join(dir, info.filename)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.Wrapf(err, "failed to remove AOF history file: %s", info.filename)
+		}
+	}
+
+	am.historyList = nil
+
+	return persistAofManifest(dir, aofFilename, am)
+}
+
+func fsyncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dir")
+	}
+	defer dirFile.Close()
+
+	return errors.Wrap(dirFile.Sync(), "failed to fsync dir")
+}
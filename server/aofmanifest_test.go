@@ -0,0 +1,102 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAofManifest(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		isError bool
+	}{
+		{
+			name: "OK",
+			content: "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+				"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+				"file appendonly.aof.2.incr.aof seq 2 type i\n" +
+				"file appendonly.aof.3.incr.aof seq 3 type i\n",
+		},
+		{
+			name:    "Empty",
+			content: "",
+		},
+		{
+			name: "Duplicate base",
+			content: "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+				"file appendonly.aof.2.base.rdb seq 2 type b\n",
+			isError: true,
+		},
+		{
+			name: "Non-monotonic seq",
+			content: "file appendonly.aof.2.incr.aof seq 2 type i\n" +
+				"file appendonly.aof.1.incr.aof seq 1 type i\n",
+			isError: true,
+		},
+		{
+			name:    "Unknown type",
+			content: "file appendonly.aof.1.incr.aof seq 1 type x\n",
+			isError: true,
+		},
+		{
+			name:    "Path in filename",
+			content: "file ../appendonly.aof.1.incr.aof seq 1 type i\n",
+			isError: true,
+		},
+	}
+
+	for index := range testCases {
+		tc := testCases[index]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			am, err := parseAofManifest(strings.NewReader(tc.content))
+			if tc.isError {
+				require.ErrorIs(t, err, errAofManifestBadFormat)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.content, am.String())
+		})
+	}
+}
+
+func TestAofManifestRewrite(t *testing.T) {
+	t.Parallel()
+
+	am := &aofManifest{}
+	am.newIncr("appendonly.aof")
+	require.Equal(t, "file appendonly.aof.1.incr.aof seq 1 type i\n", am.String())
+
+	// a rewrite starts
+	newAm := am.copy()
+	newAm.newIncr("appendonly.aof")
+	require.Len(t, am.incrList, 1)
+
+	// the rewrite is done
+	newAm.newBase("appendonly.aof", true)
+	newAm.markRewrittenIncrAsHistory()
+	require.Equal(t, "file appendonly.aof.1.base.rdb seq 1 type b\n"+
+		"file appendonly.aof.1.incr.aof seq 1 type h\n"+
+		"file appendonly.aof.2.incr.aof seq 2 type i\n", newAm.String())
+	require.Equal(t, aofFileTypeIncr, am.incrList[0].typ)
+
+	// history files are deleted, then another rewrite
+	newAm.historyList = nil
+	newAm.newIncr("appendonly.aof")
+	newAm.newBase("appendonly.aof", false)
+	newAm.markRewrittenIncrAsHistory()
+	require.Equal(t, "file appendonly.aof.2.base.aof seq 2 type b\n"+
+		"file appendonly.aof.1.base.rdb seq 1 type h\n"+
+		"file appendonly.aof.2.incr.aof seq 2 type h\n"+
+		"file appendonly.aof.3.incr.aof seq 3 type i\n", newAm.String())
+
+	parsed, err := parseAofManifest(strings.NewReader(newAm.String()))
+	require.NoError(t, err)
+	require.Equal(t, newAm, parsed)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/IfanTsai/go-lib/utils/byteutils"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+const aofReadChunkSize = 64 * 1024
+
+var (
+	errAofTruncated = errors.New("unexpected end of file")
+	errAofBadFormat = errors.New("bad file format")
+)
+
+// aofCommandReader reads the commands in RESP format from an AOF file one by one.
+// It keeps track of the number of bytes consumed, so that the offset of the end of
+// the last complete command is known when the file is truncated or corrupted.
+type aofCommandReader struct {
+	reader      *bufio.Reader
+	pos         int64 // number of bytes consumed
+	validOffset int64 // offset of the end of the last complete command
+}
+
+func newAofCommandReader(r io.Reader) *aofCommandReader {
+	return &aofCommandReader{reader: bufio.NewReaderSize(r, MaxInlineSize)}
+}
+
+// Read implements io.Reader, which is used to read the RDB preamble.
+func (r *aofCommandReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pos += int64(n)
+
+	return n, err
+}
+
+// hasRdbPreamble returns true if the AOF file starts with a RDB preamble.
+func (r *aofCommandReader) hasRdbPreamble() bool {
+	signature, err := r.reader.Peek(len(rdbMagic))
+
+	return err == nil && string(signature) == rdbMagic
+}
+
+// markValid marks all the bytes consumed so far as valid, which is called after the RDB preamble is read.
+func (r *aofCommandReader) markValid() {
+	r.validOffset = r.pos
+}
+
+// readCommand reads the next command. It returns io.EOF if there are no more commands,
+// errAofTruncated if the file ends in the middle of a command
+// and errAofBadFormat if the command is not in RESP format.
+func (r *aofCommandReader) readCommand() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 2 || line[0] != '*' {
+		return nil, r.badFormat("expected '*' for multi bulk length")
+	}
+
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, r.badFormat("invalid multi bulk length")
+	}
+
+	// the lengths are untrusted, so the arguments are appended as they are read
+	// and a bulk string can't be larger than the max size of a string.
+	var args []string
+	for i := 0; i < argc; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, r.truncated(err)
+		}
+
+		if len(line) < 2 || line[0] != '$' {
+			return nil, r.badFormat("expected '$' for bulk length")
+		}
+
+		argLen, err := strconv.Atoi(line[1:])
+		if err != nil || argLen < 0 || argLen > maxStringLength {
+			return nil, r.badFormat("invalid bulk length")
+		}
+
+		arg, err := r.readBulk(argLen + 2)
+		if err != nil {
+			return nil, r.truncated(err)
+		}
+
+		if arg[argLen] != '\r' || arg[argLen+1] != '\n' {
+			return nil, r.badFormat("expected CRLF for end of bulk string")
+		}
+
+		args = append(args, byteutils.B2S(arg[:argLen]))
+	}
+
+	r.validOffset = r.pos
+
+	return args, nil
+}
+
+// readBulk reads the bytes of the length. The length is untrusted, so the buffer grows by chunks as the bytes
+// are actually read, a corrupted length fails at the end of the file instead of allocating the whole length upfront.
+func (r *aofCommandReader) readBulk(length int) ([]byte, error) {
+	buf := make([]byte, 0, lo.Min([]int{length, aofReadChunkSize}))
+	for len(buf) < length {
+		n := lo.Min([]int{length - len(buf), aofReadChunkSize})
+		buf = append(buf, make([]byte, n)...)
+
+		read, err := io.ReadFull(r.reader, buf[len(buf)-n:])
+		r.pos += int64(read)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// readLine reads a line terminated by CRLF. It returns io.EOF only if nothing was read,
+// errAofTruncated if the file ends in the middle of a line.
+func (r *aofCommandReader) readLine() (string, error) {
+	buf, err := r.reader.ReadBytes('\n')
+	r.pos += int64(len(buf))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+
+			return "", r.truncated(io.ErrUnexpectedEOF)
+		}
+
+		return "", errors.Wrap(err, "failed to read aof file")
+	}
+
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		return "", r.badFormat("expected CRLF for end of line")
+	}
+
+	return byteutils.B2S(buf[:len(buf)-2]), nil
+}
+
+func (r *aofCommandReader) truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.Wrapf(errAofTruncated, "at offset %d", r.validOffset)
+	}
+
+	return err
+}
+
+func (r *aofCommandReader) badFormat(reason string) error {
+	return errors.Wrapf(errAofBadFormat, "%s at offset %d", reason, r.validOffset)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAofCommandReader(t *testing.T) {
+	set := catAppendOnlyGenericCommand([]string{"set", "key", "value"})
+	lpush := catAppendOnlyGenericCommand([]string{"lpush", "list", "a\r\nb"})
+	largeValue := strings.Repeat("v", aofReadChunkSize*2+1)
+	large := catAppendOnlyGenericCommand([]string{"set", "key", largeValue})
+
+	testCases := []struct {
+		name          string
+		content       string
+		expected      [][]string
+		expectedErr   error
+		expectedValid int64
+	}{
+		{
+			name:          "OK",
+			content:       set + lpush,
+			expected:      [][]string{{"set", "key", "value"}, {"lpush", "list", "a\r\nb"}},
+			expectedErr:   io.EOF,
+			expectedValid: int64(len(set + lpush)),
+		},
+		{
+			name:          "Empty",
+			content:       "",
+			expectedErr:   io.EOF,
+			expectedValid: 0,
+		},
+		{
+			name:          "Truncated in bulk string",
+			content:       set + lpush[:len(lpush)-3],
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofTruncated,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Truncated in line",
+			content:       set + "*3\r\n$5",
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofTruncated,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Truncated after multi bulk length",
+			content:       set + "*3\r\n",
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofTruncated,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Bad multi bulk length",
+			content:       set + "+OK\r\n" + set,
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofBadFormat,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Too large bulk length",
+			content:       set + "*1\r\n$9223372036854775807\r\nset\r\n",
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofBadFormat,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Large bulk length in truncated file",
+			content:       set + "*1\r\n$536870912\r\nset\r\n",
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofTruncated,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Bulk string larger than a chunk",
+			content:       set + large,
+			expected:      [][]string{{"set", "key", "value"}, {"set", "key", largeValue}},
+			expectedErr:   io.EOF,
+			expectedValid: int64(len(set + large)),
+		},
+		{
+			name:          "Too large multi bulk length",
+			content:       set + "*9223372036854775807\r\n$3\r\nset\r\n",
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofTruncated,
+			expectedValid: int64(len(set)),
+		},
+		{
+			name:          "Bad bulk string end",
+			content:       set + "*1\r\n$3\r\nsetxx" + set,
+			expected:      [][]string{{"set", "key", "value"}},
+			expectedErr:   errAofBadFormat,
+			expectedValid: int64(len(set)),
+		},
+	}
+
+	for index := range testCases {
+		tc := testCases[index]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			reader := newAofCommandReader(strings.NewReader(tc.content))
+
+			var (
+				commands [][]string
+				err      error
+			)
+
+			for {
+				var args []string
+				if args, err = reader.readCommand(); err != nil {
+					break
+				}
+
+				commands = append(commands, args)
+			}
+
+			require.ErrorIs(t, err, tc.expectedErr)
+			require.Equal(t, tc.expected, commands)
+			require.Equal(t, tc.expectedValid, reader.validOffset)
+		})
+	}
+}
+
+func TestAofCommandReaderWithRdbPreamble(t *testing.T) {
+	t.Parallel()
+
+	db := database.NewDatabase(0)
+	db.Dict.Set("key", "value")
+
+	var buf bytes.Buffer
+	require.NoError(t, rdbSaveDatabases(&buf, []*database.Databse{db}))
+	preambleLen := int64(buf.Len())
+	buf.WriteString(catAppendOnlyGenericCommand([]string{"set", "key2", "value2"}))
+	buf.WriteString("*2\r\n")
+
+	reader := newAofCommandReader(&buf)
+	require.True(t, reader.hasRdbPreamble())
+
+	loaded := database.NewDatabase(0)
+	require.NoError(t, rdbLoadDatabases(reader, []*database.Databse{loaded}))
+	reader.markValid()
+	require.Equal(t, preambleLen, reader.validOffset)
+	require.Equal(t, "value", loaded.Dict.Get("key"))
+
+	args, err := reader.readCommand()
+	require.NoError(t, err)
+	require.Equal(t, []string{"set", "key2", "value2"}, args)
+
+	_, err = reader.readCommand()
+	require.ErrorIs(t, err, errAofTruncated)
+	require.Equal(t, preambleLen+int64(len(catAppendOnlyGenericCommand(args))), reader.validOffset)
+}
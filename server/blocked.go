@@ -0,0 +1,241 @@
+package server
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/IfanTsai/metis/ae"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/IfanTsai/metis/log"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+type blockType uint8
+
+const (
+	blockNone   blockType = iota
+	blockWait             // WAIT for the acknowledgement of the replicas
+	blockList             // BLPOP, BRPOP and BLMOVE for the lists to be pushed
+	blockZset             // BZPOPMIN and BZPOPMAX for the sorted sets to be added
+	blockStream           // XREAD and XREADGROUP for the streams to be added
+)
+
+// readyKey is a key which clients are blocked by and was just pushed.
+type readyKey struct {
+	dbID int
+	key  string
+}
+
+// parseBlockTimeout parses the timeout of the blocking commands in the unit, a zero time means blocking forever.
+func parseBlockTimeout(arg string, unit time.Duration) (time.Time, error) {
+	timeout, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		return time.Time{}, errors.New("timeout is not a float or out of range")
+	}
+
+	if timeout < 0 {
+		return time.Time{}, errors.New("timeout is negative")
+	}
+
+	if timeout == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Now().Add(time.Duration(timeout * float64(unit))), nil
+}
+
+// blockClient parks the client without stalling the event loop. No more commands of the client
+// are processed until it's unblocked, a zero timeout means blocking forever.
+func blockClient(client *Client, btype blockType, timeout time.Time) {
+	client.blockType = btype
+	client.blockTimeout = timeout
+
+	eventLoop := client.srv.eventLoop
+	if timeout.IsZero() || eventLoop == nil {
+		return
+	}
+
+	// the client is timed out by a time event, which is removed if it's unblocked earlier.
+	interval := lo.Max([]int64{time.Until(timeout).Milliseconds(), 0})
+	id, err := eventLoop.AddTimeEvent(ae.TypeTimeEventOnce, interval, blockedClientTimeoutProc, client)
+	if err != nil {
+		log.Error("failed to add the time event of the blocked client", zap.Error(err))
+
+		return
+	}
+
+	client.blockTimeoutEventID = id
+}
+
+// blockForKeys blocks the client until one of the lists, the sorted sets or the streams of the keys is pushed.
+func blockForKeys(client *Client, btype blockType, keys []string, timeout time.Time) {
+	for _, key := range keys {
+		if lo.Contains(client.blockKeys, key) {
+			continue
+		}
+
+		clients, ok := client.db.BlockingKeys.Get(key).(*list.List)
+		if !ok {
+			clients = list.New()
+			client.db.BlockingKeys.Set(key, clients)
+		}
+
+		clients.PushBack(client)
+		client.blockKeys = append(client.blockKeys, key)
+	}
+
+	blockClient(client, btype, timeout)
+}
+
+// unblockClient is called when the client is served or timed out, the commands received
+// while the client was blocked are processed before the event loop sleeps.
+func unblockClient(client *Client) {
+	srv := client.srv
+
+	switch client.blockType {
+	case blockWait:
+		srv.clientsWaitingAcks = lo.Without(srv.clientsWaitingAcks, client)
+	case blockList, blockZset, blockStream:
+		unblockClientWaitingData(client)
+	case blockNone:
+		return
+	}
+
+	if client.blockTimeoutEventID >= 0 {
+		_ = srv.eventLoop.RemoveTimeEvent(client.blockTimeoutEventID)
+		client.blockTimeoutEventID = -1
+	}
+
+	client.blockType = blockNone
+	client.blockTimeout = time.Time{}
+	srv.unblockedClients = append(srv.unblockedClients, client)
+}
+
+// unblockClientWaitingData removes the client from the clients blocked by its keys.
+func unblockClientWaitingData(client *Client) {
+	for _, key := range client.blockKeys {
+		clients, ok := client.db.BlockingKeys.Get(key).(*list.List)
+		if !ok {
+			continue
+		}
+
+		for e := clients.Front(); e != nil; e = e.Next() {
+			if e.Value.(*Client) == client {
+				clients.Remove(e)
+
+				break
+			}
+		}
+
+		if clients.Len() == 0 {
+			_ = client.db.BlockingKeys.Delete(key)
+		}
+	}
+
+	client.blockKeys = nil
+}
+
+// replyToBlockedClientTimedOut replies to the client when the timeout is reached.
+func replyToBlockedClientTimedOut(client *Client) {
+	switch client.blockType {
+	case blockWait:
+		_ = client.addReplyInt(int64(replicationCountAcksByOffset(client.srv, client.blockReplOffset)))
+	case blockList:
+		if client.blockListMove {
+			_ = client.addReplyNull()
+		} else {
+			_ = client.addReplyNullArray()
+		}
+	case blockZset, blockStream:
+		_ = client.addReplyNullArray()
+	case blockNone:
+	}
+}
+
+// blockedClientTimeoutProc is the time event to unblock the client whose timeout is reached.
+func blockedClientTimeoutProc(el *ae.EventLoop, id int64, clientData any) {
+	client := clientData.(*Client)
+	if client.blockType == blockNone || client.blockTimeoutEventID != id {
+		return
+	}
+
+	replyToBlockedClientTimedOut(client)
+	unblockClient(client)
+}
+
+// signalKeyAsReady is called when a list is pushed or a sorted set or a stream is added, so that the clients
+// blocked by the key are served by handleClientsBlockedOnKeys later.
+func signalKeyAsReady(srv *Server, dbID int, key string) {
+	if srv.dbs[dbID].BlockingKeys.Find(key) == nil {
+		return
+	}
+
+	rk := readyKey{dbID: dbID, key: key}
+	if !lo.Contains(srv.readyKeys, rk) {
+		srv.readyKeys = append(srv.readyKeys, rk)
+	}
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked by the keys which were just pushed or added
+// in the order in which they were blocked.
+func handleClientsBlockedOnKeys(srv *Server) {
+	// serving the clients of BLMOVE may push other keys, which are handled in the next round.
+	for len(srv.readyKeys) > 0 {
+		readyKeys := srv.readyKeys
+		srv.readyKeys = nil
+
+		for _, rk := range readyKeys {
+			db := srv.dbs[rk.dbID]
+
+			clients, ok := db.BlockingKeys.Get(rk.key).(*list.List)
+			if !ok {
+				continue
+			}
+
+			for e := clients.Front(); e != nil; {
+				// the element is removed from the clients when the client is unblocked.
+				next := e.Next()
+				client := e.Value.(*Client)
+
+				// the clients blocked by the other type of the key are skipped.
+				switch value := db.Dict.Get(rk.key).(type) {
+				case *datastruct.Quicklist:
+					if client.blockType == blockList && value.Len() > 0 {
+						serveClientBlockedOnList(client, rk.key, value)
+					}
+				case *datastruct.Zset:
+					if client.blockType == blockZset && value.Size() > 0 {
+						serveClientBlockedOnZset(client, rk.key, value)
+					}
+				case *datastruct.Stream:
+					if client.blockType == blockStream {
+						serveClientBlockedOnStream(client, rk.key, value)
+					}
+				}
+
+				e = next
+			}
+		}
+	}
+}
+
+// processUnblockedClients processes the commands received while the clients were blocked.
+func processUnblockedClients(srv *Server) {
+	for len(srv.unblockedClients) > 0 {
+		client := srv.unblockedClients[0]
+		srv.unblockedClients = srv.unblockedClients[1:]
+
+		if client.blockType != blockNone || client.queryLen == 0 {
+			continue
+		}
+
+		if err := processInputBuffer(client); err != nil {
+			log.Error("failed to process input buffer", zap.Error(err))
+			client.free()
+		}
+	}
+}
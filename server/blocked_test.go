@@ -0,0 +1,139 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IfanTsai/metis/ae"
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockingPop(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, execute := newTestServer(t, &config.Config{})
+
+	first := NewClient(srv, -1)
+	second := NewClient(srv, -1)
+	third := NewClient(srv, -1)
+	pusher := NewClient(srv, -1)
+
+	// the element is popped immediately from the first non empty list.
+	execute(pusher, "rpush", "list2", "a", "b")
+	srv.aofBuf.Reset()
+	require.Equal(t, "*2\r\n$5\r\nlist2\r\n$1\r\na\r\n", execute(first, "blpop", "list1", "list2", "0"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"lpop", "list2"}), srv.aofBuf.String())
+	require.Equal(t, "*2\r\n$5\r\nlist2\r\n$1\r\nb\r\n", execute(first, "brpop", "list2", "0"))
+
+	require.Equal(t, "-ERR timeout is negative\r\n", execute(first, "blpop", "list1", "-1"))
+	require.Equal(t, "-ERR timeout is not a float or out of range\r\n", execute(first, "blpop", "list1", "x"))
+
+	// the clients are blocked by the empty lists, and they are served in the order they were blocked.
+	require.Empty(t, execute(first, "blpop", "list1", "list2", "0"))
+	require.Empty(t, execute(second, "brpop", "list2", "0"))
+	require.Empty(t, execute(third, "blmove", "list2", "list3", "right", "left", "0"))
+	require.Equal(t, blockList, first.blockType)
+	require.Equal(t, 3, srv.dbs[0].BlockingKeys.Get("list2").(interface{ Len() int }).Len())
+
+	srv.aofBuf.Reset()
+	require.Equal(t, ":2\r\n", execute(pusher, "rpush", "list2", "x", "y"))
+	require.Equal(t, "*2\r\n$5\r\nlist2\r\n$1\r\nx\r\n", reply(first))
+	require.Equal(t, "*2\r\n$5\r\nlist2\r\n$1\r\ny\r\n", reply(second))
+	require.Equal(t, blockNone, first.blockType)
+	require.Equal(t, blockNone, second.blockType)
+	require.Nil(t, srv.dbs[0].BlockingKeys.Find("list1"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"rpush", "list2", "x", "y"})+
+		catAppendOnlyGenericCommand([]string{"lpop", "list2"})+
+		catAppendOnlyGenericCommand([]string{"rpop", "list2"}), srv.aofBuf.String())
+
+	// the third client is served by the next push, and the element is moved to the target list.
+	require.Equal(t, blockList, third.blockType)
+	srv.aofBuf.Reset()
+	require.Equal(t, ":1\r\n", execute(pusher, "lpush", "list2", "z"))
+	require.Equal(t, "$1\r\nz\r\n", reply(third))
+	require.Equal(t, "*1\r\n$1\r\nz\r\n", execute(pusher, "lrange", "list3", "0", "-1"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"lpush", "list2", "z"})+
+		catAppendOnlyGenericCommand([]string{"lmove", "list2", "list3", "right", "left"}), srv.aofBuf.String())
+	require.Zero(t, srv.dbs[0].BlockingKeys.Size())
+
+	// the client isn't blocked in a transaction.
+	execute(first, "multi")
+	execute(first, "blpop", "list1", "0")
+	require.Equal(t, "*1\r\n*-1\r\n", execute(first, "exec"))
+}
+
+func TestBlockingPopTimeout(t *testing.T) {
+	t.Parallel()
+
+	eventLoop, err := ae.NewEventLoop()
+	require.NoError(t, err)
+
+	srv := NewServer(&config.Config{})
+	srv.eventLoop = eventLoop
+
+	client := NewClient(srv, -1)
+	client.args = []string{"blpop", "list", "0.01"}
+	require.NoError(t, processCommand(client))
+	require.Equal(t, blockList, client.blockType)
+	require.GreaterOrEqual(t, client.blockTimeoutEventID, int64(0))
+
+	// the client is timed out by the time event.
+	time.Sleep(20 * time.Millisecond)
+	blockedClientTimeoutProc(eventLoop, client.blockTimeoutEventID, client)
+	require.Equal(t, blockNone, client.blockType)
+	require.Equal(t, int64(-1), client.blockTimeoutEventID)
+	require.Equal(t, "*-1\r\n", client.replayHead.Front().Value)
+	require.Zero(t, srv.dbs[0].BlockingKeys.Size())
+	require.Error(t, eventLoop.RemoveTimeEvent(0))
+
+	// the time event is removed when the client is freed.
+	client.args = []string{"blmove", "list", "other", "left", "left", "10"}
+	require.NoError(t, processCommand(client))
+	require.Equal(t, blockList, client.blockType)
+	client.free()
+	require.Error(t, eventLoop.RemoveTimeEvent(1))
+	require.Zero(t, srv.dbs[0].BlockingKeys.Size())
+}
+
+func TestBlockingZpop(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, execute := newTestServer(t, &config.Config{})
+
+	client := NewClient(srv, -1)
+	adder := NewClient(srv, -1)
+
+	execute(adder, "zadd", "zset", "1", "a", "2", "b", "3", "c", "4", "d")
+	require.Equal(t, "*2\r\n$1\r\na\r\n$1\r\n1\r\n", execute(client, "zpopmin", "zset"))
+	require.Equal(t, "*4\r\n$1\r\nd\r\n$1\r\n4\r\n$1\r\nc\r\n$1\r\n3\r\n", execute(client, "zpopmax", "zset", "2"))
+	require.Equal(t, "*0\r\n", execute(client, "zpopmin", "zset", "0"))
+	require.Equal(t, "*0\r\n", execute(client, "zpopmin", "missing"))
+	require.Equal(t, "-ERR value is out of range, must be positive\r\n", execute(client, "zpopmin", "zset", "-1"))
+
+	// the element is popped immediately from the first non empty sorted set.
+	srv.aofBuf.Reset()
+	require.Equal(t, "*3\r\n$4\r\nzset\r\n$1\r\nb\r\n$1\r\n2\r\n", execute(client, "bzpopmax", "missing", "zset", "0"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"zpopmax", "zset"}), srv.aofBuf.String())
+
+	// the client is blocked by the empty sorted sets and served when one of them is added.
+	require.Empty(t, execute(client, "bzpopmin", "zset", "zset2", "0"))
+	require.Equal(t, blockZset, client.blockType)
+
+	// the clients blocked by the lists aren't served by the sorted set.
+	other := NewClient(srv, -1)
+	require.Empty(t, execute(other, "blpop", "zset2", "0"))
+
+	srv.aofBuf.Reset()
+	require.Equal(t, ":2\r\n", execute(adder, "zadd", "zset2", "5", "e", "6", "f"))
+	require.Equal(t, "*3\r\n$5\r\nzset2\r\n$1\r\ne\r\n$1\r\n5\r\n", reply(client))
+	require.Equal(t, blockNone, client.blockType)
+	require.Equal(t, blockList, other.blockType)
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"zadd", "zset2", "5", "e", "6", "f"})+
+		catAppendOnlyGenericCommand([]string{"zpopmin", "zset2"}), srv.aofBuf.String())
+
+	// the client isn't blocked in a transaction.
+	execute(client, "multi")
+	execute(client, "bzpopmin", "missing", "0")
+	require.Equal(t, "*1\r\n*-1\r\n", execute(client, "exec"))
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"net"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/IfanTsai/go-lib/utils/byteutils"
 	"github.com/IfanTsai/metis/ae"
@@ -13,6 +16,7 @@ import (
 	"github.com/IfanTsai/metis/datastruct"
 	"github.com/IfanTsai/metis/socket"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
 )
 
 type CommandType int
@@ -24,28 +28,82 @@ const (
 	CommandTypeMultiBulk
 )
 
+type clientFlag uint
+
+const (
+	clientFlagMaster           clientFlag = 1 << iota // the client is the master of this server
+	clientFlagReplica                                 // the client is a replica of this server
+	clientFlagMasterForceReply                        // send the reply to the master, which is used by REPLCONF ACK
+	clientFlagClusterLink                             // the connection to another node of the cluster
+	clientFlagAsking                                  // the next command is served in an importing slot, set by ASKING
+	clientFlagMulti                                   // the client is in a transaction started by MULTI
+	clientFlagDirtyCAS                                // a watched key was modified, EXEC will fail
+	clientFlagDirtyExec                               // a command was rejected while queueing, EXEC will fail
+	clientFlagPreventProp                             // the command propagates itself in other forms, e.g. XREADGROUP
+	clientFlagAofLoading                              // the fake client replaying the commands of the AOF
+	clientFlagExecPendingMulti                        // EXEC is running and MULTI isn't propagated yet
+)
+
 type Client struct {
-	srv           *Server
-	db            *database.Databse
-	fd            socket.FD
-	queryBuf      []byte
-	queryLen      int
-	cmdType       CommandType
-	args          []string
-	multiBulkLen  int
-	bulkLen       int
-	replayHead    *list.List // string
-	sentLen       int
-	authenticated bool // when server requirPassword is not empty, client must auth first
+	srv             *Server
+	db              *database.Databse
+	fd              socket.FD
+	flags           clientFlag
+	queryBuf        []byte
+	queryLen        int
+	cmdType         CommandType
+	args            []string
+	multiBulkLen    int
+	bulkLen         int
+	replayHead      *list.List // string
+	sentLen         int
+	authenticated   bool         // when server requirPassword is not empty, client must auth first
+	lastInteraction time.Time    // time of the last interaction, used for the timeout of the master
+	replWriteOffset int64        // the replication offset after the last write of the client, used by WAIT
+	multiCmds       []multiCmd   // the commands queued by MULTI
+	watchedKeys     []watchedKey // the keys watched by WATCH
+	pubsubChannels  []string     // the channels subscribed by SUBSCRIBE
+	pubsubPatterns  []string     // the patterns subscribed by PSUBSCRIBE
+
+	// the following fields are only used when the client is blocked
+	blockType            blockType
+	blockTimeout         time.Time                      // zero means blocking forever
+	blockTimeoutEventID  int64                          // the time event to time out the client, -1 if there is none
+	blockNumReplicas     int                            // WAIT: the number of replicas to wait for
+	blockReplOffset      int64                          // WAIT: the offset to be acknowledged by the replicas
+	blockKeys            []string                       // the keys which the client is blocked by
+	blockListWhere       listWhere                      // BLPOP/BRPOP/BLMOVE: the side of the list to pop from
+	blockListMove        bool                           // BLMOVE: the element is pushed to the target list
+	blockListTarget      string                         // BLMOVE: the key of the target list
+	blockListTargetWhere listWhere                      // BLMOVE: the side of the target list to push to
+	blockZsetWhere       zsetWhere                      // BZPOPMIN/BZPOPMAX: the side of the sorted set to pop from
+	blockStreamIDs       map[string]datastruct.StreamID // XREAD: the entries after the IDs are read
+	blockStreamCount     int64                          // XREAD/XREADGROUP: the max number of entries per stream
+	blockStreamGroup     string                         // XREADGROUP: the consumer group to read from
+	blockStreamConsumer  string                         // XREADGROUP: the consumer of the group
+	blockStreamNoAck     bool                           // XREADGROUP: the entries aren't added to the pending ones
+
+	// the following fields are only used when the client is a replica
+	replState         replicaState
+	replListeningPort uint16
+	replPSync         bool            // the replica uses PSYNC instead of SYNC
+	replInitialOffset int64           // the offset of the snapshot for a full resynchronization
+	replAckOffset     int64           // the offset acknowledged by the replica
+	replAckTime       time.Time       // time of the last acknowledgement
+	replPendingBuf    strings.Builder // the replication stream accumulated while waiting for the snapshot
+	replSnapshotFile  *os.File        // the snapshot being sent to the replica by chunks
 }
 
 func NewClient(srv *Server, fd socket.FD) *Client {
 	return &Client{
-		srv:        srv,
-		db:         srv.dbs[0],
-		fd:         fd,
-		queryBuf:   make([]byte, maxBulk),
-		replayHead: list.New(),
+		srv:                 srv,
+		db:                  srv.dbs[0],
+		fd:                  fd,
+		queryBuf:            make([]byte, maxBulk),
+		bulkLen:             -1,
+		blockTimeoutEventID: -1,
+		replayHead:          list.New(),
+		lastInteraction:     time.Now(),
 	}
 }
 
@@ -63,6 +121,11 @@ func (c *Client) moveToNextLineInQueryBuffer(indexCRLF int) {
 }
 
 func (c *Client) addReply(str string) error {
+	// the master doesn't expect any reply from the replica.
+	if c.flags&clientFlagMaster != 0 && c.flags&clientFlagMasterForceReply == 0 {
+		return nil
+	}
+
 	if c.replayHead.Len() == 0 && c.fd >= 0 {
 		if err := c.srv.eventLoop.AddFileEvent(c.fd, ae.TypeFileEventWritable, sendReplayToClient, c); err != nil {
 			return errors.Wrap(err, "failed to add writable file event")
@@ -98,6 +161,11 @@ func (c *Client) addReplyError(err string) error {
 	return c.addReplyStringf("-ERR %s\r\n", err)
 }
 
+// addReplyErrorCode replies an error with a specific code instead of ERR, such as READONLY.
+func (c *Client) addReplyErrorCode(code, err string) error {
+	return c.addReplyStringf("-%s %s\r\n", code, err)
+}
+
 func (c *Client) addReplyErrorf(format string, args ...any) error {
 	return c.addReplyError(fmt.Sprintf(format, args...))
 }
@@ -110,6 +178,11 @@ func (c *Client) addReplyNull() error {
 	return c.addReplyString("$-1\r\n")
 }
 
+// addReplyNullArray replies a null array, which is used when a transaction or a blocking operation fails.
+func (c *Client) addReplyNullArray() error {
+	return c.addReplyString("*-1\r\n")
+}
+
 func (c *Client) addReplyEmpty() error {
 	return c.addReplyArrays([]string{})
 }
@@ -165,6 +238,42 @@ func (c *Client) addReplyZsetElements(elements []*datastruct.ZsetElement, withSc
 	return nil
 }
 
+// addReplyStreamEntries replies the entries as an array of the ID and the field value pairs, a nil entry
+// is replied as the ID with a null array, which is the one pending but trimmed from the stream.
+func (c *Client) addReplyStreamEntries(entries []*datastruct.StreamEntry, ids []datastruct.StreamID) error {
+	if err := c.addReplyStringf("*%d\r\n", len(entries)); err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if err := c.addReplyString("*2\r\n"); err != nil {
+			return err
+		}
+
+		if entry == nil {
+			if err := c.addReplyBulkString(ids[i].String()); err != nil {
+				return err
+			}
+
+			if err := c.addReplyNullArray(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := c.addReplyBulkString(entry.ID.String()); err != nil {
+			return err
+		}
+
+		if err := c.addReplyArrays(entry.Fields); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) addReplySet(set *datastruct.Set) error {
 	if err := c.addReplyStringf("*%d\r\n", set.Size()); err != nil {
 		return err
@@ -180,6 +289,28 @@ func (c *Client) addReplySet(set *datastruct.Set) error {
 }
 
 func (c *Client) free() {
+	if c.blockType != blockNone {
+		unblockClient(c)
+	}
+
+	if c.srv != nil {
+		c.srv.unblockedClients = lo.Without(c.srv.unblockedClients, c)
+		unwatchAllKeys(c)
+		pubsubUnsubscribeAll(c)
+	}
+
+	if c.flags&clientFlagMaster != 0 {
+		replicationHandleMasterDisconnection(c.srv)
+	}
+
+	if c.flags&clientFlagReplica != 0 {
+		replicationRemoveReplica(c.srv, c)
+	}
+
+	if c.flags&clientFlagClusterLink != 0 {
+		clusterHandleLinkFree(c.srv, c)
+	}
+
 	if c.srv != nil && c.fd >= 0 {
 		delete(c.srv.clients, c.fd)
 
@@ -195,11 +326,25 @@ func (c *Client) free() {
 
 }
 
+// clientIP returns the IP address of the peer of the client.
+func clientIP(client *Client) string {
+	addr, err := client.fd.GetPeerName()
+	if err != nil {
+		return "?"
+	}
+
+	return net.IP(addr.Addr[:]).String()
+}
+
+// reset resets the client for the next command. The rest of the query buffer is kept,
+// since it may contain the following pipelined commands.
 func (c *Client) reset() {
-	c.queryBuf = nil
-	c.queryLen = 0
+	if c.queryLen == 0 {
+		c.queryBuf = nil
+	}
+
 	c.cmdType = CommandTypeUnknown
 	c.args = nil
 	c.multiBulkLen = 0
-	c.bulkLen = 0
+	c.bulkLen = -1 // the length of the next bulk is unknown until its header is read
 }
@@ -0,0 +1,1302 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IfanTsai/go-lib/utils/byteutils"
+	"github.com/IfanTsai/metis/ae"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/IfanTsai/metis/log"
+	"github.com/IfanTsai/metis/socket"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	clusterSlots             = 16384
+	clusterDefaultConfigFile = "nodes.conf"
+	clusterCronPeriod        = time.Second
+	clusterHandshakeTimeout  = 15 * time.Second // forget the node if the handshake isn't finished in time
+	clusterReadBufSize       = 1024
+	migrateDefaultTimeout    = 1000 // ms
+)
+
+type clusterNodeFlag uint
+
+const (
+	clusterNodeMyself    clusterNodeFlag = 1 << iota // the node is this server
+	clusterNodeHandshake                             // the node is met but its ID is unknown yet
+)
+
+type clusterNode struct {
+	id          string
+	ip          string // empty if this server doesn't know its own IP yet
+	port        uint16
+	flags       clusterNodeFlag
+	configEpoch uint64  // the slots claimed by a node with a greater epoch win
+	numSlots    int     // the number of slots served by the node
+	link        *Client // the connection to the node, which is used to send PING
+	ctime       time.Time
+	pongTime    time.Time // time of the last PING received from the node
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(int(n.port)))
+}
+
+type clusterState struct {
+	myself             *clusterNode
+	currentEpoch       uint64
+	nodes              map[string]*clusterNode // ID -> node
+	slots              [clusterSlots]*clusterNode
+	migratingSlotsTo   [clusterSlots]*clusterNode // the keys of the slot are being moved to the node
+	importingSlotsFrom [clusterSlots]*clusterNode // the keys of the slot are being moved from the node
+	configFile         string
+	saveConfigPending  bool // save the config file before the event loop sleeps
+	cronLastTime       time.Time
+}
+
+// slotBitmap is a set of hash slots.
+type slotBitmap [clusterSlots / 8]byte
+
+func (b *slotBitmap) set(slot int) {
+	b[slot/8] |= 1 << (slot % 8)
+}
+
+func (b *slotBitmap) has(slot int) bool {
+	return b[slot/8]&(1<<(slot%8)) != 0
+}
+
+func newClusterState() *clusterState {
+	myself := &clusterNode{
+		id:    newReplID(),
+		flags: clusterNodeMyself,
+		ctime: time.Now(),
+	}
+
+	return &clusterState{
+		myself: myself,
+		nodes:  map[string]*clusterNode{myself.id: myself},
+	}
+}
+
+// clusterInit loads the cluster config file, or creates a new node identity if there is no such file.
+func clusterInit(srv *Server, configFile string) {
+	if srv.masterHost != "" {
+		log.Fatal("replicaof is not allowed in cluster mode")
+	}
+
+	srv.cluster = newClusterState()
+	srv.cluster.configFile = configFile
+
+	err := clusterLoadConfig(srv, configFile)
+	switch {
+	case os.IsNotExist(errors.Cause(err)):
+		log.Info("no cluster configuration found, I'm " + srv.cluster.myself.id)
+
+		if err := clusterSaveConfig(srv); err != nil {
+			log.Fatal("failed to save the cluster config file", zap.Error(err))
+		}
+	case err != nil:
+		log.Fatal("unrecoverable error: corrupted cluster config file", zap.String("file", configFile), zap.Error(err))
+	default:
+		log.Info("node configuration loaded, I'm " + srv.cluster.myself.id)
+	}
+
+	// the node knows its own IP if it's bound to a specific address, otherwise it's learned from the other nodes.
+	if srv.host != "" && srv.host != "0.0.0.0" {
+		srv.cluster.myself.ip = srv.host
+	}
+
+	srv.cluster.myself.port = srv.port
+}
+
+// clusterLoadConfig loads the nodes and the slots from the config file, which has the format of CLUSTER NODES.
+func clusterLoadConfig(srv *Server, configFile string) error {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to open cluster config file")
+	}
+	defer file.Close()
+
+	c := srv.cluster
+	c.nodes = make(map[string]*clusterNode)
+	c.myself = nil
+
+	// the states of the slots in migration are resolved after all the nodes are loaded.
+	var migrations []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					if c.currentEpoch, err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+						return errors.Wrap(err, "invalid currentEpoch")
+					}
+				}
+			}
+
+			continue
+		}
+
+		if len(fields) < 8 {
+			return errors.Errorf("invalid node line: %s", scanner.Text())
+		}
+
+		node, err := clusterParseNodeLine(fields)
+		if err != nil {
+			return err
+		}
+
+		c.nodes[node.id] = node
+		if node.flags&clusterNodeMyself != 0 {
+			c.myself = node
+		}
+
+		ranges := fields[8:]
+		for len(ranges) > 0 && strings.HasPrefix(ranges[len(ranges)-1], "[") {
+			migrations = append(migrations, ranges[len(ranges)-1])
+			ranges = ranges[:len(ranges)-1]
+		}
+
+		slots, err := parseSlotRanges(ranges)
+		if err != nil {
+			return err
+		}
+
+		for slot := 0; slot < clusterSlots; slot++ {
+			if slots.has(slot) {
+				clusterAssignSlot(c, slot, node)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "failed to read cluster config file")
+	}
+
+	if c.myself == nil {
+		return errors.New("myself node not found")
+	}
+
+	for _, migration := range migrations {
+		if err := clusterLoadSlotMigration(c, migration); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clusterLoadSlotMigration loads the state of a slot in migration like "[slot->-id]" or "[slot-<-id]".
+func clusterLoadSlotMigration(c *clusterState, migration string) error {
+	migration = strings.Trim(migration, "[]")
+
+	slotStr, id, migrating := strings.Cut(migration, "->-")
+	if !migrating {
+		var importing bool
+		if slotStr, id, importing = strings.Cut(migration, "-<-"); !importing {
+			return errors.Errorf("invalid slot migration: %s", migration)
+		}
+	}
+
+	slot, err := getSlot(slotStr)
+	if err != nil {
+		return err
+	}
+
+	node, ok := c.nodes[id]
+	if !ok {
+		return errors.Errorf("unknown node in slot migration: %s", migration)
+	}
+
+	if migrating {
+		c.migratingSlotsTo[slot] = node
+	} else {
+		c.importingSlotsFrom[slot] = node
+	}
+
+	return nil
+}
+
+// clusterParseNodeLine parses the fields of a line like "<id> <ip:port@cport> <flags> <master> <ping> <pong> <epoch> <link>".
+func clusterParseNodeLine(fields []string) (*clusterNode, error) {
+	node := &clusterNode{id: fields[0], ctime: time.Now()}
+
+	addr, _, _ := strings.Cut(fields[1], "@")
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid node address: %s", fields[1])
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid node port: %s", fields[1])
+	}
+
+	node.ip, node.port = host, uint16(port)
+
+	for _, flag := range strings.Split(fields[2], ",") {
+		if flag == "myself" {
+			node.flags |= clusterNodeMyself
+		}
+	}
+
+	if node.configEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "invalid config epoch: %s", fields[6])
+	}
+
+	return node, nil
+}
+
+// clusterSaveConfig writes the config file atomically by renaming a temp file.
+func clusterSaveConfig(srv *Server) error {
+	c := srv.cluster
+	c.saveConfigPending = false
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.configFile), "temp-nodes-*.conf")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp cluster config file")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	content := clusterGenNodesDescription(c, clusterNodeHandshake) +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", c.currentEpoch)
+
+	if _, err := tmpFile.WriteString(content); err != nil {
+		return errors.Wrap(err, "failed to write temp cluster config file")
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		return errors.Wrap(err, "failed to fsync temp cluster config file")
+	}
+
+	if err := os.Rename(tmpFile.Name(), c.configFile); err != nil {
+		return errors.Wrap(err, "failed to rename temp cluster config file")
+	}
+
+	return nil
+}
+
+// clusterBeforeSleep is called before the event loop sleeps, it saves the config file if the state changed.
+func clusterBeforeSleep(srv *Server) {
+	if srv.cluster.saveConfigPending {
+		if err := clusterSaveConfig(srv); err != nil {
+			log.Error("failed to save the cluster config file", zap.Error(err))
+		}
+	}
+}
+
+// crc16 is the CRC16 implementation used by Redis cluster (XMODEM).
+func crc16(str string) uint16 {
+	var crc uint16
+	for i := 0; i < len(str); i++ {
+		crc ^= uint16(str[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// keyHashSlot returns the hash slot of the key. If the key contains a non-empty {hashtag},
+// only the hashtag is hashed, so that the keys with the same hashtag are in the same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+func clusterAssignSlot(c *clusterState, slot int, node *clusterNode) {
+	if owner := c.slots[slot]; owner != nil {
+		owner.numSlots--
+	}
+
+	c.slots[slot] = node
+	if node != nil {
+		node.numSlots++
+	}
+}
+
+// clusterSlotRanges returns the slots served by the node in ranges like "0-5460" or "5461".
+func clusterSlotRanges(c *clusterState, node *clusterNode) []string {
+	var ranges []string
+	for start := 0; start < clusterSlots; start++ {
+		if c.slots[start] != node {
+			continue
+		}
+
+		end := start
+		for end+1 < clusterSlots && c.slots[end+1] == node {
+			end++
+		}
+
+		if start == end {
+			ranges = append(ranges, strconv.Itoa(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+		}
+
+		start = end
+	}
+
+	return ranges
+}
+
+func parseSlotRanges(ranges []string) (*slotBitmap, error) {
+	slots := &slotBitmap{}
+	for _, r := range ranges {
+		startStr, endStr, isRange := strings.Cut(r, "-")
+		if !isRange {
+			endStr = startStr
+		}
+
+		start, err := getSlot(startStr)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := getSlot(endStr)
+		if err != nil {
+			return nil, err
+		}
+
+		for slot := start; slot <= end; slot++ {
+			slots.set(slot)
+		}
+	}
+
+	return slots, nil
+}
+
+func getSlot(str string) (int, error) {
+	slot, err := strconv.Atoi(str)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return -1, errors.Errorf("Invalid or out of range slot: %s", str)
+	}
+
+	return slot, nil
+}
+
+// clusterGenNodesDescription generates the output of CLUSTER NODES, the nodes with the filter flags are skipped.
+func clusterGenNodesDescription(c *clusterState, filter clusterNodeFlag) string {
+	nodes := make([]*clusterNode, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		if node.flags&filter == 0 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+
+	var sb strings.Builder
+	for _, node := range nodes {
+		var flags string
+		switch {
+		case node.flags&clusterNodeMyself != 0:
+			flags = "myself,master"
+		case node.flags&clusterNodeHandshake != 0:
+			flags = "handshake"
+		default:
+			flags = "master"
+		}
+
+		linkState := "disconnected"
+		if node.flags&clusterNodeMyself != 0 || node.link != nil {
+			linkState = "connected"
+		}
+
+		var pongTime int64
+		if !node.pongTime.IsZero() {
+			pongTime = node.pongTime.UnixMilli()
+		}
+
+		fmt.Fprintf(&sb, "%s %s@%d %s - 0 %d %d %s", node.id, node.addr(), node.port,
+			flags, pongTime, node.configEpoch, linkState)
+
+		for _, r := range clusterSlotRanges(c, node) {
+			sb.WriteString(" ")
+			sb.WriteString(r)
+		}
+
+		// only this node knows the slots in migration.
+		if node == c.myself {
+			for slot := 0; slot < clusterSlots; slot++ {
+				if target := c.migratingSlotsTo[slot]; target != nil {
+					fmt.Fprintf(&sb, " [%d->-%s]", slot, target.id)
+				}
+
+				if source := c.importingSlotsFrom[slot]; source != nil {
+					fmt.Fprintf(&sb, " [%d-<-%s]", slot, source.id)
+				}
+			}
+		}
+
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// clusterRedirectIfNeeded replies a redirection error if the keys of the command are not served by this node.
+// It returns true if the command should not be executed.
+func clusterRedirectIfNeeded(client *Client, cmd *command) (bool, error) {
+	keys := getKeysFromCommand(cmd, client.args)
+	if len(keys) == 0 {
+		return false, nil
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return true, client.addReplyErrorCode("CROSSSLOT", "Keys in request don't hash to the same slot")
+		}
+	}
+
+	c := client.srv.cluster
+	node := c.slots[slot]
+	if node == nil {
+		return true, client.addReplyErrorCode("CLUSTERDOWN", "Hash slot not served")
+	}
+
+	migrating := node == c.myself && c.migratingSlotsTo[slot] != nil
+	importing := c.importingSlotsFrom[slot] != nil &&
+		(client.flags&clientFlagAsking != 0 || cmd.flags&cmdAsking != 0)
+
+	// the keys being moved may be partly here and partly in the other node during the migration.
+	missingKeys := 0
+	if migrating || importing {
+		for _, key := range keys {
+			if client.db.Dict.Find(key) == nil {
+				missingKeys++
+			}
+		}
+	}
+
+	switch {
+	case migrating && cmd.name == "migrate":
+		// MIGRATE is always served by the node migrating the slot, the missing keys are ignored.
+		return false, nil
+	case migrating && missingKeys > 0 && missingKeys < len(keys),
+		importing && missingKeys > 0 && len(keys) > 1:
+		return true, client.addReplyErrorCode("TRYAGAIN", "Multiple keys request during rehashing of slot")
+	case migrating && missingKeys > 0:
+		// the keys may be moved already, ask the target node once.
+		return true, client.addReplyErrorCode("ASK", fmt.Sprintf("%d %s", slot, c.migratingSlotsTo[slot].addr()))
+	case node == c.myself, importing:
+		return false, nil
+	default:
+		return true, client.addReplyErrorCode("MOVED", fmt.Sprintf("%d %s", slot, node.addr()))
+	}
+}
+
+func askingCommand(client *Client) error {
+	if client.srv.cluster == nil {
+		return client.addReplyError("This instance has cluster support disabled")
+	}
+
+	client.flags |= clientFlagAsking
+
+	return client.addReplyOK()
+}
+
+func clusterCommand(client *Client) error {
+	c := client.srv.cluster
+	if c == nil {
+		return client.addReplyError("This instance has cluster support disabled")
+	}
+
+	switch subcommand := strings.ToLower(client.args[1]); {
+	case subcommand == "ping" && len(client.args) >= 7:
+		clusterProcessPing(client)
+
+		// the sender doesn't read the reply.
+		return nil
+	case subcommand == "meet" && len(client.args) == 4:
+		return clusterMeetCommand(client)
+	case subcommand == "myid" && len(client.args) == 2:
+		return client.addReplyBulkString(c.myself.id)
+	case subcommand == "info" && len(client.args) == 2:
+		return clusterInfoCommand(client)
+	case subcommand == "nodes" && len(client.args) == 2:
+		return client.addReplyBulkString(clusterGenNodesDescription(c, 0))
+	case subcommand == "slots" && len(client.args) == 2:
+		return clusterSlotsCommand(client)
+	case subcommand == "addslots" && len(client.args) >= 3:
+		return clusterAddSlotsCommand(client)
+	case subcommand == "keyslot" && len(client.args) == 3:
+		return client.addReplyInt(int64(keyHashSlot(client.args[2])))
+	case subcommand == "setslot" && len(client.args) >= 4:
+		return clusterSetSlotCommand(client)
+	case subcommand == "countkeysinslot" && len(client.args) == 3:
+		slot, err := getSlot(client.args[2])
+		if err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		return client.addReplyInt(int64(len(clusterGetKeysInSlot(client.srv, slot, -1))))
+	case subcommand == "getkeysinslot" && len(client.args) == 4:
+		slot, err := getSlot(client.args[2])
+		if err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		count, err := strconv.Atoi(client.args[3])
+		if err != nil || count < 0 {
+			return client.addReplyError("Invalid number of keys")
+		}
+
+		return client.addReplyArrays(clusterGetKeysInSlot(client.srv, slot, count))
+	default:
+		return client.addReplyErrorf("Unknown subcommand or wrong number of arguments for '%s'", client.args[1])
+	}
+}
+
+func clusterMeetCommand(client *Client) error {
+	c := client.srv.cluster
+
+	port, err := strconv.ParseUint(client.args[3], 10, 16)
+	if err != nil {
+		return client.addReplyErrorf("Invalid TCP base port specified: %s", client.args[3])
+	}
+
+	ip, err := resolveIPv4(client.args[2])
+	if err != nil {
+		return client.addReplyErrorf("Invalid node address specified: %s:%s", client.args[2], client.args[3])
+	}
+
+	for _, node := range c.nodes {
+		if node.ip == ip && node.port == uint16(port) {
+			return client.addReplyOK()
+		}
+	}
+
+	// the node is renamed when its first PING is received.
+	node := &clusterNode{
+		id:    newReplID(),
+		ip:    ip,
+		port:  uint16(port),
+		flags: clusterNodeHandshake,
+		ctime: time.Now(),
+	}
+	c.nodes[node.id] = node
+	clusterCreateLink(client.srv, node)
+
+	return client.addReplyOK()
+}
+
+func clusterInfoCommand(client *Client) error {
+	c := client.srv.cluster
+
+	var slotsAssigned, size int
+	for _, node := range c.nodes {
+		slotsAssigned += node.numSlots
+		if node.numSlots > 0 {
+			size++
+		}
+	}
+
+	state := "ok"
+	if slotsAssigned < clusterSlots {
+		state = "fail"
+	}
+
+	return client.addReplyBulkString(fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\n"+
+		"cluster_my_epoch:%d\r\n",
+		state,
+		slotsAssigned,
+		len(c.nodes),
+		size,
+		c.currentEpoch,
+		c.myself.configEpoch,
+	))
+}
+
+func clusterSlotsCommand(client *Client) error {
+	c := client.srv.cluster
+
+	var sb strings.Builder
+	ranges := 0
+	for start := 0; start < clusterSlots; start++ {
+		node := c.slots[start]
+		if node == nil {
+			continue
+		}
+
+		end := start
+		for end+1 < clusterSlots && c.slots[end+1] == node {
+			end++
+		}
+
+		// the client reaches this node by the local address of the connection if the IP isn't known yet.
+		ip := node.ip
+		if ip == "" && client.fd >= 0 {
+			if addr, err := client.fd.GetSockName(); err == nil {
+				ip = net.IP(addr.Addr[:]).String()
+			}
+		}
+
+		fmt.Fprintf(&sb, "*3\r\n:%d\r\n:%d\r\n*3\r\n$%d\r\n%s\r\n:%d\r\n$%d\r\n%s\r\n",
+			start, end, len(ip), ip, node.port, len(node.id), node.id)
+		ranges++
+		start = end
+	}
+
+	return client.addReplyStringf("*%d\r\n%s", ranges, sb.String())
+}
+
+func clusterAddSlotsCommand(client *Client) error {
+	c := client.srv.cluster
+
+	slots := &slotBitmap{}
+	for _, arg := range client.args[2:] {
+		slot, err := getSlot(arg)
+		if err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		if c.slots[slot] != nil {
+			return client.addReplyErrorf("Slot %d is already busy", slot)
+		}
+
+		if slots.has(slot) {
+			return client.addReplyErrorf("Slot %d specified multiple times", slot)
+		}
+
+		slots.set(slot)
+	}
+
+	for slot := 0; slot < clusterSlots; slot++ {
+		if slots.has(slot) {
+			clusterAssignSlot(c, slot, c.myself)
+		}
+	}
+
+	c.saveConfigPending = true
+
+	return client.addReplyOK()
+}
+
+// migrateGetKeys returns the keys of MIGRATE, which are the ones after KEYS if the key argument is empty.
+func migrateGetKeys(args []string) []string {
+	if args[3] == "" {
+		for i := 6; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "auth":
+				i++
+			case "keys":
+				return args[i+1:]
+			}
+		}
+	}
+
+	return args[3:4]
+}
+
+// migrateCommand implements MIGRATE host port key|"" db timeout [COPY] [REPLACE] [AUTH password] [KEYS key ...].
+// The keys are serialized in the DUMP format and restored by RESTORE-ASKING on the target synchronously,
+// then they are deleted here unless COPY is given, so every key is moved atomically.
+func migrateCommand(client *Client) error {
+	args := client.args
+
+	copyKeys, replace, password := false, false, ""
+	keys := args[3:4]
+	for i := 6; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "copy":
+			copyKeys = true
+		case "replace":
+			replace = true
+		case "auth":
+			if i+1 >= len(args) {
+				return client.addReplyError("syntax error")
+			}
+
+			i++
+			password = args[i]
+		case "keys":
+			if args[3] != "" {
+				return client.addReplyError(
+					"When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	if _, err := strconv.ParseUint(args[2], 10, 16); err != nil {
+		return client.addReplyError("invalid port")
+	}
+
+	dbID, err := strconv.Atoi(args[4])
+	if err != nil || dbID < 0 {
+		return client.addReplyError("invalid db index")
+	}
+
+	timeout, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		return client.addReplyError("timeout is not an integer or out of range")
+	}
+
+	if timeout <= 0 {
+		timeout = migrateDefaultTimeout
+	}
+
+	var sb strings.Builder
+	if password != "" {
+		sb.WriteString(catAppendOnlyGenericCommand([]string{"auth", password}))
+	}
+
+	sb.WriteString(catAppendOnlyGenericCommand([]string{"select", strconv.Itoa(dbID)}))
+
+	// only the existing keys are moved.
+	existingKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, err := expireIfNeeded(client, key); err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		value := client.db.Dict.Get(key)
+		if value == nil {
+			continue
+		}
+
+		payload, err := rdbDumpObject(value)
+		if err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		ttl := int64(0)
+		if expireEntry := client.db.Expire.Find(key); expireEntry != nil {
+			ttl = lo.Max([]int64{expireEntry.Value.(int64) - time.Now().UnixMilli(), 1})
+		}
+
+		restoreArgs := []string{"restore-asking", key, strconv.FormatInt(ttl, 10), payload}
+		if replace {
+			restoreArgs = append(restoreArgs, "replace")
+		}
+
+		sb.WriteString(catAppendOnlyGenericCommand(restoreArgs))
+		existingKeys = append(existingKeys, key)
+	}
+
+	if len(existingKeys) == 0 {
+		return client.addReplySimpleString("NOKEY")
+	}
+
+	deadline := time.Duration(timeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(args[1], args[2]), deadline)
+	if err != nil {
+		return client.addReplyErrorCode("IOERR", "error or timeout connecting to the client")
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(deadline))
+
+	if _, err := conn.Write(byteutils.S2B(sb.String())); err != nil {
+		return client.addReplyErrorCode("IOERR", "error or timeout writing to target instance")
+	}
+
+	// the replies of AUTH and SELECT are followed by the ones of RESTORE-ASKING in order.
+	reader := bufio.NewReader(conn)
+	numReplies := len(existingKeys) + 1
+	if password != "" {
+		numReplies++
+	}
+
+	var targetErr string
+	movedKeys := make([]string, 0, len(existingKeys))
+	for i := 0; i < numReplies; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			targetErr = "IOERR error or timeout reading to target instance"
+
+			break
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-") {
+			if targetErr == "" {
+				targetErr = "Target instance replied with error: " + line[1:]
+			}
+
+			continue
+		}
+
+		if keyIndex := i - (numReplies - len(existingKeys)); keyIndex >= 0 {
+			movedKeys = append(movedKeys, existingKeys[keyIndex])
+		}
+	}
+
+	if !copyKeys && len(movedKeys) > 0 {
+		for _, key := range movedKeys {
+			_ = client.db.Dict.Delete(key)
+			_ = client.db.Expire.Delete(key)
+			signalModifiedKey(client, key)
+			notifyKeyspaceEvent(client.srv, notifyGeneric, "del", key, client.db.ID)
+			client.srv.dirty++
+		}
+
+		// propagate the deletion of the moved keys instead of MIGRATE.
+		client.args = append([]string{"del"}, movedKeys...)
+	}
+
+	if targetErr != "" {
+		if strings.HasPrefix(targetErr, "IOERR ") {
+			return client.addReplyErrorCode("IOERR", strings.TrimPrefix(targetErr, "IOERR "))
+		}
+
+		return client.addReplyError(targetErr)
+	}
+
+	return client.addReplyOK()
+}
+
+// clusterSetSlotCommand implements CLUSTER SETSLOT <slot> MIGRATING|IMPORTING|NODE <node-id> and STABLE.
+func clusterSetSlotCommand(client *Client) error {
+	c := client.srv.cluster
+
+	slot, err := getSlot(client.args[2])
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	action := strings.ToLower(client.args[3])
+	if action == "stable" {
+		if len(client.args) != 4 {
+			return client.addReplyError("syntax error")
+		}
+
+		c.migratingSlotsTo[slot] = nil
+		c.importingSlotsFrom[slot] = nil
+		c.saveConfigPending = true
+
+		return client.addReplyOK()
+	}
+
+	if len(client.args) != 5 {
+		return client.addReplyError("syntax error")
+	}
+
+	node, ok := c.nodes[client.args[4]]
+	if !ok || node.flags&clusterNodeHandshake != 0 {
+		return client.addReplyErrorf("I don't know about node %s", client.args[4])
+	}
+
+	switch action {
+	case "migrating":
+		if c.slots[slot] != c.myself {
+			return client.addReplyErrorf("I'm not the owner of hash slot %d", slot)
+		}
+
+		if node == c.myself {
+			return client.addReplyError("I can't migrate to myself")
+		}
+
+		c.migratingSlotsTo[slot] = node
+	case "importing":
+		if c.slots[slot] == c.myself {
+			return client.addReplyErrorf("I'm already the owner of hash slot %d", slot)
+		}
+
+		if node == c.myself {
+			return client.addReplyError("I can't import from myself")
+		}
+
+		c.importingSlotsFrom[slot] = node
+	case "node":
+		if c.slots[slot] == c.myself && node != c.myself && len(clusterGetKeysInSlot(client.srv, slot, 1)) > 0 {
+			return client.addReplyErrorf(
+				"Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+
+		// the migration to another node is finished.
+		if len(clusterGetKeysInSlot(client.srv, slot, 1)) == 0 {
+			c.migratingSlotsTo[slot] = nil
+		}
+
+		// the migration to this node is finished, the config epoch is bumped so that the new
+		// owner wins when the other nodes receive the PING.
+		if node == c.myself && c.importingSlotsFrom[slot] != nil {
+			c.importingSlotsFrom[slot] = nil
+			c.currentEpoch++
+			c.myself.configEpoch = c.currentEpoch
+		}
+
+		clusterAssignSlot(c, slot, node)
+	default:
+		return client.addReplyError("Invalid CLUSTER SETSLOT action or number of arguments.")
+	}
+
+	c.saveConfigPending = true
+
+	return client.addReplyOK()
+}
+
+// clusterGetKeysInSlot returns up to count keys in the slot, or all of them if count is negative.
+// The whole database is scanned since there is no index of the keys by slot.
+func clusterGetKeysInSlot(srv *Server, slot int, count int) []string {
+	keys := make([]string, 0)
+	if count == 0 {
+		return keys
+	}
+
+	iter := datastruct.NewDictIterator(srv.dbs[0].Dict)
+	defer iter.Release()
+
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		key := entry.Key.(string)
+		if keyHashSlot(key) != slot {
+			continue
+		}
+
+		keys = append(keys, key)
+		if len(keys) == count {
+			break
+		}
+	}
+
+	return keys
+}
+
+/* -------------------------------- cluster bus -------------------------------- */
+
+// The nodes talk to each other with the normal protocol on the client port. Every node sends
+// periodically to the other nodes:
+//
+//	CLUSTER PING <id> <port> <config-epoch> <current-epoch> <slots> [<id> <ip> <port> ...]
+//
+// where <slots> are the slot ranges served by the sender separated by commas or "-" if none,
+// and the trailing triples are the other nodes known by the sender, which are met by the receiver.
+// There is no reply, so the connection is only used in one direction.
+
+// clusterCreateLink connects to the node asynchronously, the PING is sent when the connection is established.
+func clusterCreateLink(srv *Server, node *clusterNode) {
+	fd, err := ConnectTCPServerNonBlock(node.ip, node.port)
+	if err != nil {
+		log.Debug("unable to connect to node", zap.String("node", node.addr()), zap.Error(err))
+
+		return
+	}
+
+	link := NewClient(srv, fd)
+	link.flags |= clientFlagClusterLink
+
+	if err := srv.eventLoop.AddFileEvent(fd, ae.TypeFileEventWritable, clusterLinkConnectHandler, link); err != nil {
+		log.Error("failed to add file event", zap.Error(err))
+		fd.Close()
+
+		return
+	}
+
+	node.link = link
+}
+
+func clusterLinkConnectHandler(el *ae.EventLoop, fd socket.FD, clientData any) {
+	link := clientData.(*Client)
+	_ = el.RemoveFileEvent(fd, ae.TypeFileEventWritable)
+
+	soErr, err := fd.GetSockOptInt(syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err == nil && soErr != 0 {
+		err = syscall.Errno(soErr)
+	}
+
+	if err == nil {
+		err = el.AddFileEvent(fd, ae.TypeFileEventReadable, clusterLinkReadHandler, link)
+	}
+
+	if err != nil {
+		log.Debug("unable to connect to node", zap.Error(err))
+		link.free()
+
+		return
+	}
+
+	srv := link.srv
+	if srv.masterAuth != "" {
+		_ = link.addReply(catAppendOnlyGenericCommand([]string{"auth", srv.masterAuth}))
+	}
+
+	if node := clusterLookupNodeByLink(srv.cluster, link); node != nil {
+		clusterSendPing(srv, node)
+	}
+}
+
+// clusterLinkReadHandler discards the data received by the link and detects the close of the connection.
+func clusterLinkReadHandler(el *ae.EventLoop, fd socket.FD, clientData any) {
+	link := clientData.(*Client)
+
+	buf := make([]byte, clusterReadBufSize)
+	nRead, err := fd.Read(buf)
+	if err != nil {
+		switch errors.Cause(err).(syscall.Errno) {
+		case syscall.EAGAIN, syscall.EINTR:
+			return
+		}
+	}
+
+	if nRead <= 0 {
+		link.free()
+	}
+}
+
+func clusterLookupNodeByLink(c *clusterState, link *Client) *clusterNode {
+	for _, node := range c.nodes {
+		if node.link == link {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// clusterHandleLinkFree is called when the link is closed, it's reconnected by the cluster cron.
+func clusterHandleLinkFree(srv *Server, link *Client) {
+	if node := clusterLookupNodeByLink(srv.cluster, link); node != nil {
+		node.link = nil
+	}
+}
+
+func clusterSendPing(srv *Server, node *clusterNode) {
+	c := srv.cluster
+
+	slots := "-"
+	if ranges := clusterSlotRanges(c, c.myself); len(ranges) > 0 {
+		slots = strings.Join(ranges, ",")
+	}
+
+	args := []string{
+		"cluster", "ping", c.myself.id, strconv.Itoa(int(srv.port)),
+		strconv.FormatUint(c.myself.configEpoch, 10), strconv.FormatUint(c.currentEpoch, 10), slots,
+	}
+
+	for _, gossip := range c.nodes {
+		if gossip == c.myself || gossip == node || gossip.flags&clusterNodeHandshake != 0 || gossip.ip == "" {
+			continue
+		}
+
+		args = append(args, gossip.id, gossip.ip, strconv.Itoa(int(gossip.port)))
+	}
+
+	if err := node.link.addReply(catAppendOnlyGenericCommand(args)); err != nil {
+		log.Error("failed to send PING to node", zap.String("node", node.addr()), zap.Error(err))
+	}
+}
+
+// clusterProcessPing updates the state of the cluster with the PING received from another node.
+func clusterProcessPing(client *Client) {
+	srv := client.srv
+	c := srv.cluster
+	args := client.args
+
+	port, err := strconv.ParseUint(args[3], 10, 16)
+	if err != nil {
+		return
+	}
+
+	configEpoch, err := strconv.ParseUint(args[4], 10, 64)
+	if err != nil {
+		return
+	}
+
+	currentEpoch, err := strconv.ParseUint(args[5], 10, 64)
+	if err != nil {
+		return
+	}
+
+	slots := &slotBitmap{}
+	if args[6] != "-" {
+		if slots, err = parseSlotRanges(strings.Split(args[6], ",")); err != nil {
+			return
+		}
+	}
+
+	if (len(args)-7)%3 != 0 || args[2] == c.myself.id {
+		return
+	}
+
+	// learn the IP of this node from the address the other node connected to.
+	if c.myself.ip == "" && client.fd >= 0 {
+		if addr, err := client.fd.GetSockName(); err == nil {
+			c.myself.ip = net.IP(addr.Addr[:]).String()
+			c.saveConfigPending = true
+		}
+	}
+
+	sender := clusterLookupOrCreateSender(c, args[2], clientIP(client), uint16(port))
+	sender.pongTime = time.Now()
+
+	if sender.configEpoch != configEpoch {
+		sender.configEpoch = configEpoch
+		c.saveConfigPending = true
+	}
+
+	if currentEpoch > c.currentEpoch {
+		c.currentEpoch = currentEpoch
+		c.saveConfigPending = true
+	}
+
+	if clusterUpdateSlots(c, sender, slots) {
+		c.saveConfigPending = true
+	}
+
+	// meet the nodes known by the sender.
+	for i := 7; i+2 < len(args); i += 3 {
+		id, ip := args[i], args[i+1]
+		if _, ok := c.nodes[id]; ok {
+			continue
+		}
+
+		port, err := strconv.ParseUint(args[i+2], 10, 16)
+		if err != nil {
+			continue
+		}
+
+		c.nodes[id] = &clusterNode{id: id, ip: ip, port: uint16(port), ctime: time.Now()}
+		c.saveConfigPending = true
+	}
+}
+
+// clusterLookupOrCreateSender returns the node of the sender of PING, the node in handshake
+// with the same address is renamed, and an unknown node is created.
+func clusterLookupOrCreateSender(c *clusterState, id, ip string, port uint16) *clusterNode {
+	sender := c.nodes[id]
+
+	for _, node := range c.nodes {
+		if node.flags&clusterNodeHandshake == 0 || node.ip != ip || node.port != port {
+			continue
+		}
+
+		delete(c.nodes, node.id)
+		c.saveConfigPending = true
+
+		if sender != nil {
+			if node.link != nil {
+				node.link.free()
+			}
+
+			continue
+		}
+
+		node.id = id
+		node.flags &^= clusterNodeHandshake
+		c.nodes[id] = node
+		sender = node
+	}
+
+	if sender == nil {
+		sender = &clusterNode{id: id, ctime: time.Now()}
+		c.nodes[id] = sender
+	}
+
+	if sender.ip != ip || sender.port != port {
+		sender.ip, sender.port = ip, port
+		c.saveConfigPending = true
+
+		// reconnect to the new address.
+		if sender.link != nil {
+			sender.link.free()
+		}
+	}
+
+	return sender
+}
+
+// clusterUpdateSlots updates the owners of the slots with the ones claimed by the sender. A slot
+// claimed by another node is taken if the sender has a greater config epoch. It returns true if changed.
+func clusterUpdateSlots(c *clusterState, sender *clusterNode, claimed *slotBitmap) bool {
+	changed := false
+	for slot := 0; slot < clusterSlots; slot++ {
+		owner := c.slots[slot]
+
+		switch {
+		case claimed.has(slot) && owner == nil,
+			claimed.has(slot) && owner != sender && sender.configEpoch > owner.configEpoch:
+			if owner == c.myself {
+				log.Warn("slot is taken by another node with a greater config epoch",
+					zap.Int("slot", slot), zap.String("node", sender.id))
+			}
+
+			clusterAssignSlot(c, slot, sender)
+			changed = true
+		case !claimed.has(slot) && owner == sender:
+			clusterAssignSlot(c, slot, nil)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// clusterCron is called by server cron, it connects to the other nodes and sends PING to them.
+func clusterCron(srv *Server) {
+	c := srv.cluster
+
+	now := time.Now()
+	if now.Sub(c.cronLastTime) < clusterCronPeriod {
+		return
+	}
+
+	c.cronLastTime = now
+
+	for _, node := range c.nodes {
+		if node == c.myself {
+			continue
+		}
+
+		if node.flags&clusterNodeHandshake != 0 && now.Sub(node.ctime) > clusterHandshakeTimeout {
+			log.Warn("handshake with node timeout, forgetting it", zap.String("node", node.addr()))
+
+			if node.link != nil {
+				node.link.free()
+			}
+
+			delete(c.nodes, node.id)
+
+			continue
+		}
+
+		switch {
+		case node.link == nil:
+			clusterCreateLink(srv, node)
+		case node.link.fd >= 0 && node.link.replayHead.Len() == 0:
+			// skip the link which is still connecting or has pending data.
+			if _, err := node.link.fd.GetPeerName(); err == nil {
+				clusterSendPing(srv, node)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		key  string
+		slot int
+	}{
+		{name: "plain", key: "foo", slot: 12182},
+		{name: "plain 2", key: "bar", slot: 5061},
+		{name: "check value", key: "123456789", slot: 0x31C3},
+		{name: "hashtag", key: "{user1000}.following", slot: keyHashSlot("user1000")},
+		{name: "first hashtag", key: "{user1000}.{other}", slot: keyHashSlot("user1000")},
+		{name: "empty hashtag", key: "foo{}{bar}", slot: int(crc16("foo{}{bar}") & (clusterSlots - 1))},
+		{name: "unclosed hashtag", key: "foo{bar", slot: int(crc16("foo{bar") & (clusterSlots - 1))},
+	}
+
+	for index := range testCases {
+		testCase := testCases[index]
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, testCase.slot, keyHashSlot(testCase.key))
+		})
+	}
+}
+
+func TestClusterSlotRanges(t *testing.T) {
+	t.Parallel()
+
+	c := newClusterState()
+	slots, err := parseSlotRanges([]string{"0-100", "200", "16383"})
+	require.NoError(t, err)
+
+	other := &clusterNode{id: "other"}
+	require.True(t, clusterUpdateSlots(c, other, slots))
+	require.Equal(t, []string{"0-100", "200", "16383"}, clusterSlotRanges(c, other))
+	require.Equal(t, 103, other.numSlots)
+
+	_, err = parseSlotRanges([]string{"16384"})
+	require.Error(t, err)
+
+	// the slots are not taken from a node with the same config epoch.
+	third := &clusterNode{id: "third"}
+	clusterAssignSlot(c, 300, third)
+	slots.set(300)
+	require.False(t, clusterUpdateSlots(c, other, slots))
+	require.Equal(t, third, c.slots[300])
+
+	other.configEpoch = 1
+	require.True(t, clusterUpdateSlots(c, other, slots))
+	require.Equal(t, other, c.slots[300])
+	require.Zero(t, third.numSlots)
+
+	// the slots no longer claimed by the node are unassigned.
+	require.True(t, clusterUpdateSlots(c, other, &slotBitmap{}))
+	require.Nil(t, c.slots[0])
+	require.Zero(t, other.numSlots)
+}
+
+func TestClusterRedirect(t *testing.T) {
+	t.Parallel()
+
+	srv := NewServer(&config.Config{})
+	srv.cluster = newClusterState()
+	c := srv.cluster
+
+	other := &clusterNode{id: "other", ip: "127.0.0.1", port: 7001}
+	c.nodes[other.id] = other
+	clusterAssignSlot(c, keyHashSlot("foo"), c.myself)
+	clusterAssignSlot(c, keyHashSlot("bar"), other)
+
+	testCases := []struct {
+		name       string
+		args       []string
+		redirected bool
+		reply      string
+	}{
+		{name: "served", args: []string{"get", "foo"}},
+		{name: "no key", args: []string{"ping"}},
+		{name: "moved", args: []string{"get", "bar"}, redirected: true, reply: "-MOVED 5061 127.0.0.1:7001\r\n"},
+		{name: "not served", args: []string{"get", "baz"}, redirected: true, reply: "-CLUSTERDOWN Hash slot not served\r\n"},
+		{
+			name: "cross slot", args: []string{"sinter", "foo", "bar"}, redirected: true,
+			reply: "-CROSSSLOT Keys in request don't hash to the same slot\r\n",
+		},
+	}
+
+	for index := range testCases {
+		testCase := testCases[index]
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := NewClient(srv, -1)
+			client.args = testCase.args
+
+			redirected, err := clusterRedirectIfNeeded(client, lookupCommand(testCase.args[0]))
+			require.NoError(t, err)
+			require.Equal(t, testCase.redirected, redirected)
+
+			if testCase.reply == "" {
+				require.Zero(t, client.replayHead.Len())
+			} else {
+				require.Equal(t, testCase.reply, client.replayHead.Front().Value)
+			}
+		})
+	}
+}
+
+func TestClusterRedirectMigrating(t *testing.T) {
+	t.Parallel()
+
+	srv := NewServer(&config.Config{})
+	srv.cluster = newClusterState()
+	c := srv.cluster
+
+	other := &clusterNode{id: "other", ip: "127.0.0.1", port: 7001}
+	c.nodes[other.id] = other
+
+	slot := keyHashSlot("{tag}")
+	srv.dbs[0].Dict.Set("{tag}a", "value")
+
+	testCases := []struct {
+		name      string
+		migrating bool
+		asking    bool
+		args      []string
+		reply     string
+	}{
+		{name: "migrating served", migrating: true, args: []string{"get", "{tag}a"}},
+		{name: "migrating ask", migrating: true, args: []string{"get", "{tag}b"}, reply: "-ASK 8338 127.0.0.1:7001\r\n"},
+		{
+			name: "migrating try again", migrating: true, args: []string{"sinter", "{tag}a", "{tag}b"},
+			reply: "-TRYAGAIN Multiple keys request during rehashing of slot\r\n",
+		},
+		{name: "migrating migrate", migrating: true, args: []string{"migrate", "127.0.0.1", "7001", "{tag}b", "0", "0"}},
+		{name: "importing moved", args: []string{"get", "{tag}b"}, reply: "-MOVED 8338 127.0.0.1:7001\r\n"},
+		{name: "importing asking", asking: true, args: []string{"get", "{tag}b"}},
+		{name: "importing restore", args: []string{"restore-asking", "{tag}b", "0", "payload"}},
+	}
+
+	for index := range testCases {
+		testCase := testCases[index]
+
+		if testCase.migrating {
+			clusterAssignSlot(c, slot, c.myself)
+			c.migratingSlotsTo[slot], c.importingSlotsFrom[slot] = other, nil
+		} else {
+			clusterAssignSlot(c, slot, other)
+			c.migratingSlotsTo[slot], c.importingSlotsFrom[slot] = nil, other
+		}
+
+		client := NewClient(srv, -1)
+		client.args = testCase.args
+		if testCase.asking {
+			client.flags |= clientFlagAsking
+		}
+
+		redirected, err := clusterRedirectIfNeeded(client, lookupCommand(testCase.args[0]))
+		require.NoError(t, err, testCase.name)
+		require.Equal(t, testCase.reply != "", redirected, testCase.name)
+
+		if testCase.reply != "" {
+			require.Equal(t, testCase.reply, client.replayHead.Front().Value, testCase.name)
+		}
+	}
+}
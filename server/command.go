@@ -4,6 +4,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/IfanTsai/metis/database"
 	"github.com/pkg/errors"
 )
 
@@ -12,69 +13,189 @@ var (
 	errWrongType = errors.New("wrong type")
 )
 
+type commandFlag uint
+
+const (
+	cmdWrite  commandFlag = 1 << iota // the command may modify the dataset
+	cmdAsking                         // the command is served in an importing slot without ASKING
+)
+
 type command struct {
 	name  string
 	proc  func(client *Client) error
 	arity int
+	flags commandFlag
+	// the positions of the keys in the arguments, a negative lastKey counts from the end,
+	// which are used to find the hash slot in cluster mode.
+	firstKey int
+	lastKey  int
+	keyStep  int
 }
 
 var commandTable = []command{
 	// connection
-	{"ping", pingCommand, 1},
-	{"select", selectCommand, 2},
-	{"auth", authCommand, 2},
+	{"ping", pingCommand, 1, 0, 0, 0, 0},
+	{"select", selectCommand, 2, 0, 0, 0, 0},
+	{"auth", authCommand, 2, 0, 0, 0, 0},
 	// server
-	{"bgrewriteaof", bgRewriteAofCommand, 1},
+	{"bgrewriteaof", bgRewriteAofCommand, 1, 0, 0, 0, 0},
+	{"save", saveCommand, 1, 0, 0, 0, 0},
+	{"bgsave", bgSaveCommand, 1, 0, 0, 0, 0},
+	{"lastsave", lastSaveCommand, 1, 0, 0, 0, 0},
+	{"info", infoCommand, -1, 0, 0, 0, 0},
+	// replication
+	{"replicaof", replicaOfCommand, 3, 0, 0, 0, 0},
+	{"slaveof", replicaOfCommand, 3, 0, 0, 0, 0},
+	{"sync", syncCommand, 1, 0, 0, 0, 0},
+	{"psync", syncCommand, 3, 0, 0, 0, 0},
+	{"replconf", replConfCommand, -1, 0, 0, 0, 0},
+	{"wait", waitCommand, 3, 0, 0, 0, 0},
+	// transaction
+	{"multi", multiCommand, 1, 0, 0, 0, 0},
+	{"exec", execCommand, 1, 0, 0, 0, 0},
+	{"discard", discardCommand, 1, 0, 0, 0, 0},
+	{"watch", watchCommand, -2, 0, 1, -1, 1},
+	{"unwatch", unwatchCommand, 1, 0, 0, 0, 0},
+	// pub/sub
+	{"subscribe", subscribeCommand, -2, 0, 0, 0, 0},
+	{"unsubscribe", unsubscribeCommand, -1, 0, 0, 0, 0},
+	{"psubscribe", psubscribeCommand, -2, 0, 0, 0, 0},
+	{"punsubscribe", punsubscribeCommand, -1, 0, 0, 0, 0},
+	{"publish", publishCommand, 3, 0, 0, 0, 0},
+	{"pubsub", pubsubCommand, -2, 0, 0, 0, 0},
+	// cluster
+	{"cluster", clusterCommand, -2, 0, 0, 0, 0},
+	{"asking", askingCommand, 1, 0, 0, 0, 0},
+	{"migrate", migrateCommand, -6, cmdWrite, 3, 3, 1},
+	{"restore-asking", restoreCommand, -4, cmdWrite | cmdAsking, 1, 1, 1},
 	// key
-	{"expire", expireCommand, 3},
-	{"expireat", expireAtCommand, 3},
-	{"ttl", ttlCommand, 2},
-	{"keys", keysCommand, 2},
+	{"expire", expireCommand, -3, cmdWrite, 1, 1, 1},
+	{"pexpire", pexpireCommand, -3, cmdWrite, 1, 1, 1},
+	{"expireat", expireAtCommand, -3, cmdWrite, 1, 1, 1},
+	{"pexpireat", pexpireAtCommand, -3, cmdWrite, 1, 1, 1},
+	{"persist", persistCommand, 2, cmdWrite, 1, 1, 1},
+	{"ttl", ttlCommand, 2, 0, 1, 1, 1},
+	{"pttl", pttlCommand, 2, 0, 1, 1, 1},
+	{"expiretime", expireTimeCommand, 2, 0, 1, 1, 1},
+	{"pexpiretime", pexpireTimeCommand, 2, 0, 1, 1, 1},
+	{"keys", keysCommand, 2, 0, 0, 0, 0},
+	{"del", delCommand, -2, cmdWrite, 1, -1, 1},
+	{"unlink", delCommand, -2, cmdWrite, 1, -1, 1},
+	{"exists", existsCommand, -2, 0, 1, -1, 1},
+	{"touch", touchCommand, -2, 0, 1, -1, 1},
+	{"type", typeCommand, 2, 0, 1, 1, 1},
+	{"rename", renameCommand, 3, cmdWrite, 1, 2, 1},
+	{"renamenx", renameNxCommand, 3, cmdWrite, 1, 2, 1},
+	{"copy", copyCommand, -3, cmdWrite, 1, 2, 1},
+	{"move", moveCommand, 3, cmdWrite, 1, 1, 1},
+	{"dump", dumpCommand, 2, 0, 1, 1, 1},
+	{"restore", restoreCommand, -4, cmdWrite, 1, 1, 1},
 	// string
-	{"set", setCommand, -3},
-	{"setex", setExCommand, 4},
-	{"get", getCommand, 2},
-	{"randomget", randomGetCommand, 1},
+	{"set", setCommand, -3, cmdWrite, 1, 1, 1},
+	{"setex", setExCommand, 4, cmdWrite, 1, 1, 1},
+	{"get", getCommand, 2, 0, 1, 1, 1},
+	{"randomget", randomGetCommand, 1, 0, 0, 0, 0},
+	{"setnx", setNxCommand, 3, cmdWrite, 1, 1, 1},
+	{"mset", mSetCommand, -3, cmdWrite, 1, -1, 2},
+	{"msetnx", mSetNxCommand, -3, cmdWrite, 1, -1, 2},
+	{"mget", mGetCommand, -2, 0, 1, -1, 1},
+	{"getset", getSetCommand, 3, cmdWrite, 1, 1, 1},
+	{"getdel", getDelCommand, 2, cmdWrite, 1, 1, 1},
+	{"getex", getExCommand, -2, cmdWrite, 1, 1, 1},
+	{"incr", incrCommand, 2, cmdWrite, 1, 1, 1},
+	{"decr", decrCommand, 2, cmdWrite, 1, 1, 1},
+	{"incrby", incrByCommand, 3, cmdWrite, 1, 1, 1},
+	{"decrby", decrByCommand, 3, cmdWrite, 1, 1, 1},
+	{"incrbyfloat", incrByFloatCommand, 3, cmdWrite, 1, 1, 1},
+	{"append", appendCommand, 3, cmdWrite, 1, 1, 1},
+	{"strlen", strLenCommand, 2, 0, 1, 1, 1},
+	{"getrange", getRangeCommand, 4, 0, 1, 1, 1},
+	{"setrange", setRangeCommand, 4, cmdWrite, 1, 1, 1},
+	// bitmap
+	{"setbit", setBitCommand, 4, cmdWrite, 1, 1, 1},
+	{"getbit", getBitCommand, 3, 0, 1, 1, 1},
+	{"bitcount", bitCountCommand, -2, 0, 1, 1, 1},
+	{"bitpos", bitPosCommand, -3, 0, 1, 1, 1},
+	{"bitop", bitOpCommand, -4, cmdWrite, 2, -1, 1},
+	{"bitfield", bitFieldCommand, -2, cmdWrite, 1, 1, 1},
+	{"bitfield_ro", bitFieldRoCommand, -2, 0, 1, 1, 1},
+	// hyperloglog
+	{"pfadd", pfAddCommand, -2, cmdWrite, 1, 1, 1},
+	{"pfcount", pfCountCommand, -2, 0, 1, -1, 1},
+	{"pfmerge", pfMergeCommand, -2, cmdWrite, 1, -1, 1},
 	// hash
-	{"hset", hSetCommand, -4},
-	{"hget", hGetCommand, 3},
-	{"hdel", hDelCommand, -3},
-	{"hexists", hExistsCommand, 3},
-	{"hkeys", hKeysCommand, 2},
-	{"hlen", hLenCommand, 2},
+	{"hset", hSetCommand, -4, cmdWrite, 1, 1, 1},
+	{"hget", hGetCommand, 3, 0, 1, 1, 1},
+	{"hdel", hDelCommand, -3, cmdWrite, 1, 1, 1},
+	{"hexists", hExistsCommand, 3, 0, 1, 1, 1},
+	{"hkeys", hKeysCommand, 2, 0, 1, 1, 1},
+	{"hlen", hLenCommand, 2, 0, 1, 1, 1},
 	// list
-	{"lpush", lPushCommand, -3},
-	{"rpush", rPushCommand, -3},
-	{"lpop", lPopCommand, 2},
-	{"rpop", rPopCommand, 2},
-	{"llen", lLenCommand, 2},
-	{"lindex", lIndexCommand, 3},
-	{"lrange", lRangeCommand, -4},
+	{"lpush", lPushCommand, -3, cmdWrite, 1, 1, 1},
+	{"rpush", rPushCommand, -3, cmdWrite, 1, 1, 1},
+	{"lpop", lPopCommand, 2, cmdWrite, 1, 1, 1},
+	{"rpop", rPopCommand, 2, cmdWrite, 1, 1, 1},
+	{"llen", lLenCommand, 2, 0, 1, 1, 1},
+	{"lindex", lIndexCommand, 3, 0, 1, 1, 1},
+	{"lrange", lRangeCommand, -4, 0, 1, 1, 1},
+	{"lmove", lMoveCommand, 5, cmdWrite, 1, 2, 1},
+	{"blpop", blPopCommand, -3, cmdWrite, 1, -2, 1},
+	{"brpop", brPopCommand, -3, cmdWrite, 1, -2, 1},
+	{"blmove", blMoveCommand, 6, cmdWrite, 1, 2, 1},
 	// set
-	{"sadd", sAddCommand, -3},
-	{"srem", sRemCommand, -3},
-	{"spop", sPopCommand, 2},
-	{"scard", sCardCommand, 2},
-	{"sismember", sIsMemberCommand, 3},
-	{"smembers", sMembersCommand, 2},
-	{"sdiff", sDiffCommand, -3},
-	{"sinter", sInterCommand, -3},
-	{"sunion", sUnionCommand, -3},
+	{"sadd", sAddCommand, -3, cmdWrite, 1, 1, 1},
+	{"srem", sRemCommand, -3, cmdWrite, 1, 1, 1},
+	{"spop", sPopCommand, 2, cmdWrite, 1, 1, 1},
+	{"scard", sCardCommand, 2, 0, 1, 1, 1},
+	{"sismember", sIsMemberCommand, 3, 0, 1, 1, 1},
+	{"smembers", sMembersCommand, 2, 0, 1, 1, 1},
+	{"sdiff", sDiffCommand, -3, 0, 1, -1, 1},
+	{"sinter", sInterCommand, -3, 0, 1, -1, 1},
+	{"sunion", sUnionCommand, -3, 0, 1, -1, 1},
 	// zset
-	{"zadd", zAddCommand, -4},
-	{"zrange", zRangeCommand, -4},
-	{"zrangebyscore", zRangeByScoreCommand, -4},
-	{"zrem", zRemCommand, -3},
-	{"zremrangebyrank", zRemRangeByRankCommand, -4},
-	{"zremrangebyscore", zRemRangeByScoreCommand, -4},
-	{"zcard", zCardCommand, 2},
-	{"zcount", zCountCommand, 4},
-	{"zscore", zScoreCommand, 3},
+	{"zadd", zAddCommand, -4, cmdWrite, 1, 1, 1},
+	{"zrange", zRangeCommand, -4, 0, 1, 1, 1},
+	{"zrangebyscore", zRangeByScoreCommand, -4, 0, 1, 1, 1},
+	{"zrem", zRemCommand, -3, cmdWrite, 1, 1, 1},
+	{"zremrangebyrank", zRemRangeByRankCommand, -4, cmdWrite, 1, 1, 1},
+	{"zremrangebyscore", zRemRangeByScoreCommand, -4, cmdWrite, 1, 1, 1},
+	{"zcard", zCardCommand, 2, 0, 1, 1, 1},
+	{"zcount", zCountCommand, 4, 0, 1, 1, 1},
+	{"zscore", zScoreCommand, 3, 0, 1, 1, 1},
+	{"zpopmin", zPopMinCommand, -2, cmdWrite, 1, 1, 1},
+	{"zpopmax", zPopMaxCommand, -2, cmdWrite, 1, 1, 1},
+	{"bzpopmin", bzPopMinCommand, -3, cmdWrite, 1, -2, 1},
+	{"bzpopmax", bzPopMaxCommand, -3, cmdWrite, 1, -2, 1},
+	// geo
+	{"geoadd", geoAddCommand, -5, cmdWrite, 1, 1, 1},
+	{"geopos", geoPosCommand, -2, 0, 1, 1, 1},
+	{"geodist", geoDistCommand, -4, 0, 1, 1, 1},
+	{"geohash", geoHashCommand, -2, 0, 1, 1, 1},
+	{"geosearch", geoSearchCommand, -7, 0, 1, 1, 1},
+	{"geosearchstore", geoSearchStoreCommand, -8, cmdWrite, 1, 2, 1},
+	// stream
+	{"xadd", xAddCommand, -5, cmdWrite, 1, 1, 1},
+	{"xlen", xLenCommand, 2, 0, 1, 1, 1},
+	{"xrange", xRangeCommand, -4, 0, 1, 1, 1},
+	{"xrevrange", xRevRangeCommand, -4, 0, 1, 1, 1},
+	{"xtrim", xTrimCommand, -4, cmdWrite, 1, 1, 1},
+	{"xread", xReadCommand, -4, 0, 0, 0, 0},
+	{"xreadgroup", xReadGroupCommand, -7, cmdWrite, 0, 0, 0},
+	{"xgroup", xGroupCommand, -2, cmdWrite, 2, 2, 1},
+	{"xack", xAckCommand, -4, cmdWrite, 1, 1, 1},
+	{"xpending", xPendingCommand, -3, 0, 1, 1, 1},
+	{"xclaim", xClaimCommand, -6, cmdWrite, 1, 1, 1},
 	// TODO: implement more commands
 }
 
 func expireIfNeeded(client *Client, key string) (bool, error) {
-	expireObj := client.db.Expire.Find(key)
+	return dbExpireIfNeeded(client.srv, client.db, key)
+}
+
+// dbExpireIfNeeded deletes the key of the database if it's expired, which may not be the one selected
+// by the client.
+func dbExpireIfNeeded(srv *Server, db *database.Databse, key string) (bool, error) {
+	expireObj := db.Expire.Find(key)
 	if expireObj != nil {
 		when, ok := expireObj.Value.(int64)
 		if !ok {
@@ -82,8 +203,10 @@ func expireIfNeeded(client *Client, key string) (bool, error) {
 		}
 
 		if when < time.Now().UnixMilli() {
-			_ = client.db.Dict.Delete(key)
-			_ = client.db.Expire.Delete(key)
+			_ = db.Dict.Delete(key)
+			_ = db.Expire.Delete(key)
+			touchWatchedKey(srv, db.ID, key)
+			notifyKeyspaceEvent(srv, notifyExpired, "expired", key, db.ID)
 
 			return true, nil
 		}
@@ -92,6 +215,11 @@ func expireIfNeeded(client *Client, key string) (bool, error) {
 	return false, nil
 }
 
+// signalModifiedKey is called every time a key in the database is modified.
+func signalModifiedKey(client *Client, key string) {
+	touchWatchedKey(client.srv, client.db.ID, key)
+}
+
 func lookupCommand(name string) *command {
 	for _, cmd := range commandTable {
 		if cmd.name == name {
@@ -102,6 +230,33 @@ func lookupCommand(name string) *command {
 	return nil
 }
 
+// getKeysFromCommand returns the keys in the arguments of the command.
+func getKeysFromCommand(cmd *command, args []string) []string {
+	if cmd.name == "migrate" {
+		return migrateGetKeys(args)
+	}
+
+	if cmd.name == "xread" || cmd.name == "xreadgroup" {
+		return xreadGetKeys(args)
+	}
+
+	if cmd.firstKey == 0 {
+		return nil
+	}
+
+	lastKey := cmd.lastKey
+	if lastKey < 0 {
+		lastKey += len(args)
+	}
+
+	keys := make([]string, 0, lastKey-cmd.firstKey+1)
+	for i := cmd.firstKey; i <= lastKey && i < len(args); i += cmd.keyStep {
+		keys = append(keys, args[i])
+	}
+
+	return keys
+}
+
 func processCommand(client *Client) error {
 	var err error
 
@@ -109,16 +264,65 @@ func processCommand(client *Client) error {
 	cmd := lookupCommand(cmdName)
 	switch {
 	case cmd == nil:
+		flagTransaction(client)
 		err = client.addReplyError("unknown command")
 	case (cmd.arity > 0 && len(client.args) != cmd.arity) || (len(client.args) < -cmd.arity):
+		flagTransaction(client)
 		err = client.addReplyError("wrong number of arguments")
 	default:
 		if client.srv.requirePassword != "" && !client.authenticated && cmdName != "auth" {
+			flagTransaction(client)
 			err = client.addReplyError("operation not permitted")
 			break
 		}
 
+		// don't accept write commands if this is a read only replica, except the ones from the master.
+		if client.srv.masterHost != "" && client.srv.replicaReadOnly &&
+			client.flags&clientFlagMaster == 0 && cmd.flags&cmdWrite != 0 {
+			flagTransaction(client)
+			err = client.addReplyErrorCode("READONLY", "You can't write against a read only replica.")
+			break
+		}
+
+		// only the commands about the subscriptions are allowed in the context of pub/sub.
+		if pubsubSubscriptionCount(client) > 0 && cmdName != "subscribe" && cmdName != "unsubscribe" &&
+			cmdName != "psubscribe" && cmdName != "punsubscribe" && cmdName != "ping" {
+			flagTransaction(client)
+			err = client.addReplyErrorf(
+				"Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", cmdName)
+			break
+		}
+
+		// redirect the client to the node serving the keys in cluster mode.
+		if client.srv.cluster != nil && client.flags&clientFlagMaster == 0 {
+			redirected, rerr := clusterRedirectIfNeeded(client, cmd)
+			if redirected {
+				flagTransaction(client)
+				err = rerr
+
+				break
+			}
+		}
+
+		// queue the commands of the transaction, except the ones controlling it.
+		if client.flags&clientFlagMulti != 0 &&
+			cmdName != "exec" && cmdName != "discard" && cmdName != "multi" && cmdName != "watch" {
+			err = queueMultiCommand(client, cmd)
+
+			break
+		}
+
 		err = call(client, cmd)
+
+		// serve the clients blocked by the keys pushed by the command.
+		if len(client.srv.readyKeys) > 0 {
+			handleClientsBlockedOnKeys(client.srv)
+		}
+	}
+
+	// ASKING only affects the next command.
+	if cmdName != "asking" {
+		client.flags &^= clientFlagAsking
 	}
 
 	client.reset()
@@ -133,10 +337,40 @@ func call(client *Client, cmd *command) error {
 		return err
 	}
 	dirty = client.srv.dirty - dirty
+	if dirty < 0 {
+		// dirty is reset by SAVE
+		dirty = 0
+	}
 
-	if client.srv.aofEnable && dirty != 0 {
-		feedAppendOnlyFile(client.srv, cmd, client.db.ID, client.args)
+	// the command may propagate itself in other forms.
+	if dirty != 0 && client.flags&clientFlagPreventProp == 0 {
+		execPropagateMulti(client)
+		propagate(client.srv, client.db.ID, client.args)
+		client.replWriteOffset = client.srv.masterReplOffset
 	}
 
+	client.flags &^= clientFlagPreventProp
+
 	return nil
 }
+
+// propagate feeds the command that was just executed to the AOF and the replicas.
+func propagate(srv *Server, dbID int, args []string) {
+	// a replica proxies the stream of its master to its own replicas instead, so that the offsets
+	// are the same in the whole chain.
+	feedReplicas := srv.masterHost == "" && srv.replBacklog != nil
+
+	if !srv.aofEnable && !feedReplicas {
+		return
+	}
+
+	cmdStr := catAppendOnlyGenericCommand(args)
+
+	if srv.aofEnable {
+		feedAppendOnlyFile(srv, dbID, cmdStr)
+	}
+
+	if feedReplicas {
+		replicationFeedReplicas(srv, dbID, cmdStr)
+	}
+}
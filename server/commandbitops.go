@@ -0,0 +1,710 @@
+package server
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/IfanTsai/go-lib/utils/byteutils"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+const (
+	bitOffsetErr = "bit offset is not an integer or out of range"
+	bitValueErr  = "bit is not an integer or out of range"
+
+	// maxBitOffset limits the string to 512MB, which is the max size of a bulk string.
+	maxBitOffset = 1<<32 - 1
+)
+
+type bitOp uint8
+
+const (
+	bitOpAnd bitOp = iota
+	bitOpOr
+	bitOpXor
+	bitOpNot
+)
+
+func setBitCommand(client *Client) error {
+	key := client.args[1]
+
+	offset, ok := parseBitOffset(client.args[2])
+	if !ok {
+		return client.addReplyError(bitOffsetErr)
+	}
+
+	on, err := strconv.ParseInt(client.args[3], 10, 64)
+	if err != nil || on&^1 != 0 {
+		return client.addReplyError(bitValueErr)
+	}
+
+	if _, err := getBitmapIfExist(client, key); err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	buf := getBitmapForWrite(client, key, int64(offset>>3)+1)
+	byteIndex, bit := offset>>3, byte(1<<(7-offset&7))
+	old := buf[byteIndex]&bit != 0
+
+	if on == 1 {
+		buf[byteIndex] |= bit
+	} else {
+		buf[byteIndex] &^= bit
+	}
+
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "setbit", key, client.db.ID)
+	client.srv.dirty++
+
+	if old {
+		return client.addReplyInt(1)
+	}
+
+	return client.addReplyInt(0)
+}
+
+func getBitCommand(client *Client) error {
+	offset, ok := parseBitOffset(client.args[2])
+	if !ok {
+		return client.addReplyError(bitOffsetErr)
+	}
+
+	value, err := getBitmapIfExist(client, client.args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	if offset>>3 >= uint64(len(value)) || value[offset>>3]&byte(1<<(7-offset&7)) == 0 {
+		return client.addReplyInt(0)
+	}
+
+	return client.addReplyInt(1)
+}
+
+func bitCountCommand(client *Client) error {
+	args := client.args
+	if len(args) == 3 || len(args) > 5 {
+		return client.addReplyError("syntax error")
+	}
+
+	value, err := getBitmapIfExist(client, args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	startBit, endBit := int64(0), int64(len(value))*8-1
+	if len(args) > 2 {
+		var errMsg string
+		if startBit, endBit, errMsg = parseBitRange(args[2:], int64(len(value))); errMsg != "" {
+			return client.addReplyError(errMsg)
+		}
+	}
+
+	if startBit > endBit {
+		return client.addReplyInt(0)
+	}
+
+	return client.addReplyInt(bitCount(value, startBit, endBit))
+}
+
+func bitPosCommand(client *Client) error {
+	args := client.args
+	if len(args) > 6 {
+		return client.addReplyError("syntax error")
+	}
+
+	bit, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || bit&^1 != 0 {
+		return client.addReplyError("The bit argument must be 1 or 0.")
+	}
+
+	value, err := getBitmapIfExist(client, args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	// the missing key is treated as an empty string, which has no set bit but a clear bit at the start.
+	if len(value) == 0 {
+		if bit == 1 {
+			return client.addReplyInt(-1)
+		}
+
+		return client.addReplyInt(0)
+	}
+
+	startBit, endBit := int64(0), int64(len(value))*8-1
+	if len(args) > 3 {
+		rangeArgs := args[3:]
+		if len(rangeArgs) == 1 {
+			rangeArgs = append(rangeArgs, "-1")
+		}
+
+		var errMsg string
+		if startBit, endBit, errMsg = parseBitRange(rangeArgs, int64(len(value))); errMsg != "" {
+			return client.addReplyError(errMsg)
+		}
+	}
+
+	if startBit > endBit {
+		return client.addReplyInt(-1)
+	}
+
+	pos := bitPos(value, byte(bit), startBit, endBit)
+
+	// looking for a clear bit without the end of the range, the bits after the string are considered clear.
+	if pos == -1 && bit == 0 && len(args) < 5 {
+		return client.addReplyInt(endBit + 1)
+	}
+
+	return client.addReplyInt(pos)
+}
+
+func bitOpCommand(client *Client) error {
+	args := client.args
+	dst, keys := args[2], args[3:]
+
+	var op bitOp
+	switch strings.ToLower(args[1]) {
+	case "and":
+		op = bitOpAnd
+	case "or":
+		op = bitOpOr
+	case "xor":
+		op = bitOpXor
+	case "not":
+		op = bitOpNot
+		if len(keys) != 1 {
+			return client.addReplyError("BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return client.addReplyError("syntax error")
+	}
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		value, err := getBitmapIfExist(client, key)
+		if err != nil && !errors.Is(err, errNotExist) {
+			return client.addReplyError(err.Error())
+		}
+
+		values[i] = value
+	}
+
+	result := bitOpStrings(op, values)
+	if len(result) == 0 {
+		if client.db.Dict.Delete(dst) == nil {
+			_ = client.db.Expire.Delete(dst)
+			signalModifiedKey(client, dst)
+			notifyKeyspaceEvent(client.srv, notifyGeneric, "del", dst, client.db.ID)
+			client.srv.dirty++
+		}
+
+		return client.addReplyInt(0)
+	}
+
+	_ = client.db.Expire.Delete(dst)
+	client.db.Dict.Set(dst, byteutils.B2S(result))
+	signalModifiedKey(client, dst)
+	notifyKeyspaceEvent(client.srv, notifyString, "set", dst, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyInt(int64(len(result)))
+}
+
+// parseBitOffset parses the offset of a bit, which is limited to the max size of a string.
+func parseBitOffset(arg string) (uint64, bool) {
+	offset, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || offset > maxBitOffset {
+		return 0, false
+	}
+
+	return offset, true
+}
+
+// parseBitRange parses the start and the end of BITCOUNT and BITPOS in bytes by default or in bits
+// with the BIT unit, and returns the inclusive range in bits. The negative indexes count from the end,
+// the range is empty if the start is greater than the end.
+func parseBitRange(args []string, strLen int64) (int64, int64, string) {
+	start, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, 0, valueNotIntegerErr
+	}
+
+	end, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return 0, 0, valueNotIntegerErr
+	}
+
+	isBit := false
+	if len(args) > 2 {
+		switch strings.ToLower(args[2]) {
+		case "byte":
+		case "bit":
+			isBit = true
+		default:
+			return 0, 0, "syntax error"
+		}
+	}
+
+	total := strLen
+	if isBit {
+		total *= 8
+	}
+
+	if start < 0 {
+		start = lo.Max([]int64{start + total, 0})
+	}
+
+	if end < 0 {
+		end = lo.Max([]int64{end + total, 0})
+	}
+
+	if end >= total {
+		end = total - 1
+	}
+
+	if start > end {
+		return 1, 0, ""
+	}
+
+	if isBit {
+		return start, end, ""
+	}
+
+	return start * 8, end*8 + 7, ""
+}
+
+// bitCount counts the set bits between the inclusive bit offsets of the string, the whole bytes
+// are counted by words.
+func bitCount(value string, startBit, endBit int64) int64 {
+	buf := byteutils.S2B(value)
+	firstByte, lastByte := startBit>>3, endBit>>3
+	headMask, tailMask := byte(0xff>>(startBit&7)), byte(0xff<<(7-endBit&7))
+
+	if firstByte == lastByte {
+		return int64(bits.OnesCount8(buf[firstByte] & headMask & tailMask))
+	}
+
+	count := bits.OnesCount8(buf[firstByte]&headMask) + bits.OnesCount8(buf[lastByte]&tailMask)
+	for middle := buf[firstByte+1 : lastByte]; len(middle) > 0; {
+		if len(middle) >= 8 {
+			count += bits.OnesCount64(binary.LittleEndian.Uint64(middle))
+			middle = middle[8:]
+		} else {
+			count += bits.OnesCount8(middle[0])
+			middle = middle[1:]
+		}
+	}
+
+	return int64(count)
+}
+
+// bitPos returns the offset of the first bit equal to bit between the inclusive bit offsets of the string,
+// or -1 if there is none. The words which can't contain the bit are skipped.
+func bitPos(value string, bit byte, startBit, endBit int64) int64 {
+	buf := byteutils.S2B(value)
+
+	for i := startBit; i <= endBit; {
+		if i&63 == 0 && i+63 <= endBit {
+			word := binary.BigEndian.Uint64(buf[i>>3:])
+			if bit == 0 {
+				word = ^word
+			}
+
+			if word == 0 {
+				i += 64
+
+				continue
+			}
+
+			return i + int64(bits.LeadingZeros64(word))
+		}
+
+		if (buf[i>>3]>>(7-i&7))&1 == bit {
+			return i
+		}
+
+		i++
+	}
+
+	return -1
+}
+
+// bitOpStrings performs the operation on the strings, the shorter ones are padded with zero bytes.
+func bitOpStrings(op bitOp, values []string) []byte {
+	maxLen := 0
+	for _, value := range values {
+		if len(value) > maxLen {
+			maxLen = len(value)
+		}
+	}
+
+	if maxLen == 0 {
+		return nil
+	}
+
+	result := make([]byte, maxLen)
+	if op == bitOpNot {
+		for i := 0; i < maxLen; i++ {
+			result[i] = ^values[0][i]
+		}
+
+		return result
+	}
+
+	copy(result, values[0])
+	for _, value := range values[1:] {
+		src := byteutils.S2B(value)
+		if op == bitOpAnd {
+			// the bytes after the shorter string are zero.
+			for i := len(src); i < maxLen; i++ {
+				result[i] = 0
+			}
+		}
+
+		i := 0
+		for ; i+8 <= len(src); i += 8 {
+			a, b := binary.LittleEndian.Uint64(result[i:]), binary.LittleEndian.Uint64(src[i:])
+			binary.LittleEndian.PutUint64(result[i:], bitOpWord(op, a, b))
+		}
+
+		for ; i < len(src); i++ {
+			result[i] = byte(bitOpWord(op, uint64(result[i]), uint64(src[i])))
+		}
+	}
+
+	return result
+}
+
+// bitOpWord performs the binary operation on the words, NOT is performed by bitOpStrings directly.
+func bitOpWord(op bitOp, a, b uint64) uint64 {
+	switch op {
+	case bitOpAnd:
+		return a & b
+	case bitOpOr:
+		return a | b
+	default:
+		return a ^ b
+	}
+}
+
+type bitFieldOpType uint8
+
+const (
+	bitFieldGet bitFieldOpType = iota
+	bitFieldSet
+	bitFieldIncrBy
+)
+
+type bitFieldOverflow uint8
+
+const (
+	bitFieldWrap bitFieldOverflow = iota
+	bitFieldSat
+	bitFieldFail
+)
+
+// bitFieldOp is a subcommand of BITFIELD, the integer is written at the offset in bits.
+type bitFieldOp struct {
+	opType   bitFieldOpType
+	offset   uint64
+	bits     uint
+	signed   bool
+	value    int64 // the value of SET or the increment of INCRBY
+	overflow bitFieldOverflow
+}
+
+func bitFieldCommand(client *Client) error {
+	return bitFieldGenericCommand(client, false)
+}
+
+func bitFieldRoCommand(client *Client) error {
+	return bitFieldGenericCommand(client, true)
+}
+
+// bitFieldGenericCommand parses all the subcommands before any of them is performed, the integers beyond the
+// string are read as zero and the string is padded with zero bytes for the writes.
+func bitFieldGenericCommand(client *Client, readOnly bool) error {
+	args := client.args
+	key := args[1]
+
+	ops := make([]bitFieldOp, 0, len(args)/3)
+	overflow := bitFieldWrap
+	maxWriteBit := int64(-1)
+
+	for i := 2; i < len(args); i++ {
+		subcommand := strings.ToLower(args[i])
+		if subcommand == "overflow" && i+1 < len(args) {
+			i++
+
+			switch strings.ToLower(args[i]) {
+			case "wrap":
+				overflow = bitFieldWrap
+			case "sat":
+				overflow = bitFieldSat
+			case "fail":
+				overflow = bitFieldFail
+			default:
+				return client.addReplyError("Invalid OVERFLOW type specified")
+			}
+
+			continue
+		}
+
+		op := bitFieldOp{overflow: overflow}
+		switch {
+		case subcommand == "get" && i+2 < len(args):
+			op.opType = bitFieldGet
+		case subcommand == "set" && i+3 < len(args):
+			op.opType = bitFieldSet
+		case subcommand == "incrby" && i+3 < len(args):
+			op.opType = bitFieldIncrBy
+		default:
+			return client.addReplyError("syntax error")
+		}
+
+		var ok bool
+		if op.signed, op.bits, ok = parseBitFieldType(args[i+1]); !ok {
+			return client.addReplyError("Invalid bitfield type. Use something like i16 u8. " +
+				"Note that u64 is not supported but i64 is.")
+		}
+
+		if op.offset, ok = parseBitFieldOffset(args[i+2], op.bits); !ok {
+			return client.addReplyError(bitOffsetErr)
+		}
+
+		i += 2
+
+		if op.opType != bitFieldGet {
+			if readOnly {
+				return client.addReplyError("BITFIELD_RO only supports the GET subcommand")
+			}
+
+			i++
+
+			value, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return client.addReplyError(valueNotIntegerErr)
+			}
+
+			op.value = value
+			maxWriteBit = lo.Max([]int64{maxWriteBit, int64(op.offset) + int64(op.bits) - 1})
+		}
+
+		ops = append(ops, op)
+	}
+
+	value, err := getBitmapIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	buf := byteutils.S2B(value)
+
+	if err := client.addReplyStringf("*%d\r\n", len(ops)); err != nil {
+		return err
+	}
+
+	changes := 0
+	for _, op := range ops {
+		old := getBitField(buf, op.offset, op.bits, op.signed)
+		if op.opType == bitFieldGet {
+			if err := client.addReplyInt(old); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		newValue, incr := op.value, int64(0)
+		if op.opType == bitFieldIncrBy {
+			newValue, incr = old, op.value
+		}
+
+		newValue, ok := bitFieldOverflowed(newValue, incr, op.bits, op.signed, op.overflow)
+		if !ok {
+			if err := client.addReplyNull(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// the string is grown by the first write, the failed ones leave it as it is.
+		if changes == 0 {
+			buf = getBitmapForWrite(client, key, maxWriteBit>>3+1)
+		}
+
+		setBitField(buf, op.offset, op.bits, newValue)
+		changes++
+
+		// SET replies the old value and INCRBY replies the new one.
+		reply := newValue
+		if op.opType == bitFieldSet {
+			reply = old
+		}
+
+		if err := client.addReplyInt(reply); err != nil {
+			return err
+		}
+	}
+
+	if changes > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyString, "setbit", key, client.db.ID)
+		client.srv.dirty += int64(changes)
+	}
+
+	return nil
+}
+
+// parseBitFieldType parses the type of the integer in the form of "i<bits>" or "u<bits>",
+// the signed integers have up to 64 bits and the unsigned ones have up to 63 bits.
+func parseBitFieldType(arg string) (bool, uint, bool) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u' && arg[0] != 'I' && arg[0] != 'U') {
+		return false, 0, false
+	}
+
+	signed := arg[0] == 'i' || arg[0] == 'I'
+
+	bits, err := strconv.ParseUint(arg[1:], 10, 8)
+	if err != nil || bits < 1 || (signed && bits > 64) || (!signed && bits > 63) {
+		return false, 0, false
+	}
+
+	return signed, uint(bits), true
+}
+
+// parseBitFieldOffset parses the offset in bits, or in the number of integers of the width if it's prefixed by '#'.
+func parseBitFieldOffset(arg string, bits uint) (uint64, bool) {
+	multiply := uint64(1)
+	if strings.HasPrefix(arg, "#") {
+		arg, multiply = arg[1:], uint64(bits)
+	}
+
+	offset, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || offset > maxBitOffset/multiply || offset*multiply+uint64(bits)-1 > maxBitOffset {
+		return 0, false
+	}
+
+	return offset * multiply, true
+}
+
+// getBitField reads the integer at the offset, the bits beyond the buffer are read as zero.
+func getBitField(buf []byte, offset uint64, bits uint, signed bool) int64 {
+	var value uint64
+	for i := uint64(0); i < uint64(bits); i++ {
+		value <<= 1
+
+		byteIndex := (offset + i) >> 3
+		if byteIndex < uint64(len(buf)) {
+			value |= uint64(buf[byteIndex]>>(7-(offset+i)&7)) & 1
+		}
+	}
+
+	// extend the sign bit of the signed integers.
+	if signed && bits < 64 && value&(1<<(bits-1)) != 0 {
+		value |= ^uint64(0) << bits
+	}
+
+	return int64(value)
+}
+
+// setBitField writes the lowest bits of the integer at the offset, the buffer must be large enough.
+func setBitField(buf []byte, offset uint64, bits uint, value int64) {
+	for i := uint64(0); i < uint64(bits); i++ {
+		bit := byte(uint64(value)>>(uint64(bits)-1-i)) & 1
+		byteIndex, shift := (offset+i)>>3, 7-(offset+i)&7
+
+		buf[byteIndex] = buf[byteIndex]&^(1<<shift) | bit<<shift
+	}
+}
+
+// bitFieldOverflowed returns the value plus the increment in the integer type handled by the overflow
+// behavior, false is returned if it overflows with FAIL.
+func bitFieldOverflowed(value, incr int64, bits uint, signed bool, overflow bitFieldOverflow) (int64, bool) {
+	var maxValue, minValue int64
+	var overflowed, underflowed bool
+
+	if signed {
+		maxValue = int64(^uint64(0) >> (65 - bits))
+		minValue = -maxValue - 1
+		// the 64 bits integers can't overflow by adding to the opposite sign.
+		overflowed = value > maxValue || (incr > 0 && (value >= 0 || bits < 64) && incr > maxValue-value)
+		underflowed = value < minValue || (incr < 0 && (value < 0 || bits < 64) && incr < minValue-value)
+	} else {
+		// the unsigned integers have at most 63 bits, so the negative value is out of range.
+		maxValue = int64(^uint64(0) >> (64 - bits))
+		overflowed = uint64(value) > uint64(maxValue) || (incr > 0 && incr > maxValue-value)
+		underflowed = !overflowed && incr < 0 && incr < -value
+	}
+
+	if !overflowed && !underflowed {
+		return value + incr, true
+	}
+
+	switch overflow {
+	case bitFieldFail:
+		return 0, false
+	case bitFieldSat:
+		if overflowed {
+			return maxValue, true
+		}
+
+		return minValue, true
+	case bitFieldWrap:
+	}
+
+	// the sum is wrapped around by keeping the lowest bits.
+	wrapped := uint64(value) + uint64(incr)
+	if !signed {
+		return int64(wrapped & uint64(maxValue)), true
+	}
+
+	if bits < 64 {
+		if wrapped&(1<<(bits-1)) != 0 {
+			wrapped |= ^uint64(0) << bits
+		} else {
+			wrapped &^= ^uint64(0) << bits
+		}
+	}
+
+	return int64(wrapped), true
+}
+
+// getBitmapIfExist returns the string or the bitmap as a string without copying, which must not be kept
+// after the command since the bitmap is modified in place.
+func getBitmapIfExist(client *Client, key string) (string, error) {
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return "", err
+	}
+
+	switch value := client.db.Dict.Get(key).(type) {
+	case nil:
+		return "", errNotExist
+	case string:
+		return value, nil
+	case *datastruct.Bitmap:
+		return byteutils.B2S(value.Bytes()), nil
+	default:
+		return "", errWrongType
+	}
+}
+
+// getBitmapForWrite returns the bytes of the string padded with zero bytes to the length at least, which are
+// modified in place. The string is converted to a bitmap by the first write, so that the later writes don't
+// copy it. The type of the value must have been checked.
+func getBitmapForWrite(client *Client, key string, length int64) []byte {
+	bitmap, ok := client.db.Dict.Get(key).(*datastruct.Bitmap)
+	if !ok {
+		value, _ := client.db.Dict.Get(key).(string)
+		bitmap = datastruct.NewBitmap(value)
+		client.db.Dict.Set(key, bitmap)
+	}
+
+	return bitmap.Grow(int(length))
+}
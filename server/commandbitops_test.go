@@ -0,0 +1,259 @@
+package server
+
+import (
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, ":0\r\n", execute(client, "setbit", "bits", "7", "1"))
+	require.Equal(t, ":1\r\n", execute(client, "setbit", "bits", "7", "1"))
+	require.Equal(t, ":0\r\n", execute(client, "setbit", "bits", "17", "1"))
+	require.Equal(t, "$3\r\n\x01\x00\x40\r\n", execute(client, "get", "bits"))
+	require.Equal(t, ":1\r\n", execute(client, "getbit", "bits", "17"))
+	require.Equal(t, ":0\r\n", execute(client, "getbit", "bits", "16"))
+	require.Equal(t, ":0\r\n", execute(client, "getbit", "bits", "100000"))
+	require.Equal(t, ":0\r\n", execute(client, "getbit", "missing", "1"))
+	require.Equal(t, "-ERR bit offset is not an integer or out of range\r\n",
+		execute(client, "setbit", "bits", "4294967296", "1"))
+	require.Equal(t, "-ERR bit offset is not an integer or out of range\r\n", execute(client, "getbit", "bits", "-1"))
+	require.Equal(t, "-ERR bit is not an integer or out of range\r\n", execute(client, "setbit", "bits", "1", "2"))
+
+	// the bitmap is modified in place, but not the copy for the background saving.
+	bitmap := srv.dbs[0].Dict.Get("bits").(*datastruct.Bitmap)
+	saving := srv.dbs[0].DeepCopy()
+	require.Equal(t, ":0\r\n", execute(client, "setbit", "bits", "1", "1"))
+	require.Same(t, bitmap, srv.dbs[0].Dict.Get("bits"))
+	require.Equal(t, "\x41\x00\x40", bitmap.String())
+	require.Equal(t, "\x01\x00\x40", saving.Dict.Get("bits").(*datastruct.Bitmap).String())
+
+	// the bitmap is a string for the other commands.
+	require.Equal(t, "+string\r\n", execute(client, "type", "bits"))
+	require.Equal(t, ":3\r\n", execute(client, "strlen", "bits"))
+	require.Equal(t, ":4\r\n", execute(client, "append", "bits", "x"))
+	require.Equal(t, "$4\r\n\x41\x00\x40x\r\n", execute(client, "get", "bits"))
+	require.Equal(t, "\x41\x00\x40", bitmap.String())
+	require.Equal(t, ":0\r\n", execute(client, "setbit", "bits", "2", "1"))
+	require.Equal(t, "$4\r\n\x61\x00\x40x\r\n", execute(client, "get", "bits"))
+
+	// "foobar" is the example of the redis documentation.
+	execute(client, "set", "foo", "foobar")
+	require.Equal(t, ":26\r\n", execute(client, "bitcount", "foo"))
+	require.Equal(t, ":4\r\n", execute(client, "bitcount", "foo", "0", "0"))
+	require.Equal(t, ":6\r\n", execute(client, "bitcount", "foo", "1", "1"))
+	require.Equal(t, ":18\r\n", execute(client, "bitcount", "foo", "1", "-2"))
+	require.Equal(t, ":17\r\n", execute(client, "bitcount", "foo", "5", "30", "bit"))
+	require.Equal(t, ":0\r\n", execute(client, "bitcount", "foo", "3", "1"))
+	require.Equal(t, ":0\r\n", execute(client, "bitcount", "missing"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "bitcount", "foo", "1"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "bitcount", "foo", "1", "2", "bits"))
+
+	execute(client, "set", "pos", "\xff\xf0\x00")
+	require.Equal(t, ":12\r\n", execute(client, "bitpos", "pos", "0"))
+	require.Equal(t, ":2\r\n", execute(client, "bitpos", "pos", "1", "2", "-1", "bit"))
+	require.Equal(t, ":8\r\n", execute(client, "bitpos", "pos", "1", "1"))
+	require.Equal(t, ":-1\r\n", execute(client, "bitpos", "pos", "1", "2"))
+	require.Equal(t, ":0\r\n", execute(client, "bitpos", "missing", "0"))
+	require.Equal(t, ":-1\r\n", execute(client, "bitpos", "missing", "1"))
+
+	// the bits after the string are clear unless the end of the range is given.
+	execute(client, "set", "ones", "\xff\xff")
+	require.Equal(t, ":16\r\n", execute(client, "bitpos", "ones", "0"))
+	require.Equal(t, ":-1\r\n", execute(client, "bitpos", "ones", "0", "0", "-1"))
+	require.Equal(t, "-ERR The bit argument must be 1 or 0.\r\n", execute(client, "bitpos", "ones", "2"))
+
+	execute(client, "set", "a", "\x0f\xff\x01")
+	execute(client, "set", "b", "\xf0\x0f")
+	require.Equal(t, ":3\r\n", execute(client, "bitop", "and", "dst", "a", "b"))
+	require.Equal(t, "$3\r\n\x00\x0f\x00\r\n", execute(client, "get", "dst"))
+	require.Equal(t, ":3\r\n", execute(client, "bitop", "or", "dst", "a", "b"))
+	require.Equal(t, "$3\r\n\xff\xff\x01\r\n", execute(client, "get", "dst"))
+	require.Equal(t, ":3\r\n", execute(client, "bitop", "xor", "dst", "a", "b", "missing"))
+	require.Equal(t, "$3\r\n\xff\xf0\x01\r\n", execute(client, "get", "dst"))
+	require.Equal(t, ":2\r\n", execute(client, "bitop", "not", "dst", "b"))
+	require.Equal(t, "$2\r\n\x0f\xf0\r\n", execute(client, "get", "dst"))
+	require.Equal(t, "-ERR BITOP NOT must be called with a single source key.\r\n",
+		execute(client, "bitop", "not", "dst", "a", "b"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "bitop", "nand", "dst", "a"))
+
+	// the destination is deleted when the result is empty.
+	require.Equal(t, ":0\r\n", execute(client, "bitop", "and", "dst", "missing"))
+	require.Equal(t, "$-1\r\n", execute(client, "get", "dst"))
+
+	execute(client, "hset", "hash", "field", "value")
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "setbit", "hash", "1", "1"))
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "bitop", "or", "dst", "a", "hash"))
+
+	srv.aofBuf.Reset()
+	execute(client, "setbit", "bits", "0", "1")
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"setbit", "bits", "0", "1"}), srv.aofBuf.String())
+}
+
+func TestBitCountAndPos(t *testing.T) {
+	t.Parallel()
+
+	getBit := func(value string, i int64) byte {
+		return (value[i/8] >> (7 - i%8)) & 1
+	}
+
+	buf := make([]byte, 100)
+	for i := range buf {
+		switch i % 4 {
+		case 0:
+			buf[i] = 0
+		case 1:
+			buf[i] = 0xff
+		default:
+			buf[i] = byte(rand.Intn(256))
+		}
+	}
+
+	// the long runs of the clear and set bits are skipped by words.
+	value := string(buf[:16]) + strings.Repeat("\x00", 40) + string(buf[16:40]) + strings.Repeat("\xff", 40) + string(buf[40:])
+
+	for n := 0; n < 2000; n++ {
+		startBit := rand.Int63n(int64(len(value)) * 8)
+		endBit := startBit + rand.Int63n(int64(len(value))*8-startBit)
+
+		count := int64(0)
+		pos := [2]int64{-1, -1}
+
+		for i := startBit; i <= endBit; i++ {
+			bit := getBit(value, i)
+			count += int64(bit)
+
+			if pos[bit] == -1 {
+				pos[bit] = i
+			}
+		}
+
+		require.Equal(t, count, bitCount(value, startBit, endBit), "%d-%d", startBit, endBit)
+		require.Equal(t, pos[0], bitPos(value, 0, startBit, endBit), "%d-%d", startBit, endBit)
+		require.Equal(t, pos[1], bitPos(value, 1, startBit, endBit), "%d-%d", startBit, endBit)
+	}
+}
+
+func TestBitFieldCommand(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	// the reads don't create the key.
+	require.Equal(t, "*2\r\n:0\r\n:0\r\n",
+		execute(client, "bitfield", "counters", "get", "u8", "0", "get", "i64", "100"))
+	require.Nil(t, srv.dbs[0].Dict.Get("counters"))
+
+	require.Equal(t, "*2\r\n:1\r\n:0\r\n",
+		execute(client, "bitfield", "counters", "incrby", "i5", "100", "1", "get", "u4", "0"))
+	require.Equal(t, "*2\r\n:0\r\n:255\r\n",
+		execute(client, "bitfield", "counters", "set", "u8", "#1", "255", "get", "u8", "8"))
+	require.Equal(t, "*1\r\n:-1\r\n", execute(client, "bitfield_ro", "counters", "get", "i8", "8"))
+
+	// the unsigned counter is saturated at the max value, and isn't changed on failure.
+	for _, expected := range []string{"1", "2", "3", "3"} {
+		require.Equal(t, "*1\r\n:"+expected+"\r\n",
+			execute(client, "bitfield", "sat", "overflow", "sat", "incrby", "u2", "102", "1"))
+	}
+
+	srv.aofBuf.Reset()
+	require.Equal(t, "*1\r\n$-1\r\n",
+		execute(client, "bitfield", "sat", "overflow", "fail", "incrby", "u2", "102", "1"))
+	require.Empty(t, srv.aofBuf.String())
+	require.Equal(t, "*2\r\n:0\r\n$-1\r\n",
+		execute(client, "bitfield", "sat", "incrby", "u2", "102", "1", "overflow", "fail", "set", "u2", "102", "4"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{
+		"bitfield", "sat", "incrby", "u2", "102", "1", "overflow", "fail", "set", "u2", "102", "4",
+	}), srv.aofBuf.String())
+
+	require.Equal(t, "*2\r\n:0\r\n:-128\r\n",
+		execute(client, "bitfield", "signed", "set", "i8", "3", "127", "incrby", "i8", "3", "1"))
+	require.Equal(t, "*1\r\n:-128\r\n",
+		execute(client, "bitfield", "signed", "overflow", "sat", "incrby", "i8", "3", "-300"))
+	require.Equal(t, "*3\r\n:0\r\n:-9223372036854775808\r\n:-9223372036854775808\r\n",
+		execute(client, "bitfield", "signed", "set", "i64", "20", "9223372036854775807", "incrby", "i64", "20", "1",
+			"overflow", "sat", "incrby", "i64", "20", "-1"))
+	require.Equal(t, "*2\r\n:0\r\n:9223372036854775807\r\n",
+		execute(client, "bitfield", "unsigned", "set", "u63", "0", "-1", "get", "u63", "0"))
+
+	require.Equal(t, "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n",
+		execute(client, "bitfield", "counters", "get", "u64", "0"))
+	require.Equal(t, "-ERR bit offset is not an integer or out of range\r\n",
+		execute(client, "bitfield", "counters", "get", "u8", "4294967290"))
+	require.Equal(t, "-ERR Invalid OVERFLOW type specified\r\n",
+		execute(client, "bitfield", "counters", "overflow", "max"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "bitfield", "counters", "get", "u8"))
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n",
+		execute(client, "bitfield", "counters", "set", "u8", "0", "x"))
+	require.Equal(t, "-ERR BITFIELD_RO only supports the GET subcommand\r\n",
+		execute(client, "bitfield_ro", "counters", "set", "u8", "0", "1"))
+}
+
+func TestBitFieldOverflowed(t *testing.T) {
+	t.Parallel()
+
+	values := []int64{0, 1, -1, 2, 100, -100, 1 << 31, -1 << 31, 1<<62 - 1, -1 << 62, 1<<63 - 1, -1 << 63}
+
+	for bits := uint(1); bits <= 64; bits++ {
+		for _, signed := range []bool{true, false} {
+			if !signed && bits == 64 {
+				continue
+			}
+
+			minValue, maxValue := big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), bits)
+			if signed {
+				minValue.Neg(new(big.Int).Lsh(big.NewInt(1), bits-1))
+				maxValue.Lsh(big.NewInt(1), bits-1)
+			}
+
+			maxValue.Sub(maxValue, big.NewInt(1))
+			modulo := new(big.Int).Lsh(big.NewInt(1), bits)
+
+			for _, value := range values {
+				// INCRBY starts from the value in range.
+				buf := make([]byte, 8)
+				setBitField(buf, 0, bits, value)
+				old := getBitField(buf, 0, bits, signed)
+
+				for _, incr := range values {
+					sum := new(big.Int).Add(big.NewInt(old), big.NewInt(incr))
+					inRange := sum.Cmp(minValue) >= 0 && sum.Cmp(maxValue) <= 0
+
+					wrapped := new(big.Int).Mod(sum, modulo)
+					if wrapped.Cmp(maxValue) > 0 {
+						wrapped.Sub(wrapped, modulo)
+					}
+
+					saturated := sum
+					if sum.Cmp(minValue) < 0 {
+						saturated = minValue
+					} else if sum.Cmp(maxValue) > 0 {
+						saturated = maxValue
+					}
+
+					result, ok := bitFieldOverflowed(old, incr, bits, signed, bitFieldWrap)
+					require.True(t, ok)
+					require.Equal(t, wrapped.Int64(), result, "wrap bits %d signed %v %d+%d", bits, signed, old, incr)
+
+					result, ok = bitFieldOverflowed(old, incr, bits, signed, bitFieldSat)
+					require.True(t, ok)
+					require.Equal(t, saturated.Int64(), result, "sat bits %d signed %v %d+%d", bits, signed, old, incr)
+
+					_, ok = bitFieldOverflowed(old, incr, bits, signed, bitFieldFail)
+					require.Equal(t, inRange, ok, "fail bits %d signed %v %d+%d", bits, signed, old, incr)
+				}
+			}
+		}
+	}
+}
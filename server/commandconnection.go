@@ -3,6 +3,11 @@ package server
 import "strconv"
 
 func pingCommand(client *Client) error {
+	// the reply is in the format of pub/sub messages in the context of pub/sub.
+	if pubsubSubscriptionCount(client) > 0 {
+		return client.addReplyArrays([]string{"pong", ""})
+	}
+
 	return client.addReplySimpleString("PONG")
 }
 
@@ -16,6 +21,10 @@ func selectCommand(client *Client) error {
 		return client.addReplyError("invalid db index")
 	}
 
+	if client.srv.cluster != nil && dbIndex != 0 {
+		return client.addReplyError("SELECT is not allowed in cluster mode")
+	}
+
 	client.db = client.srv.dbs[dbIndex]
 
 	return client.addReplyOK()
@@ -0,0 +1,582 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IfanTsai/metis/database"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/pkg/errors"
+)
+
+const (
+	valueNotFloatErr    = "value is not a valid float"
+	geoInvalidPairErr   = "invalid longitude,latitude pair %f,%f"
+	geoUnsupportedUnit  = "unsupported unit provided. please use M, KM, FT, MI"
+	geoMemberNotFound   = "could not decode requested zset member"
+	geoCountNotPositive = "COUNT must be > 0"
+)
+
+// the geospatial indexes are sorted sets whose scores are the 52 bits geohashes of the members,
+// so that the sorted set commands work on them as well.
+
+type geoSort uint8
+
+const (
+	geoSortNone geoSort = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+type geoPoint struct {
+	member    string
+	score     float64
+	long, lat float64
+	dist      float64 // the distance to the center of the shape in meters
+}
+
+type geoSearchOptions struct {
+	shape      datastruct.GeoShape
+	unit       float64 // the meters of the unit of the shape and the distances
+	sort       geoSort
+	count      int64
+	any        bool
+	withCoord  bool
+	withDist   bool
+	withHash   bool
+	storeDist  bool
+	fromMember string
+}
+
+// geoAddCommand implements GEOADD key [NX | XX] [CH] longitude latitude member [...].
+func geoAddCommand(client *Client) error {
+	args := client.args
+	key := args[1]
+
+	var nx, xx, ch bool
+
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ch":
+			ch = true
+		default:
+			break options
+		}
+	}
+
+	if nx && xx {
+		return client.addReplyError("XX and NX options at the same time are not compatible")
+	}
+
+	if len(args) == i || (len(args)-i)%3 != 0 {
+		return client.addReplyError("syntax error")
+	}
+
+	// all the coordinates are validated before adding any member.
+	points := make([]geoPoint, 0, (len(args)-i)/3)
+	for ; i < len(args); i += 3 {
+		long, lat, errMsg := parseGeoCoordinates(args[i], args[i+1])
+		if errMsg != "" {
+			return client.addReplyError(errMsg)
+		}
+
+		score := datastruct.GeoHashEncode(long, lat, datastruct.GeoStepMax).Bits
+		points = append(points, geoPoint{member: args[i+2], score: float64(score)})
+	}
+
+	zset, err := getZsetIfExist(client, key)
+	created := false
+
+	switch {
+	case errors.Is(err, errNotExist):
+		zset, created = datastruct.NewZset(&database.DictType{}), true
+	case err != nil:
+		return client.addReplyError(err.Error())
+	}
+
+	var added, updated int64
+	for _, point := range points {
+		element := zset.Get(point.member)
+		switch {
+		case element == nil && !xx:
+			zset.Add(point.score, point.member)
+			added++
+		case element != nil && !nx && element.Score != point.score:
+			zset.Add(point.score, point.member)
+			updated++
+		}
+	}
+
+	if added+updated > 0 {
+		if created {
+			client.db.Dict.Set(key, zset)
+		}
+
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyZset, "zadd", key, client.db.ID)
+		signalKeyAsReady(client.srv, client.db.ID, key)
+		client.srv.dirty += added + updated
+	}
+
+	if ch {
+		return client.addReplyInt(added + updated)
+	}
+
+	return client.addReplyInt(added)
+}
+
+// geoPosCommand implements GEOPOS key [member ...].
+func geoPosCommand(client *Client) error {
+	zset, err := getZsetIfExist(client, client.args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	members := client.args[2:]
+	if err := client.addReplyStringf("*%d\r\n", len(members)); err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		var element *datastruct.ZsetElement
+		if zset != nil {
+			element = zset.Get(member)
+		}
+
+		if element == nil {
+			if err := client.addReplyNullArray(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		long, lat := datastruct.GeoDecodeScore(element.Score)
+		if err := client.addReplyArrays([]string{formatGeoFloat(long), formatGeoFloat(lat)}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// geoDistCommand implements GEODIST key member1 member2 [M | KM | FT | MI].
+func geoDistCommand(client *Client) error {
+	args := client.args
+	if len(args) > 5 {
+		return client.addReplyError("syntax error")
+	}
+
+	unit := 1.0
+	if len(args) == 5 {
+		var ok bool
+		if unit, ok = parseGeoUnit(args[4]); !ok {
+			return client.addReplyError(geoUnsupportedUnit)
+		}
+	}
+
+	zset, err := getZsetIfExist(client, args[1])
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyNull()
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	element1, element2 := zset.Get(args[2]), zset.Get(args[3])
+	if element1 == nil || element2 == nil {
+		return client.addReplyNull()
+	}
+
+	long1, lat1 := datastruct.GeoDecodeScore(element1.Score)
+	long2, lat2 := datastruct.GeoDecodeScore(element2.Score)
+
+	return client.addReplyBulkString(fmt.Sprintf("%.4f", datastruct.GeoDistance(long1, lat1, long2, lat2)/unit))
+}
+
+// geoHashCommand implements GEOHASH key [member ...], which replies the standard geohash strings.
+func geoHashCommand(client *Client) error {
+	zset, err := getZsetIfExist(client, client.args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	members := client.args[2:]
+	if err := client.addReplyStringf("*%d\r\n", len(members)); err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		var element *datastruct.ZsetElement
+		if zset != nil {
+			element = zset.Get(member)
+		}
+
+		if element == nil {
+			if err := client.addReplyNull(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := client.addReplyBulkString(datastruct.GeoHashString(datastruct.GeoDecodeScore(element.Score))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// geoSearchCommand implements GEOSEARCH key FROMMEMBER member | FROMLONLAT longitude latitude
+// BYRADIUS radius unit | BYBOX width height unit [ASC | DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH].
+func geoSearchCommand(client *Client) error {
+	return geoSearchGenericCommand(client, 1, "")
+}
+
+// geoSearchStoreCommand implements GEOSEARCHSTORE destination source with the options of GEOSEARCH
+// except WITH*, and [STOREDIST] to store the distances instead of the geohashes.
+func geoSearchStoreCommand(client *Client) error {
+	return geoSearchGenericCommand(client, 2, client.args[1])
+}
+
+func geoSearchGenericCommand(client *Client, srcIndex int, dst string) error {
+	args := client.args
+	src := args[srcIndex]
+
+	opts, errMsg := parseGeoSearchOptions(args, srcIndex+1, dst != "")
+	if errMsg != "" {
+		return client.addReplyError(errMsg)
+	}
+
+	zset, err := getZsetIfExist(client, src)
+	if err != nil {
+		if !errors.Is(err, errNotExist) {
+			return client.addReplyError(err.Error())
+		}
+
+		if dst == "" {
+			return client.addReplyEmpty()
+		}
+
+		geoSearchStoreDeleteDst(client, dst)
+
+		return client.addReplyInt(0)
+	}
+
+	if opts.fromMember != "" {
+		element := zset.Get(opts.fromMember)
+		if element == nil {
+			return client.addReplyError(geoMemberNotFound)
+		}
+
+		opts.shape.Long, opts.shape.Lat = datastruct.GeoDecodeScore(element.Score)
+	}
+
+	points := geoSearch(zset, opts)
+
+	if dst != "" {
+		return geoSearchStore(client, dst, points, opts)
+	}
+
+	return addReplyGeoPoints(client, points, opts)
+}
+
+// parseGeoSearchOptions parses the options of GEOSEARCH and GEOSEARCHSTORE from the index,
+// the shape is in meters after parsing.
+func parseGeoSearchOptions(args []string, index int, store bool) (*geoSearchOptions, string) {
+	opts := &geoSearchOptions{}
+
+	var fromMember, fromLonLat, byRadius, byBox bool
+
+	for i := index; i < len(args); i++ {
+		remaining := len(args) - i - 1
+
+		switch option := strings.ToLower(args[i]); {
+		case option == "frommember" && remaining >= 1:
+			opts.fromMember, fromMember = args[i+1], true
+			i++
+		case option == "fromlonlat" && remaining >= 2:
+			long, lat, errMsg := parseGeoCoordinates(args[i+1], args[i+2])
+			if errMsg != "" {
+				return nil, errMsg
+			}
+
+			opts.shape.Long, opts.shape.Lat, fromLonLat = long, lat, true
+			i += 2
+		case option == "byradius" && remaining >= 2:
+			radius, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				return nil, valueNotFloatErr
+			}
+
+			if radius < 0 {
+				return nil, "radius cannot be negative"
+			}
+
+			unit, ok := parseGeoUnit(args[i+2])
+			if !ok {
+				return nil, geoUnsupportedUnit
+			}
+
+			opts.shape.Radius, opts.unit, byRadius = radius*unit, unit, true
+			i += 2
+		case option == "bybox" && remaining >= 3:
+			width, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				return nil, valueNotFloatErr
+			}
+
+			height, err := strconv.ParseFloat(args[i+2], 64)
+			if err != nil {
+				return nil, valueNotFloatErr
+			}
+
+			if width < 0 || height < 0 {
+				return nil, "height or width cannot be negative"
+			}
+
+			unit, ok := parseGeoUnit(args[i+3])
+			if !ok {
+				return nil, geoUnsupportedUnit
+			}
+
+			opts.shape.Width, opts.shape.Height, opts.unit, byBox = width*unit, height*unit, unit, true
+			i += 3
+		case option == "asc":
+			opts.sort = geoSortAsc
+		case option == "desc":
+			opts.sort = geoSortDesc
+		case option == "count" && remaining >= 1:
+			count, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, valueNotIntegerErr
+			}
+
+			if count <= 0 {
+				return nil, geoCountNotPositive
+			}
+
+			opts.count = count
+			i++
+		case option == "any":
+			opts.any = true
+		case option == "withcoord" && !store:
+			opts.withCoord = true
+		case option == "withdist" && !store:
+			opts.withDist = true
+		case option == "withhash" && !store:
+			opts.withHash = true
+		case option == "storedist" && store:
+			opts.storeDist = true
+		default:
+			return nil, "syntax error"
+		}
+	}
+
+	if fromMember == fromLonLat {
+		return nil, fmt.Sprintf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %s",
+			strings.ToLower(args[0]))
+	}
+
+	if byRadius == byBox {
+		return nil, fmt.Sprintf("exactly one of BYRADIUS and BYBOX can be specified for %s",
+			strings.ToLower(args[0]))
+	}
+
+	if opts.any && opts.count == 0 {
+		return nil, "the ANY argument requires COUNT argument"
+	}
+
+	// the nearest ones are returned with COUNT unless ANY is specified.
+	if opts.count > 0 && !opts.any && opts.sort == geoSortNone {
+		opts.sort = geoSortAsc
+	}
+
+	return opts, ""
+}
+
+// geoSearch returns the members in the shape, the geohash areas covering the shape are scanned
+// by the score ranges of the sorted set.
+func geoSearch(zset *datastruct.Zset, opts *geoSearchOptions) []geoPoint {
+	var points []geoPoint
+
+	for _, area := range datastruct.GeoSearchAreas(&opts.shape) {
+		min, max := datastruct.GeoScoreRange(area)
+
+		// the range of the area is [min, max), and the scores are integers.
+		for _, element := range zset.RangeByScore(float64(min), float64(max-1), -1, false) {
+			long, lat := datastruct.GeoDecodeScore(element.Score)
+
+			dist, ok := opts.shape.Contains(long, lat)
+			if !ok {
+				continue
+			}
+
+			points = append(points, geoPoint{member: element.Member, score: element.Score, long: long, lat: lat, dist: dist})
+
+			// any matched members are enough with ANY.
+			if opts.any && int64(len(points)) == opts.count {
+				break
+			}
+		}
+
+		if opts.any && int64(len(points)) == opts.count {
+			break
+		}
+	}
+
+	switch opts.sort {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	case geoSortNone:
+	}
+
+	if opts.count > 0 && int64(len(points)) > opts.count {
+		points = points[:opts.count]
+	}
+
+	return points
+}
+
+// addReplyGeoPoints replies the members, or the arrays of the member followed by the distance,
+// the geohash and the coordinates if they're requested.
+func addReplyGeoPoints(client *Client, points []geoPoint, opts *geoSearchOptions) error {
+	if !opts.withCoord && !opts.withDist && !opts.withHash {
+		members := make([]string, len(points))
+		for i, point := range points {
+			members[i] = point.member
+		}
+
+		return client.addReplyArrays(members)
+	}
+
+	fields := 1
+	for _, with := range []bool{opts.withDist, opts.withHash, opts.withCoord} {
+		if with {
+			fields++
+		}
+	}
+
+	if err := client.addReplyStringf("*%d\r\n", len(points)); err != nil {
+		return err
+	}
+
+	for _, point := range points {
+		if err := client.addReplyStringf("*%d\r\n", fields); err != nil {
+			return err
+		}
+
+		if err := client.addReplyBulkString(point.member); err != nil {
+			return err
+		}
+
+		if opts.withDist {
+			if err := client.addReplyBulkString(fmt.Sprintf("%.4f", point.dist/opts.unit)); err != nil {
+				return err
+			}
+		}
+
+		if opts.withHash {
+			if err := client.addReplyInt(int64(point.score)); err != nil {
+				return err
+			}
+		}
+
+		if opts.withCoord {
+			if err := client.addReplyArrays([]string{formatGeoFloat(point.long), formatGeoFloat(point.lat)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// geoSearchStore stores the members into a new sorted set of the destination, which replaces the old value.
+// The scores are the geohashes, or the distances in the unit with STOREDIST.
+func geoSearchStore(client *Client, dst string, points []geoPoint, opts *geoSearchOptions) error {
+	if len(points) == 0 {
+		geoSearchStoreDeleteDst(client, dst)
+
+		return client.addReplyInt(0)
+	}
+
+	zset := datastruct.NewZset(&database.DictType{})
+	for _, point := range points {
+		score := point.score
+		if opts.storeDist {
+			score = point.dist / opts.unit
+		}
+
+		zset.Add(score, point.member)
+	}
+
+	_ = client.db.Expire.Delete(dst)
+	client.db.Dict.Set(dst, zset)
+	signalModifiedKey(client, dst)
+	notifyKeyspaceEvent(client.srv, notifyZset, "geosearchstore", dst, client.db.ID)
+	signalKeyAsReady(client.srv, client.db.ID, dst)
+	client.srv.dirty++
+
+	return client.addReplyInt(zset.Size())
+}
+
+func geoSearchStoreDeleteDst(client *Client, dst string) {
+	if client.db.Dict.Delete(dst) == nil {
+		_ = client.db.Expire.Delete(dst)
+		signalModifiedKey(client, dst)
+		notifyKeyspaceEvent(client.srv, notifyGeneric, "del", dst, client.db.ID)
+		client.srv.dirty++
+	}
+}
+
+// parseGeoCoordinates parses the longitude and the latitude, it returns the error message if they're invalid.
+func parseGeoCoordinates(longArg, latArg string) (float64, float64, string) {
+	long, err := strconv.ParseFloat(longArg, 64)
+	if err != nil {
+		return 0, 0, valueNotFloatErr
+	}
+
+	lat, err := strconv.ParseFloat(latArg, 64)
+	if err != nil {
+		return 0, 0, valueNotFloatErr
+	}
+
+	if !datastruct.GeoValid(long, lat) {
+		return 0, 0, fmt.Sprintf(geoInvalidPairErr, long, lat)
+	}
+
+	return long, lat, ""
+}
+
+// parseGeoUnit returns the meters of the unit.
+func parseGeoUnit(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	default:
+		return 0, false
+	}
+}
+
+func formatGeoFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	// the examples are the same as the documents of redis.
+	require.Equal(t, ":2\r\n", execute(client, "geoadd", "Sicily", "13.361389", "38.115556", "Palermo",
+		"15.087269", "37.502669", "Catania"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"geoadd", "Sicily", "13.361389", "38.115556", "Palermo",
+		"15.087269", "37.502669", "Catania"}), srv.aofBuf.String())
+	require.Equal(t, "+3479099956230698\r\n", execute(client, "zscore", "Sicily", "Palermo"))
+
+	require.Equal(t, "$11\r\n166274.1516\r\n", execute(client, "geodist", "Sicily", "Palermo", "Catania"))
+	require.Equal(t, "$8\r\n166.2742\r\n", execute(client, "geodist", "Sicily", "Palermo", "Catania", "km"))
+	require.Equal(t, "$8\r\n103.3182\r\n", execute(client, "geodist", "Sicily", "Palermo", "Catania", "MI"))
+	require.Equal(t, "$-1\r\n", execute(client, "geodist", "Sicily", "Palermo", "missing"))
+	require.Equal(t, "$-1\r\n", execute(client, "geodist", "missing", "Palermo", "Catania"))
+	require.Equal(t, "-ERR unsupported unit provided. please use M, KM, FT, MI\r\n",
+		execute(client, "geodist", "Sicily", "Palermo", "Catania", "yd"))
+
+	require.Equal(t, "*3\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n$-1\r\n",
+		execute(client, "geohash", "Sicily", "Palermo", "Catania", "missing"))
+	require.Equal(t, "*2\r\n*2\r\n$18\r\n13.361389338970184\r\n$16\r\n38.1155563954963\r\n*-1\r\n",
+		execute(client, "geopos", "Sicily", "Palermo", "missing"))
+	require.Equal(t, "*1\r\n*-1\r\n", execute(client, "geopos", "missing", "Palermo"))
+
+	// the options of GEOADD.
+	srv.aofBuf.Reset()
+	require.Equal(t, ":0\r\n", execute(client, "geoadd", "Sicily", "xx", "13.5", "38", "missing"))
+	require.Equal(t, ":0\r\n", execute(client, "geoadd", "Sicily", "nx", "13.5", "38", "Palermo"))
+	require.Equal(t, ":0\r\n", execute(client, "geoadd", "missing", "xx", "13.5", "38", "Palermo"))
+	require.Empty(t, srv.aofBuf.String())
+	require.Nil(t, srv.dbs[0].Dict.Get("missing"))
+	require.Equal(t, ":1\r\n", execute(client, "geoadd", "Sicily", "ch", "13.361389", "38.115556", "Palermo",
+		"13.5", "38", "Catania"))
+	require.Equal(t, ":0\r\n", execute(client, "geoadd", "Sicily", "15.087269", "37.502669", "Catania"))
+	require.Equal(t, "-ERR XX and NX options at the same time are not compatible\r\n",
+		execute(client, "geoadd", "Sicily", "nx", "xx", "13.5", "38", "Palermo"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "geoadd", "Sicily", "13.5", "38", "Palermo", "14"))
+	require.Equal(t, "-ERR invalid longitude,latitude pair 13.500000,86.000000\r\n",
+		execute(client, "geoadd", "Sicily", "13.5", "86", "Palermo"))
+	require.Equal(t, "-ERR value is not a valid float\r\n", execute(client, "geoadd", "Sicily", "a", "38", "Palermo"))
+
+	execute(client, "set", "string", "value")
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "geoadd", "string", "13.5", "38", "Palermo"))
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "geopos", "string", "Palermo"))
+}
+
+func TestGeoSearchCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	execute(client, "geoadd", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+
+	require.Equal(t, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"))
+	require.Equal(t, "*2\r\n$7\r\nPalermo\r\n$7\r\nCatania\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "desc"))
+	require.Equal(t, "*1\r\n$7\r\nCatania\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "100", "km"))
+	require.Equal(t, "*1\r\n*3\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n:3479447370796909\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km",
+			"count", "1", "withhash", "withdist"))
+	require.Equal(t, "*2\r\n*2\r\n$7\r\nPalermo\r\n$6\r\n0.0000\r\n*2\r\n$7\r\nCatania\r\n$8\r\n166.2742\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "Palermo", "byradius", "200", "km", "asc", "withdist"))
+
+	execute(client, "geoadd", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+	require.Equal(t, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"))
+	require.Equal(t, "*4\r\n*2\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n*2\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n"+
+		"*2\r\n$5\r\nedge2\r\n$8\r\n279.7403\r\n*2\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "asc", "withdist"))
+	require.Equal(t, "*2\r\n",
+		execute(client, "geosearch", "Sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "count", "2",
+			"any")[:4])
+	require.Equal(t, "*0\r\n", execute(client, "geosearch", "missing", "fromlonlat", "15", "37", "byradius", "1", "m"))
+
+	// the errors of the options.
+	require.Equal(t, "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch\r\n",
+		execute(client, "geosearch", "Sicily", "byradius", "200", "km", "asc", "desc"))
+	require.Equal(t, "-ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "Palermo", "asc", "desc", "asc"))
+	require.Equal(t, "-ERR the ANY argument requires COUNT argument\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "Palermo", "byradius", "200", "km", "any"))
+	require.Equal(t, "-ERR COUNT must be > 0\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "Palermo", "byradius", "200", "km", "count", "0"))
+	require.Equal(t, "-ERR radius cannot be negative\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "Palermo", "byradius", "-1", "km"))
+	require.Equal(t, "-ERR could not decode requested zset member\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "missing", "byradius", "200", "km"))
+	require.Equal(t, "-ERR syntax error\r\n",
+		execute(client, "geosearch", "Sicily", "frommember", "Palermo", "byradius", "200", "km", "storedist"))
+
+	// GEOSEARCHSTORE stores the geohashes or the distances.
+	srv.aofBuf.Reset()
+	require.Equal(t, ":2\r\n", execute(client, "geosearchstore", "dst", "Sicily", "fromlonlat", "15", "37",
+		"byradius", "200", "km"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"geosearchstore", "dst", "Sicily", "fromlonlat", "15", "37",
+		"byradius", "200", "km"}), srv.aofBuf.String())
+	require.Equal(t, "+3479447370796909\r\n", execute(client, "zscore", "dst", "Catania"))
+	require.Equal(t, ":2\r\n", execute(client, "geosearchstore", "dst", "Sicily", "fromlonlat", "15", "37",
+		"byradius", "200", "km", "storedist"))
+	require.True(t, strings.HasPrefix(execute(client, "zscore", "dst", "Catania"), "+56.4412"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "geosearchstore", "dst", "Sicily", "fromlonlat", "15", "37",
+		"byradius", "200", "km", "withdist"))
+	require.Equal(t, ":0\r\n", execute(client, "geosearchstore", "dst", "Sicily", "fromlonlat", "0", "0",
+		"byradius", "1", "km"))
+	require.Nil(t, srv.dbs[0].Dict.Get("dst"))
+}
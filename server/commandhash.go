@@ -26,6 +26,9 @@ func hSetCommand(client *Client) error {
 		client.srv.dirty++
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyHash, "hset", key, client.db.ID)
+
 	return client.addReplyInt(created)
 }
 
@@ -69,6 +72,11 @@ func hDelCommand(client *Client) error {
 		}
 	}
 
+	if deleted > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyHash, "hdel", key, client.db.ID)
+	}
+
 	return client.addReplyInt(deleted)
 }
 
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/pkg/errors"
+)
+
+const hllInvalidErr = "Key is not a valid HyperLogLog string value."
+
+// the HyperLogLogs are stored as strings in the format of redis, so that they can be moved between metis
+// and redis by DUMP and RESTORE.
+
+func pfAddCommand(client *Client) error {
+	key := client.args[1]
+
+	hll, err := getHyperLogLogIfExist(client, key)
+	updated := false
+
+	switch {
+	case errors.Is(err, errNotExist):
+		hll, updated = datastruct.NewHyperLogLog(), true
+	case err != nil:
+		return addReplyHyperLogLogError(client, err)
+	}
+
+	for _, element := range client.args[2:] {
+		updated = hll.Add(element) || updated
+	}
+
+	if !updated {
+		return client.addReplyInt(0)
+	}
+
+	client.db.Dict.Set(key, hll.Encode(client.srv.hllSparseMaxBytes))
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "pfadd", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyInt(1)
+}
+
+// pfCountCommand counts the union of the HyperLogLogs of the keys. The cardinality of a single key is
+// cached in the string, which is propagated as a modification.
+func pfCountCommand(client *Client) error {
+	keys := client.args[1:]
+	if len(keys) > 1 {
+		union := datastruct.NewHyperLogLog()
+		for _, key := range keys {
+			hll, err := getHyperLogLogIfExist(client, key)
+			if errors.Is(err, errNotExist) {
+				continue
+			}
+
+			if err != nil {
+				return addReplyHyperLogLogError(client, err)
+			}
+
+			union.Merge(hll)
+		}
+
+		return client.addReplyInt(int64(union.Count()))
+	}
+
+	hll, err := getHyperLogLogIfExist(client, keys[0])
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyInt(0)
+		}
+
+		return addReplyHyperLogLogError(client, err)
+	}
+
+	if !hll.Cached() {
+		card := hll.Count()
+		client.db.Dict.Set(keys[0], hll.Encode(client.srv.hllSparseMaxBytes))
+		signalModifiedKey(client, keys[0])
+		client.srv.dirty++
+
+		return client.addReplyInt(int64(card))
+	}
+
+	return client.addReplyInt(int64(hll.Count()))
+}
+
+func pfMergeCommand(client *Client) error {
+	dst := client.args[1]
+
+	merged, err := getHyperLogLogIfExist(client, dst)
+	switch {
+	case errors.Is(err, errNotExist):
+		merged = datastruct.NewHyperLogLog()
+	case err != nil:
+		return addReplyHyperLogLogError(client, err)
+	}
+
+	for _, key := range client.args[2:] {
+		hll, err := getHyperLogLogIfExist(client, key)
+		if errors.Is(err, errNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return addReplyHyperLogLogError(client, err)
+		}
+
+		merged.Merge(hll)
+	}
+
+	client.db.Dict.Set(dst, merged.Encode(client.srv.hllSparseMaxBytes))
+	signalModifiedKey(client, dst)
+	notifyKeyspaceEvent(client.srv, notifyString, "pfadd", dst, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyOK()
+}
+
+func getHyperLogLogIfExist(client *Client, key string) (*datastruct.HyperLogLog, error) {
+	value, err := getStringIfExist(client, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return datastruct.ParseHyperLogLog(value)
+}
+
+func addReplyHyperLogLogError(client *Client, err error) error {
+	if errors.Is(err, datastruct.ErrInvalidHyperLogLog) {
+		return client.addReplyErrorCode("WRONGTYPE", hllInvalidErr)
+	}
+
+	return client.addReplyError(err.Error())
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLogCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, ":1\r\n", execute(client, "pfadd", "empty"))
+	require.Equal(t, ":0\r\n", execute(client, "pfcount", "empty"))
+	require.Equal(t, ":1\r\n", execute(client, "pfadd", "hll", "a", "b", "c", "d", "e", "f", "g"))
+	require.Equal(t, ":0\r\n", execute(client, "pfadd", "hll", "a", "b"))
+	require.Equal(t, ":0\r\n", execute(client, "pfcount", "missing"))
+
+	// the cardinality is cached by the first count, which is propagated.
+	srv.aofBuf.Reset()
+	require.Equal(t, ":7\r\n", execute(client, "pfcount", "hll"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"pfcount", "hll"}), srv.aofBuf.String())
+	require.Equal(t, byte(7), srv.dbs[0].Dict.Get("hll").(string)[8])
+
+	srv.aofBuf.Reset()
+	require.Equal(t, ":7\r\n", execute(client, "pfcount", "hll"))
+	require.Empty(t, srv.aofBuf.String())
+
+	require.Equal(t, ":1\r\n", execute(client, "pfadd", "other", "f", "g", "h", "i"))
+	require.Equal(t, ":9\r\n", execute(client, "pfcount", "hll", "other", "missing"))
+	require.Equal(t, "+OK\r\n", execute(client, "pfmerge", "merged", "hll", "other", "missing"))
+	require.Equal(t, ":9\r\n", execute(client, "pfcount", "merged"))
+	require.Equal(t, "+OK\r\n", execute(client, "pfmerge", "hll", "other"))
+	require.Equal(t, ":9\r\n", execute(client, "pfcount", "hll"))
+
+	// the HyperLogLog is a string, which is moved between the servers by DUMP and RESTORE.
+	_, dump, _ := strings.Cut(execute(client, "dump", "hll"), "\r\n")
+	dump = strings.TrimSuffix(dump, "\r\n")
+	require.Equal(t, "+OK\r\n", execute(client, "restore", "restored", "0", dump))
+	require.Equal(t, ":9\r\n", execute(client, "pfcount", "restored"))
+	require.True(t, strings.HasPrefix(execute(client, "get", "restored"), "$"))
+
+	execute(client, "set", "string", "value")
+	require.Equal(t, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n",
+		execute(client, "pfadd", "string", "a"))
+	require.Equal(t, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n",
+		execute(client, "pfcount", "hll", "string"))
+	require.Equal(t, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n",
+		execute(client, "pfmerge", "hll", "string"))
+
+	execute(client, "lpush", "list", "a")
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "pfcount", "list"))
+
+	// PFCOUNT is still a read command for the read only replica.
+	srv.masterHost = "127.0.0.1"
+	srv.replicaReadOnly = true
+	require.Equal(t, ":4\r\n", execute(client, "pfcount", "other"))
+	require.Equal(t, "-READONLY You can't write against a read only replica.\r\n", execute(client, "pfadd", "other", "j"))
+}
@@ -1,45 +1,172 @@
 package server
 
 import (
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/IfanTsai/metis/database"
 	"github.com/IfanTsai/metis/datastruct"
+	"github.com/samber/lo"
+)
+
+type expireFlag uint8
+
+const (
+	expireNX expireFlag = 1 << iota
+	expireXX
+	expireGT
+	expireLT
 )
 
 func expireCommand(client *Client) error {
-	key := client.args[1]
+	return expireGenericCommand(client, time.Now().UnixMilli(), time.Second)
+}
+
+func pexpireCommand(client *Client) error {
+	return expireGenericCommand(client, time.Now().UnixMilli(), time.Millisecond)
+}
 
-	expireInt, err := strconv.ParseInt(client.args[2], 10, 64)
+func expireAtCommand(client *Client) error {
+	return expireGenericCommand(client, 0, time.Second)
+}
+
+func pexpireAtCommand(client *Client) error {
+	return expireGenericCommand(client, 0, time.Millisecond)
+}
+
+// expireGenericCommand implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT with [NX | XX | GT | LT],
+// the time in the unit is relative to the base time in milliseconds, which is 0 for the absolute time.
+// A key without TTL is considered to have an infinite TTL by GT and LT.
+func expireGenericCommand(client *Client, baseTime int64, unit time.Duration) error {
+	args := client.args
+	key := args[1]
+
+	num, err := strconv.ParseInt(args[2], 10, 64)
 	if err != nil {
-		return client.addReplyErrorf("invalid expire: %s, error: %v", client.args[2], err)
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	var flags expireFlag
+	for _, arg := range args[3:] {
+		switch strings.ToLower(arg) {
+		case "nx":
+			flags |= expireNX
+		case "xx":
+			flags |= expireXX
+		case "gt":
+			flags |= expireGT
+		case "lt":
+			flags |= expireLT
+		default:
+			return client.addReplyErrorf("Unsupported option %s", arg)
+		}
+	}
+
+	if flags&expireNX != 0 && flags&(expireXX|expireGT|expireLT) != 0 {
+		return client.addReplyError("NX and XX, GT or LT options at the same time are not compatible")
+	}
+
+	if flags&expireGT != 0 && flags&expireLT != 0 {
+		return client.addReplyError("GT and LT options at the same time are not compatible")
+	}
+
+	scale := int64(unit / time.Millisecond)
+	if num > (math.MaxInt64-baseTime)/scale || num < (math.MinInt64+baseTime)/scale {
+		return client.addReplyErrorf("invalid expire time in '%s' command", strings.ToLower(args[0]))
+	}
+
+	when := baseTime + num*scale
+
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	if client.db.Dict.Find(key) == nil {
+		return client.addReplyInt(0)
+	}
+
+	current := int64(-1)
+	if entry := client.db.Expire.Find(key); entry != nil {
+		current = entry.Value.(int64)
+	}
+
+	if (flags&expireNX != 0 && current != -1) ||
+		(flags&expireXX != 0 && current == -1) ||
+		(flags&expireGT != 0 && (current == -1 || when <= current)) ||
+		(flags&expireLT != 0 && current != -1 && when >= current) {
+		return client.addReplyInt(0)
+	}
+
+	// the key with the time in the past is deleted right away and DEL is propagated. It's kept when the
+	// command is replayed from the AOF, or sent by the master which propagates its own DEL later.
+	if when <= time.Now().UnixMilli() && client.flags&(clientFlagAofLoading|clientFlagMaster) == 0 {
+		_ = client.db.Dict.Delete(key)
+		_ = client.db.Expire.Delete(key)
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyGeneric, "del", key, client.db.ID)
+		client.srv.dirty++
+		client.args = []string{"del", key}
+
+		return client.addReplyInt(1)
 	}
 
-	when := time.Now().UnixMilli() + expireInt*1000
 	client.db.Expire.Set(key, when)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "expire", key, client.db.ID)
 	client.srv.dirty++
 
-	return client.addReplyOK()
+	// propagate the absolute expiration time in milliseconds with the same options.
+	client.args = append([]string{"pexpireat", key, strconv.FormatInt(when, 10)}, args[3:]...)
+
+	return client.addReplyInt(1)
 }
 
-func expireAtCommand(client *Client) error {
+func persistCommand(client *Client) error {
 	key := client.args[1]
 
-	expireInt, err := strconv.ParseInt(client.args[2], 10, 64)
-	if err != nil {
-		return client.addReplyErrorf("invalid expire: %s, error: %v", client.args[2], err)
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
 	}
 
-	client.db.Expire.Set(key, expireInt*1000)
+	if client.db.Dict.Find(key) == nil || client.db.Expire.Delete(key) != nil {
+		return client.addReplyInt(0)
+	}
+
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "persist", key, client.db.ID)
 	client.srv.dirty++
 
-	return client.addReplyOK()
+	return client.addReplyInt(1)
 }
 
 func ttlCommand(client *Client) error {
+	return ttlGenericCommand(client, time.Second, false)
+}
+
+func pttlCommand(client *Client) error {
+	return ttlGenericCommand(client, time.Millisecond, false)
+}
+
+func expireTimeCommand(client *Client) error {
+	return ttlGenericCommand(client, time.Second, true)
+}
+
+func pexpireTimeCommand(client *Client) error {
+	return ttlGenericCommand(client, time.Millisecond, true)
+}
+
+// ttlGenericCommand replies the remaining time to live or the absolute expire time in the unit,
+// -2 if the key doesn't exist and -1 if it has no TTL.
+func ttlGenericCommand(client *Client, unit time.Duration, absolute bool) error {
 	key := client.args[1]
 
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
 	if client.db.Dict.Find(key) == nil {
 		return client.addReplyInt(-2)
 	}
@@ -54,9 +181,15 @@ func ttlCommand(client *Client) error {
 		return client.addReplyError("expire value is not an integer")
 	}
 
-	ttl := (when - time.Now().UnixMilli()) / 1000
+	scale := int64(unit / time.Millisecond)
+	if absolute {
+		return client.addReplyInt(when / scale)
+	}
 
-	return client.addReplyInt(ttl)
+	ttl := lo.Max([]int64{when - time.Now().UnixMilli(), 0})
+
+	// the TTL in seconds is rounded.
+	return client.addReplyInt((ttl + scale/2) / scale)
 }
 
 func keysCommand(client *Client) error {
@@ -95,3 +228,404 @@ func keysCommand(client *Client) error {
 
 	return client.addReplyArrays(keys)
 }
+
+func delCommand(client *Client) error {
+	deleted := 0
+	for _, key := range client.args[1:] {
+		if _, err := expireIfNeeded(client, key); err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		if client.db.Dict.Delete(key) == nil {
+			_ = client.db.Expire.Delete(key)
+			signalModifiedKey(client, key)
+			notifyKeyspaceEvent(client.srv, notifyGeneric, "del", key, client.db.ID)
+			client.srv.dirty++
+			deleted++
+		}
+	}
+
+	return client.addReplyInt(int64(deleted))
+}
+
+func existsCommand(client *Client) error {
+	// the duplicated keys are counted multiple times.
+	var count int64
+	for _, key := range client.args[1:] {
+		if _, err := expireIfNeeded(client, key); err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		if client.db.Dict.Find(key) != nil {
+			count++
+		}
+	}
+
+	return client.addReplyInt(count)
+}
+
+// touchCommand counts the existing keys, the keys don't have the access time to be updated,
+// but the command is still propagated to the AOF and the replicas like redis does.
+func touchCommand(client *Client) error {
+	var count int64
+	for _, key := range client.args[1:] {
+		if _, err := expireIfNeeded(client, key); err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		if client.db.Dict.Find(key) != nil {
+			count++
+		}
+	}
+
+	if count > 0 {
+		client.srv.dirty++
+	}
+
+	return client.addReplyInt(count)
+}
+
+func typeCommand(client *Client) error {
+	key := client.args[1]
+
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	return client.addReplySimpleString(objectTypeName(client.db.Dict.Get(key)))
+}
+
+// objectTypeName returns the name of the type of the value reported by TYPE, "none" for the missing key.
+func objectTypeName(value any) string {
+	switch value.(type) {
+	case string, *datastruct.Bitmap:
+		return "string"
+	case *datastruct.Quicklist:
+		return "list"
+	case *datastruct.Dict:
+		return "hash"
+	case *datastruct.Set:
+		return "set"
+	case *datastruct.Zset:
+		return "zset"
+	case *datastruct.Stream:
+		return "stream"
+	default:
+		return "none"
+	}
+}
+
+func renameCommand(client *Client) error {
+	return renameGenericCommand(client, false)
+}
+
+func renameNxCommand(client *Client) error {
+	return renameGenericCommand(client, true)
+}
+
+// renameGenericCommand renames the key with its TTL, the destination is overwritten unless NX is specified.
+func renameGenericCommand(client *Client, nx bool) error {
+	src, dst := client.args[1], client.args[2]
+
+	if _, err := expireIfNeeded(client, src); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	value := client.db.Dict.Get(src)
+	if value == nil {
+		return client.addReplyError("no such key")
+	}
+
+	if src == dst {
+		if nx {
+			return client.addReplyInt(0)
+		}
+
+		return client.addReplyOK()
+	}
+
+	if _, err := expireIfNeeded(client, dst); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	if nx && client.db.Dict.Find(dst) != nil {
+		return client.addReplyInt(0)
+	}
+
+	when, volatile := getExpire(client.db, src)
+	_ = client.db.Dict.Delete(src)
+	_ = client.db.Expire.Delete(src)
+
+	client.db.Dict.Set(dst, value)
+	_ = client.db.Expire.Delete(dst)
+
+	if volatile {
+		client.db.Expire.Set(dst, when)
+	}
+
+	signalModifiedKey(client, src)
+	signalModifiedKey(client, dst)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "rename_from", src, client.db.ID)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "rename_to", dst, client.db.ID)
+	signalKeyAsReady(client.srv, client.db.ID, dst)
+	client.srv.dirty++
+
+	if nx {
+		return client.addReplyInt(1)
+	}
+
+	return client.addReplyOK()
+}
+
+// moveCommand moves the key with its TTL to another database, nothing is moved if the key exists there.
+func moveCommand(client *Client) error {
+	key := client.args[1]
+
+	if client.srv.cluster != nil {
+		return client.addReplyError("MOVE is not allowed in cluster mode")
+	}
+
+	dstDB, errMsg := parseDBIndex(client, client.args[2])
+	if errMsg != "" {
+		return client.addReplyError(errMsg)
+	}
+
+	if dstDB == client.db {
+		return client.addReplyError("source and destination objects are the same")
+	}
+
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	value := client.db.Dict.Get(key)
+	if value == nil {
+		return client.addReplyInt(0)
+	}
+
+	if _, err := dbExpireIfNeeded(client.srv, dstDB, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	if dstDB.Dict.Find(key) != nil {
+		return client.addReplyInt(0)
+	}
+
+	when, volatile := getExpire(client.db, key)
+	_ = client.db.Dict.Delete(key)
+	_ = client.db.Expire.Delete(key)
+
+	dstDB.Dict.Set(key, value)
+	if volatile {
+		dstDB.Expire.Set(key, when)
+	}
+
+	signalModifiedKey(client, key)
+	touchWatchedKey(client.srv, dstDB.ID, key)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "move_from", key, client.db.ID)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "move_to", key, dstDB.ID)
+	signalKeyAsReady(client.srv, dstDB.ID, key)
+	client.srv.dirty++
+
+	return client.addReplyInt(1)
+}
+
+// copyCommand implements COPY source destination [DB destination-db] [REPLACE], the value is copied
+// with its TTL.
+func copyCommand(client *Client) error {
+	args := client.args
+	src, dst := args[1], args[2]
+	dstDB, replace := client.db, false
+
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == "replace":
+			replace = true
+		case option == "db" && i+1 < len(args):
+			var errMsg string
+			if dstDB, errMsg = parseDBIndex(client, args[i+1]); errMsg != "" {
+				return client.addReplyError(errMsg)
+			}
+
+			i++
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	if client.srv.cluster != nil && dstDB != client.db {
+		return client.addReplyError("Copying to another database is not allowed in cluster mode")
+	}
+
+	if src == dst && dstDB == client.db {
+		return client.addReplyError("source and destination objects are the same")
+	}
+
+	if _, err := expireIfNeeded(client, src); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	value := client.db.Dict.Get(src)
+	if value == nil {
+		return client.addReplyInt(0)
+	}
+
+	if _, err := dbExpireIfNeeded(client.srv, dstDB, dst); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	if !replace && dstDB.Dict.Find(dst) != nil {
+		return client.addReplyInt(0)
+	}
+
+	copied, err := copyObject(value)
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	dstDB.Dict.Set(dst, copied)
+	_ = dstDB.Expire.Delete(dst)
+
+	if when, volatile := getExpire(client.db, src); volatile {
+		dstDB.Expire.Set(dst, when)
+	}
+
+	touchWatchedKey(client.srv, dstDB.ID, dst)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "copy_to", dst, dstDB.ID)
+	signalKeyAsReady(client.srv, dstDB.ID, dst)
+	client.srv.dirty++
+
+	return client.addReplyInt(1)
+}
+
+// parseDBIndex returns the database of the index, it returns the error message if the index is invalid.
+func parseDBIndex(client *Client, arg string) (*database.Databse, string) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, valueNotIntegerErr
+	}
+
+	if index < 0 || index >= len(client.srv.dbs) {
+		return nil, "DB index is out of range"
+	}
+
+	return client.srv.dbs[index], ""
+}
+
+// getExpire returns the expire time of the key in milliseconds, false if the key has no TTL.
+func getExpire(db *database.Databse, key string) (int64, bool) {
+	entry := db.Expire.Find(key)
+	if entry == nil {
+		return 0, false
+	}
+
+	return entry.Value.(int64), true
+}
+
+// copyObject returns a deep copy of the value by serializing it as DUMP does, the strings are immutable
+// and shared.
+func copyObject(value any) (any, error) {
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+
+	payload, err := rdbDumpObject(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return rdbRestoreObject(payload)
+}
+
+func dumpCommand(client *Client) error {
+	key := client.args[1]
+
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	value := client.db.Dict.Get(key)
+	if value == nil {
+		return client.addReplyNull()
+	}
+
+	payload, err := rdbDumpObject(value)
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	return client.addReplyBulkString(payload)
+}
+
+// restoreCommand implements RESTORE key ttl serialized-value [REPLACE] [ABSTTL],
+// RESTORE-ASKING is the same but it's used by MIGRATE in cluster mode.
+func restoreCommand(client *Client) error {
+	key := client.args[1]
+
+	replace, absTTL := false, false
+	for _, arg := range client.args[4:] {
+		switch strings.ToLower(arg) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	ttl, err := strconv.ParseInt(client.args[2], 10, 64)
+	if err != nil || ttl < 0 {
+		return client.addReplyError("Invalid TTL value, must be >= 0")
+	}
+
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	if !replace && client.db.Dict.Find(key) != nil {
+		return client.addReplyErrorCode("BUSYKEY", "Target key name already exists.")
+	}
+
+	value, err := rdbRestoreObject(client.args[3])
+	if err != nil {
+		return client.addReplyError("Bad data format")
+	}
+
+	when := int64(0)
+	if ttl > 0 {
+		when = ttl
+		if !absTTL {
+			when += time.Now().UnixMilli()
+
+			// propagate the absolute time computed here, so that the AOF and the replicas have the same one.
+			client.args = append([]string{client.args[0], key, strconv.FormatInt(when, 10)}, client.args[3:]...)
+			client.args = append(client.args, "absttl")
+		}
+	}
+
+	_ = client.db.Expire.Delete(key)
+
+	// the key is already expired, it's deleted instead.
+	if when > 0 && when <= time.Now().UnixMilli() {
+		if client.db.Dict.Delete(key) == nil {
+			signalModifiedKey(client, key)
+			notifyKeyspaceEvent(client.srv, notifyGeneric, "del", key, client.db.ID)
+			client.srv.dirty++
+		}
+
+		return client.addReplyOK()
+	}
+
+	client.db.Dict.Set(key, value)
+	if when > 0 {
+		client.db.Expire.Set(key, when)
+	}
+
+	signalKeyAsReady(client.srv, client.db.ID, key)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "restore", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyOK()
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpireCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, ":0\r\n", execute(client, "expire", "missing", "100"))
+	execute(client, "set", "key", "value")
+
+	// the expirations are propagated as PEXPIREAT in milliseconds.
+	srv.aofBuf.Reset()
+	now := time.Now().UnixMilli()
+	require.Equal(t, ":1\r\n", execute(client, "pexpire", "key", "100500"))
+	when := srv.dbs[0].Expire.Get("key").(int64)
+	require.InDelta(t, now+100500, when, 1000)
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"pexpireat", "key", strconv.FormatInt(when, 10)}),
+		srv.aofBuf.String())
+
+	srv.aofBuf.Reset()
+	require.Equal(t, ":1\r\n", execute(client, "expireat", "key", "4102444800", "gt"))
+	require.Equal(t, int64(4102444800000), srv.dbs[0].Expire.Get("key").(int64))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"pexpireat", "key", "4102444800000", "gt"}),
+		srv.aofBuf.String())
+
+	srv.aofBuf.Reset()
+	require.Equal(t, ":1\r\n", execute(client, "pexpireat", "key", "4102444800001"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"pexpireat", "key", "4102444800001"}), srv.aofBuf.String())
+
+	// the conditions are not met, nothing is propagated.
+	srv.aofBuf.Reset()
+	require.Equal(t, ":0\r\n", execute(client, "expire", "key", "100", "nx"))
+	require.Equal(t, ":0\r\n", execute(client, "expire", "key", "100", "gt"))
+	require.Equal(t, ":0\r\n", execute(client, "pexpireat", "key", "4102444800002", "lt"))
+	require.Empty(t, srv.aofBuf.String())
+	require.Equal(t, ":1\r\n", execute(client, "expire", "key", "100", "lt"))
+	require.Equal(t, ":1\r\n", execute(client, "expire", "key", "200", "xx", "gt"))
+
+	// a key without TTL has an infinite TTL.
+	execute(client, "set", "persistent", "value")
+	require.Equal(t, ":0\r\n", execute(client, "expire", "persistent", "100", "xx"))
+	require.Equal(t, ":0\r\n", execute(client, "expire", "persistent", "100", "gt"))
+	require.Equal(t, ":1\r\n", execute(client, "expire", "persistent", "100", "lt"))
+	require.Equal(t, ":1\r\n", execute(client, "persist", "persistent"))
+	require.Equal(t, ":0\r\n", execute(client, "persist", "persistent"))
+	require.Equal(t, ":0\r\n", execute(client, "persist", "missing"))
+	require.Equal(t, ":1\r\n", execute(client, "expire", "persistent", "100", "nx"))
+
+	// the key in the past is deleted right away and DEL is propagated.
+	srv.aofBuf.Reset()
+	require.Equal(t, ":1\r\n", execute(client, "expire", "persistent", "-1"))
+	require.Nil(t, srv.dbs[0].Dict.Get("persistent"))
+	require.Nil(t, srv.dbs[0].Expire.Get("persistent"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"del", "persistent"}), srv.aofBuf.String())
+
+	// the key is kept by the AOF loading until it's accessed.
+	execute(client, "set", "persistent", "value")
+	loader := NewClient(srv, -1)
+	loader.flags |= clientFlagAofLoading
+	require.Equal(t, ":1\r\n", execute(loader, "pexpireat", "persistent", "1"))
+	require.NotNil(t, srv.dbs[0].Dict.Get("persistent"))
+	require.Equal(t, "$-1\r\n", execute(client, "get", "persistent"))
+
+	require.Equal(t, "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n",
+		execute(client, "expire", "key", "100", "nx", "xx"))
+	require.Equal(t, "-ERR GT and LT options at the same time are not compatible\r\n",
+		execute(client, "expire", "key", "100", "gt", "lt"))
+	require.Equal(t, "-ERR Unsupported option foo\r\n", execute(client, "expire", "key", "100", "foo"))
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "expire", "key", "a"))
+	require.Equal(t, "-ERR invalid expire time in 'expire' command\r\n",
+		execute(client, "expire", "key", "9223372036854775807"))
+}
+
+func TestTTLCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	for _, cmd := range []string{"ttl", "pttl", "expiretime", "pexpiretime"} {
+		require.Equal(t, ":-2\r\n", execute(client, cmd, "missing"))
+	}
+
+	execute(client, "set", "key", "value")
+	for _, cmd := range []string{"ttl", "pttl", "expiretime", "pexpiretime"} {
+		require.Equal(t, ":-1\r\n", execute(client, cmd, "key"))
+	}
+
+	execute(client, "pexpireat", "key", "4102444800123")
+	require.Equal(t, ":4102444800\r\n", execute(client, "expiretime", "key"))
+	require.Equal(t, ":4102444800123\r\n", execute(client, "pexpiretime", "key"))
+
+	execute(client, "pexpire", "key", "100000")
+	require.Equal(t, ":100\r\n", execute(client, "ttl", "key"))
+
+	pttl, err := strconv.ParseInt(strings.TrimSpace(execute(client, "pttl", "key")[1:]), 10, 64)
+	require.NoError(t, err)
+	require.InDelta(t, 100000, pttl, 1000)
+}
+
+func TestGenericKeyCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	execute(client, "set", "string", "value")
+	execute(client, "rpush", "list", "a", "b")
+	execute(client, "hset", "hash", "field", "value")
+	execute(client, "sadd", "set", "a")
+	execute(client, "zadd", "zset", "1", "a")
+	execute(client, "xadd", "stream", "1-1", "field", "value")
+
+	for _, typ := range []string{"string", "list", "hash", "set", "zset", "stream"} {
+		require.Equal(t, "+"+typ+"\r\n", execute(client, "type", typ))
+	}
+
+	require.Equal(t, "+none\r\n", execute(client, "type", "missing"))
+	require.Equal(t, ":3\r\n", execute(client, "exists", "string", "list", "missing", "string"))
+	srv.aofBuf.Reset()
+	require.Equal(t, ":2\r\n", execute(client, "touch", "string", "list", "missing"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"touch", "string", "list", "missing"}), srv.aofBuf.String())
+	srv.aofBuf.Reset()
+	require.Equal(t, ":0\r\n", execute(client, "touch", "missing"))
+	require.Empty(t, srv.aofBuf.String())
+
+	// TOUCH is still a read command for the read only replica.
+	srv.masterHost = "127.0.0.1"
+	srv.replicaReadOnly = true
+	require.Equal(t, ":1\r\n", execute(client, "touch", "string"))
+	srv.masterHost = ""
+
+	// RENAME moves the TTL along with the value.
+	srv.aofBuf.Reset()
+	execute(client, "expire", "string", "100")
+	require.Equal(t, "+OK\r\n", execute(client, "rename", "string", "renamed"))
+	require.Equal(t, "+none\r\n", execute(client, "type", "string"))
+	require.Equal(t, ":100\r\n", execute(client, "ttl", "renamed"))
+	require.Contains(t, srv.aofBuf.String(), catAppendOnlyGenericCommand([]string{"rename", "string", "renamed"}))
+	require.Equal(t, "+OK\r\n", execute(client, "rename", "renamed", "renamed"))
+	require.Equal(t, "-ERR no such key\r\n", execute(client, "rename", "missing", "renamed"))
+	require.Equal(t, ":0\r\n", execute(client, "renamenx", "renamed", "list"))
+	require.Equal(t, ":1\r\n", execute(client, "renamenx", "renamed", "string"))
+	require.Equal(t, "+OK\r\n", execute(client, "rename", "string", "list"))
+	require.Equal(t, "+string\r\n", execute(client, "type", "list"))
+	require.Equal(t, ":-1\r\n", execute(client, "ttl", "hash"))
+
+	// COPY makes a deep copy of the value.
+	require.Equal(t, ":1\r\n", execute(client, "copy", "set", "copied"))
+	execute(client, "sadd", "copied", "b")
+	require.Equal(t, "*1\r\n$1\r\na\r\n", execute(client, "smembers", "set"))
+	require.Equal(t, ":0\r\n", execute(client, "copy", "set", "copied"))
+	require.Equal(t, ":1\r\n", execute(client, "copy", "set", "copied", "replace"))
+	require.Equal(t, ":1\r\n", execute(client, "copy", "stream", "stream", "db", "1"))
+	require.Equal(t, ":0\r\n", execute(client, "copy", "missing", "copied"))
+	require.Equal(t, "-ERR source and destination objects are the same\r\n", execute(client, "copy", "set", "set"))
+	require.Equal(t, "-ERR DB index is out of range\r\n", execute(client, "copy", "set", "copied", "db", "100"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "copy", "set", "copied", "foo"))
+
+	// MOVE moves the key to another database unless it exists there.
+	require.Equal(t, ":0\r\n", execute(client, "move", "stream", "1"))
+	require.Equal(t, ":1\r\n", execute(client, "move", "zset", "1"))
+	require.Equal(t, ":0\r\n", execute(client, "move", "zset", "1"))
+	require.Equal(t, "-ERR source and destination objects are the same\r\n", execute(client, "move", "set", "0"))
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "move", "set", "a"))
+	execute(client, "select", "1")
+	require.Equal(t, "+zset\r\n", execute(client, "type", "zset"))
+	require.Equal(t, "+stream\r\n", execute(client, "type", "stream"))
+	execute(client, "select", "0")
+
+	// DEL and UNLINK remove the keys with their TTLs.
+	execute(client, "expire", "hash", "100")
+	require.Equal(t, ":2\r\n", execute(client, "unlink", "hash", "set", "missing"))
+	require.Nil(t, srv.dbs[0].Expire.Find("hash"))
+	require.Equal(t, ":1\r\n", execute(client, "del", "copied"))
+	require.Equal(t, ":0\r\n", execute(client, "exists", "hash", "set", "copied"))
+
+	// the client blocked by the destination is served.
+	blocked := NewClient(srv, -1)
+	require.Empty(t, execute(blocked, "blpop", "target", "0"))
+	execute(client, "rpush", "source", "x")
+	require.Equal(t, "+OK\r\n", execute(client, "rename", "source", "target"))
+	require.Equal(t, "*2\r\n$6\r\ntarget\r\n$1\r\nx\r\n", reply(blocked))
+
+	// RESTORE is propagated with the absolute TTL which is set.
+	_, dump, _ := strings.Cut(execute(client, "dump", "target"), "\r\n")
+	srv.aofBuf.Reset()
+	require.Equal(t, "+OK\r\n", execute(client, "restore", "restored", "100000", strings.TrimSuffix(dump, "\r\n")))
+	when := srv.dbs[0].Expire.Get("restored").(int64)
+	require.Equal(t, catAppendOnlyGenericCommand([]string{
+		"restore", "restored", strconv.FormatInt(when, 10), strings.TrimSuffix(dump, "\r\n"), "absttl",
+	}), srv.aofBuf.String())
+}
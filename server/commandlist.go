@@ -2,11 +2,21 @@ package server
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/IfanTsai/metis/database"
 	"github.com/IfanTsai/metis/datastruct"
 	"github.com/pkg/errors"
 )
 
+type listWhere uint8
+
+const (
+	listHead listWhere = iota // the left side of the list
+	listTail                  // the right side of the list
+)
+
 func lPushCommand(client *Client) error {
 	key := client.args[1]
 
@@ -20,6 +30,10 @@ func lPushCommand(client *Client) error {
 		client.srv.dirty++
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyList, "lpush", key, client.db.ID)
+	signalKeyAsReady(client.srv, client.db.ID, key)
+
 	return client.addReplyInt(int64(list.Len()))
 }
 
@@ -36,6 +50,10 @@ func rPushCommand(client *Client) error {
 		client.srv.dirty++
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyList, "rpush", key, client.db.ID)
+	signalKeyAsReady(client.srv, client.db.ID, key)
+
 	return client.addReplyInt(int64(list.Len()))
 }
 
@@ -55,6 +73,8 @@ func lPopCommand(client *Client) error {
 		return client.addReplyNull()
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyList, "lpop", key, client.db.ID)
 	client.srv.dirty++
 
 	return client.addReplyBulkString(list.PopFront().(string))
@@ -76,6 +96,8 @@ func rPopCommand(client *Client) error {
 		return client.addReplyNull()
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyList, "rpop", key, client.db.ID)
 	client.srv.dirty++
 
 	return client.addReplyBulkString(list.PopBack().(string))
@@ -191,3 +213,259 @@ func getQuickListIfExist(client *Client, key string) (*datastruct.Quicklist, err
 
 	return list, nil
 }
+
+func blPopCommand(client *Client) error {
+	return blockingPopGenericCommand(client, listHead)
+}
+
+func brPopCommand(client *Client) error {
+	return blockingPopGenericCommand(client, listTail)
+}
+
+// blockingPopGenericCommand implements BLPOP and BRPOP. The element is popped from the first non empty
+// list of the keys, or the client is blocked until one of the lists is pushed.
+func blockingPopGenericCommand(client *Client, where listWhere) error {
+	keys := client.args[1 : len(client.args)-1]
+
+	timeout, err := parseBlockTimeout(client.args[len(client.args)-1], time.Second)
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	for _, key := range keys {
+		list, err := getQuickListIfExist(client, key)
+		if err != nil {
+			if errors.Is(err, errNotExist) {
+				continue
+			}
+
+			return client.addReplyError(err.Error())
+		}
+
+		if list.Len() == 0 {
+			continue
+		}
+
+		value := listTypePop(client.srv, client.db, key, list, where)
+
+		// propagate the plain pop instead of the blocking one.
+		client.args = []string{listPopCommandName(where), key}
+
+		return client.addReplyArrays([]string{key, value})
+	}
+
+	// the client can't be blocked in a transaction.
+	if client.flags&clientFlagMulti != 0 {
+		return client.addReplyNullArray()
+	}
+
+	client.blockListWhere = where
+	client.blockListMove = false
+	blockForKeys(client, blockList, keys, timeout)
+
+	return nil
+}
+
+func lMoveCommand(client *Client) error {
+	wherefrom, ok := parseListWhere(client.args[3])
+	if !ok {
+		return client.addReplyError("syntax error")
+	}
+
+	whereto, ok := parseListWhere(client.args[4])
+	if !ok {
+		return client.addReplyError("syntax error")
+	}
+
+	return lMoveGenericCommand(client, wherefrom, whereto)
+}
+
+// lMoveGenericCommand moves an element from the source list to the destination list, it replies
+// null if the source list is empty.
+func lMoveGenericCommand(client *Client, wherefrom, whereto listWhere) error {
+	src, dst := client.args[1], client.args[2]
+
+	list, err := getQuickListIfExist(client, src)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyNull()
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	if list.Len() == 0 {
+		return client.addReplyNull()
+	}
+
+	if _, err := expireIfNeeded(client, dst); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	value, err := listTypeMove(client.srv, client.db, src, list, dst, wherefrom, whereto)
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	return client.addReplyBulkString(value)
+}
+
+func blMoveCommand(client *Client) error {
+	src, dst := client.args[1], client.args[2]
+
+	wherefrom, ok := parseListWhere(client.args[3])
+	if !ok {
+		return client.addReplyError("syntax error")
+	}
+
+	whereto, ok := parseListWhere(client.args[4])
+	if !ok {
+		return client.addReplyError("syntax error")
+	}
+
+	timeout, err := parseBlockTimeout(client.args[5], time.Second)
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	list, err := getQuickListIfExist(client, src)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	if list != nil && list.Len() > 0 {
+		// propagate LMOVE instead of the blocking one.
+		client.args = client.args[:5]
+		client.args[0] = "lmove"
+
+		return lMoveGenericCommand(client, wherefrom, whereto)
+	}
+
+	// the client can't be blocked in a transaction.
+	if client.flags&clientFlagMulti != 0 {
+		return client.addReplyNull()
+	}
+
+	client.blockListWhere = wherefrom
+	client.blockListMove = true
+	client.blockListTarget = dst
+	client.blockListTargetWhere = whereto
+	blockForKeys(client, blockList, []string{src}, timeout)
+
+	return nil
+}
+
+// serveClientBlockedOnList serves the client blocked by the key with the list which was just pushed,
+// the pop is propagated as a plain one.
+func serveClientBlockedOnList(client *Client, key string, list *datastruct.Quicklist) {
+	srv := client.srv
+	db := client.db
+
+	var args []string
+	if client.blockListMove {
+		value, err := listTypeMove(srv, db, key, list, client.blockListTarget, client.blockListWhere,
+			client.blockListTargetWhere)
+		if err != nil {
+			_ = client.addReplyError(err.Error())
+		} else {
+			_ = client.addReplyBulkString(value)
+			args = []string{"lmove", key, client.blockListTarget,
+				listWhereName(client.blockListWhere), listWhereName(client.blockListTargetWhere)}
+		}
+	} else {
+		value := listTypePop(srv, db, key, list, client.blockListWhere)
+		_ = client.addReplyArrays([]string{key, value})
+		args = []string{listPopCommandName(client.blockListWhere), key}
+	}
+
+	if args != nil {
+		propagate(srv, db.ID, args)
+		client.replWriteOffset = srv.masterReplOffset
+	}
+
+	unblockClient(client)
+}
+
+// listTypePop pops an element from the list, and signals the modification of the key.
+func listTypePop(srv *Server, db *database.Databse, key string, list *datastruct.Quicklist, where listWhere) string {
+	var value any
+	if where == listHead {
+		value = list.PopFront()
+	} else {
+		value = list.PopBack()
+	}
+
+	srv.dirty++
+	touchWatchedKey(srv, db.ID, key)
+	notifyKeyspaceEvent(srv, notifyList, listPopCommandName(where), key, db.ID)
+
+	return value.(string)
+}
+
+// listTypePush pushes an element to the list, and signals the modification of the key.
+func listTypePush(srv *Server, db *database.Databse, key string, list *datastruct.Quicklist, value string,
+	where listWhere,
+) {
+	event := "lpush"
+	if where == listHead {
+		list.PushFront(value)
+	} else {
+		list.PushBack(value)
+		event = "rpush"
+	}
+
+	srv.dirty++
+	touchWatchedKey(srv, db.ID, key)
+	notifyKeyspaceEvent(srv, notifyList, event, key, db.ID)
+	signalKeyAsReady(srv, db.ID, key)
+}
+
+// listTypeMove pops an element from the source list and pushes it to the destination list,
+// which is created if it doesn't exist.
+func listTypeMove(srv *Server, db *database.Databse, src string, srcList *datastruct.Quicklist, dst string,
+	wherefrom, whereto listWhere,
+) (string, error) {
+	dstValue := db.Dict.Get(dst)
+	dstList, ok := dstValue.(*datastruct.Quicklist)
+	if dstValue != nil && !ok {
+		return "", errWrongType
+	}
+
+	value := listTypePop(srv, db, src, srcList, wherefrom)
+
+	if dstList == nil {
+		dstList = datastruct.NewQuicklist()
+		db.Dict.Set(dst, dstList)
+	}
+
+	listTypePush(srv, db, dst, dstList, value, whereto)
+
+	return value, nil
+}
+
+func parseListWhere(arg string) (listWhere, bool) {
+	switch strings.ToLower(arg) {
+	case "left":
+		return listHead, true
+	case "right":
+		return listTail, true
+	default:
+		return listHead, false
+	}
+}
+
+func listWhereName(where listWhere) string {
+	if where == listHead {
+		return "left"
+	}
+
+	return "right"
+}
+
+func listPopCommandName(where listWhere) string {
+	if where == listHead {
+		return "lpop"
+	}
+
+	return "rpop"
+}
@@ -1,9 +1,25 @@
 package server
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 func bgRewriteAofCommand(client *Client) error {
 	srv := client.srv
 
+	if !srv.aofEnable {
+		return client.addReplyError("append only file is disabled")
+	}
+
+	if srv.backgroundTaskTypeAtomic.Load() == uint32(TypeBackgroundTaskAOFRewrite) {
+		return client.addReplyError("Background append only file rewriting already in progress")
+	}
+
 	if srv.backgroundTaskTypeAtomic.Load() != uint32(TypeBackgroundTaskNone) {
+		srv.aofRewriteScheduled = true
+
 		return client.addReplySimpleString("Background append only file rewriting scheduled")
 	}
 
@@ -11,3 +27,175 @@ func bgRewriteAofCommand(client *Client) error {
 
 	return client.addReplySimpleString("Background append only file rewriting started")
 }
+
+func saveCommand(client *Client) error {
+	if client.srv.backgroundTaskTypeAtomic.Load() == uint32(TypeBackgroundTaskRDB) {
+		return client.addReplyError("Background save already in progress")
+	}
+
+	if err := rdbSave(client.srv); err != nil {
+		return client.addReplyErrorf("failed to save: %v", err)
+	}
+
+	return client.addReplyOK()
+}
+
+func bgSaveCommand(client *Client) error {
+	switch TypeBackgroundTask(client.srv.backgroundTaskTypeAtomic.Load()) {
+	case TypeBackgroundTaskRDB:
+		return client.addReplyError("Background save already in progress")
+	case TypeBackgroundTaskAOFRewrite:
+		return client.addReplyError("An AOF log rewriting in progress: can't BGSAVE right now")
+	}
+
+	if !rdbSaveBackground(client.srv) {
+		return client.addReplyError("Background save already in progress")
+	}
+
+	return client.addReplySimpleString("Background saving started")
+}
+
+func lastSaveCommand(client *Client) error {
+	return client.addReplyInt(client.srv.lastSaveTime.Unix())
+}
+
+// infoSections is the list of sections of INFO command in the order of output.
+var infoSections = []struct {
+	name string
+	gen  func(srv *Server) string
+}{
+	{"persistence", genPersistenceInfo},
+	{"replication", genReplicationInfo},
+	{"cluster", genClusterInfo},
+}
+
+func infoCommand(client *Client) error {
+	if len(client.args) > 2 {
+		return client.addReplyError("syntax error")
+	}
+
+	section := "default"
+	if len(client.args) == 2 {
+		section = strings.ToLower(client.args[1])
+	}
+
+	var sb strings.Builder
+	for _, infoSection := range infoSections {
+		if section != "default" && section != "all" && section != infoSection.name {
+			continue
+		}
+
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+
+		sb.WriteString("# ")
+		sb.WriteString(strings.ToUpper(infoSection.name[:1]) + infoSection.name[1:])
+		sb.WriteString("\r\n")
+		sb.WriteString(infoSection.gen(client.srv))
+	}
+
+	return client.addReplyBulkString(sb.String())
+}
+
+func genPersistenceInfo(srv *Server) string {
+	backgroundTaskType := TypeBackgroundTask(srv.backgroundTaskTypeAtomic.Load())
+
+	lastBgSaveStatus := "ok"
+	if !srv.lastBgSaveOK {
+		lastBgSaveStatus = "err"
+	}
+
+	return fmt.Sprintf("rdb_changes_since_last_save:%d\r\n"+
+		"rdb_bgsave_in_progress:%d\r\n"+
+		"rdb_last_save_time:%d\r\n"+
+		"rdb_last_bgsave_status:%s\r\n"+
+		"aof_enabled:%d\r\n"+
+		"aof_rewrite_in_progress:%d\r\n"+
+		"aof_rewrite_scheduled:%d\r\n"+
+		"aof_current_size:%d\r\n"+
+		"aof_base_size:%d\r\n",
+		srv.dirty,
+		boolToInt(backgroundTaskType == TypeBackgroundTaskRDB),
+		srv.lastSaveTime.Unix(),
+		lastBgSaveStatus,
+		boolToInt(srv.aofEnable),
+		boolToInt(backgroundTaskType == TypeBackgroundTaskAOFRewrite),
+		boolToInt(srv.aofRewriteScheduled),
+		srv.aofCurrentSize,
+		srv.aofRewriteBaseSize,
+	)
+}
+
+func genClusterInfo(srv *Server) string {
+	return fmt.Sprintf("cluster_enabled:%d\r\n", boolToInt(srv.cluster != nil))
+}
+
+func genReplicationInfo(srv *Server) string {
+	var sb strings.Builder
+
+	if srv.masterHost == "" {
+		sb.WriteString("role:master\r\n")
+	} else {
+		masterLinkStatus := "down"
+		masterLastIOSecondsAgo := int64(-1)
+		if srv.replState == replStateConnected {
+			masterLinkStatus = "up"
+			masterLastIOSecondsAgo = int64(time.Since(srv.master.lastInteraction).Seconds())
+		}
+
+		fmt.Fprintf(&sb, "role:slave\r\n"+
+			"master_host:%s\r\n"+
+			"master_port:%d\r\n"+
+			"master_link_status:%s\r\n"+
+			"master_last_io_seconds_ago:%d\r\n"+
+			"master_sync_in_progress:%d\r\n",
+			srv.masterHost,
+			srv.masterPort,
+			masterLinkStatus,
+			masterLastIOSecondsAgo,
+			boolToInt(srv.replState == replStateTransfer),
+		)
+	}
+
+	fmt.Fprintf(&sb, "connected_slaves:%d\r\n", len(srv.replicas))
+	for i, replica := range srv.replicas {
+		fmt.Fprintf(&sb, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, clientIP(replica), replica.replListeningPort, replica.replState,
+			replica.replAckOffset, int64(time.Since(replica.replAckTime).Seconds()))
+	}
+
+	var replBacklogFirstByteOffset, replBacklogHistLen int64
+	if srv.replBacklog != nil {
+		replBacklogFirstByteOffset = srv.replBacklog.firstOffset()
+		replBacklogHistLen = int64(srv.replBacklog.histLen)
+	}
+
+	fmt.Fprintf(&sb, "master_replid:%s\r\n"+
+		"master_replid2:%s\r\n"+
+		"master_repl_offset:%d\r\n"+
+		"second_repl_offset:%d\r\n"+
+		"repl_backlog_active:%d\r\n"+
+		"repl_backlog_size:%d\r\n"+
+		"repl_backlog_first_byte_offset:%d\r\n"+
+		"repl_backlog_histlen:%d\r\n",
+		srv.replID,
+		srv.replID2,
+		srv.masterReplOffset,
+		srv.secondReplOffset,
+		boolToInt(srv.replBacklog != nil),
+		srv.replBacklogSize,
+		replBacklogFirstByteOffset,
+		replBacklogHistLen,
+	)
+
+	return sb.String()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
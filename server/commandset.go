@@ -23,6 +23,9 @@ func sAddCommand(client *Client) error {
 		client.srv.dirty++
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifySet, "sadd", key, client.db.ID)
+
 	return client.addReplyInt(created)
 }
 
@@ -46,6 +49,11 @@ func sRemCommand(client *Client) error {
 		}
 	}
 
+	if deleted > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifySet, "srem", key, client.db.ID)
+	}
+
 	return client.addReplyInt(deleted)
 }
 
@@ -70,6 +78,8 @@ func sPopCommand(client *Client) error {
 		return client.addReplyErrorf("delete random member error: %v", err)
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifySet, "spop", key, client.db.ID)
 	client.srv.dirty++
 
 	return client.addReplyBulkString(randomMember.(string))
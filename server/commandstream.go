@@ -0,0 +1,1193 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/pkg/errors"
+)
+
+const (
+	streamIDInvalidErr   = "Invalid stream ID specified as stream command argument"
+	streamIDTooSmallErr  = "The ID specified in XADD is equal or smaller than the target stream top item"
+	streamIDZeroErr      = "The ID specified in XADD must be greater than 0-0"
+	streamExhaustedErr   = "The stream has exhausted the last possible ID, unable to add more items"
+	streamKeyRequiredErr = "The XGROUP subcommand requires the key to exist. " +
+		"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+	valueNotIntegerErr = "value is not an integer or out of range"
+)
+
+// streamReadResult is the entries read from a stream by XREAD or XREADGROUP.
+type streamReadResult struct {
+	key     string
+	entries []*datastruct.StreamEntry
+	ids     []datastruct.StreamID // the IDs of the entries, only used for the pending ones which may be trimmed
+}
+
+func xAddCommand(client *Client) error {
+	args := client.args
+	key := args[1]
+
+	noMkStream := false
+	maxLen := int64(-1)
+
+	// the options are followed by the ID.
+	i := 2
+parse:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nomkstream":
+			noMkStream = true
+		case "maxlen":
+			var errMsg string
+			if maxLen, i, errMsg = parseStreamMaxLen(args, i); errMsg != "" {
+				return client.addReplyError(errMsg)
+			}
+		default:
+			break parse
+		}
+	}
+
+	if i >= len(args) || len(args[i+1:]) == 0 || len(args[i+1:])%2 != 0 {
+		return client.addReplyError("wrong number of arguments for 'xadd' command")
+	}
+
+	stream, err := getStreamIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	if stream == nil && noMkStream {
+		return client.addReplyNull()
+	}
+
+	lastID := datastruct.StreamMinID
+	if stream != nil {
+		lastID = stream.LastID
+	}
+
+	id, errMsg := streamGenerateID(args[i], lastID, time.Now().UnixMilli())
+	if errMsg != "" {
+		return client.addReplyError(errMsg)
+	}
+
+	if stream == nil {
+		stream = datastruct.NewStream()
+		client.db.Dict.Set(key, stream)
+	}
+
+	stream.Append(id, append([]string(nil), args[i+1:]...))
+
+	// propagate the generated ID instead of the auto one, so that the replicas and the AOF get the same entry.
+	client.args[i] = id.String()
+
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyStream, "xadd", key, client.db.ID)
+
+	if maxLen >= 0 && stream.TrimMaxLen(maxLen) > 0 {
+		notifyKeyspaceEvent(client.srv, notifyStream, "xtrim", key, client.db.ID)
+	}
+
+	signalKeyAsReady(client.srv, client.db.ID, key)
+	client.srv.dirty++
+
+	return client.addReplyBulkString(id.String())
+}
+
+func xLenCommand(client *Client) error {
+	stream, err := getStreamIfExist(client, client.args[1])
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyInt(0)
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	return client.addReplyInt(stream.Len())
+}
+
+func xRangeCommand(client *Client) error {
+	return xRangeGenericCommand(client, false)
+}
+
+func xRevRangeCommand(client *Client) error {
+	return xRangeGenericCommand(client, true)
+}
+
+// xRangeGenericCommand implements XRANGE key start end [COUNT count] and XREVRANGE key end start [COUNT count],
+// an ID prefixed by "(" is exclusive.
+func xRangeGenericCommand(client *Client, reverse bool) error {
+	args := client.args
+
+	startArg, endArg := args[2], args[3]
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, exclusive, ok := parseStreamRangeID(startArg, 0)
+	if !ok {
+		return client.addReplyError(streamIDInvalidErr)
+	}
+
+	if exclusive {
+		if start, ok = start.Incr(); !ok {
+			return client.addReplyError("invalid start ID for the interval")
+		}
+	}
+
+	end, exclusive, ok := parseStreamRangeID(endArg, math.MaxUint64)
+	if !ok {
+		return client.addReplyError(streamIDInvalidErr)
+	}
+
+	if exclusive {
+		if end, ok = end.Decr(); !ok {
+			return client.addReplyError("invalid end ID for the interval")
+		}
+	}
+
+	count := int64(-1)
+	if len(args) > 4 {
+		if len(args) != 6 || !strings.EqualFold(args[4], "count") {
+			return client.addReplyError("syntax error")
+		}
+
+		var err error
+		if count, err = strconv.ParseInt(args[5], 10, 64); err != nil {
+			return client.addReplyError(valueNotIntegerErr)
+		}
+
+		if count <= 0 {
+			return client.addReplyEmpty()
+		}
+	}
+
+	stream, err := getStreamIfExist(client, args[1])
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyEmpty()
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	return client.addReplyStreamEntries(stream.Range(start, end, count, reverse), nil)
+}
+
+// xTrimCommand implements XTRIM key MAXLEN [~|=] threshold, the stream is always trimmed exactly.
+func xTrimCommand(client *Client) error {
+	args := client.args
+	key := args[1]
+
+	if !strings.EqualFold(args[2], "maxlen") {
+		return client.addReplyError("syntax error")
+	}
+
+	maxLen, next, errMsg := parseStreamMaxLen(args, 2)
+	if errMsg != "" {
+		return client.addReplyError(errMsg)
+	}
+
+	if next != len(args)-1 {
+		return client.addReplyError("syntax error")
+	}
+
+	stream, err := getStreamIfExist(client, key)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyInt(0)
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	removed := stream.TrimMaxLen(maxLen)
+	if removed > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyStream, "xtrim", key, client.db.ID)
+		client.srv.dirty++
+	}
+
+	return client.addReplyInt(removed)
+}
+
+// xreadGetKeys returns the keys after the STREAMS option of XREAD and XREADGROUP.
+func xreadGetKeys(args []string) []string {
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "group":
+			i += 2
+		case "count", "block":
+			i++
+		case "streams":
+			streams := args[i+1:]
+
+			return streams[:len(streams)/2]
+		}
+	}
+
+	return nil
+}
+
+func xReadCommand(client *Client) error {
+	return xReadGenericCommand(client, false)
+}
+
+func xReadGroupCommand(client *Client) error {
+	return xReadGenericCommand(client, true)
+}
+
+// xReadGenericCommand implements XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+// and XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...].
+// The client is blocked if there is no entry to read and BLOCK is given.
+func xReadGenericCommand(client *Client, xreadgroup bool) error {
+	args := client.args
+
+	count := int64(-1)
+	block, noAck := false, false
+	groupName, consumerName := "", ""
+	streamsIndex := 0
+
+	var timeout time.Time
+
+	for i := 1; i < len(args) && streamsIndex == 0; i++ {
+		moreArgs := len(args) - i - 1
+
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "count" && moreArgs > 0:
+			value, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return client.addReplyError(valueNotIntegerErr)
+			}
+
+			if value > 0 {
+				count = value
+			}
+
+			i++
+		case opt == "block" && moreArgs > 0:
+			var err error
+			if timeout, err = parseBlockTimeout(args[i+1], time.Millisecond); err != nil {
+				return client.addReplyError(err.Error())
+			}
+
+			block = true
+			i++
+		case opt == "group" && xreadgroup && moreArgs > 1:
+			groupName, consumerName = args[i+1], args[i+2]
+			i += 2
+		case opt == "noack" && xreadgroup:
+			noAck = true
+		case opt == "streams" && moreArgs > 0:
+			streamsIndex = i + 1
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	if streamsIndex == 0 {
+		return client.addReplyError("syntax error")
+	}
+
+	if xreadgroup && groupName == "" {
+		return client.addReplyError("Missing GROUP option for XREADGROUP")
+	}
+
+	streams := args[streamsIndex:]
+	if len(streams)%2 != 0 {
+		return client.addReplyErrorf("Unbalanced '%s' list of streams: "+
+			"for each stream key an ID or '$' must be specified.", strings.ToLower(args[0]))
+	}
+
+	keys, idArgs := streams[:len(streams)/2], streams[len(streams)/2:]
+	ids := make([]datastruct.StreamID, len(keys))
+	history := make([]bool, len(keys)) // XREADGROUP: the pending entries of the consumer are read
+	objs := make([]*datastruct.Stream, len(keys))
+	groups := make([]*datastruct.StreamCG, len(keys))
+
+	// check all the arguments before any consumer group is touched.
+	for i, key := range keys {
+		stream, err := getStreamIfExist(client, key)
+		if err != nil && !errors.Is(err, errNotExist) {
+			return client.addReplyError(err.Error())
+		}
+
+		objs[i] = stream
+
+		if xreadgroup {
+			if stream != nil {
+				groups[i] = stream.Group(groupName)
+			}
+
+			if groups[i] == nil {
+				return client.addReplyErrorCode("NOGROUP",
+					"No such key '"+key+"' or consumer group '"+groupName+"' in XREADGROUP with GROUP option")
+			}
+		}
+
+		switch idArg := idArgs[i]; {
+		case idArg == "$":
+			if xreadgroup {
+				return client.addReplyError("The $ ID is meaningless in the context of XREADGROUP: " +
+					"you want to read the history of this consumer by specifying a proper ID, " +
+					"or use the > ID to get new messages. The $ ID would just return an empty result set.")
+			}
+
+			if stream != nil {
+				ids[i] = stream.LastID
+			}
+		case idArg == ">":
+			if !xreadgroup {
+				return client.addReplyError("The > ID can be specified only when calling " +
+					"XREADGROUP using the GROUP <group> <consumer> option.")
+			}
+		default:
+			id, ok := parseStreamID(idArg, 0)
+			if !ok {
+				return client.addReplyError(streamIDInvalidErr)
+			}
+
+			ids[i] = id
+			history[i] = xreadgroup
+		}
+	}
+
+	// XREADGROUP propagates the deliveries as XCLAIM instead of itself.
+	if xreadgroup {
+		client.flags |= clientFlagPreventProp
+	}
+
+	now := time.Now().UnixMilli()
+	results := make([]streamReadResult, 0, len(keys))
+
+	for i, key := range keys {
+		stream := objs[i]
+
+		if !xreadgroup {
+			if stream == nil {
+				continue
+			}
+
+			start, ok := ids[i].Incr()
+			if !ok {
+				continue
+			}
+
+			if entries := stream.Range(start, datastruct.StreamMaxID, count, false); len(entries) > 0 {
+				results = append(results, streamReadResult{key: key, entries: entries})
+			}
+
+			continue
+		}
+
+		consumer := streamLookupConsumer(client, key, groupName, groups[i], consumerName, now)
+
+		// the pending entries of the consumer are replied even if there is none.
+		if history[i] {
+			entries, pendingIDs := streamReadConsumerPEL(client, key, stream, groupName, groups[i], consumer,
+				ids[i], count, now)
+			results = append(results, streamReadResult{key: key, entries: entries, ids: pendingIDs})
+
+			continue
+		}
+
+		entries := streamReadGroupNew(client, key, stream, groupName, groups[i], consumer, count, noAck, now)
+		if len(entries) > 0 {
+			results = append(results, streamReadResult{key: key, entries: entries})
+		}
+	}
+
+	if len(results) > 0 {
+		return addReplyStreamReadResults(client, results)
+	}
+
+	// the client can't be blocked in a transaction.
+	if !block || client.flags&clientFlagMulti != 0 {
+		return client.addReplyNullArray()
+	}
+
+	client.blockStreamIDs = make(map[string]datastruct.StreamID, len(keys))
+	for i, key := range keys {
+		client.blockStreamIDs[key] = ids[i]
+	}
+
+	client.blockStreamCount = count
+	client.blockStreamGroup = groupName
+	client.blockStreamConsumer = consumerName
+	client.blockStreamNoAck = noAck
+	blockForKeys(client, blockStream, keys, timeout)
+
+	return nil
+}
+
+// serveClientBlockedOnStream serves the client blocked by XREAD or XREADGROUP if there are new entries
+// in the stream which was just added.
+func serveClientBlockedOnStream(client *Client, key string, stream *datastruct.Stream) {
+	var entries []*datastruct.StreamEntry
+
+	if client.blockStreamGroup == "" {
+		start, ok := client.blockStreamIDs[key].Incr()
+		if !ok {
+			return
+		}
+
+		entries = stream.Range(start, datastruct.StreamMaxID, client.blockStreamCount, false)
+	} else {
+		group := stream.Group(client.blockStreamGroup)
+		if group == nil {
+			_ = client.addReplyErrorCode("NOGROUP", "the consumer group this client was blocked on no longer exists")
+			unblockClient(client)
+
+			return
+		}
+
+		now := time.Now().UnixMilli()
+		consumer := streamLookupConsumer(client, key, client.blockStreamGroup, group, client.blockStreamConsumer, now)
+		entries = streamReadGroupNew(client, key, stream, client.blockStreamGroup, group, consumer,
+			client.blockStreamCount, client.blockStreamNoAck, now)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	_ = addReplyStreamReadResults(client, []streamReadResult{{key: key, entries: entries}})
+	unblockClient(client)
+}
+
+// streamLookupConsumer returns the consumer of the group, which is created if it doesn't exist.
+func streamLookupConsumer(client *Client, key, groupName string, group *datastruct.StreamCG, name string,
+	now int64,
+) *datastruct.StreamConsumer {
+	consumer, created := group.Consumer(name, true, now)
+	consumer.SeenTime = now
+
+	if created {
+		client.srv.dirty++
+		notifyKeyspaceEvent(client.srv, notifyStream, "xgroup-createconsumer", key, client.db.ID)
+		streamPropagate(client, []string{"xgroup", "createconsumer", key, groupName, name})
+	}
+
+	return consumer
+}
+
+// streamReadGroupNew delivers the entries never delivered to the group to the consumer, they are added to
+// the pending entries of the consumer unless noAck is true.
+func streamReadGroupNew(client *Client, key string, stream *datastruct.Stream, groupName string,
+	group *datastruct.StreamCG, consumer *datastruct.StreamConsumer, count int64, noAck bool, now int64,
+) []*datastruct.StreamEntry {
+	start, ok := group.LastID.Incr()
+	if !ok {
+		return nil
+	}
+
+	entries := stream.Range(start, datastruct.StreamMaxID, count, false)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	group.LastID = entries[len(entries)-1].ID
+	client.srv.dirty++
+
+	if noAck {
+		streamPropagate(client, []string{"xgroup", "setid", key, groupName, group.LastID.String()})
+
+		return entries
+	}
+
+	for _, entry := range entries {
+		nack := group.Claim(entry.ID, consumer, now)
+		nack.DeliveryCount = 1
+		streamPropagateClaim(client, key, groupName, group, entry.ID, nack)
+	}
+
+	return entries
+}
+
+// streamReadConsumerPEL delivers the pending entries of the consumer with IDs greater than after again,
+// the entries trimmed from the stream are nil.
+func streamReadConsumerPEL(client *Client, key string, stream *datastruct.Stream, groupName string,
+	group *datastruct.StreamCG, consumer *datastruct.StreamConsumer, after datastruct.StreamID, count, now int64,
+) ([]*datastruct.StreamEntry, []datastruct.StreamID) {
+	var (
+		entries []*datastruct.StreamEntry
+		ids     []datastruct.StreamID
+	)
+
+	start, ok := after.Incr()
+	if !ok {
+		return entries, ids
+	}
+
+	for _, id := range datastruct.PendingIDs(consumer.PEL) {
+		if id.Compare(start) < 0 {
+			continue
+		}
+
+		if count > 0 && int64(len(ids)) >= count {
+			break
+		}
+
+		nack := consumer.PEL[id]
+		nack.DeliveryTime = now
+		nack.DeliveryCount++
+		streamPropagateClaim(client, key, groupName, group, id, nack)
+
+		entries = append(entries, stream.Get(id))
+		ids = append(ids, id)
+	}
+
+	if len(ids) > 0 {
+		client.srv.dirty++
+	}
+
+	return entries, ids
+}
+
+// streamPropagateClaim propagates the delivery of the pending entry as XCLAIM with the exact delivery time
+// and count, so that the pending entries are the same when it's replayed.
+func streamPropagateClaim(client *Client, key, groupName string, group *datastruct.StreamCG, id datastruct.StreamID,
+	nack *datastruct.StreamNACK,
+) {
+	streamPropagate(client, []string{
+		"xclaim", key, groupName, nack.Consumer.Name, "0", id.String(),
+		"time", strconv.FormatInt(nack.DeliveryTime, 10),
+		"retrycount", strconv.FormatUint(nack.DeliveryCount, 10),
+		"force", "justid", "lastid", group.LastID.String(),
+	})
+}
+
+// streamPropagate propagates the command which is executed in place of the one of the client.
+func streamPropagate(client *Client, args []string) {
+	execPropagateMulti(client)
+	propagate(client.srv, client.db.ID, args)
+	client.replWriteOffset = client.srv.masterReplOffset
+}
+
+func addReplyStreamReadResults(client *Client, results []streamReadResult) error {
+	if err := client.addReplyStringf("*%d\r\n", len(results)); err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if err := client.addReplyString("*2\r\n"); err != nil {
+			return err
+		}
+
+		if err := client.addReplyBulkString(result.key); err != nil {
+			return err
+		}
+
+		if err := client.addReplyStreamEntries(result.entries, result.ids); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// xGroupCommand implements XGROUP CREATE key group id|$ [MKSTREAM], XGROUP SETID key group id|$,
+// XGROUP DESTROY key group, XGROUP CREATECONSUMER key group consumer and XGROUP DELCONSUMER key group consumer.
+func xGroupCommand(client *Client) error {
+	args := client.args
+	subcommand := strings.ToLower(args[1])
+
+	switch {
+	case subcommand == "create" && (len(args) == 5 || len(args) == 6):
+	case (subcommand == "setid" || subcommand == "createconsumer" || subcommand == "delconsumer") && len(args) == 5:
+	case subcommand == "destroy" && len(args) == 4:
+	default:
+		return client.addReplyErrorf("Unknown XGROUP subcommand or wrong number of arguments for '%s'", args[1])
+	}
+
+	key, groupName := args[2], args[3]
+
+	mkStream := false
+	if len(args) == 6 {
+		if !strings.EqualFold(args[5], "mkstream") {
+			return client.addReplyError("syntax error")
+		}
+
+		mkStream = true
+	}
+
+	stream, err := getStreamIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	if stream == nil && !mkStream {
+		return client.addReplyError(streamKeyRequiredErr)
+	}
+
+	var group *datastruct.StreamCG
+	if subcommand != "create" && subcommand != "destroy" {
+		if group = stream.Group(groupName); group == nil {
+			return client.addReplyErrorCode("NOGROUP",
+				"No such consumer group '"+groupName+"' for key name '"+key+"'")
+		}
+	}
+
+	switch subcommand {
+	case "create", "setid":
+		id := datastruct.StreamMinID
+		if args[4] == "$" {
+			if stream != nil {
+				id = stream.LastID
+			}
+		} else {
+			var ok bool
+			if id, ok = parseStreamID(args[4], 0); !ok {
+				return client.addReplyError(streamIDInvalidErr)
+			}
+		}
+
+		// propagate the ID instead of "$".
+		client.args[4] = id.String()
+
+		if subcommand == "setid" {
+			group.LastID = id
+		} else {
+			if stream != nil && stream.Group(groupName) != nil {
+				return client.addReplyErrorCode("BUSYGROUP", "Consumer Group name already exists")
+			}
+
+			if stream == nil {
+				stream = datastruct.NewStream()
+				client.db.Dict.Set(key, stream)
+			}
+
+			stream.CreateGroup(groupName, id)
+		}
+
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyStream, "xgroup-"+subcommand, key, client.db.ID)
+		client.srv.dirty++
+
+		return client.addReplyOK()
+	case "destroy":
+		if !stream.DestroyGroup(groupName) {
+			return client.addReplyInt(0)
+		}
+
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyStream, "xgroup-destroy", key, client.db.ID)
+		client.srv.dirty++
+
+		// the clients blocked by the group are replied with an error.
+		signalKeyAsReady(client.srv, client.db.ID, key)
+
+		return client.addReplyInt(1)
+	case "createconsumer":
+		if _, created := group.Consumer(args[4], true, time.Now().UnixMilli()); !created {
+			return client.addReplyInt(0)
+		}
+
+		notifyKeyspaceEvent(client.srv, notifyStream, "xgroup-createconsumer", key, client.db.ID)
+		client.srv.dirty++
+
+		return client.addReplyInt(1)
+	default:
+		pending := group.DeleteConsumer(args[4])
+		if pending < 0 {
+			return client.addReplyInt(0)
+		}
+
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyStream, "xgroup-delconsumer", key, client.db.ID)
+		client.srv.dirty++
+
+		return client.addReplyInt(pending)
+	}
+}
+
+// xAckCommand implements XACK key group id [id ...], it replies the number of the entries acknowledged.
+func xAckCommand(client *Client) error {
+	args := client.args
+
+	ids := make([]datastruct.StreamID, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		id, ok := parseStreamID(arg, 0)
+		if !ok {
+			return client.addReplyError(streamIDInvalidErr)
+		}
+
+		ids = append(ids, id)
+	}
+
+	stream, err := getStreamIfExist(client, args[1])
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyInt(0)
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	group := stream.Group(args[2])
+	if group == nil {
+		return client.addReplyInt(0)
+	}
+
+	var acked int64
+	for _, id := range ids {
+		if group.Ack(id) {
+			acked++
+		}
+	}
+
+	client.srv.dirty += acked
+
+	return client.addReplyInt(acked)
+}
+
+// xPendingCommand implements XPENDING key group [[IDLE min-idle-time] start end count [consumer]].
+// Without the range, the summary of the pending entries is replied.
+func xPendingCommand(client *Client) error {
+	args := client.args
+	key, groupName := args[1], args[2]
+
+	i := 3
+	minIdle := int64(0)
+
+	if len(args) > 3 && strings.EqualFold(args[3], "idle") {
+		if len(args) < 8 {
+			return client.addReplyError("syntax error")
+		}
+
+		var err error
+		if minIdle, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+			return client.addReplyError(valueNotIntegerErr)
+		}
+
+		i = 5
+	}
+
+	if len(args) != 3 && len(args)-i != 3 && len(args)-i != 4 {
+		return client.addReplyError("syntax error")
+	}
+
+	stream, err := getStreamIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	var group *datastruct.StreamCG
+	if stream != nil {
+		group = stream.Group(groupName)
+	}
+
+	if group == nil {
+		return client.addReplyErrorCode("NOGROUP", "No such key '"+key+"' or consumer group '"+groupName+"'")
+	}
+
+	if len(args) == 3 {
+		return addReplyStreamPendingSummary(client, group)
+	}
+
+	start, exclusive, ok := parseStreamRangeID(args[i], 0)
+	if !ok {
+		return client.addReplyError(streamIDInvalidErr)
+	}
+
+	if exclusive {
+		if start, ok = start.Incr(); !ok {
+			return client.addReplyError("invalid start ID for the interval")
+		}
+	}
+
+	end, exclusive, ok := parseStreamRangeID(args[i+1], math.MaxUint64)
+	if !ok {
+		return client.addReplyError(streamIDInvalidErr)
+	}
+
+	if exclusive {
+		if end, ok = end.Decr(); !ok {
+			return client.addReplyError("invalid end ID for the interval")
+		}
+	}
+
+	count, err := strconv.ParseInt(args[i+2], 10, 64)
+	if err != nil {
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	pel := group.PEL
+	if len(args)-i == 4 {
+		consumer, _ := group.Consumer(args[i+3], false, 0)
+		if consumer == nil {
+			return client.addReplyEmpty()
+		}
+
+		pel = consumer.PEL
+	}
+
+	now := time.Now().UnixMilli()
+
+	var replies []string
+	for _, id := range datastruct.PendingIDs(pel) {
+		if int64(len(replies)) >= count || id.Compare(end) > 0 {
+			break
+		}
+
+		nack := pel[id]
+		idle := now - nack.DeliveryTime
+		if id.Compare(start) < 0 || idle < minIdle {
+			continue
+		}
+
+		replies = append(replies, "*4\r\n"+
+			"$"+strconv.Itoa(len(id.String()))+"\r\n"+id.String()+"\r\n"+
+			"$"+strconv.Itoa(len(nack.Consumer.Name))+"\r\n"+nack.Consumer.Name+"\r\n"+
+			":"+strconv.FormatInt(idle, 10)+"\r\n"+
+			":"+strconv.FormatUint(nack.DeliveryCount, 10)+"\r\n")
+	}
+
+	if err := client.addReplyStringf("*%d\r\n", len(replies)); err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		if err := client.addReplyString(reply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addReplyStreamPendingSummary replies the number of the pending entries, the smallest and the greatest IDs
+// and the number of the pending entries of every consumer.
+func addReplyStreamPendingSummary(client *Client, group *datastruct.StreamCG) error {
+	if len(group.PEL) == 0 {
+		return client.addReplyString("*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n")
+	}
+
+	ids := datastruct.PendingIDs(group.PEL)
+	if err := client.addReplyStringf("*4\r\n:%d\r\n", len(ids)); err != nil {
+		return err
+	}
+
+	if err := client.addReplyBulkString(ids[0].String()); err != nil {
+		return err
+	}
+
+	if err := client.addReplyBulkString(ids[len(ids)-1].String()); err != nil {
+		return err
+	}
+
+	var consumers []*datastruct.StreamConsumer
+	for _, name := range group.ConsumerNames() {
+		if consumer, _ := group.Consumer(name, false, 0); len(consumer.PEL) > 0 {
+			consumers = append(consumers, consumer)
+		}
+	}
+
+	if err := client.addReplyStringf("*%d\r\n", len(consumers)); err != nil {
+		return err
+	}
+
+	for _, consumer := range consumers {
+		if err := client.addReplyArrays([]string{consumer.Name, strconv.Itoa(len(consumer.PEL))}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// xClaimCommand implements XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-ms]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id]. The pending entries idle for at least min-idle-time are
+// assigned to the consumer, FORCE creates the pending entries which don't exist.
+func xClaimCommand(client *Client) error {
+	args := client.args
+	key, groupName, consumerName := args[1], args[2], args[3]
+
+	minIdle, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return client.addReplyError("Invalid min-idle-time argument for XCLAIM")
+	}
+
+	// the IDs are followed by the options.
+	i := 5
+
+	var ids []datastruct.StreamID
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i], 0)
+		if !ok {
+			break
+		}
+
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return client.addReplyError(streamIDInvalidErr)
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID, hasLastID := false, false, false
+	lastID := datastruct.StreamMinID
+
+	for ; i < len(args); i++ {
+		moreArgs := len(args) - i - 1
+
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "force":
+			force = true
+		case opt == "justid":
+			justID = true
+		case (opt == "idle" || opt == "time" || opt == "retrycount") && moreArgs > 0:
+			value, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return client.addReplyError(valueNotIntegerErr)
+			}
+
+			switch opt {
+			case "idle":
+				deliveryTime = now - value
+			case "time":
+				deliveryTime = value
+			default:
+				retryCount = value
+			}
+
+			i++
+		case opt == "lastid" && moreArgs > 0:
+			var ok bool
+			if lastID, ok = parseStreamID(args[i+1], 0); !ok {
+				return client.addReplyError(streamIDInvalidErr)
+			}
+
+			hasLastID = true
+			i++
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	stream, err := getStreamIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	var group *datastruct.StreamCG
+	if stream != nil {
+		group = stream.Group(groupName)
+	}
+
+	if group == nil {
+		return client.addReplyErrorCode("NOGROUP", "No such key '"+key+"' or consumer group '"+groupName+"'")
+	}
+
+	// the claims are propagated with the exact delivery time and count instead of the command.
+	client.flags |= clientFlagPreventProp
+
+	lastIDChanged := hasLastID && lastID.Compare(group.LastID) > 0
+	if lastIDChanged {
+		group.LastID = lastID
+		client.srv.dirty++
+	}
+
+	consumer, _ := group.Consumer(consumerName, true, now)
+	consumer.SeenTime = now
+
+	var claimed []*datastruct.StreamEntry
+	for _, id := range ids {
+		nack, ok := group.PEL[id]
+		entry := stream.Get(id)
+
+		// the pending entries trimmed from the stream are only created by FORCE when the AOF is loaded,
+		// since they are written so by the AOF rewrite.
+		restore := force && entry == nil && client.flags&clientFlagAofLoading != 0
+
+		switch {
+		case !ok && (!force || entry == nil) && !restore:
+			continue
+		case ok && entry == nil:
+			// the entry was trimmed from the stream, so it can't be claimed anymore.
+			group.Ack(id)
+			client.srv.dirty++
+			streamPropagate(client, []string{"xack", key, groupName, id.String()})
+
+			continue
+		case ok && minIdle > 0 && now-nack.DeliveryTime < minIdle:
+			continue
+		}
+
+		nack = group.Claim(id, consumer, deliveryTime)
+		if retryCount >= 0 {
+			nack.DeliveryCount = uint64(retryCount)
+		} else if !justID {
+			nack.DeliveryCount++
+		}
+
+		client.srv.dirty++
+		streamPropagateClaim(client, key, groupName, group, id, nack)
+
+		if entry == nil {
+			entry = &datastruct.StreamEntry{ID: id}
+		}
+
+		claimed = append(claimed, entry)
+	}
+
+	if lastIDChanged && len(claimed) == 0 {
+		streamPropagate(client, []string{"xgroup", "setid", key, groupName, group.LastID.String()})
+	}
+
+	if !justID {
+		return client.addReplyStreamEntries(claimed, nil)
+	}
+
+	claimedIDs := make([]string, len(claimed))
+	for i, entry := range claimed {
+		claimedIDs[i] = entry.ID.String()
+	}
+
+	return client.addReplyArrays(claimedIDs)
+}
+
+func getStreamIfExist(client *Client, key string) (*datastruct.Stream, error) {
+	// check if key expired
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return nil, err
+	}
+
+	value := client.db.Dict.Get(key)
+	if value == nil {
+		return nil, errNotExist
+	}
+
+	stream, ok := value.(*datastruct.Stream)
+	if !ok {
+		return nil, errWrongType
+	}
+
+	return stream, nil
+}
+
+// parseStreamID parses a stream ID in the form of "<ms>-<seq>" or "<ms>", the sequence number is
+// missingSeq if it's omitted.
+func parseStreamID(arg string, missingSeq uint64) (datastruct.StreamID, bool) {
+	msStr, seqStr, hasSeq := strings.Cut(arg, "-")
+
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return datastruct.StreamMinID, false
+	}
+
+	seq := missingSeq
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqStr, 10, 64); err != nil {
+			return datastruct.StreamMinID, false
+		}
+	}
+
+	return datastruct.StreamID{Ms: ms, Seq: seq}, true
+}
+
+// parseStreamRangeID parses the ID of a range, which can be "-" and "+" for the minimum and the maximum IDs,
+// exclusive is true if the ID is prefixed by "(".
+func parseStreamRangeID(arg string, missingSeq uint64) (id datastruct.StreamID, exclusive, ok bool) {
+	switch arg {
+	case "-":
+		return datastruct.StreamMinID, false, true
+	case "+":
+		return datastruct.StreamMaxID, false, true
+	}
+
+	if strings.HasPrefix(arg, "(") {
+		arg = arg[1:]
+		exclusive = true
+	}
+
+	id, ok = parseStreamID(arg, missingSeq)
+
+	return id, exclusive, ok
+}
+
+// parseStreamMaxLen parses MAXLEN [~|=] threshold at the index of MAXLEN, it returns the index of the threshold.
+// The approximate trimming is always done exactly.
+func parseStreamMaxLen(args []string, i int) (int64, int, string) {
+	i++
+	if i < len(args) && (args[i] == "~" || args[i] == "=") {
+		i++
+	}
+
+	if i >= len(args) {
+		return 0, i, "syntax error"
+	}
+
+	maxLen, err := strconv.ParseInt(args[i], 10, 64)
+	if err != nil {
+		return 0, i, valueNotIntegerErr
+	}
+
+	if maxLen < 0 {
+		return 0, i, "The MAXLEN argument must be >= 0."
+	}
+
+	return maxLen, i, ""
+}
+
+// streamGenerateID returns the ID of the entry to be added by XADD, which is "*" for an auto generated one,
+// "<ms>-*" for an auto generated sequence number, or an explicit ID greater than the last one.
+func streamGenerateID(arg string, lastID datastruct.StreamID, now int64) (datastruct.StreamID, string) {
+	if arg == "*" {
+		id := datastruct.StreamID{Ms: uint64(now), Seq: 0}
+		if id.Compare(lastID) <= 0 {
+			next, ok := lastID.Incr()
+			if !ok {
+				return id, streamExhaustedErr
+			}
+
+			id = next
+		}
+
+		return id, ""
+	}
+
+	if msStr, found := strings.CutSuffix(arg, "-*"); found {
+		ms, err := strconv.ParseUint(msStr, 10, 64)
+		if err != nil {
+			return datastruct.StreamMinID, streamIDInvalidErr
+		}
+
+		id := datastruct.StreamID{Ms: ms, Seq: 0}
+		if id.Compare(lastID) <= 0 {
+			if ms != lastID.Ms || lastID.Seq == math.MaxUint64 {
+				return id, streamIDTooSmallErr
+			}
+
+			id.Seq = lastID.Seq + 1
+		}
+
+		return id, ""
+	}
+
+	id, ok := parseStreamID(arg, 0)
+	if !ok {
+		return id, streamIDInvalidErr
+	}
+
+	if id == datastruct.StreamMinID {
+		return id, streamIDZeroErr
+	}
+
+	if id.Compare(lastID) <= 0 {
+		return id, streamIDTooSmallErr
+	}
+
+	return id, ""
+}
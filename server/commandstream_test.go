@@ -0,0 +1,283 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+// streamState describes the entries and the consumer groups of the stream, which is used to compare streams.
+func streamState(stream *datastruct.Stream) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "len=%d last=%s\n", stream.Len(), stream.LastID)
+	for _, entry := range stream.Range(datastruct.StreamMinID, datastruct.StreamMaxID, -1, false) {
+		fmt.Fprintf(&sb, "%s %v\n", entry.ID, entry.Fields)
+	}
+
+	for _, name := range stream.GroupNames() {
+		group := stream.Group(name)
+		fmt.Fprintf(&sb, "group=%s last=%s consumers=%v\n", name, group.LastID, group.ConsumerNames())
+
+		for _, id := range datastruct.PendingIDs(group.PEL) {
+			nack := group.PEL[id]
+			fmt.Fprintf(&sb, "%s %s %d %d\n", id, nack.Consumer.Name, nack.DeliveryTime, nack.DeliveryCount)
+		}
+	}
+
+	return sb.String()
+}
+
+func TestStreamCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, "$3\r\n1-1\r\n", execute(client, "xadd", "s", "1-1", "a", "1"))
+	require.Equal(t, "$3\r\n1-2\r\n", execute(client, "xadd", "s", "1-*", "b", "2"))
+	require.Equal(t, "$3\r\n2-0\r\n", execute(client, "xadd", "s", "2", "c", "3"))
+	require.Equal(t, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n",
+		execute(client, "xadd", "s", "2-0", "d", "4"))
+	require.Equal(t, "-ERR The ID specified in XADD must be greater than 0-0\r\n",
+		execute(client, "xadd", "other", "0-0", "d", "4"))
+	require.Equal(t, "-ERR Invalid stream ID specified as stream command argument\r\n",
+		execute(client, "xadd", "s", "x", "d", "4"))
+	require.Equal(t, "-ERR wrong number of arguments\r\n",
+		execute(client, "xadd", "s", "*", "d"))
+	require.Equal(t, "$-1\r\n", execute(client, "xadd", "other", "nomkstream", "*", "d", "4"))
+	require.Equal(t, ":3\r\n", execute(client, "xlen", "s"))
+	require.Equal(t, ":0\r\n", execute(client, "xlen", "other"))
+
+	// the auto generated ID is propagated.
+	srv.aofBuf.Reset()
+	id := strings.Split(execute(client, "xadd", "s", "*", "d", "4"), "\r\n")[1]
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"xadd", "s", id, "d", "4"}), srv.aofBuf.String())
+
+	require.Equal(t, "*2\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		execute(client, "xrange", "s", "-", "+", "count", "2"))
+	require.Equal(t, "*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		execute(client, "xrange", "s", "(1-1", "(2-0"))
+	require.Equal(t, "*2\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		execute(client, "xrevrange", "s", "2", "1-2"))
+	require.Equal(t, "*0\r\n", execute(client, "xrange", "missing", "-", "+"))
+
+	require.Equal(t, ":2\r\n", execute(client, "xtrim", "s", "maxlen", "~", "2"))
+	require.Equal(t, "$22\r\n18446744073709551615-0\r\n",
+		execute(client, "xadd", "s", "maxlen", "1", "18446744073709551615-0", "e", "5"))
+	require.Equal(t, ":1\r\n", execute(client, "xlen", "s"))
+
+	execute(client, "set", "string", "value")
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "xadd", "string", "*", "a", "1"))
+}
+
+func TestStreamConsumerGroup(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, "-ERR The XGROUP subcommand requires the key to exist. "+
+		"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n",
+		execute(client, "xgroup", "create", "s", "g", "$"))
+	require.Equal(t, "+OK\r\n", execute(client, "xgroup", "create", "s", "g", "$", "mkstream"))
+	require.Equal(t, "-BUSYGROUP Consumer Group name already exists\r\n",
+		execute(client, "xgroup", "create", "s", "g", "0"))
+
+	for i := 1; i <= 3; i++ {
+		execute(client, "xadd", "s", fmt.Sprintf("%d-0", i), "n", fmt.Sprint(i))
+	}
+
+	// the deliveries are propagated as XCLAIM instead of XREADGROUP.
+	srv.aofBuf.Reset()
+	require.Equal(t, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nn\r\n$1\r\n1\r\n"+
+		"*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nn\r\n$1\r\n2\r\n",
+		execute(client, "xreadgroup", "group", "g", "alice", "count", "2", "streams", "s", ">"))
+	require.NotContains(t, srv.aofBuf.String(), "xreadgroup")
+	require.Contains(t, srv.aofBuf.String(), "createconsumer")
+	require.Equal(t, 2, strings.Count(srv.aofBuf.String(), "xclaim"))
+
+	require.Equal(t, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nn\r\n$1\r\n3\r\n",
+		execute(client, "xreadgroup", "group", "g", "bob", "streams", "s", ">"))
+	require.Equal(t, "*-1\r\n", execute(client, "xreadgroup", "group", "g", "bob", "streams", "s", ">"))
+	require.Equal(t, "-NOGROUP No such key 's' or consumer group 'missing' in XREADGROUP with GROUP option\r\n",
+		execute(client, "xreadgroup", "group", "missing", "bob", "streams", "s", ">"))
+
+	require.Equal(t, "*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n*2\r\n$5\r\nalice\r\n$1\r\n2\r\n*2\r\n$3\r\nbob\r\n$1\r\n1\r\n",
+		execute(client, "xpending", "s", "g"))
+
+	// the history of the consumer is delivered again.
+	require.Equal(t, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nn\r\n$1\r\n2\r\n",
+		execute(client, "xreadgroup", "group", "g", "alice", "streams", "s", "1-0"))
+
+	pending := execute(client, "xpending", "s", "g", "-", "+", "10", "alice")
+	require.True(t, strings.HasPrefix(pending, "*2\r\n*4\r\n$3\r\n1-0\r\n$5\r\nalice\r\n:"), pending)
+	require.True(t, strings.HasSuffix(pending, ":2\r\n"), pending)
+
+	require.Equal(t, ":1\r\n", execute(client, "xack", "s", "g", "1-0", "9-0"))
+
+	// the pending entry is claimed by another consumer.
+	require.Equal(t, "*1\r\n$3\r\n2-0\r\n", execute(client, "xclaim", "s", "g", "bob", "0", "2-0", "1-0", "justid"))
+	require.Equal(t, "*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nn\r\n$1\r\n1\r\n",
+		execute(client, "xclaim", "s", "g", "bob", "0", "1-0", "force"))
+	require.Equal(t, "*0\r\n", execute(client, "xclaim", "s", "g", "bob", "3600000", "1-0"))
+
+	group := srv.dbs[0].Dict.Get("s").(*datastruct.Stream).Group("g")
+	require.Len(t, group.PEL, 3)
+	require.Equal(t, "bob", group.PEL[datastruct.StreamID{Ms: 1, Seq: 0}].Consumer.Name)
+	require.Equal(t, uint64(1), group.PEL[datastruct.StreamID{Ms: 1, Seq: 0}].DeliveryCount)
+	require.Equal(t, uint64(2), group.PEL[datastruct.StreamID{Ms: 2, Seq: 0}].DeliveryCount)
+
+	require.Equal(t, ":3\r\n", execute(client, "xgroup", "delconsumer", "s", "g", "bob"))
+	require.Equal(t, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n", execute(client, "xpending", "s", "g"))
+	require.Equal(t, ":1\r\n", execute(client, "xgroup", "destroy", "s", "g"))
+	require.Equal(t, ":0\r\n", execute(client, "xgroup", "destroy", "s", "g"))
+}
+
+func TestStreamBlockingRead(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, execute := newTestServer(t, &config.Config{})
+	reader := NewClient(srv, -1)
+	groupReader := NewClient(srv, -1)
+	writer := NewClient(srv, -1)
+
+	execute(writer, "xgroup", "create", "s", "g", "$", "mkstream")
+
+	require.Equal(t, "*-1\r\n", execute(reader, "xread", "streams", "s", "$"))
+	require.Empty(t, execute(reader, "xread", "block", "0", "streams", "other", "s", "$", "$"))
+	require.Empty(t, execute(groupReader, "xreadgroup", "group", "g", "alice", "block", "0", "streams", "s", ">"))
+	require.Equal(t, blockStream, reader.blockType)
+	require.Equal(t, blockStream, groupReader.blockType)
+
+	srv.aofBuf.Reset()
+	execute(writer, "xadd", "s", "1-0", "a", "1")
+	entry := "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n"
+	require.Equal(t, entry, reply(reader))
+	require.Equal(t, entry, reply(groupReader))
+	require.Equal(t, blockNone, reader.blockType)
+	require.Equal(t, blockNone, groupReader.blockType)
+	require.Contains(t, srv.aofBuf.String(), "xclaim")
+	require.Len(t, srv.dbs[0].Dict.Get("s").(*datastruct.Stream).Group("g").PEL, 1)
+
+	// the client blocked by a destroyed group is replied with an error.
+	require.Empty(t, execute(groupReader, "xreadgroup", "group", "g", "alice", "block", "0", "streams", "s", ">"))
+	execute(writer, "xgroup", "destroy", "s", "g")
+	require.Equal(t, "-NOGROUP the consumer group this client was blocked on no longer exists\r\n", reply(groupReader))
+
+	// the client isn't blocked in a transaction.
+	execute(reader, "multi")
+	execute(reader, "xread", "block", "0", "streams", "s", "$")
+	require.Equal(t, "*1\r\n*-1\r\n", execute(reader, "exec"))
+}
+
+func TestStreamPersistence(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	for i := 1; i <= 5; i++ {
+		execute(client, "xadd", "s", fmt.Sprintf("%d-0", i), "n", fmt.Sprint(i))
+	}
+
+	execute(client, "xgroup", "create", "s", "g1", "0")
+	execute(client, "xgroup", "create", "s", "g2", "$")
+	execute(client, "xgroup", "createconsumer", "s", "g2", "idle")
+	execute(client, "xreadgroup", "group", "g1", "alice", "count", "2", "streams", "s", ">")
+	execute(client, "xreadgroup", "group", "g1", "bob", "count", "1", "streams", "s", ">")
+	execute(client, "xadd", "empty", "maxlen", "0", "7-0", "x", "y")
+
+	// the pending entries are kept even if they are trimmed from the stream.
+	execute(client, "xtrim", "s", "maxlen", "3")
+
+	for _, key := range []string{"s", "empty"} {
+		stream := srv.dbs[0].Dict.Get(key).(*datastruct.Stream)
+
+		// DUMP and RESTORE
+		payload, err := rdbDumpObject(stream)
+		require.NoError(t, err)
+
+		value, err := rdbRestoreObject(payload)
+		require.NoError(t, err)
+		require.Equal(t, streamState(stream), streamState(value.(*datastruct.Stream)))
+
+		// the copy for the background saving
+		require.Equal(t, streamState(stream), streamState(stream.DeepCopy()))
+
+		// AOF rewrite
+		file, err := os.CreateTemp(t.TempDir(), "stream")
+		require.NoError(t, err)
+		require.NoError(t, rewriteStreamObject(file, key, stream))
+		_, err = file.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+
+		loaded, _, loadExecute := newTestServer(t, &config.Config{})
+		loader := NewClient(loaded, -1)
+		loader.flags |= clientFlagAofLoading
+		reader := newAofCommandReader(file)
+
+		for {
+			args, err := reader.readCommand()
+			if err == io.EOF {
+				break
+			}
+
+			require.NoError(t, err)
+			require.NotContains(t, loadExecute(loader, args...), "-ERR")
+		}
+
+		require.NoError(t, file.Close())
+		require.Equal(t, streamState(stream), streamState(loaded.dbs[0].Dict.Get(key).(*datastruct.Stream)))
+	}
+}
+
+func TestStreamRestoreBadFormat(t *testing.T) {
+	t.Parallel()
+
+	// the IDs of the entries must be increasing and not greater than the last ID.
+	unordered := datastruct.NewStream()
+	unordered.Append(datastruct.StreamID{Ms: 2}, []string{"f", "v"})
+	unordered.Append(datastruct.StreamID{Ms: 1}, []string{"f", "v"})
+
+	behind := datastruct.NewStream()
+	behind.Append(datastruct.StreamID{Ms: 2}, []string{"f", "v"})
+	behind.LastID = datastruct.StreamID{Ms: 1}
+
+	for _, stream := range []*datastruct.Stream{unordered, behind} {
+		payload, err := rdbDumpObject(stream)
+		require.NoError(t, err)
+
+		_, err = rdbRestoreObject(payload)
+		require.ErrorIs(t, err, errRdbBadFormat)
+	}
+
+	// the corrupted counts fail at the end of the data without allocating by them.
+	var sb strings.Builder
+	enc := newRdbEncoder(&sb)
+	require.NoError(t, enc.writeByte(rdbTypeMetisStream))
+	require.NoError(t, enc.writeLen(1))
+	require.NoError(t, enc.writeStreamID(datastruct.StreamID{Ms: 1}))
+	require.NoError(t, enc.writeLen(1<<62))
+
+	_, err := rdbRestoreObject(dumpPayload(sb.String()))
+	require.ErrorIs(t, err, io.EOF)
+
+	sb.Reset()
+	require.NoError(t, enc.writeByte(rdbTypeMetisStream))
+	require.NoError(t, enc.writeLen(0))
+	require.NoError(t, enc.writeStreamID(datastruct.StreamID{Ms: 1}))
+	require.NoError(t, enc.writeLen(1))
+	require.NoError(t, enc.writeString("g"))
+	require.NoError(t, enc.writeStreamID(datastruct.StreamID{Ms: 1}))
+	require.NoError(t, enc.writeLen(1<<62))
+
+	_, err = rdbRestoreObject(dumpPayload(sb.String()))
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -1,21 +1,124 @@
 package server
 
 import (
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/IfanTsai/go-lib/utils/byteutils"
 	"github.com/IfanTsai/metis/datastruct"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
 )
 
+const (
+	stringTooLongErr = "string exceeds maximum allowed size (proto-max-bulk-len)"
+	incrOverflowErr  = "increment or decrement would overflow"
+
+	// maxStringLength is the max size of a bulk string.
+	maxStringLength = 512 * 1024 * 1024
+)
+
+type setFlag uint8
+
+const (
+	setNX setFlag = 1 << iota
+	setXX
+	setGet
+	setKeepTTL
+	setExpire
+)
+
+// setCommand implements SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT timestamp |
+// PXAT timestamp | KEEPTTL]. The expiration is propagated as PXAT, so that the key expires at the same time
+// after replaying.
 func setCommand(client *Client) error {
-	key, value := client.args[1], client.args[2]
-	_ = client.db.Expire.Delete(key)
+	args := client.args
+	key, value := args[1], args[2]
+
+	var flags setFlag
+	var when int64
+
+	for i := 3; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch {
+		case option == "nx" && flags&setXX == 0:
+			flags |= setNX
+		case option == "xx" && flags&setNX == 0:
+			flags |= setXX
+		case option == "get":
+			flags |= setGet
+		case option == "keepttl" && flags&setExpire == 0:
+			flags |= setKeepTTL
+		case (option == "ex" || option == "px" || option == "exat" || option == "pxat") &&
+			flags&(setKeepTTL|setExpire) == 0 && i+1 < len(args):
+			i++
+
+			num, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return client.addReplyError(valueNotIntegerErr)
+			}
+
+			var ok bool
+			if when, ok = parseExpireTime(option, num); !ok {
+				return client.addReplyError("invalid expire time in 'set' command")
+			}
+
+			flags |= setExpire
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	// the old value of other types is overwritten, but it can't be replied by GET.
+	old, err := getStringIfExist(client, key)
+	exist := !errors.Is(err, errNotExist)
+
+	if flags&setGet != 0 && errors.Is(err, errWrongType) {
+		return client.addReplyError(err.Error())
+	}
+
+	if (flags&setNX != 0 && exist) || (flags&setXX != 0 && !exist) {
+		if flags&setGet != 0 {
+			return addReplySetGet(client, old, exist)
+		}
+
+		return client.addReplyNull()
+	}
+
 	client.db.Dict.Set(key, value)
+	if flags&setKeepTTL == 0 {
+		_ = client.db.Expire.Delete(key)
+	}
+
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "set", key, client.db.ID)
+
+	if flags&setExpire != 0 {
+		client.db.Expire.Set(key, when)
+		notifyKeyspaceEvent(client.srv, notifyGeneric, "expire", key, client.db.ID)
+		client.args = []string{"set", key, value, "pxat", strconv.FormatInt(when, 10)}
+	}
+
 	client.srv.dirty++
 
+	if flags&setGet != 0 {
+		return addReplySetGet(client, old, exist)
+	}
+
 	return client.addReplyOK()
 }
 
+// addReplySetGet replies the old value of the key for SET with GET.
+func addReplySetGet(client *Client, old string, exist bool) error {
+	if !exist {
+		return client.addReplyNull()
+	}
+
+	return client.addReplyBulkString(old)
+}
+
 func setExCommand(client *Client) error {
 	key, value := client.args[1], client.args[3]
 	expireInt, err := strconv.ParseInt(client.args[2], 10, 64)
@@ -26,8 +129,14 @@ func setExCommand(client *Client) error {
 	when := time.Now().UnixMilli() + expireInt*1000
 	client.db.Expire.Set(key, when)
 	client.db.Dict.Set(key, value)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "set", key, client.db.ID)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "expire", key, client.db.ID)
 	client.srv.dirty++
 
+	// propagate the absolute expiration time.
+	client.args = []string{"set", key, value, "pxat", strconv.FormatInt(when, 10)}
+
 	return client.addReplyOK()
 }
 
@@ -44,12 +153,14 @@ func getCommand(client *Client) error {
 		return client.addReplyNull()
 	}
 
-	valueStr, ok := value.(string)
-	if !ok {
+	switch value := value.(type) {
+	case string:
+		return client.addReplyBulkString(value)
+	case *datastruct.Bitmap:
+		return client.addReplyBulkString(byteutils.B2S(value.Bytes()))
+	default:
 		return client.addReplyError("value is not a string")
 	}
-
-	return client.addReplyBulkString(valueStr)
 }
 
 func randomGetCommand(client *Client) error {
@@ -78,3 +189,467 @@ func randomGetCommand(client *Client) error {
 
 	return client.addReplyBulkString(keyStr)
 }
+
+func setNxCommand(client *Client) error {
+	key, value := client.args[1], client.args[2]
+
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	if client.db.Dict.Find(key) != nil {
+		return client.addReplyInt(0)
+	}
+
+	client.db.Dict.Set(key, value)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "set", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyInt(1)
+}
+
+func mSetCommand(client *Client) error {
+	return mSetGenericCommand(client, false)
+}
+
+func mSetNxCommand(client *Client) error {
+	return mSetGenericCommand(client, true)
+}
+
+// mSetGenericCommand sets the key value pairs, nothing is set with NX if any of the keys exists.
+func mSetGenericCommand(client *Client, nx bool) error {
+	args := client.args
+	if len(args)&1 == 0 {
+		return client.addReplyErrorf("wrong number of arguments for '%s' command", strings.ToLower(args[0]))
+	}
+
+	if nx {
+		for i := 1; i < len(args); i += 2 {
+			if _, err := expireIfNeeded(client, args[i]); err != nil {
+				return client.addReplyError(err.Error())
+			}
+
+			if client.db.Dict.Find(args[i]) != nil {
+				return client.addReplyInt(0)
+			}
+		}
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		key := args[i]
+		_ = client.db.Expire.Delete(key)
+		client.db.Dict.Set(key, args[i+1])
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyString, "set", key, client.db.ID)
+		client.srv.dirty++
+	}
+
+	if nx {
+		return client.addReplyInt(1)
+	}
+
+	return client.addReplyOK()
+}
+
+func mGetCommand(client *Client) error {
+	keys := client.args[1:]
+	if err := client.addReplyStringf("*%d\r\n", len(keys)); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// the keys of other types are replied as null.
+		value, err := getStringIfExist(client, key)
+		if err != nil {
+			if err := client.addReplyNull(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := client.addReplyBulkString(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getSetCommand sets the value and replies the old one, the TTL is discarded as SET does.
+func getSetCommand(client *Client) error {
+	key, value := client.args[1], client.args[2]
+
+	old, err := getStringIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	_ = client.db.Expire.Delete(key)
+	client.db.Dict.Set(key, value)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "set", key, client.db.ID)
+	client.srv.dirty++
+
+	if errors.Is(err, errNotExist) {
+		return client.addReplyNull()
+	}
+
+	return client.addReplyBulkString(old)
+}
+
+func getDelCommand(client *Client) error {
+	key := client.args[1]
+
+	value, err := getStringIfExist(client, key)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyNull()
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	_ = client.db.Dict.Delete(key)
+	_ = client.db.Expire.Delete(key)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyGeneric, "del", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyBulkString(value)
+}
+
+// getExCommand implements GETEX key [EX seconds | PX milliseconds | EXAT timestamp | PXAT timestamp | PERSIST].
+// The relative expiration is propagated as PXAT, so that the key expires at the same time after replaying.
+func getExCommand(client *Client) error {
+	args := client.args
+	key := args[1]
+
+	var when int64
+	persist, expire := false, false
+
+	for i := 2; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch {
+		case option == "persist" && !expire && !persist:
+			persist = true
+		case (option == "ex" || option == "px" || option == "exat" || option == "pxat") &&
+			!expire && !persist && i+1 < len(args):
+			i++
+
+			num, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return client.addReplyError(valueNotIntegerErr)
+			}
+
+			var ok bool
+			if when, ok = parseExpireTime(option, num); !ok {
+				return client.addReplyError("invalid expire time in 'getex' command")
+			}
+
+			expire = true
+		default:
+			return client.addReplyError("syntax error")
+		}
+	}
+
+	value, err := getStringIfExist(client, key)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyNull()
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	switch {
+	case expire && when <= time.Now().UnixMilli():
+		// the key expires immediately.
+		_ = client.db.Dict.Delete(key)
+		_ = client.db.Expire.Delete(key)
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyGeneric, "del", key, client.db.ID)
+		client.srv.dirty++
+		client.args = []string{"getex", key, "pxat", strconv.FormatInt(when, 10)}
+	case expire:
+		client.db.Expire.Set(key, when)
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyGeneric, "expire", key, client.db.ID)
+		client.srv.dirty++
+		client.args = []string{"getex", key, "pxat", strconv.FormatInt(when, 10)}
+	case persist:
+		if client.db.Expire.Delete(key) == nil {
+			signalModifiedKey(client, key)
+			notifyKeyspaceEvent(client.srv, notifyGeneric, "persist", key, client.db.ID)
+			client.srv.dirty++
+		}
+	}
+
+	return client.addReplyBulkString(value)
+}
+
+// parseExpireTime returns the absolute unix time in milliseconds of the expire option EX, PX, EXAT or PXAT,
+// the time must be positive and not overflow.
+func parseExpireTime(option string, num int64) (int64, bool) {
+	if num <= 0 {
+		return 0, false
+	}
+
+	switch option {
+	case "ex", "exat":
+		if num > math.MaxInt64/1000 {
+			return 0, false
+		}
+
+		num *= 1000
+	}
+
+	switch option {
+	case "ex", "px":
+		now := time.Now().UnixMilli()
+		if num > math.MaxInt64-now {
+			return 0, false
+		}
+
+		num += now
+	}
+
+	return num, true
+}
+
+func incrCommand(client *Client) error {
+	return incrDecrCommand(client, 1)
+}
+
+func decrCommand(client *Client) error {
+	return incrDecrCommand(client, -1)
+}
+
+func incrByCommand(client *Client) error {
+	incr, ok := parseStrictInt(client.args[2])
+	if !ok {
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	return incrDecrCommand(client, incr)
+}
+
+func decrByCommand(client *Client) error {
+	decr, ok := parseStrictInt(client.args[2])
+	if !ok {
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	if decr == math.MinInt64 {
+		return client.addReplyError("decrement would overflow")
+	}
+
+	return incrDecrCommand(client, -decr)
+}
+
+// incrDecrCommand adds the increment to the integer value of the key, the missing key is set to 0 first.
+// The value must be in the canonical form of the integer, e.g. "+1" or "01" isn't an integer. The TTL of
+// the key is kept.
+func incrDecrCommand(client *Client, incr int64) error {
+	key := client.args[1]
+
+	value, err := getStringIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	var num int64
+	if err == nil {
+		var ok bool
+		if num, ok = parseStrictInt(value); !ok {
+			return client.addReplyError(valueNotIntegerErr)
+		}
+	}
+
+	if (incr < 0 && num < math.MinInt64-incr) || (incr > 0 && num > math.MaxInt64-incr) {
+		return client.addReplyError(incrOverflowErr)
+	}
+
+	num += incr
+	client.db.Dict.Set(key, strconv.FormatInt(num, 10))
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "incrby", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyInt(num)
+}
+
+// incrByFloatCommand adds the float increment to the value of the key, it's propagated as SET with KEEPTTL
+// since the result of the float operations may be different on the replicas.
+func incrByFloatCommand(client *Client) error {
+	key := client.args[1]
+
+	incr, err := strconv.ParseFloat(client.args[2], 64)
+	if err != nil || math.IsNaN(incr) {
+		return client.addReplyError(valueNotFloatErr)
+	}
+
+	value, err := getStringIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	var num float64
+	if err == nil {
+		if num, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(num) {
+			return client.addReplyError(valueNotFloatErr)
+		}
+	}
+
+	num += incr
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return client.addReplyError("increment would produce NaN or Infinity")
+	}
+
+	value = strconv.FormatFloat(num, 'f', -1, 64)
+	client.db.Dict.Set(key, value)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "incrbyfloat", key, client.db.ID)
+	client.srv.dirty++
+	client.args = []string{"set", key, value, "keepttl"}
+
+	return client.addReplyBulkString(value)
+}
+
+func appendCommand(client *Client) error {
+	key, suffix := client.args[1], client.args[2]
+
+	value, err := getStringIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	if len(value)+len(suffix) > maxStringLength {
+		return client.addReplyError(stringTooLongErr)
+	}
+
+	value += suffix
+	client.db.Dict.Set(key, value)
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "append", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyInt(int64(len(value)))
+}
+
+func strLenCommand(client *Client) error {
+	value, err := getStringIfExist(client, client.args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	return client.addReplyInt(int64(len(value)))
+}
+
+// getRangeCommand replies the substring of the inclusive range, the negative indexes count from the end.
+func getRangeCommand(client *Client) error {
+	start, err := strconv.ParseInt(client.args[2], 10, 64)
+	if err != nil {
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	end, err := strconv.ParseInt(client.args[3], 10, 64)
+	if err != nil {
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	value, err := getStringIfExist(client, client.args[1])
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	length := int64(len(value))
+	if start < 0 && end < 0 && start > end {
+		return client.addReplyBulkString("")
+	}
+
+	if start < 0 {
+		start += length
+	}
+
+	if end < 0 {
+		end += length
+	}
+
+	start, end = lo.Max([]int64{start, 0}), lo.Min([]int64{lo.Max([]int64{end, 0}), length - 1})
+	if start > end || length == 0 {
+		return client.addReplyBulkString("")
+	}
+
+	return client.addReplyBulkString(value[start : end+1])
+}
+
+// setRangeCommand overwrites the string from the offset, which is padded with zero bytes if it's shorter.
+func setRangeCommand(client *Client) error {
+	key, patch := client.args[1], client.args[3]
+
+	offset, err := strconv.ParseInt(client.args[2], 10, 64)
+	if err != nil {
+		return client.addReplyError(valueNotIntegerErr)
+	}
+
+	if offset < 0 {
+		return client.addReplyError("offset is out of range")
+	}
+
+	value, err := getStringIfExist(client, key)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return client.addReplyError(err.Error())
+	}
+
+	// nothing is changed by an empty patch, and the missing key isn't created.
+	if len(patch) == 0 {
+		return client.addReplyInt(int64(len(value)))
+	}
+
+	if offset+int64(len(patch)) > maxStringLength {
+		return client.addReplyError(stringTooLongErr)
+	}
+
+	buf := stringGrow(value, offset+int64(len(patch)))
+	copy(buf[offset:], patch)
+
+	client.db.Dict.Set(key, byteutils.B2S(buf))
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyString, "setrange", key, client.db.ID)
+	client.srv.dirty++
+
+	return client.addReplyInt(int64(len(buf)))
+}
+
+func getStringIfExist(client *Client, key string) (string, error) {
+	// check if key expired
+	if _, err := expireIfNeeded(client, key); err != nil {
+		return "", err
+	}
+
+	value := client.db.Dict.Get(key)
+	if value == nil {
+		return "", errNotExist
+	}
+
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case *datastruct.Bitmap:
+		// the string is copied, since the bitmap is modified in place later.
+		return value.String(), nil
+	default:
+		return "", errWrongType
+	}
+}
+
+// stringGrow returns a copy of the string which is padded with zero bytes to the length at least,
+// the values are copied before being modified since they're shared with the background saving.
+func stringGrow(value string, length int64) []byte {
+	buf := make([]byte, lo.Max([]int64{int64(len(value)), length}))
+	copy(buf, value)
+
+	return buf
+}
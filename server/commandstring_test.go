@@ -0,0 +1,217 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrDecrCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, ":1\r\n", execute(client, "incr", "counter"))
+	require.Equal(t, ":11\r\n", execute(client, "incrby", "counter", "10"))
+	require.Equal(t, ":10\r\n", execute(client, "decr", "counter"))
+	require.Equal(t, ":-5\r\n", execute(client, "decrby", "counter", "15"))
+	require.Equal(t, "$2\r\n-5\r\n", execute(client, "get", "counter"))
+
+	execute(client, "set", "max", "9223372036854775807")
+	require.Equal(t, "-ERR increment or decrement would overflow\r\n", execute(client, "incr", "max"))
+	require.Equal(t, "-ERR decrement would overflow\r\n", execute(client, "decrby", "max", "-9223372036854775808"))
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "incrby", "max", "1.5"))
+
+	execute(client, "set", "string", "value")
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "incr", "string"))
+
+	// only the canonical form of the integer is accepted.
+	for _, value := range []string{"+1", "01", "-0", " 1", "1 "} {
+		execute(client, "set", "string", value)
+		require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "incr", "string"), value)
+		require.Equal(t, "-ERR value is not an integer or out of range\r\n",
+			execute(client, "incrby", "counter", value), value)
+		require.Equal(t, "-ERR value is not an integer or out of range\r\n",
+			execute(client, "decrby", "counter", value), value)
+	}
+
+	execute(client, "set", "string", "value")
+	require.Equal(t, "-ERR value is not a valid float\r\n", execute(client, "incrbyfloat", "string", "1"))
+
+	// INCRBYFLOAT is propagated as SET with the result.
+	srv.aofBuf.Reset()
+	require.Equal(t, "$4\r\n10.5\r\n", execute(client, "incrbyfloat", "float", "10.5"))
+	require.Equal(t, "$4\r\n5.55\r\n", execute(client, "incrbyfloat", "float", "-4.95"))
+	require.Equal(t, "$7\r\n5005.55\r\n", execute(client, "incrbyfloat", "float", "5.0e3"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"set", "float", "10.5", "keepttl"})+
+		catAppendOnlyGenericCommand([]string{"set", "float", "5.55", "keepttl"})+
+		catAppendOnlyGenericCommand([]string{"set", "float", "5005.55", "keepttl"}), srv.aofBuf.String())
+	require.Equal(t, "-ERR value is not a valid float\r\n", execute(client, "incrbyfloat", "float", "abc"))
+	require.Equal(t, "-ERR increment would produce NaN or Infinity\r\n",
+		execute(client, "incrbyfloat", "float", "+inf"))
+
+	// the TTL is kept by the increments.
+	execute(client, "expire", "counter", "100")
+	execute(client, "incr", "counter")
+	require.NotNil(t, srv.dbs[0].Expire.Find("counter"))
+
+	execute(client, "lpush", "list", "a")
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "incr", "list"))
+}
+
+func TestStringRangeCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, ":5\r\n", execute(client, "append", "key", "Hello"))
+	require.Equal(t, ":11\r\n", execute(client, "append", "key", " World"))
+	require.Equal(t, ":11\r\n", execute(client, "strlen", "key"))
+	require.Equal(t, ":0\r\n", execute(client, "strlen", "missing"))
+
+	require.Equal(t, "$4\r\nHell\r\n", execute(client, "getrange", "key", "0", "3"))
+	require.Equal(t, "$3\r\nrld\r\n", execute(client, "getrange", "key", "-3", "-1"))
+	require.Equal(t, "$11\r\nHello World\r\n", execute(client, "getrange", "key", "0", "-1"))
+	require.Equal(t, "$11\r\nHello World\r\n", execute(client, "getrange", "key", "-100", "100"))
+	require.Equal(t, "$0\r\n\r\n", execute(client, "getrange", "key", "5", "3"))
+	require.Equal(t, "$0\r\n\r\n", execute(client, "getrange", "key", "-1", "-5"))
+	require.Equal(t, "$0\r\n\r\n", execute(client, "getrange", "missing", "0", "-1"))
+
+	require.Equal(t, ":11\r\n", execute(client, "setrange", "key", "6", "Redis"))
+	require.Equal(t, "$11\r\nHello Redis\r\n", execute(client, "get", "key"))
+	require.Equal(t, ":11\r\n", execute(client, "setrange", "padded", "6", "Redis"))
+	require.Equal(t, "$11\r\n\x00\x00\x00\x00\x00\x00Redis\r\n", execute(client, "get", "padded"))
+	require.Equal(t, ":0\r\n", execute(client, "setrange", "missing", "10", ""))
+	require.Nil(t, srv.dbs[0].Dict.Get("missing"))
+	require.Equal(t, "-ERR offset is out of range\r\n", execute(client, "setrange", "key", "-1", "a"))
+	require.Equal(t, "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n",
+		execute(client, "setrange", "key", "536870911", "ab"))
+}
+
+func TestMultiKeyStringCommands(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, "+OK\r\n", execute(client, "mset", "a", "1", "b", "2"))
+	require.Equal(t, "-ERR wrong number of arguments for 'mset' command\r\n", execute(client, "mset", "a", "1", "b"))
+	execute(client, "lpush", "list", "a")
+	require.Equal(t, "*4\r\n$1\r\n1\r\n$1\r\n2\r\n$-1\r\n$-1\r\n", execute(client, "mget", "a", "b", "missing", "list"))
+
+	require.Equal(t, ":0\r\n", execute(client, "msetnx", "c", "3", "a", "4"))
+	require.Equal(t, "$-1\r\n", execute(client, "get", "c"))
+	require.Equal(t, ":1\r\n", execute(client, "msetnx", "c", "3", "d", "4"))
+	require.Equal(t, "$1\r\n3\r\n", execute(client, "get", "c"))
+
+	require.Equal(t, ":0\r\n", execute(client, "setnx", "a", "5"))
+	require.Equal(t, ":1\r\n", execute(client, "setnx", "e", "5"))
+
+	execute(client, "expire", "a", "100")
+	require.Equal(t, "$1\r\n1\r\n", execute(client, "getset", "a", "6"))
+	require.Nil(t, srv.dbs[0].Expire.Find("a"))
+	require.Equal(t, "$-1\r\n", execute(client, "getset", "f", "7"))
+	require.Equal(t, "$1\r\n7\r\n", execute(client, "get", "f"))
+
+	require.Equal(t, "$1\r\n6\r\n", execute(client, "getdel", "a"))
+	require.Equal(t, "$-1\r\n", execute(client, "getdel", "a"))
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "getdel", "list"))
+}
+
+func TestGetExCommand(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	execute(client, "set", "key", "value")
+
+	// the relative TTL is propagated as the absolute one.
+	srv.aofBuf.Reset()
+	now := time.Now().UnixMilli()
+	require.Equal(t, "$5\r\nvalue\r\n", execute(client, "getex", "key", "ex", "100"))
+	when := srv.dbs[0].Expire.Get("key").(int64)
+	require.InDelta(t, now+100*1000, when, 1000)
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"getex", "key", "pxat", strconv.FormatInt(when, 10)}),
+		srv.aofBuf.String())
+
+	// the plain GETEX is not propagated.
+	srv.aofBuf.Reset()
+	require.Equal(t, "$5\r\nvalue\r\n", execute(client, "getex", "key"))
+	require.Equal(t, "$5\r\nvalue\r\n", execute(client, "getex", "key", "persist"))
+	require.Nil(t, srv.dbs[0].Expire.Find("key"))
+	require.Equal(t, "$5\r\nvalue\r\n", execute(client, "getex", "key", "persist"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"getex", "key", "persist"}), srv.aofBuf.String())
+
+	require.Equal(t, "$5\r\nvalue\r\n", execute(client, "getex", "key", "pxat", "1"))
+	require.Nil(t, srv.dbs[0].Dict.Get("key"))
+	require.Equal(t, "$-1\r\n", execute(client, "getex", "key", "px", "100"))
+
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "getex", "key", "ex", "100", "persist"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "getex", "key", "ex"))
+	require.Equal(t, "-ERR invalid expire time in 'getex' command\r\n", execute(client, "getex", "key", "ex", "0"))
+	require.Equal(t, "-ERR invalid expire time in 'getex' command\r\n",
+		execute(client, "getex", "key", "ex", "9223372036854775807"))
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "getex", "key", "px", "a"))
+}
+
+func TestSetCommand(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, "$-1\r\n", execute(client, "set", "lock", "a", "xx"))
+	require.Equal(t, "+OK\r\n", execute(client, "set", "lock", "a", "nx"))
+	require.Equal(t, "$-1\r\n", execute(client, "set", "lock", "b", "nx"))
+	require.Equal(t, "$1\r\na\r\n", execute(client, "set", "lock", "b", "nx", "get"))
+	require.Equal(t, "$1\r\na\r\n", execute(client, "set", "lock", "b", "xx", "get"))
+	require.Equal(t, "$-1\r\n", execute(client, "set", "missing", "b", "get"))
+	require.Equal(t, "$1\r\nb\r\n", execute(client, "get", "missing"))
+
+	// the relative expiration is propagated as PXAT.
+	srv.aofBuf.Reset()
+	now := time.Now().UnixMilli()
+	require.Equal(t, "+OK\r\n", execute(client, "set", "lock", "c", "px", "30000"))
+	when := srv.dbs[0].Expire.Get("lock").(int64)
+	require.InDelta(t, now+30000, when, 1000)
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"set", "lock", "c", "pxat", strconv.FormatInt(when, 10)}),
+		srv.aofBuf.String())
+
+	// the TTL is kept by KEEPTTL, and discarded by the plain SET.
+	require.Equal(t, "+OK\r\n", execute(client, "set", "lock", "d", "keepttl"))
+	require.Equal(t, when, srv.dbs[0].Expire.Get("lock").(int64))
+	require.Equal(t, "+OK\r\n", execute(client, "set", "lock", "e", "exat", "4102444800"))
+	require.Equal(t, int64(4102444800000), srv.dbs[0].Expire.Get("lock").(int64))
+	require.Equal(t, "+OK\r\n", execute(client, "set", "lock", "f"))
+	require.Nil(t, srv.dbs[0].Expire.Find("lock"))
+
+	require.Equal(t, "+OK\r\n", execute(client, "set", "other", "a", "NX", "PX", "30000"))
+	require.NotNil(t, srv.dbs[0].Expire.Find("other"))
+	require.Equal(t, "$-1\r\n", execute(client, "set", "other", "b", "NX", "PX", "30000"))
+
+	srv.aofBuf.Reset()
+	require.Equal(t, "+OK\r\n", execute(client, "setex", "lock", "10", "g"))
+	when = srv.dbs[0].Expire.Get("lock").(int64)
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"set", "lock", "g", "pxat", strconv.FormatInt(when, 10)}),
+		srv.aofBuf.String())
+
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "set", "lock", "a", "nx", "xx"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "set", "lock", "a", "ex", "10", "px", "10"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "set", "lock", "a", "ex", "10", "keepttl"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "set", "lock", "a", "ex"))
+	require.Equal(t, "-ERR syntax error\r\n", execute(client, "set", "lock", "a", "foo"))
+	require.Equal(t, "-ERR invalid expire time in 'set' command\r\n", execute(client, "set", "lock", "a", "ex", "-1"))
+	require.Equal(t, "-ERR value is not an integer or out of range\r\n", execute(client, "set", "lock", "a", "px", "a"))
+
+	// the values of other types are overwritten, but not replied by GET.
+	execute(client, "lpush", "list", "a")
+	require.Equal(t, "-ERR wrong type\r\n", execute(client, "set", "list", "a", "get"))
+	require.Equal(t, "+OK\r\n", execute(client, "set", "list", "a"))
+	require.Equal(t, "$1\r\na\r\n", execute(client, "get", "list"))
+}
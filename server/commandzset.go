@@ -2,10 +2,19 @@ package server
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/IfanTsai/metis/database"
 	"github.com/IfanTsai/metis/datastruct"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+type zsetWhere uint8
+
+const (
+	zsetMin zsetWhere = iota // the elements with the lowest scores
+	zsetMax                  // the elements with the highest scores
 )
 
 func zAddCommand(client *Client) error {
@@ -35,6 +44,10 @@ func zAddCommand(client *Client) error {
 		client.srv.dirty++
 	}
 
+	signalModifiedKey(client, key)
+	notifyKeyspaceEvent(client.srv, notifyZset, "zadd", key, client.db.ID)
+	signalKeyAsReady(client.srv, client.db.ID, key)
+
 	return client.addReplyInt(created)
 }
 
@@ -177,6 +190,11 @@ func zRemCommand(client *Client) error {
 		}
 	}
 
+	if deleted > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyZset, "zrem", key, client.db.ID)
+	}
+
 	return client.addReplyInt(int64(deleted))
 }
 
@@ -205,6 +223,11 @@ func zRemRangeByRankCommand(client *Client) error {
 	deletedElements := zset.DeleteRangeByRank(start, stop)
 	client.srv.dirty += int64(len(deletedElements))
 
+	if len(deletedElements) > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyZset, "zremrangebyrank", key, client.db.ID)
+	}
+
 	return client.addReplyInt(int64(len(deletedElements)))
 }
 
@@ -233,9 +256,162 @@ func zRemRangeByScoreCommand(client *Client) error {
 	deletedElements := zset.DeleteRangeByScore(min, max)
 	client.srv.dirty += int64(len(deletedElements))
 
+	if len(deletedElements) > 0 {
+		signalModifiedKey(client, key)
+		notifyKeyspaceEvent(client.srv, notifyZset, "zremrangebyscore", key, client.db.ID)
+	}
+
 	return client.addReplyInt(int64(len(deletedElements)))
 }
 
+func zPopMinCommand(client *Client) error {
+	return zPopGenericCommand(client, zsetMin)
+}
+
+func zPopMaxCommand(client *Client) error {
+	return zPopGenericCommand(client, zsetMax)
+}
+
+// zPopGenericCommand implements ZPOPMIN and ZPOPMAX, it replies the popped members followed by their scores.
+func zPopGenericCommand(client *Client, where zsetWhere) error {
+	if len(client.args) > 3 {
+		return client.addReplyError("syntax error")
+	}
+
+	key := client.args[1]
+
+	count := int64(1)
+	if len(client.args) == 3 {
+		var err error
+		if count, err = strconv.ParseInt(client.args[2], 10, 64); err != nil {
+			return client.addReplyError("value is not an integer or out of range")
+		}
+
+		if count < 0 {
+			return client.addReplyError("value is out of range, must be positive")
+		}
+	}
+
+	zset, err := getZsetIfExist(client, key)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return client.addReplyEmpty()
+		}
+
+		return client.addReplyError(err.Error())
+	}
+
+	if count == 0 || zset.Size() == 0 {
+		return client.addReplyEmpty()
+	}
+
+	elements := zsetTypePop(client.srv, client.db, key, zset, where, count)
+
+	replies := make([]string, 0, len(elements)*2)
+	for _, element := range elements {
+		replies = append(replies, element.Member, strconv.FormatFloat(element.Score, 'f', -1, 64))
+	}
+
+	return client.addReplyArrays(replies)
+}
+
+func bzPopMinCommand(client *Client) error {
+	return blockingZpopGenericCommand(client, zsetMin)
+}
+
+func bzPopMaxCommand(client *Client) error {
+	return blockingZpopGenericCommand(client, zsetMax)
+}
+
+// blockingZpopGenericCommand implements BZPOPMIN and BZPOPMAX. The element is popped from the first non empty
+// sorted set of the keys, or the client is blocked until one of the sorted sets is added.
+func blockingZpopGenericCommand(client *Client, where zsetWhere) error {
+	keys := client.args[1 : len(client.args)-1]
+
+	timeout, err := parseBlockTimeout(client.args[len(client.args)-1], time.Second)
+	if err != nil {
+		return client.addReplyError(err.Error())
+	}
+
+	for _, key := range keys {
+		zset, err := getZsetIfExist(client, key)
+		if err != nil {
+			if errors.Is(err, errNotExist) {
+				continue
+			}
+
+			return client.addReplyError(err.Error())
+		}
+
+		if zset.Size() == 0 {
+			continue
+		}
+
+		element := zsetTypePop(client.srv, client.db, key, zset, where, 1)[0]
+
+		// propagate the plain pop instead of the blocking one.
+		client.args = []string{zsetPopCommandName(where), key}
+
+		return client.addReplyArrays([]string{key, element.Member, strconv.FormatFloat(element.Score, 'f', -1, 64)})
+	}
+
+	// the client can't be blocked in a transaction.
+	if client.flags&clientFlagMulti != 0 {
+		return client.addReplyNullArray()
+	}
+
+	client.blockZsetWhere = where
+	blockForKeys(client, blockZset, keys, timeout)
+
+	return nil
+}
+
+// serveClientBlockedOnZset serves the client blocked by the key with the sorted set which was just added,
+// the pop is propagated as a plain one.
+func serveClientBlockedOnZset(client *Client, key string, zset *datastruct.Zset) {
+	srv := client.srv
+	db := client.db
+
+	element := zsetTypePop(srv, db, key, zset, client.blockZsetWhere, 1)[0]
+	_ = client.addReplyArrays([]string{key, element.Member, strconv.FormatFloat(element.Score, 'f', -1, 64)})
+
+	args := []string{zsetPopCommandName(client.blockZsetWhere), key}
+	propagate(srv, db.ID, args)
+	client.replWriteOffset = srv.masterReplOffset
+
+	unblockClient(client)
+}
+
+// zsetTypePop pops at most count elements from the sorted set in the order they are popped,
+// and signals the modification of the key.
+func zsetTypePop(srv *Server, db *database.Databse, key string, zset *datastruct.Zset, where zsetWhere,
+	count int64,
+) []*datastruct.ZsetElement {
+	size := zset.Size()
+	count = lo.Min([]int64{count, size})
+
+	var elements []*datastruct.ZsetElement
+	if where == zsetMin {
+		elements = zset.DeleteRangeByRank(0, count-1)
+	} else {
+		elements = lo.Reverse(zset.DeleteRangeByRank(size-count, size-1))
+	}
+
+	srv.dirty++
+	touchWatchedKey(srv, db.ID, key)
+	notifyKeyspaceEvent(srv, notifyZset, zsetPopCommandName(where), key, db.ID)
+
+	return elements
+}
+
+func zsetPopCommandName(where zsetWhere) string {
+	if where == zsetMin {
+		return "zpopmin"
+	}
+
+	return "zpopmax"
+}
+
 func getZset(client *Client, key string) (*datastruct.Zset, error) {
 	dict := client.db.Dict
 	value := dict.Get(key)
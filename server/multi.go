@@ -0,0 +1,199 @@
+package server
+
+import (
+	"github.com/samber/lo"
+)
+
+// multiCmd is a command queued by the client in a transaction.
+type multiCmd struct {
+	cmd  *command
+	args []string
+}
+
+// watchedKey is a key watched by WATCH in a specific database.
+type watchedKey struct {
+	dbID int
+	key  string
+}
+
+// queueMultiCommand adds the command to the transaction of the client, which is executed by EXEC.
+func queueMultiCommand(client *Client, cmd *command) error {
+	// the transaction will fail anyway, there is no need to queue more commands.
+	if client.flags&clientFlagDirtyExec == 0 {
+		client.multiCmds = append(client.multiCmds, multiCmd{cmd: cmd, args: client.args})
+	}
+
+	return client.addReplySimpleString("QUEUED")
+}
+
+// flagTransaction marks the transaction as failed when a command is rejected while queueing it,
+// so that EXEC replies EXECABORT instead of executing a part of the transaction.
+func flagTransaction(client *Client) {
+	if client.flags&clientFlagMulti != 0 {
+		client.flags |= clientFlagDirtyExec
+	}
+}
+
+// discardTransaction resets the transaction state of the client and unwatches all the keys.
+func discardTransaction(client *Client) {
+	client.multiCmds = nil
+	client.flags &^= clientFlagMulti | clientFlagDirtyCAS | clientFlagDirtyExec
+	unwatchAllKeys(client)
+}
+
+func multiCommand(client *Client) error {
+	if client.flags&clientFlagMulti != 0 {
+		return client.addReplyError("MULTI calls can not be nested")
+	}
+
+	client.flags |= clientFlagMulti
+
+	return client.addReplyOK()
+}
+
+func discardCommand(client *Client) error {
+	if client.flags&clientFlagMulti == 0 {
+		return client.addReplyError("DISCARD without MULTI")
+	}
+
+	discardTransaction(client)
+
+	return client.addReplyOK()
+}
+
+func execCommand(client *Client) error {
+	if client.flags&clientFlagMulti == 0 {
+		return client.addReplyError("EXEC without MULTI")
+	}
+
+	if client.flags&clientFlagDirtyExec != 0 {
+		discardTransaction(client)
+
+		return client.addReplyErrorCode("EXECABORT", "Transaction discarded because of previous errors.")
+	}
+
+	// a watched key was modified, the transaction is aborted with a null array.
+	if client.flags&clientFlagDirtyCAS != 0 {
+		discardTransaction(client)
+
+		return client.addReplyNullArray()
+	}
+
+	// the keys are unwatched before executing the commands, since the transaction itself may touch them.
+	unwatchAllKeys(client)
+
+	if err := client.addReplyStringf("*%d\r\n", len(client.multiCmds)); err != nil {
+		return err
+	}
+
+	execArgs := client.args
+
+	// MULTI is propagated before the first propagated command, which may be a read command updating
+	// the dataset, such as PFCOUNT.
+	client.flags |= clientFlagExecPendingMulti
+
+	for _, mc := range client.multiCmds {
+		client.args = mc.args
+		if err := call(client, mc.cmd); err != nil {
+			client.flags &^= clientFlagExecPendingMulti
+
+			return err
+		}
+	}
+
+	multiPropagated := client.flags&clientFlagExecPendingMulti == 0
+	client.flags &^= clientFlagExecPendingMulti
+
+	client.args = execArgs
+	discardTransaction(client)
+
+	// make sure EXEC is propagated by call() to close the MULTI block, even if no command changed the dataset,
+	// and never propagated without MULTI.
+	if multiPropagated {
+		client.srv.dirty++
+	} else {
+		client.flags |= clientFlagPreventProp
+	}
+
+	return nil
+}
+
+// execPropagateMulti propagates MULTI before the first command propagated by EXEC, so that the transaction
+// is applied as a whole by the AOF and the replicas.
+func execPropagateMulti(client *Client) {
+	if client.flags&clientFlagExecPendingMulti == 0 {
+		return
+	}
+
+	client.flags &^= clientFlagExecPendingMulti
+	propagate(client.srv, client.db.ID, []string{"multi"})
+}
+
+func watchCommand(client *Client) error {
+	if client.flags&clientFlagMulti != 0 {
+		return client.addReplyError("WATCH inside MULTI is not allowed")
+	}
+
+	for _, key := range client.args[1:] {
+		// delete the key if it's already expired, so that the lazy expiration later doesn't
+		// fail the transaction.
+		if _, err := expireIfNeeded(client, key); err != nil {
+			return client.addReplyError(err.Error())
+		}
+
+		watchKey(client, key)
+	}
+
+	return client.addReplyOK()
+}
+
+func unwatchCommand(client *Client) error {
+	unwatchAllKeys(client)
+	client.flags &^= clientFlagDirtyCAS
+
+	return client.addReplyOK()
+}
+
+// watchKey watches the key in the database selected by the client.
+func watchKey(client *Client, key string) {
+	wk := watchedKey{dbID: client.db.ID, key: key}
+	if lo.Contains(client.watchedKeys, wk) {
+		return
+	}
+
+	srv := client.srv
+	srv.watchedKeys[wk] = append(srv.watchedKeys[wk], client)
+	client.watchedKeys = append(client.watchedKeys, wk)
+}
+
+// unwatchAllKeys unwatches all the keys watched by the client.
+func unwatchAllKeys(client *Client) {
+	srv := client.srv
+	for _, wk := range client.watchedKeys {
+		clients := lo.Without(srv.watchedKeys[wk], client)
+		if len(clients) == 0 {
+			delete(srv.watchedKeys, wk)
+		} else {
+			srv.watchedKeys[wk] = clients
+		}
+	}
+
+	client.watchedKeys = nil
+}
+
+// touchWatchedKey marks the transactions of the clients watching the key as failed.
+func touchWatchedKey(srv *Server, dbID int, key string) {
+	for _, client := range srv.watchedKeys[watchedKey{dbID: dbID, key: key}] {
+		client.flags |= clientFlagDirtyCAS
+	}
+}
+
+// touchAllWatchedKeys marks all the transactions watching keys as failed, which is called
+// when the whole dataset is replaced.
+func touchAllWatchedKeys(srv *Server) {
+	for _, clients := range srv.watchedKeys {
+		for _, client := range clients {
+			client.flags |= clientFlagDirtyCAS
+		}
+	}
+}
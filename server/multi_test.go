@@ -0,0 +1,106 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiExec(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+
+	require.Equal(t, "-ERR EXEC without MULTI\r\n", execute(client, "exec"))
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "-ERR MULTI calls can not be nested\r\n", execute(client, "multi"))
+	require.Equal(t, "-ERR WATCH inside MULTI is not allowed\r\n", execute(client, "watch", "key"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "get", "key"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "set", "key", "value"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "get", "key"))
+	require.Nil(t, srv.dbs[0].Dict.Get("key"))
+	require.Equal(t, "*3\r\n$-1\r\n+OK\r\n$5\r\nvalue\r\n", execute(client, "exec"))
+	require.Zero(t, client.flags&clientFlagMulti)
+
+	// the transaction is propagated as a MULTI/EXEC block, the read commands before the first write are not.
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"multi"})+
+		catAppendOnlyGenericCommand([]string{"set", "key", "value"})+
+		catAppendOnlyGenericCommand([]string{"exec"}), srv.aofBuf.String())
+
+	// the transaction without any change isn't propagated.
+	srv.aofBuf.Reset()
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "get", "key"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "del", "missing"))
+	require.Equal(t, "*2\r\n$5\r\nvalue\r\n:0\r\n", execute(client, "exec"))
+	require.Empty(t, srv.aofBuf.String())
+
+	// MULTI is propagated before PFCOUNT updating the cached cardinality.
+	execute(client, "pfadd", "hll", "a")
+	srv.aofBuf.Reset()
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "pfcount", "hll"))
+	require.Equal(t, "*1\r\n:1\r\n", execute(client, "exec"))
+	require.Equal(t, catAppendOnlyGenericCommand([]string{"multi"})+
+		catAppendOnlyGenericCommand([]string{"pfcount", "hll"})+
+		catAppendOnlyGenericCommand([]string{"exec"}), srv.aofBuf.String())
+
+	// the transaction is aborted by an error while queueing.
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "set", "key", "other"))
+	require.Equal(t, "-ERR wrong number of arguments\r\n", execute(client, "set", "key"))
+	require.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", execute(client, "exec"))
+	require.Equal(t, "value", srv.dbs[0].Dict.Get("key"))
+
+	require.Equal(t, "-ERR DISCARD without MULTI\r\n", execute(client, "discard"))
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "set", "key", "other"))
+	require.Equal(t, "+OK\r\n", execute(client, "discard"))
+	require.Equal(t, "value", srv.dbs[0].Dict.Get("key"))
+	require.Empty(t, client.multiCmds)
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	srv, _, execute := newTestServer(t, &config.Config{})
+	client := NewClient(srv, -1)
+	other := NewClient(srv, -1)
+
+	// the watched key is modified by another client, the transaction fails.
+	require.Equal(t, "+OK\r\n", execute(client, "watch", "key", "key2"))
+	require.Len(t, srv.watchedKeys, 2)
+	require.Equal(t, "+OK\r\n", execute(other, "set", "key", "other"))
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "set", "key", "value"))
+	require.Equal(t, "*-1\r\n", execute(client, "exec"))
+	require.Equal(t, "other", srv.dbs[0].Dict.Get("key"))
+	require.Empty(t, srv.watchedKeys)
+	require.Empty(t, client.watchedKeys)
+
+	// the same key in another database isn't watched.
+	require.Equal(t, "+OK\r\n", execute(client, "watch", "key"))
+	require.Equal(t, "+OK\r\n", execute(other, "select", "1"))
+	require.Equal(t, "+OK\r\n", execute(other, "set", "key", "other"))
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "set", "key", "value"))
+	require.Equal(t, "*1\r\n+OK\r\n", execute(client, "exec"))
+	require.Equal(t, "value", srv.dbs[0].Dict.Get("key"))
+
+	// the keys are forgotten by UNWATCH.
+	require.Equal(t, "+OK\r\n", execute(client, "watch", "key"))
+	require.Equal(t, "+OK\r\n", execute(client, "unwatch"))
+	require.Empty(t, srv.watchedKeys)
+	require.Equal(t, "+OK\r\n", execute(other, "select", "0"))
+	require.Equal(t, ":1\r\n", execute(other, "del", "key"))
+	require.Equal(t, "+OK\r\n", execute(client, "multi"))
+	require.Equal(t, "+QUEUED\r\n", execute(client, "get", "key"))
+	require.Equal(t, "*1\r\n$-1\r\n", execute(client, "exec"))
+
+	// the keys of a freed client are unwatched.
+	require.Equal(t, "+OK\r\n", execute(client, "watch", "key"))
+	client.free()
+	require.Empty(t, srv.watchedKeys)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strconv"
+)
+
+type notifyFlag uint
+
+const (
+	notifyKeyspace notifyFlag = 1 << iota // K: __keyspace@<db>__:<key> <event>
+	notifyKeyevent                        // E: __keyevent@<db>__:<event> <key>
+	notifyGeneric                         // g: generic commands like DEL and EXPIRE
+	notifyString                          // $: string commands
+	notifyList                            // l: list commands
+	notifySet                             // s: set commands
+	notifyHash                            // h: hash commands
+	notifyZset                            // z: sorted set commands
+	notifyExpired                         // x: expired events, when a key is deleted by the expiration
+	notifyEvicted                         // e: evicted events, when a key is evicted for maxmemory
+	notifyStream                          // t: stream commands
+
+	// A: alias for all the events except K and E.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset |
+		notifyExpired | notifyEvicted | notifyStream
+)
+
+// keyspaceEventsStringToFlags parses the notify-keyspace-events config like "KEA",
+// it returns false if there is any unknown character.
+func keyspaceEventsStringToFlags(classes string) (notifyFlag, bool) {
+	var flags notifyFlag
+
+	for _, c := range classes {
+		switch c {
+		case 'A':
+			flags |= notifyAll
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZset
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 't':
+			flags |= notifyStream
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		default:
+			return 0, false
+		}
+	}
+
+	return flags, true
+}
+
+// notifyKeyspaceEvent publishes the event of the key to the keyspace channel and the keyevent channel
+// if the type of the event is enabled by notify-keyspace-events, so that the clients are able to
+// subscribe to the changes of the keys.
+func notifyKeyspaceEvent(srv *Server, typ notifyFlag, event, key string, dbID int) {
+	flags := srv.notifyKeyspaceEvents
+	if flags&typ == 0 {
+		return
+	}
+
+	db := strconv.Itoa(dbID)
+
+	if flags&notifyKeyspace != 0 {
+		pubsubPublishMessage(srv, "__keyspace@"+db+"__:"+key, event)
+	}
+
+	if flags&notifyKeyevent != 0 {
+		pubsubPublishMessage(srv, "__keyevent@"+db+"__:"+event, key)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyspaceEventsStringToFlags(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		classes string
+		flags   notifyFlag
+		ok      bool
+	}{
+		{classes: "", flags: 0, ok: true},
+		{classes: "KEA", flags: notifyKeyspace | notifyKeyevent | notifyAll, ok: true},
+		{classes: "Kx", flags: notifyKeyspace | notifyExpired, ok: true},
+		{classes: "E$lshz", flags: notifyKeyevent | notifyString | notifyList | notifySet | notifyHash | notifyZset, ok: true},
+		{classes: "Kw", ok: false},
+	}
+
+	for index := range testCases {
+		testCase := testCases[index]
+		flags, ok := keyspaceEventsStringToFlags(testCase.classes)
+		require.Equal(t, testCase.ok, ok, testCase.classes)
+		require.Equal(t, testCase.flags, flags, testCase.classes)
+	}
+}
+
+func TestNotifyKeyspaceEvent(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, execute := newTestServer(t, &config.Config{NotifyKeyspaceEvents: "KEg$x"})
+	subscriber := NewClient(srv, -1)
+	client := NewClient(srv, -1)
+
+	execute(subscriber, "psubscribe", "__key*__:*")
+
+	execute(client, "set", "foo", "bar")
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyspace@0__:foo\r\n$3\r\nset\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyevent@0__:set\r\n$3\r\nfoo\r\n",
+		reply(subscriber))
+
+	// the list events are not enabled.
+	execute(client, "lpush", "list", "a")
+	require.Empty(t, reply(subscriber))
+
+	execute(client, "del", "foo", "missing")
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyspace@0__:foo\r\n$3\r\ndel\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyevent@0__:del\r\n$3\r\nfoo\r\n",
+		reply(subscriber))
+
+	// the key with the TTL in the past is deleted right away.
+	execute(client, "set", "foo", "bar")
+	reply(subscriber)
+	execute(client, "expire", "foo", "-1")
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyspace@0__:foo\r\n$3\r\ndel\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyevent@0__:del\r\n$3\r\nfoo\r\n",
+		reply(subscriber))
+
+	// the key is expired when it's accessed.
+	srv.dbs[0].Dict.Set("foo", "bar")
+	srv.dbs[0].Expire.Set("foo", time.Now().UnixMilli()-1)
+	execute(client, "get", "foo")
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyspace@0__:foo\r\n$7\r\nexpired\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$22\r\n__keyevent@0__:expired\r\n$3\r\nfoo\r\n",
+		reply(subscriber))
+
+	// the key is expired by the active expiration.
+	srv.dbs[1].Dict.Set("foo", "bar")
+	srv.dbs[1].Expire.Set("foo", time.Now().UnixMilli()-1)
+	databasesCron(srv)
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$18\r\n__keyspace@1__:foo\r\n$7\r\nexpired\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$22\r\n__keyevent@1__:expired\r\n$3\r\nfoo\r\n",
+		reply(subscriber))
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// pubsubSubscriptionCount returns the number of channels and patterns subscribed by the client.
+func pubsubSubscriptionCount(client *Client) int {
+	return len(client.pubsubChannels) + len(client.pubsubPatterns)
+}
+
+// addReplyPubsubMessage replies a message of pub/sub, which is an array of the kind,
+// the channel or pattern, and the payload or the number of subscriptions.
+func addReplyPubsubMessage(client *Client, kind string, channel *string, count int) error {
+	if err := client.addReplyString("*3\r\n"); err != nil {
+		return err
+	}
+
+	if err := client.addReplyBulkString(kind); err != nil {
+		return err
+	}
+
+	if channel == nil {
+		if err := client.addReplyNull(); err != nil {
+			return err
+		}
+	} else if err := client.addReplyBulkString(*channel); err != nil {
+		return err
+	}
+
+	return client.addReplyInt(int64(count))
+}
+
+// pubsubSubscribeChannel subscribes the client to the channel, it returns false
+// if the client is already subscribed.
+func pubsubSubscribeChannel(client *Client, channel string) bool {
+	if lo.Contains(client.pubsubChannels, channel) {
+		return false
+	}
+
+	srv := client.srv
+	srv.pubsubChannels[channel] = append(srv.pubsubChannels[channel], client)
+	client.pubsubChannels = append(client.pubsubChannels, channel)
+
+	return true
+}
+
+// pubsubUnsubscribeChannel unsubscribes the client from the channel, it returns false
+// if the client is not subscribed.
+func pubsubUnsubscribeChannel(client *Client, channel string) bool {
+	if !lo.Contains(client.pubsubChannels, channel) {
+		return false
+	}
+
+	srv := client.srv
+	clients := lo.Without(srv.pubsubChannels[channel], client)
+	if len(clients) == 0 {
+		delete(srv.pubsubChannels, channel)
+	} else {
+		srv.pubsubChannels[channel] = clients
+	}
+
+	client.pubsubChannels = lo.Without(client.pubsubChannels, channel)
+
+	return true
+}
+
+// pubsubSubscribePattern subscribes the client to the pattern, it returns false
+// if the client is already subscribed.
+func pubsubSubscribePattern(client *Client, pattern string) bool {
+	if lo.Contains(client.pubsubPatterns, pattern) {
+		return false
+	}
+
+	srv := client.srv
+	srv.pubsubPatterns[pattern] = append(srv.pubsubPatterns[pattern], client)
+	client.pubsubPatterns = append(client.pubsubPatterns, pattern)
+
+	return true
+}
+
+// pubsubUnsubscribePattern unsubscribes the client from the pattern, it returns false
+// if the client is not subscribed.
+func pubsubUnsubscribePattern(client *Client, pattern string) bool {
+	if !lo.Contains(client.pubsubPatterns, pattern) {
+		return false
+	}
+
+	srv := client.srv
+	clients := lo.Without(srv.pubsubPatterns[pattern], client)
+	if len(clients) == 0 {
+		delete(srv.pubsubPatterns, pattern)
+	} else {
+		srv.pubsubPatterns[pattern] = clients
+	}
+
+	client.pubsubPatterns = lo.Without(client.pubsubPatterns, pattern)
+
+	return true
+}
+
+// pubsubUnsubscribeAll unsubscribes the client from all the channels and patterns without
+// notifying it, which is called when the client is freed.
+func pubsubUnsubscribeAll(client *Client) {
+	for _, channel := range append([]string(nil), client.pubsubChannels...) {
+		pubsubUnsubscribeChannel(client, channel)
+	}
+
+	for _, pattern := range append([]string(nil), client.pubsubPatterns...) {
+		pubsubUnsubscribePattern(client, pattern)
+	}
+}
+
+// pubsubPublishMessage sends the message to the clients subscribed to the channel
+// and the patterns matching it, and returns the number of the receivers.
+func pubsubPublishMessage(srv *Server, channel, message string) int {
+	receivers := 0
+
+	for _, client := range srv.pubsubChannels[channel] {
+		_ = client.addReplyArrays([]string{"message", channel, message})
+		receivers++
+	}
+
+	for pattern, clients := range srv.pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+
+		for _, client := range clients {
+			_ = client.addReplyArrays([]string{"pmessage", pattern, channel, message})
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+func subscribeCommand(client *Client) error {
+	for _, channel := range client.args[1:] {
+		pubsubSubscribeChannel(client, channel)
+
+		channel := channel
+		if err := addReplyPubsubMessage(client, "subscribe", &channel, pubsubSubscriptionCount(client)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unsubscribeCommand(client *Client) error {
+	channels := client.args[1:]
+	if len(channels) == 0 {
+		// unsubscribe from all the channels.
+		if len(client.pubsubChannels) == 0 {
+			return addReplyPubsubMessage(client, "unsubscribe", nil, pubsubSubscriptionCount(client))
+		}
+
+		channels = append([]string(nil), client.pubsubChannels...)
+	}
+
+	for _, channel := range channels {
+		pubsubUnsubscribeChannel(client, channel)
+
+		channel := channel
+		if err := addReplyPubsubMessage(client, "unsubscribe", &channel, pubsubSubscriptionCount(client)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func psubscribeCommand(client *Client) error {
+	for _, pattern := range client.args[1:] {
+		pubsubSubscribePattern(client, pattern)
+
+		pattern := pattern
+		if err := addReplyPubsubMessage(client, "psubscribe", &pattern, pubsubSubscriptionCount(client)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func punsubscribeCommand(client *Client) error {
+	patterns := client.args[1:]
+	if len(patterns) == 0 {
+		// unsubscribe from all the patterns.
+		if len(client.pubsubPatterns) == 0 {
+			return addReplyPubsubMessage(client, "punsubscribe", nil, pubsubSubscriptionCount(client))
+		}
+
+		patterns = append([]string(nil), client.pubsubPatterns...)
+	}
+
+	for _, pattern := range patterns {
+		pubsubUnsubscribePattern(client, pattern)
+
+		pattern := pattern
+		if err := addReplyPubsubMessage(client, "punsubscribe", &pattern, pubsubSubscriptionCount(client)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func publishCommand(client *Client) error {
+	receivers := pubsubPublishMessage(client.srv, client.args[1], client.args[2])
+
+	return client.addReplyInt(int64(receivers))
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern], NUMSUB [channel ...] and NUMPAT.
+func pubsubCommand(client *Client) error {
+	srv := client.srv
+
+	switch subcommand := strings.ToLower(client.args[1]); {
+	case subcommand == "channels" && len(client.args) <= 3:
+		channels := make([]string, 0, len(srv.pubsubChannels))
+		for channel := range srv.pubsubChannels {
+			if len(client.args) == 2 || stringMatch(client.args[2], channel, false) {
+				channels = append(channels, channel)
+			}
+		}
+
+		sort.Strings(channels)
+
+		return client.addReplyArrays(channels)
+	case subcommand == "numsub":
+		if err := client.addReplyStringf("*%d\r\n", (len(client.args)-2)*2); err != nil {
+			return err
+		}
+
+		for _, channel := range client.args[2:] {
+			if err := client.addReplyBulkString(channel); err != nil {
+				return err
+			}
+
+			if err := client.addReplyInt(int64(len(srv.pubsubChannels[channel]))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case subcommand == "numpat" && len(client.args) == 2:
+		return client.addReplyInt(int64(len(srv.pubsubPatterns)))
+	default:
+		return client.addReplyErrorf("Unknown PUBSUB subcommand or wrong number of arguments for '%s'", client.args[1])
+	}
+}
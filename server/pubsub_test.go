@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubsub(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, execute := newTestServer(t, &config.Config{})
+	subscriber := NewClient(srv, -1)
+	publisher := NewClient(srv, -1)
+
+	require.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$3\r\nfoo\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$3\r\nbar\r\n:2\r\n",
+		execute(subscriber, "subscribe", "foo", "bar"))
+	require.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:3\r\n",
+		execute(subscriber, "psubscribe", "news.*"))
+
+	// only the commands about the subscriptions are allowed in the context of pub/sub.
+	require.Equal(t, "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context\r\n",
+		execute(subscriber, "get", "foo"))
+	require.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", execute(subscriber, "ping"))
+
+	require.Equal(t, ":1\r\n", execute(publisher, "publish", "foo", "hello"))
+	require.Equal(t, "*3\r\n$7\r\nmessage\r\n$3\r\nfoo\r\n$5\r\nhello\r\n", reply(subscriber))
+	require.Equal(t, ":1\r\n", execute(publisher, "publish", "news.tech", "hi"))
+	require.Equal(t, "*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$2\r\nhi\r\n", reply(subscriber))
+	require.Equal(t, ":0\r\n", execute(publisher, "publish", "baz", "hello"))
+
+	require.Equal(t, "*2\r\n$3\r\nbar\r\n$3\r\nfoo\r\n", execute(publisher, "pubsub", "channels"))
+	require.Equal(t, "*1\r\n$3\r\nfoo\r\n", execute(publisher, "pubsub", "channels", "f*"))
+	require.Equal(t, "*4\r\n$3\r\nfoo\r\n:1\r\n$3\r\nbaz\r\n:0\r\n", execute(publisher, "pubsub", "numsub", "foo", "baz"))
+	require.Equal(t, ":1\r\n", execute(publisher, "pubsub", "numpat"))
+
+	require.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$3\r\nfoo\r\n:2\r\n*3\r\n$11\r\nunsubscribe\r\n$3\r\nbar\r\n:1\r\n",
+		execute(subscriber, "unsubscribe"))
+	require.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:1\r\n", execute(subscriber, "unsubscribe"))
+	require.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$6\r\nnews.*\r\n:0\r\n", execute(subscriber, "punsubscribe", "news.*"))
+	require.Equal(t, "$-1\r\n", execute(subscriber, "get", "foo"))
+	require.Empty(t, srv.pubsubChannels)
+	require.Empty(t, srv.pubsubPatterns)
+
+	// the subscriptions of a freed client are removed.
+	execute(subscriber, "subscribe", "foo")
+	execute(subscriber, "psubscribe", "*")
+	subscriber.free()
+	require.Empty(t, srv.pubsubChannels)
+	require.Empty(t, srv.pubsubPatterns)
+}
@@ -0,0 +1,1121 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IfanTsai/go-lib/utils/byteutils"
+	"github.com/IfanTsai/metis/database"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/IfanTsai/metis/log"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// The snapshot file follows the layout of Redis RDB version 9:
+//
+//	"REDIS0009" [SELECTDB dbid [EXPIRETIME_MS ms] type key value ...]... EOF checksum
+//
+// All the lengths use the Redis length encoding and the checksum is the CRC64 (Jones) of all the
+// preceding bytes. Only a subset of the format is supported: strings (plain or integer encoded),
+// lists, sets, hashes and sorted sets in their plain encodings. The compact encodings of redis
+// (ziplist, listpack, quicklist, intset) and the LZF compressed strings can't be read, nor can
+// the files of versions after 9, and the streams use a metis specific type which redis refuses.
+// So the files written by metis without streams can be read by redis, but not the other way around
+// in general.
+const (
+	RdbVersion            = 9
+	RdbTempFilePrefix     = "temp-"
+	rdbMagic              = "REDIS"
+	rdbDefaultFilename    = "dump.rdb"
+	rdbLenEncoding6Bit    = 0
+	rdbLenEncoding14Bit   = 1
+	rdbLenEncoding32Bit   = 0x80
+	rdbLenEncoding64Bit   = 0x81
+	rdbLenEncodingSpecial = 3
+	rdbEncodingInt8       = 0
+	rdbEncodingInt16      = 1
+	rdbEncodingInt32      = 2
+	rdbReadChunkSize      = 64 * 1024
+)
+
+const (
+	rdbTypeString byte = 0
+	rdbTypeList   byte = 1
+	rdbTypeSet    byte = 2
+	rdbTypeHash   byte = 4
+	rdbTypeZset2  byte = 5
+
+	// streams are saved in a metis specific format instead of the listpacks of redis,
+	// so the type is out of the range of redis, which refuses to load it.
+	rdbTypeMetisStream byte = 200
+
+	rdbOpcodeAux          byte = 0xFA
+	rdbOpcodeResizeDB     byte = 0xFB
+	rdbOpcodeExpireTimeMs byte = 0xFC
+	rdbOpcodeExpireTime   byte = 0xFD
+	rdbOpcodeSelectDB     byte = 0xFE
+	rdbOpcodeEOF          byte = 0xFF
+)
+
+var (
+	errRdbBadFormat   = errors.New("bad rdb format")
+	errRdbBadChecksum = errors.New("wrong rdb checksum")
+
+	// crc64 with Jones polynomial (reflected), which is the one used by redis.
+	crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+)
+
+// crc64Jones updates crc with p. Unlike hash/crc64 the register is neither inverted before nor after
+// the update, so the result is the same as crc64() of redis.
+func crc64Jones(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64JonesTable, p)
+}
+
+// rdbEncoder writes RDB encoded data and keeps track of the checksum of everything written.
+type rdbEncoder struct {
+	w   io.Writer
+	crc uint64
+	buf [9]byte
+}
+
+func newRdbEncoder(w io.Writer) *rdbEncoder {
+	return &rdbEncoder{w: w}
+}
+
+func (e *rdbEncoder) write(p []byte) error {
+	e.crc = crc64Jones(e.crc, p)
+	if _, err := e.w.Write(p); err != nil {
+		return errors.Wrap(err, "failed to write rdb")
+	}
+
+	return nil
+}
+
+func (e *rdbEncoder) writeByte(b byte) error {
+	e.buf[0] = b
+
+	return e.write(e.buf[:1])
+}
+
+func (e *rdbEncoder) writeLen(length uint64) error {
+	switch {
+	case length < 1<<6:
+		return e.writeByte(byte(length) | rdbLenEncoding6Bit<<6)
+	case length < 1<<14:
+		e.buf[0] = byte(length>>8) | rdbLenEncoding14Bit<<6
+		e.buf[1] = byte(length)
+
+		return e.write(e.buf[:2])
+	case length <= math.MaxUint32:
+		e.buf[0] = rdbLenEncoding32Bit
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(length))
+
+		return e.write(e.buf[:5])
+	default:
+		e.buf[0] = rdbLenEncoding64Bit
+		binary.BigEndian.PutUint64(e.buf[1:], length)
+
+		return e.write(e.buf[:9])
+	}
+}
+
+func (e *rdbEncoder) writeString(str string) error {
+	if err := e.writeLen(uint64(len(str))); err != nil {
+		return err
+	}
+
+	return e.write(byteutils.S2B(str))
+}
+
+func (e *rdbEncoder) writeMillisecondTime(ms int64) error {
+	binary.LittleEndian.PutUint64(e.buf[:], uint64(ms))
+
+	return e.write(e.buf[:8])
+}
+
+func (e *rdbEncoder) writeBinaryDouble(value float64) error {
+	binary.LittleEndian.PutUint64(e.buf[:], math.Float64bits(value))
+
+	return e.write(e.buf[:8])
+}
+
+// writeChecksum writes the checksum of all the data written so far, it must be the last write.
+func (e *rdbEncoder) writeChecksum() error {
+	binary.LittleEndian.PutUint64(e.buf[:], e.crc)
+	_, err := e.w.Write(e.buf[:8])
+
+	return errors.Wrap(err, "failed to write rdb checksum")
+}
+
+// rdbObjectType returns the RDB type of value.
+func rdbObjectType(value any) (byte, error) {
+	switch value.(type) {
+	case string, *datastruct.Bitmap:
+		return rdbTypeString, nil
+	case *datastruct.Quicklist:
+		return rdbTypeList, nil
+	case *datastruct.Set:
+		return rdbTypeSet, nil
+	case *datastruct.Dict:
+		return rdbTypeHash, nil
+	case *datastruct.Zset:
+		return rdbTypeZset2, nil
+	case *datastruct.Stream:
+		return rdbTypeMetisStream, nil
+	default:
+		return 0, errors.Errorf("unknown object type: %T", value)
+	}
+}
+
+// writeObject writes the value of an object, without its type.
+func (e *rdbEncoder) writeObject(value any) error {
+	switch value := value.(type) {
+	case string:
+		return e.writeString(value)
+	case *datastruct.Bitmap:
+		return e.writeString(byteutils.B2S(value.Bytes()))
+	case *datastruct.Quicklist:
+		if err := e.writeLen(uint64(value.Len())); err != nil {
+			return err
+		}
+
+		iter := datastruct.NewQuicklistIterator(value)
+		for element := iter.Next(); element != nil; element = iter.Next() {
+			if err := e.writeString(element.(string)); err != nil {
+				return err
+			}
+		}
+	case *datastruct.Set:
+		members := value.Range()
+		if err := e.writeLen(uint64(len(members))); err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if err := e.writeString(member.(string)); err != nil {
+				return err
+			}
+		}
+	case *datastruct.Dict:
+		if err := e.writeLen(uint64(value.Size())); err != nil {
+			return err
+		}
+
+		iter := datastruct.NewDictIterator(value)
+		defer iter.Release()
+
+		for entry := iter.Next(); entry != nil; entry = iter.Next() {
+			if err := e.writeString(entry.Key.(string)); err != nil {
+				return err
+			}
+
+			if err := e.writeString(entry.Value.(string)); err != nil {
+				return err
+			}
+		}
+	case *datastruct.Zset:
+		if err := e.writeLen(uint64(value.Size())); err != nil {
+			return err
+		}
+
+		// elements are saved from the highest to the lowest score, the same as redis does,
+		// so that the skiplist insertion at loading time is always at the head.
+		for _, element := range value.RangeByRank(0, value.Size()-1, true) {
+			if err := e.writeString(element.Member); err != nil {
+				return err
+			}
+
+			if err := e.writeBinaryDouble(element.Score); err != nil {
+				return err
+			}
+		}
+	case *datastruct.Stream:
+		return e.writeStream(value)
+	default:
+		return errors.Errorf("unknown object type: %T", value)
+	}
+
+	return nil
+}
+
+func (e *rdbEncoder) writeStreamID(id datastruct.StreamID) error {
+	if err := e.writeLen(id.Ms); err != nil {
+		return err
+	}
+
+	return e.writeLen(id.Seq)
+}
+
+// writeStream writes the entries, the last ID, and the consumer groups with their pending entries:
+//
+//	len [id len field value ...]... lastID groups [name lastID pending [id deliveryTime deliveryCount]...
+//	consumers [name seenTime pending [id]...]...]...
+func (e *rdbEncoder) writeStream(stream *datastruct.Stream) error {
+	if err := e.writeLen(uint64(stream.Len())); err != nil {
+		return err
+	}
+
+	for _, entry := range stream.Range(datastruct.StreamMinID, datastruct.StreamMaxID, -1, false) {
+		if err := e.writeStreamID(entry.ID); err != nil {
+			return err
+		}
+
+		if err := e.writeLen(uint64(len(entry.Fields))); err != nil {
+			return err
+		}
+
+		for _, field := range entry.Fields {
+			if err := e.writeString(field); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := e.writeStreamID(stream.LastID); err != nil {
+		return err
+	}
+
+	names := stream.GroupNames()
+	if err := e.writeLen(uint64(len(names))); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		group := stream.Group(name)
+		if err := e.writeString(name); err != nil {
+			return err
+		}
+
+		if err := e.writeStreamID(group.LastID); err != nil {
+			return err
+		}
+
+		ids := datastruct.PendingIDs(group.PEL)
+		if err := e.writeLen(uint64(len(ids))); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			nack := group.PEL[id]
+			if err := e.writeStreamID(id); err != nil {
+				return err
+			}
+
+			if err := e.writeMillisecondTime(nack.DeliveryTime); err != nil {
+				return err
+			}
+
+			if err := e.writeLen(nack.DeliveryCount); err != nil {
+				return err
+			}
+		}
+
+		consumerNames := group.ConsumerNames()
+		if err := e.writeLen(uint64(len(consumerNames))); err != nil {
+			return err
+		}
+
+		for _, consumerName := range consumerNames {
+			consumer, _ := group.Consumer(consumerName, false, 0)
+			if err := e.writeString(consumerName); err != nil {
+				return err
+			}
+
+			if err := e.writeMillisecondTime(consumer.SeenTime); err != nil {
+				return err
+			}
+
+			ids := datastruct.PendingIDs(consumer.PEL)
+			if err := e.writeLen(uint64(len(ids))); err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				if err := e.writeStreamID(id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// rdbDumpObject serializes the value in the format of DUMP payload: the type, the value,
+// the RDB version in 2 bytes and the checksum of all the preceding bytes in 8 bytes.
+func rdbDumpObject(value any) (string, error) {
+	var buf bytes.Buffer
+	enc := newRdbEncoder(&buf)
+
+	typ, err := rdbObjectType(value)
+	if err != nil {
+		return "", err
+	}
+
+	if err := enc.writeByte(typ); err != nil {
+		return "", err
+	}
+
+	if err := enc.writeObject(value); err != nil {
+		return "", err
+	}
+
+	binary.LittleEndian.PutUint16(enc.buf[:2], RdbVersion)
+	if err := enc.write(enc.buf[:2]); err != nil {
+		return "", err
+	}
+
+	if err := enc.writeChecksum(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// rdbRestoreObject deserializes the value from a DUMP payload after verifying the version and the checksum.
+func rdbRestoreObject(payload string) (any, error) {
+	if len(payload) < 10 {
+		return nil, errors.Wrap(errRdbBadFormat, "payload too short")
+	}
+
+	footer := byteutils.S2B(payload[len(payload)-10:])
+	if version := binary.LittleEndian.Uint16(footer[:2]); version > RdbVersion {
+		return nil, errors.Wrapf(errRdbBadFormat, "can't handle rdb version: %d", version)
+	}
+
+	data := payload[:len(payload)-8]
+	if checksum := binary.LittleEndian.Uint64(footer[2:]); checksum != crc64Jones(0, byteutils.S2B(data)) {
+		return nil, errRdbBadChecksum
+	}
+
+	dec := newRdbDecoder(strings.NewReader(data[:len(data)-2]))
+
+	typ, err := dec.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	return dec.readObject(typ)
+}
+
+// rdbDecoder reads RDB encoded data and keeps track of the checksum of everything read.
+type rdbDecoder struct {
+	r   io.Reader
+	crc uint64
+	buf [9]byte
+}
+
+func newRdbDecoder(r io.Reader) *rdbDecoder {
+	return &rdbDecoder{r: r}
+}
+
+func (d *rdbDecoder) read(p []byte) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return errors.Wrap(err, "failed to read rdb")
+	}
+
+	d.crc = crc64Jones(d.crc, p)
+
+	return nil
+}
+
+func (d *rdbDecoder) readByte() (byte, error) {
+	if err := d.read(d.buf[:1]); err != nil {
+		return 0, err
+	}
+
+	return d.buf[0], nil
+}
+
+// readLen reads an encoded length, isEncoded is true if the length is a special encoding of string.
+func (d *rdbDecoder) readLen() (length uint64, isEncoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch {
+	case b>>6 == rdbLenEncoding6Bit:
+		return uint64(b & 0x3F), false, nil
+	case b>>6 == rdbLenEncoding14Bit:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case b>>6 == rdbLenEncodingSpecial:
+		return uint64(b & 0x3F), true, nil
+	case b == rdbLenEncoding32Bit:
+		if err := d.read(d.buf[:4]); err != nil {
+			return 0, false, err
+		}
+
+		return uint64(binary.BigEndian.Uint32(d.buf[:4])), false, nil
+	case b == rdbLenEncoding64Bit:
+		if err := d.read(d.buf[:8]); err != nil {
+			return 0, false, err
+		}
+
+		return binary.BigEndian.Uint64(d.buf[:8]), false, nil
+	default:
+		return 0, false, errors.Wrapf(errRdbBadFormat, "unknown length encoding: %x", b)
+	}
+}
+
+func (d *rdbDecoder) readString() (string, error) {
+	length, isEncoded, err := d.readLen()
+	if err != nil {
+		return "", err
+	}
+
+	if isEncoded {
+		var value int64
+
+		switch length {
+		case rdbEncodingInt8:
+			b, err := d.readByte()
+			if err != nil {
+				return "", err
+			}
+
+			value = int64(int8(b))
+		case rdbEncodingInt16:
+			if err := d.read(d.buf[:2]); err != nil {
+				return "", err
+			}
+
+			value = int64(int16(binary.LittleEndian.Uint16(d.buf[:2])))
+		case rdbEncodingInt32:
+			if err := d.read(d.buf[:4]); err != nil {
+				return "", err
+			}
+
+			value = int64(int32(binary.LittleEndian.Uint32(d.buf[:4])))
+		default:
+			return "", errors.Wrapf(errRdbBadFormat, "unsupported string encoding: %d", length)
+		}
+
+		return strconv.FormatInt(value, 10), nil
+	}
+
+	if length > maxStringLength {
+		return "", errors.Wrapf(errRdbBadFormat, "string too long: %d", length)
+	}
+
+	// the length is untrusted, so the buffer grows by chunks as the bytes are actually read,
+	// a corrupted length fails at the end of the data instead of allocating the whole length upfront.
+	buf := make([]byte, 0, lo.Min([]uint64{length, rdbReadChunkSize}))
+	for uint64(len(buf)) < length {
+		n := lo.Min([]uint64{length - uint64(len(buf)), rdbReadChunkSize})
+		buf = append(buf, make([]byte, n)...)
+
+		if err := d.read(buf[uint64(len(buf))-n:]); err != nil {
+			return "", err
+		}
+	}
+
+	return byteutils.B2S(buf), nil
+}
+
+func (d *rdbDecoder) readMillisecondTime() (int64, error) {
+	if err := d.read(d.buf[:8]); err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint64(d.buf[:8])), nil
+}
+
+func (d *rdbDecoder) readBinaryDouble() (float64, error) {
+	if err := d.read(d.buf[:8]); err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(binary.LittleEndian.Uint64(d.buf[:8])), nil
+}
+
+// verifyChecksum reads the checksum at the end of the RDB and compares it with the computed one.
+// A zero checksum means that the checksum is disabled.
+func (d *rdbDecoder) verifyChecksum() error {
+	expected := d.crc
+	if _, err := io.ReadFull(d.r, d.buf[:8]); err != nil {
+		return errors.Wrap(err, "failed to read rdb checksum")
+	}
+
+	checksum := binary.LittleEndian.Uint64(d.buf[:8])
+	if checksum != 0 && checksum != expected {
+		return errors.Wrapf(errRdbBadChecksum, "expected: %x, got: %x", expected, checksum)
+	}
+
+	return nil
+}
+
+// readObject reads the value of an object with the given type.
+func (d *rdbDecoder) readObject(typ byte) (any, error) {
+	switch typ {
+	case rdbTypeString:
+		return d.readString()
+	case rdbTypeList:
+		length, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		list := datastruct.NewQuicklist()
+		for i := uint64(0); i < length; i++ {
+			element, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			list.PushBack(element)
+		}
+
+		return list, nil
+	case rdbTypeSet:
+		length, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		set := datastruct.NewSet(&database.DictType{})
+		for i := uint64(0); i < length; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			set.Add(member)
+		}
+
+		return set, nil
+	case rdbTypeHash:
+		length, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		hash := datastruct.NewDict(&database.DictType{})
+		for i := uint64(0); i < length; i++ {
+			field, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			hash.Set(field, value)
+		}
+
+		return hash, nil
+	case rdbTypeZset2:
+		length, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		zset := datastruct.NewZset(&database.DictType{})
+		for i := uint64(0); i < length; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			score, err := d.readBinaryDouble()
+			if err != nil {
+				return nil, err
+			}
+
+			zset.Add(score, member)
+		}
+
+		return zset, nil
+	case rdbTypeMetisStream:
+		return d.readStream()
+	default:
+		return nil, errors.Wrapf(errRdbBadFormat, "unknown object type: %d", typ)
+	}
+}
+
+func (d *rdbDecoder) readStreamID() (datastruct.StreamID, error) {
+	ms, _, err := d.readLen()
+	if err != nil {
+		return datastruct.StreamMinID, err
+	}
+
+	seq, _, err := d.readLen()
+	if err != nil {
+		return datastruct.StreamMinID, err
+	}
+
+	return datastruct.StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// readStream reads a stream written by writeStream.
+func (d *rdbDecoder) readStream() (*datastruct.Stream, error) {
+	length, _, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+
+	// the counts are untrusted, so nothing is allocated by them upfront.
+	stream := datastruct.NewStream()
+	for i := uint64(0); i < length; i++ {
+		id, err := d.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+
+		if id.Compare(stream.LastID) <= 0 {
+			return nil, errors.Wrapf(errRdbBadFormat, "stream entry ID not increasing: %s", id)
+		}
+
+		numFields, _, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+
+		if numFields == 0 || numFields%2 != 0 {
+			return nil, errors.Wrapf(errRdbBadFormat, "wrong number of stream entry fields: %d", numFields)
+		}
+
+		var fields []string
+		for j := uint64(0); j < numFields; j++ {
+			field, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			fields = append(fields, field)
+		}
+
+		stream.Append(id, fields)
+	}
+
+	lastID, err := d.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	if lastID.Compare(stream.LastID) < 0 {
+		return nil, errors.Wrapf(errRdbBadFormat, "stream last ID smaller than the last entry: %s", lastID)
+	}
+
+	stream.LastID = lastID
+
+	numGroups, _, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < numGroups; i++ {
+		if err := d.readStreamGroup(stream); err != nil {
+			return nil, err
+		}
+	}
+
+	return stream, nil
+}
+
+// readStreamGroup reads a consumer group, the pending entries of the group are assigned to the consumers
+// which they were delivered to.
+func (d *rdbDecoder) readStreamGroup(stream *datastruct.Stream) error {
+	name, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	lastID, err := d.readStreamID()
+	if err != nil {
+		return err
+	}
+
+	group, ok := stream.CreateGroup(name, lastID)
+	if !ok {
+		return errors.Wrapf(errRdbBadFormat, "duplicated consumer group: %s", name)
+	}
+
+	numPending, _, err := d.readLen()
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[datastruct.StreamID]datastruct.StreamNACK)
+	for i := uint64(0); i < numPending; i++ {
+		id, err := d.readStreamID()
+		if err != nil {
+			return err
+		}
+
+		var nack datastruct.StreamNACK
+		if nack.DeliveryTime, err = d.readMillisecondTime(); err != nil {
+			return err
+		}
+
+		if nack.DeliveryCount, _, err = d.readLen(); err != nil {
+			return err
+		}
+
+		pending[id] = nack
+	}
+
+	numConsumers, _, err := d.readLen()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < numConsumers; i++ {
+		consumerName, err := d.readString()
+		if err != nil {
+			return err
+		}
+
+		seenTime, err := d.readMillisecondTime()
+		if err != nil {
+			return err
+		}
+
+		consumer, _ := group.Consumer(consumerName, true, seenTime)
+
+		numConsumerPending, _, err := d.readLen()
+		if err != nil {
+			return err
+		}
+
+		for j := uint64(0); j < numConsumerPending; j++ {
+			id, err := d.readStreamID()
+			if err != nil {
+				return err
+			}
+
+			saved, ok := pending[id]
+			if !ok {
+				return errors.Wrapf(errRdbBadFormat, "pending entry of consumer not found in group: %s", id)
+			}
+
+			nack := group.Claim(id, consumer, saved.DeliveryTime)
+			nack.DeliveryCount = saved.DeliveryCount
+		}
+	}
+
+	return nil
+}
+
+// rdbSaveDatabases writes the whole RDB of dbs to w.
+func rdbSaveDatabases(w io.Writer, dbs []*database.Databse) error {
+	enc := newRdbEncoder(w)
+	if err := enc.write([]byte(rdbMagic + strconv.Itoa(RdbVersion + 10000)[1:])); err != nil {
+		return err
+	}
+
+	for _, db := range dbs {
+		if db.Dict.Size() == 0 {
+			continue
+		}
+
+		if err := rdbSaveDatabase(enc, db); err != nil {
+			return err
+		}
+	}
+
+	if err := enc.writeByte(rdbOpcodeEOF); err != nil {
+		return err
+	}
+
+	return enc.writeChecksum()
+}
+
+func rdbSaveDatabase(enc *rdbEncoder, db *database.Databse) error {
+	if err := enc.writeByte(rdbOpcodeSelectDB); err != nil {
+		return err
+	}
+
+	if err := enc.writeLen(uint64(db.ID)); err != nil {
+		return err
+	}
+
+	iter := datastruct.NewDictIterator(db.Dict)
+	defer iter.Release()
+
+	for entry := iter.Next(); entry != nil; entry = iter.Next() {
+		key := entry.Key.(string)
+
+		if expireEntry := db.Expire.Find(key); expireEntry != nil {
+			if err := enc.writeByte(rdbOpcodeExpireTimeMs); err != nil {
+				return err
+			}
+
+			if err := enc.writeMillisecondTime(expireEntry.Value.(int64)); err != nil {
+				return err
+			}
+		}
+
+		if err := rdbSaveKeyValuePair(enc, key, entry.Value); err != nil {
+			return errors.Wrapf(err, "failed to save key: %s", key)
+		}
+	}
+
+	return nil
+}
+
+// rdbSaveKeyValuePair writes the type, the key and the value.
+func rdbSaveKeyValuePair(enc *rdbEncoder, key string, value any) error {
+	typ, err := rdbObjectType(value)
+	if err != nil {
+		return err
+	}
+
+	if err := enc.writeByte(typ); err != nil {
+		return err
+	}
+
+	if err := enc.writeString(key); err != nil {
+		return err
+	}
+
+	return enc.writeObject(value)
+}
+
+// rdbLoadDatabases reads a whole RDB from r into dbs. Keys that are already expired are skipped.
+func rdbLoadDatabases(r io.Reader, dbs []*database.Databse) error {
+	now := time.Now().UnixMilli()
+
+	return rdbLoadKeys(r, func(dbID uint64, key string, value any, expireAt int64) error {
+		if dbID >= uint64(len(dbs)) {
+			return errors.Errorf("rdb contains db %d, but only %d databases are configured", dbID, len(dbs))
+		}
+
+		if expireAt != -1 && expireAt <= now {
+			return nil
+		}
+
+		db := dbs[dbID]
+		db.Dict.Set(key, value)
+		if expireAt != -1 {
+			db.Expire.Set(key, expireAt)
+		}
+
+		return nil
+	})
+}
+
+// rdbLoadKeyFunc is called for every key read from RDB, expireAt is -1 if the key has no expire.
+type rdbLoadKeyFunc func(dbID uint64, key string, value any, expireAt int64) error
+
+// rdbLoadKeys reads a whole RDB from r and calls fn for every key.
+func rdbLoadKeys(r io.Reader, fn rdbLoadKeyFunc) error {
+	dec := newRdbDecoder(r)
+
+	header := make([]byte, len(rdbMagic)+4)
+	if err := dec.read(header); err != nil {
+		return err
+	}
+
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return errors.Wrap(errRdbBadFormat, "wrong signature")
+	}
+
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil || version < 1 || version > RdbVersion {
+		return errors.Wrapf(errRdbBadFormat, "can't handle rdb version: %s", header[len(rdbMagic):])
+	}
+
+	dbID := uint64(0)
+	expireAt := int64(-1)
+
+	for {
+		typ, err := dec.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case rdbOpcodeEOF:
+			return dec.verifyChecksum()
+		case rdbOpcodeSelectDB:
+			if dbID, _, err = dec.readLen(); err != nil {
+				return err
+			}
+
+			continue
+		case rdbOpcodeExpireTimeMs:
+			if expireAt, err = dec.readMillisecondTime(); err != nil {
+				return err
+			}
+
+			continue
+		case rdbOpcodeExpireTime:
+			if err := dec.read(dec.buf[:4]); err != nil {
+				return err
+			}
+
+			expireAt = int64(binary.LittleEndian.Uint32(dec.buf[:4])) * 1000
+
+			continue
+		case rdbOpcodeResizeDB:
+			// only hints of the dict sizes, ignore them
+			for i := 0; i < 2; i++ {
+				if _, _, err := dec.readLen(); err != nil {
+					return err
+				}
+			}
+
+			continue
+		case rdbOpcodeAux:
+			// auxiliary fields are informational, ignore them
+			for i := 0; i < 2; i++ {
+				if _, err := dec.readString(); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		key, err := dec.readString()
+		if err != nil {
+			return err
+		}
+
+		value, err := dec.readObject(typ)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load key: %s", key)
+		}
+
+		if err := fn(dbID, key, value, expireAt); err != nil {
+			return err
+		}
+
+		expireAt = -1
+	}
+}
+
+// rdbSave saves the databases on disk synchronously.
+func rdbSave(srv *Server) error {
+	if err := rdbSaveToFile(srv.rdbFilename, srv.dbs); err != nil {
+		return err
+	}
+
+	srv.dirty = 0
+	srv.lastSaveTime = time.Now()
+
+	return nil
+}
+
+// rdbSaveToFile writes the RDB to a temp file first and then renames it, so that the old RDB is
+// replaced atomically only if the new one was written successfully.
+func rdbSaveToFile(filename string, dbs []*database.Databse) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), RdbTempFilePrefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	writer := bufio.NewWriter(tmpFile)
+	if err := rdbSaveDatabases(writer, dbs); err != nil {
+		return err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush rdb")
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		return errors.Wrap(err, "failed to fsync rdb")
+	}
+
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return errors.Wrapf(err, "failed to rename %s to %s", tmpFile.Name(), filename)
+	}
+
+	return nil
+}
+
+// rdbSaveBackground saves the databases on disk in background.
+func rdbSaveBackground(srv *Server) bool {
+	return rdbSaveBackgroundToFile(srv, srv.rdbFilename)
+}
+
+// rdbSaveBackgroundToFile saves the databases to the file in background, a file other than the RDB file
+// is the snapshot for the replicas, which isn't a save of the databases.
+func rdbSaveBackgroundToFile(srv *Server, filename string) bool {
+	if !srv.backgroundTaskTypeAtomic.CompareAndSwap(uint32(TypeBackgroundTaskNone), uint32(TypeBackgroundTaskRDB)) {
+		return false
+	}
+
+	tmpDBs := make([]*database.Databse, len(srv.dbs))
+	for i, db := range srv.dbs {
+		tmpDBs[i] = db.DeepCopy()
+	}
+
+	if filename == srv.rdbFilename {
+		srv.dirtyBeforeBgSave = srv.dirty
+		srv.lastBgSaveTryTime = time.Now()
+	}
+
+	srv.rdbSaveFilename = filename
+
+	go func() {
+		srv.rdbSaveDoneCh <- rdbSaveToFile(filename, tmpDBs)
+	}()
+
+	return true
+}
+
+// rdbSaveDoneCallback is called when background saving is done in server cron
+func rdbSaveDoneCallback(srv *Server) {
+	err := <-srv.rdbSaveDoneCh
+	srv.backgroundTaskTypeAtomic.Store(uint32(TypeBackgroundTaskNone))
+
+	switch {
+	case srv.rdbSaveFilename != srv.rdbFilename:
+		// the snapshot for the replicas doesn't change the state of the saving.
+	case err != nil:
+		log.Error("background saving error", zap.Error(err))
+		srv.lastBgSaveOK = false
+	default:
+		srv.dirty -= srv.dirtyBeforeBgSave
+		srv.lastSaveTime = time.Now()
+		srv.lastBgSaveOK = true
+
+		log.Info("background saving terminated with success")
+	}
+
+	// serve the replicas waiting for this snapshot.
+	updateReplicasWaitingBgSave(srv, srv.rdbSaveFilename, err)
+}
+
+// rdbLoad loads the RDB file into the databases if it exists.
+func rdbLoad(srv *Server) {
+	rdbFile, err := os.Open(srv.rdbFilename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+
+		log.Fatal("failed to open rdb file", zap.Error(err))
+	}
+	defer rdbFile.Close()
+
+	start := time.Now()
+	if err := rdbLoadDatabases(bufio.NewReader(rdbFile), srv.dbs); err != nil {
+		log.Fatal("failed to load rdb file", zap.Error(err), zap.String("filename", srv.rdbFilename))
+	}
+
+	log.Info("DB loaded from disk", zap.Duration("elapsed", time.Since(start)))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/IfanTsai/metis/database"
+	"github.com/IfanTsai/metis/datastruct"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrc64Jones(t *testing.T) {
+	t.Parallel()
+
+	// test vector from redis src/crc64.c
+	require.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc64Jones(0, []byte("123456789")))
+	require.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc64Jones(crc64Jones(0, []byte("1234")), []byte("56789")))
+}
+
+func TestRdbSaveAndLoad(t *testing.T) {
+	t.Parallel()
+
+	dbs := []*database.Databse{database.NewDatabase(0), database.NewDatabase(1)}
+
+	dbs[0].Dict.Set("string", "value")
+	dbs[0].Dict.Set("long-string", string(bytes.Repeat([]byte("a"), 20000)))
+
+	list := datastruct.NewQuicklist()
+	for i := 0; i < 100; i++ {
+		list.PushBack(strconv.Itoa(i))
+	}
+	dbs[0].Dict.Set("list", list)
+
+	hash := datastruct.NewDict(&database.DictType{})
+	hash.Set("field", "value")
+	dbs[1].Dict.Set("hash", hash)
+
+	set := datastruct.NewSet(&database.DictType{})
+	set.Add("member")
+	dbs[1].Dict.Set("set", set)
+
+	zset := datastruct.NewZset(&database.DictType{})
+	zset.Add(1.5, "a")
+	zset.Add(-2, "b")
+	dbs[1].Dict.Set("zset", zset)
+
+	when := time.Now().Add(time.Hour).UnixMilli()
+	dbs[1].Expire.Set("zset", when)
+
+	dbs[1].Dict.Set("expired", "value")
+	dbs[1].Expire.Set("expired", time.Now().Add(-time.Hour).UnixMilli())
+
+	var buf bytes.Buffer
+	require.NoError(t, rdbSaveDatabases(&buf, dbs))
+	require.Equal(t, "REDIS0009", buf.String()[:9])
+
+	loaded := []*database.Databse{database.NewDatabase(0), database.NewDatabase(1)}
+	require.NoError(t, rdbLoadDatabases(bytes.NewReader(buf.Bytes()), loaded))
+
+	require.Equal(t, int64(3), loaded[0].Dict.Size())
+	require.Equal(t, "value", loaded[0].Dict.Get("string"))
+	require.Equal(t, dbs[0].Dict.Get("long-string"), loaded[0].Dict.Get("long-string"))
+
+	loadedList := loaded[0].Dict.Get("list").(*datastruct.Quicklist)
+	require.Equal(t, list.Range(0, -1), loadedList.Range(0, -1))
+
+	require.Equal(t, int64(3), loaded[1].Dict.Size())
+	require.Equal(t, "value", loaded[1].Dict.Get("hash").(*datastruct.Dict).Get("field"))
+	require.True(t, loaded[1].Dict.Get("set").(*datastruct.Set).Contains("member"))
+
+	loadedZset := loaded[1].Dict.Get("zset").(*datastruct.Zset)
+	require.Equal(t, zset.RangeByRank(0, zset.Size()-1, false), loadedZset.RangeByRank(0, loadedZset.Size()-1, false))
+	require.Equal(t, when, loaded[1].Expire.Get("zset"))
+
+	require.Nil(t, loaded[1].Dict.Get("expired"))
+}
+
+func TestRdbLoadBadChecksum(t *testing.T) {
+	t.Parallel()
+
+	db := database.NewDatabase(0)
+	db.Dict.Set("key", "value")
+
+	var buf bytes.Buffer
+	require.NoError(t, rdbSaveDatabases(&buf, []*database.Databse{db}))
+
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xFF
+
+	err := rdbLoadDatabases(bytes.NewReader(data), []*database.Databse{database.NewDatabase(0)})
+	require.ErrorIs(t, err, errRdbBadChecksum)
+}
+
+func TestRdbDumpAndRestoreObject(t *testing.T) {
+	t.Parallel()
+
+	// the payload of DUMP "v-bar" generated by redis.
+	payload, err := rdbDumpObject("v-bar")
+	require.NoError(t, err)
+	require.Equal(t, "\x00\x05v-bar\x09\x00\x931\xff&\x80\xeb\xcf\xe5", payload)
+
+	list := datastruct.NewQuicklist()
+	list.PushBack("1")
+	list.PushBack("2")
+
+	payload, err = rdbDumpObject(list)
+	require.NoError(t, err)
+
+	value, err := rdbRestoreObject(payload)
+	require.NoError(t, err)
+	require.Equal(t, list.Range(0, -1), value.(*datastruct.Quicklist).Range(0, -1))
+
+	_, err = rdbRestoreObject(payload[:len(payload)-1] + "x")
+	require.ErrorIs(t, err, errRdbBadChecksum)
+
+	_, err = rdbRestoreObject("short")
+	require.ErrorIs(t, err, errRdbBadFormat)
+
+	// the corrupted lengths of strings fail without allocating the whole lengths.
+	_, err = rdbRestoreObject(dumpPayload("\x00\x80\x1f\xff\xff\xffv-bar"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = rdbRestoreObject(dumpPayload("\x00\x81\x00\x00\x00\x01\x00\x00\x00\x00v-bar"))
+	require.ErrorIs(t, err, errRdbBadFormat)
+}
+
+// dumpPayload appends the footer of DUMP to the serialized value.
+func dumpPayload(data string) string {
+	data += "\x09\x00"
+
+	var checksum [8]byte
+	binary.LittleEndian.PutUint64(checksum[:], crc64Jones(0, []byte(data)))
+
+	return data + string(checksum[:])
+}
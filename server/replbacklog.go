@@ -0,0 +1,66 @@
+package server
+
+// replBacklog is a circular buffer of the latest replication stream, so that a replica which was
+// disconnected for a short time can continue from where it left instead of a full resynchronization.
+type replBacklog struct {
+	buf       []byte
+	idx       int   // the next position to write in buf
+	histLen   int   // the number of valid bytes in buf
+	endOffset int64 // the replication offset of the last byte written
+}
+
+// newReplBacklog creates a backlog whose next byte written is at the given replication offset.
+func newReplBacklog(size int, nextOffset int64) *replBacklog {
+	return &replBacklog{
+		buf:       make([]byte, size),
+		endOffset: nextOffset - 1,
+	}
+}
+
+// firstOffset returns the replication offset of the first byte in the backlog.
+func (b *replBacklog) firstOffset() int64 {
+	return b.endOffset - int64(b.histLen) + 1
+}
+
+func (b *replBacklog) write(str string) {
+	b.endOffset += int64(len(str))
+
+	// only the tail of a string longer than the backlog is kept.
+	if len(str) > len(b.buf) {
+		str = str[len(str)-len(b.buf):]
+	}
+
+	for len(str) > 0 {
+		n := copy(b.buf[b.idx:], str)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histLen += n
+		str = str[n:]
+	}
+
+	if b.histLen > len(b.buf) {
+		b.histLen = len(b.buf)
+	}
+}
+
+// contains returns true if the stream from the given offset is available in the backlog,
+// the offset right after the last byte is included, which means there is nothing to send.
+func (b *replBacklog) contains(offset int64) bool {
+	return offset >= b.firstOffset() && offset <= b.endOffset+1
+}
+
+// readFrom returns the stream from the given offset to the end, the offset must be contained in the backlog.
+func (b *replBacklog) readFrom(offset int64) string {
+	skip := int(offset - b.firstOffset())
+	length := b.histLen - skip
+	start := (b.idx - length + len(b.buf)) % len(b.buf)
+
+	data := make([]byte, 0, length)
+	if start+length <= len(b.buf) {
+		data = append(data, b.buf[start:start+length]...)
+	} else {
+		data = append(data, b.buf[start:]...)
+		data = append(data, b.buf[:length-(len(b.buf)-start)]...)
+	}
+
+	return string(data)
+}
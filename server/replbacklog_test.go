@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplBacklog(t *testing.T) {
+	t.Parallel()
+
+	backlog := newReplBacklog(8, 101)
+	require.Equal(t, int64(101), backlog.firstOffset())
+	require.True(t, backlog.contains(101))
+	require.False(t, backlog.contains(102))
+	require.Equal(t, "", backlog.readFrom(101))
+
+	backlog.write("abcde")
+	require.Equal(t, int64(101), backlog.firstOffset())
+	require.Equal(t, "abcde", backlog.readFrom(101))
+	require.Equal(t, "cde", backlog.readFrom(103))
+	require.True(t, backlog.contains(106))
+	require.False(t, backlog.contains(107))
+
+	// wrap around, the oldest bytes are overwritten.
+	backlog.write("fghij")
+	require.Equal(t, int64(103), backlog.firstOffset())
+	require.False(t, backlog.contains(102))
+	require.Equal(t, "cdefghij", backlog.readFrom(103))
+	require.Equal(t, "hij", backlog.readFrom(108))
+
+	// only the tail of a string longer than the backlog is kept.
+	backlog.write("0123456789")
+	require.Equal(t, int64(113), backlog.firstOffset())
+	require.Equal(t, int64(120), backlog.endOffset)
+	require.Equal(t, "23456789", backlog.readFrom(113))
+}
@@ -0,0 +1,1018 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IfanTsai/go-lib/utils/byteutils"
+	"github.com/IfanTsai/metis/ae"
+	"github.com/IfanTsai/metis/log"
+	"github.com/IfanTsai/metis/socket"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	ReplTempFilePrefix     = "temp-sync-"
+	replSnapshotFilename   = "temp-repl-snapshot-%d.rdb" // the snapshot for the full resynchronization of the replicas
+	replSnapshotChunkSize  = 16 * 1024
+	replCronPeriod         = time.Second
+	replPingReplicaPeriod  = 10 * time.Second // the master pings the replicas periodically
+	replTimeout            = 60 * time.Second // the replication link is considered broken after no data for a while
+	replReadBufSize        = 16 * 1024
+	replIDLen              = 40
+	replDefaultBacklogSize = 1024 * 1024
+)
+
+var replIDNone = strings.Repeat("0", replIDLen)
+
+// replState is the state of the replication link with the master, seen by the replica.
+type replState uint8
+
+const (
+	replStateNone         replState = iota // not a replica
+	replStateConnect                       // must connect to the master
+	replStateConnecting                    // connecting to the master
+	replStateReceivePong                   // wait for the reply of PING
+	replStateReceiveAuth                   // wait for the reply of AUTH
+	replStateReceivePort                   // wait for the reply of REPLCONF listening-port
+	replStateReceivePSync                  // wait for the reply of PSYNC
+	replStateTransfer                      // receiving the snapshot from the master
+	replStateConnected                     // the snapshot is loaded and the replication stream is being received
+)
+
+// replicaState is the state of a replica, seen by the master.
+type replicaState uint8
+
+const (
+	replicaStateNone            replicaState = iota // not a replica
+	replicaStateWaitBgSaveStart                     // waiting for a background saving to start
+	replicaStateWaitBgSaveEnd                       // waiting for the background saving to end, the stream is accumulated
+	replicaStateSendBulk                            // sending the snapshot, the stream is still accumulated
+	replicaStateOnline                              // the snapshot is sent and the stream is forwarded to the replica
+)
+
+func (s replicaState) String() string {
+	switch s {
+	case replicaStateWaitBgSaveStart, replicaStateWaitBgSaveEnd:
+		return "wait_bgsave"
+	case replicaStateSendBulk:
+		return "send_bulk"
+	case replicaStateOnline:
+		return "online"
+	default:
+		return "none"
+	}
+}
+
+/* ---------------------------------- master ---------------------------------- */
+
+// syncCommand handles both SYNC and PSYNC. PSYNC replies +CONTINUE and the missing part of the stream
+// if the replica can continue from the backlog, otherwise +FULLRESYNC followed by the snapshot.
+func syncCommand(client *Client) error {
+	srv := client.srv
+
+	// ignore SYNC if the client is already a replica.
+	if client.flags&clientFlagReplica != 0 {
+		return nil
+	}
+
+	if srv.masterHost != "" && srv.replState != replStateConnected {
+		return client.addReplyError("Can't SYNC while not connected with my master")
+	}
+
+	isPSync := strings.EqualFold(client.args[0], "psync")
+	if isPSync && masterTryPartialResynchronization(client) {
+		return nil
+	}
+
+	client.flags |= clientFlagReplica
+	client.replState = replicaStateWaitBgSaveStart
+	client.replPSync = isPSync
+	srv.replicas = append(srv.replicas, client)
+
+	log.Info("replica asks for synchronization", zap.String("replica", replicaName(client)))
+
+	// if a background saving is in progress for another replica, this replica can share it
+	// by copying the replication stream accumulated so far.
+	for _, replica := range srv.replicas {
+		if replica != client && replica.replState == replicaStateWaitBgSaveEnd {
+			client.replPendingBuf.WriteString(replica.replPendingBuf.String())
+			replicationSetupReplicaForFullResync(client, replica.replInitialOffset)
+
+			log.Info("waiting for end of BGSAVE for SYNC", zap.String("replica", replicaName(client)))
+
+			return nil
+		}
+	}
+
+	// otherwise start a new background saving, or wait for the next one in replication cron.
+	replicationStartBgSaveForSync(srv)
+
+	return nil
+}
+
+// masterTryPartialResynchronization serves PSYNC from the backlog, it returns false if a full
+// resynchronization is needed.
+func masterTryPartialResynchronization(client *Client) bool {
+	srv := client.srv
+	replID := client.args[1]
+
+	psyncOffset, err := strconv.ParseInt(client.args[2], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	// the replica must be on the same history as this server, which is either the current one, or the
+	// previous one before this server was promoted, up to the offset of the promotion.
+	if replID != srv.replID && (replID != srv.replID2 || psyncOffset > srv.secondReplOffset) {
+		if replID != "?" {
+			log.Info("partial resynchronization not accepted: replication ID mismatch",
+				zap.String("replica", replicaName(client)), zap.String("replid", replID))
+		}
+
+		return false
+	}
+
+	if srv.replBacklog == nil || !srv.replBacklog.contains(psyncOffset) {
+		log.Info("unable to partial resync with replica: lack of backlog",
+			zap.String("replica", replicaName(client)), zap.Int64("offset", psyncOffset))
+
+		return false
+	}
+
+	client.flags |= clientFlagReplica
+	client.replState = replicaStateOnline
+	client.replPSync = true
+	srv.replicas = append(srv.replicas, client)
+
+	// the replica learns the new replication ID if this server was promoted.
+	for _, str := range []string{"+CONTINUE " + srv.replID + "\r\n", srv.replBacklog.readFrom(psyncOffset)} {
+		if err := client.addReply(str); err != nil {
+			log.Error("failed to reply PSYNC", zap.String("replica", replicaName(client)), zap.Error(err))
+			client.free()
+
+			return true
+		}
+	}
+
+	log.Info("partial resynchronization request accepted",
+		zap.String("replica", replicaName(client)), zap.Int64("offset", psyncOffset),
+		zap.Int64("backlog_bytes", srv.replBacklog.endOffset+1-psyncOffset))
+
+	return true
+}
+
+// replicationSetupReplicaForFullResync is called when the snapshot for the replica starts, the replica
+// accumulates the stream from the initial offset. A PSYNC replica is told the replication ID and the offset.
+func replicationSetupReplicaForFullResync(replica *Client, initialOffset int64) {
+	replica.replState = replicaStateWaitBgSaveEnd
+	replica.replInitialOffset = initialOffset
+
+	if !replica.replPSync {
+		return
+	}
+
+	if err := replica.addReplyStringf("+FULLRESYNC %s %d\r\n", replica.srv.replID, initialOffset); err != nil {
+		log.Error("failed to reply PSYNC", zap.String("replica", replicaName(replica)), zap.Error(err))
+	}
+}
+
+func replConfCommand(client *Client) error {
+	if len(client.args)%2 == 0 {
+		return client.addReplyError("syntax error")
+	}
+
+	for i := 1; i < len(client.args); i += 2 {
+		switch strings.ToLower(client.args[i]) {
+		case "listening-port":
+			port, err := strconv.ParseUint(client.args[i+1], 10, 16)
+			if err != nil {
+				return client.addReplyError("invalid listening port")
+			}
+
+			client.replListeningPort = uint16(port)
+		case "capa":
+			// no capabilities are supported yet, ignore them.
+		case "ack":
+			// the replica acknowledges the processed offset, there is no reply.
+			if client.flags&clientFlagReplica == 0 {
+				return nil
+			}
+
+			offset, err := strconv.ParseInt(client.args[i+1], 10, 64)
+			if err != nil {
+				return nil
+			}
+
+			if offset > client.replAckOffset {
+				client.replAckOffset = offset
+			}
+
+			client.replAckTime = time.Now()
+			processClientsWaitingReplicas(client.srv)
+
+			return nil
+		case "getack":
+			// the master asks for an acknowledgement as soon as possible.
+			if client.flags&clientFlagMaster != 0 {
+				replicationSendAck(client.srv)
+			}
+
+			return nil
+		default:
+			return client.addReplyErrorf("Unrecognized REPLCONF option: %s", client.args[i])
+		}
+	}
+
+	return client.addReplyOK()
+}
+
+func waitCommand(client *Client) error {
+	srv := client.srv
+
+	if srv.masterHost != "" {
+		return client.addReplyError("WAIT cannot be used with replica instances")
+	}
+
+	numReplicas, err := strconv.Atoi(client.args[1])
+	if err != nil || numReplicas < 0 {
+		return client.addReplyError("invalid number of replicas")
+	}
+
+	timeout, err := strconv.ParseInt(client.args[2], 10, 64)
+	if err != nil {
+		return client.addReplyError("timeout is not an integer or out of range")
+	}
+
+	if timeout < 0 {
+		return client.addReplyError("timeout is negative")
+	}
+
+	// the writes of the client are acknowledged by enough replicas already, or the client
+	// can't be blocked since it's executing a transaction.
+	ackReplicas := replicationCountAcksByOffset(srv, client.replWriteOffset)
+	if ackReplicas >= numReplicas || client.flags&clientFlagMulti != 0 {
+		return client.addReplyInt(int64(ackReplicas))
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+
+	client.blockNumReplicas = numReplicas
+	client.blockReplOffset = client.replWriteOffset
+	blockClient(client, blockWait, deadline)
+	srv.clientsWaitingAcks = append(srv.clientsWaitingAcks, client)
+
+	// ask the replicas for an acknowledgement before the event loop sleeps,
+	// only once for all the clients blocked in this iteration.
+	srv.replGetAckPending = true
+
+	return nil
+}
+
+// replicationCountAcksByOffset returns the number of replicas which acknowledged the offset.
+func replicationCountAcksByOffset(srv *Server, offset int64) int {
+	return lo.CountBy(srv.replicas, func(replica *Client) bool {
+		return replica.replState == replicaStateOnline && replica.replAckOffset >= offset
+	})
+}
+
+// processClientsWaitingReplicas unblocks the clients in WAIT whose writes are acknowledged by enough replicas.
+func processClientsWaitingReplicas(srv *Server) {
+	for _, client := range append([]*Client(nil), srv.clientsWaitingAcks...) {
+		ackReplicas := replicationCountAcksByOffset(srv, client.blockReplOffset)
+		if ackReplicas >= client.blockNumReplicas {
+			_ = client.addReplyInt(int64(ackReplicas))
+			unblockClient(client)
+		}
+	}
+}
+
+// replicationRequestAckFromReplicas sends REPLCONF GETACK in the replication stream.
+func replicationRequestAckFromReplicas(srv *Server) {
+	srv.replGetAckPending = false
+
+	if srv.masterHost == "" && len(srv.replicas) > 0 {
+		replicationFeedStream(srv, catAppendOnlyGenericCommand([]string{"replconf", "getack", "*"}))
+	}
+}
+
+// replicationStartBgSaveForSync starts a background saving if there are replicas waiting for it.
+// The replicas start accumulating the replication stream from now on.
+func replicationStartBgSaveForSync(srv *Server) {
+	waiting := lo.ContainsBy(srv.replicas, func(replica *Client) bool {
+		return replica.replState == replicaStateWaitBgSaveStart
+	})
+	if !waiting || !rdbSaveBackgroundToFile(srv, replicationSnapshotFilename(srv)) {
+		return
+	}
+
+	log.Info("starting BGSAVE for SYNC")
+
+	// the replication stream after the snapshot must start with SELECT.
+	srv.replSelectDBID = -1
+	replicationCreateBacklog(srv)
+
+	for _, replica := range srv.replicas {
+		if replica.replState == replicaStateWaitBgSaveStart {
+			replicationSetupReplicaForFullResync(replica, srv.masterReplOffset)
+		}
+	}
+}
+
+// replicationCreateBacklog creates the backlog if it doesn't exist, which is kept after the replicas
+// are disconnected, so that they are able to continue when they come back.
+func replicationCreateBacklog(srv *Server) {
+	if srv.replBacklog == nil {
+		srv.replBacklog = newReplBacklog(srv.replBacklogSize, srv.masterReplOffset+1)
+	}
+}
+
+// replicationSnapshotFilename returns the file of the snapshot for the full resynchronization, which is
+// dedicated to the transfer instead of the RDB file, since it's written by another server in the same
+// directory when this server is a replica.
+func replicationSnapshotFilename(srv *Server) string {
+	return filepath.Join(filepath.Dir(srv.rdbFilename), fmt.Sprintf(replSnapshotFilename, os.Getpid()))
+}
+
+// updateReplicasWaitingBgSave is called when a background saving to the file is done. It sends the snapshot
+// to the replicas waiting for it, and starts another background saving for the replicas arrived later.
+func updateReplicasWaitingBgSave(srv *Server, filename string, bgSaveErr error) {
+	for _, replica := range lo.Filter(srv.replicas, func(replica *Client, _ int) bool {
+		return replica.replState == replicaStateWaitBgSaveEnd
+	}) {
+		// every replica reads the snapshot by its own file, which is still readable after it's removed.
+		var file *os.File
+		if bgSaveErr == nil {
+			if file, bgSaveErr = os.Open(filename); bgSaveErr != nil {
+				bgSaveErr = errors.Wrap(bgSaveErr, "failed to open snapshot")
+			}
+		}
+
+		if bgSaveErr != nil {
+			log.Warn("SYNC failed", zap.String("replica", replicaName(replica)), zap.Error(bgSaveErr))
+			replica.free()
+
+			continue
+		}
+
+		replicaSendSnapshot(replica, file)
+	}
+
+	if filename != srv.rdbFilename {
+		_ = os.Remove(filename)
+	}
+
+	replicationStartBgSaveForSync(srv)
+}
+
+// replicaSendSnapshot starts sending the snapshot in the format of bulk string. The content is read from
+// the file by chunks when the replica is writable, instead of being loaded in memory as a whole.
+func replicaSendSnapshot(replica *Client, file *os.File) {
+	info, err := file.Stat()
+	if err == nil {
+		err = replica.addReply("$" + strconv.FormatInt(info.Size(), 10) + "\r\n")
+	}
+
+	if err != nil {
+		log.Error("failed to send snapshot to replica", zap.String("replica", replicaName(replica)), zap.Error(err))
+		_ = file.Close()
+		replica.free()
+
+		return
+	}
+
+	replica.replState = replicaStateSendBulk
+	replica.replSnapshotFile = file
+}
+
+// replicaSendSnapshotChunk queues the next chunk of the snapshot, or the replication stream accumulated
+// during the background saving after the end of the snapshot. It returns false if the replica is freed.
+func replicaSendSnapshotChunk(replica *Client) bool {
+	buf := make([]byte, replSnapshotChunkSize)
+
+	n, err := replica.replSnapshotFile.Read(buf)
+	if n > 0 {
+		replica.replayHead.PushBack(byteutils.B2S(buf[:n]))
+
+		return true
+	}
+
+	if !errors.Is(err, io.EOF) {
+		log.Error("failed to read snapshot", zap.String("replica", replicaName(replica)), zap.Error(err))
+		replica.free()
+
+		return false
+	}
+
+	_ = replica.replSnapshotFile.Close()
+	replica.replSnapshotFile = nil
+	replica.replState = replicaStateOnline
+
+	if replica.replPendingBuf.Len() > 0 {
+		replica.replayHead.PushBack(replica.replPendingBuf.String())
+		replica.replPendingBuf.Reset()
+	}
+
+	log.Info("synchronization with replica succeeded", zap.String("replica", replicaName(replica)))
+
+	return true
+}
+
+// replicationFeedReplicas feeds the backlog and the replicas with the command that was just executed.
+// A negative dbID means the command doesn't depend on the selected database.
+func replicationFeedReplicas(srv *Server, dbID int, cmdStr string) {
+	if dbID >= 0 && srv.replSelectDBID != dbID {
+		srv.replSelectDBID = dbID
+		cmdStr = catAppendOnlyGenericCommand([]string{"select", strconv.Itoa(dbID)}) + cmdStr
+	}
+
+	replicationFeedStream(srv, cmdStr)
+}
+
+// replicationFeedStream appends the raw stream to the backlog and sends it to the replicas.
+func replicationFeedStream(srv *Server, stream string) {
+	replicationCreateBacklog(srv)
+	srv.replBacklog.write(stream)
+	srv.masterReplOffset += int64(len(stream))
+
+	for _, replica := range srv.replicas {
+		switch replica.replState {
+		case replicaStateWaitBgSaveEnd, replicaStateSendBulk:
+			replica.replPendingBuf.WriteString(stream)
+		case replicaStateOnline:
+			if err := replica.addReply(stream); err != nil {
+				log.Error("failed to feed replica", zap.String("replica", replicaName(replica)), zap.Error(err))
+			}
+		}
+	}
+}
+
+// replicationRemoveReplica is called when the connection with a replica is closed.
+func replicationRemoveReplica(srv *Server, replica *Client) {
+	srv.replicas = lo.Without(srv.replicas, replica)
+
+	if replica.replSnapshotFile != nil {
+		_ = replica.replSnapshotFile.Close()
+	}
+
+	log.Info("connection with replica lost", zap.String("replica", replicaName(replica)))
+}
+
+func replicaName(replica *Client) string {
+	return net.JoinHostPort(clientIP(replica), strconv.Itoa(int(replica.replListeningPort)))
+}
+
+/* ---------------------------------- replica ---------------------------------- */
+
+func replicaOfCommand(client *Client) error {
+	srv := client.srv
+
+	if srv.cluster != nil {
+		return client.addReplyError("REPLICAOF not allowed in cluster mode.")
+	}
+
+	if strings.EqualFold(client.args[1], "no") && strings.EqualFold(client.args[2], "one") {
+		if srv.masterHost != "" {
+			replicationUnsetMaster(srv)
+			log.Info("MASTER MODE enabled")
+		}
+
+		return client.addReplyOK()
+	}
+
+	port, err := strconv.ParseUint(client.args[2], 10, 16)
+	if err != nil {
+		return client.addReplyError("invalid master port")
+	}
+
+	if srv.masterHost == client.args[1] && srv.masterPort == uint16(port) {
+		return client.addReplySimpleString("OK Already connected to specified master")
+	}
+
+	replicationSetMaster(srv, client.args[1], uint16(port))
+	log.Info("REPLICAOF enabled", zap.String("host", srv.masterHost), zap.Uint16("port", srv.masterPort))
+
+	return client.addReplyOK()
+}
+
+// replicationSetMaster makes this server a replica of the given master, the connection is made in replication cron.
+func replicationSetMaster(srv *Server, host string, port uint16) {
+	srv.masterHost = host
+	srv.masterPort = port
+
+	if srv.master != nil {
+		srv.master.free()
+	}
+
+	replicationCancelHandshake(srv)
+	srv.replState = replStateConnect
+
+	// the replicas of this server will reconnect and continue with the new master if possible.
+	replicationDisconnectReplicas(srv)
+}
+
+// replicationUnsetMaster turns this replica into a master, the dataset is kept.
+func replicationUnsetMaster(srv *Server) {
+	srv.masterHost = ""
+	srv.masterPort = 0
+
+	if srv.master != nil {
+		srv.master.free()
+	}
+
+	replicationCancelHandshake(srv)
+	srv.replState = replStateNone
+
+	// start a new history, the replicas of the old master are still able to continue with
+	// the old replication ID up to the current offset.
+	srv.replID2 = srv.replID
+	srv.secondReplOffset = srv.masterReplOffset + 1
+	srv.replID = newReplID()
+	srv.replSelectDBID = -1
+
+	// the replicas of this server must learn the new replication ID.
+	replicationDisconnectReplicas(srv)
+}
+
+// replicationDisconnectReplicas closes the connections of all the replicas.
+func replicationDisconnectReplicas(srv *Server) {
+	for _, replica := range append([]*Client(nil), srv.replicas...) {
+		replica.free()
+	}
+}
+
+// newReplID returns a random replication ID of 40 hex characters.
+func newReplID() string {
+	id := make([]byte, replIDLen/2)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// replicationHandleMasterDisconnection is called when the connection with the master is closed.
+func replicationHandleMasterDisconnection(srv *Server) {
+	// the replication ID and the offset are kept to try a partial resynchronization later.
+	srv.replCachedMasterDBID = srv.master.db.ID
+	srv.master = nil
+
+	if srv.masterHost != "" {
+		srv.replState = replStateConnect
+
+		log.Warn("connection with master lost")
+	}
+}
+
+// replicationCancelHandshake aborts the handshake or the transfer in progress, the connection
+// is retried in replication cron.
+func replicationCancelHandshake(srv *Server) {
+	if srv.replState < replStateConnecting || srv.replState > replStateTransfer {
+		return
+	}
+
+	_ = srv.eventLoop.RemoveFileEvent(srv.replFd, ae.TypeFileEventReadable)
+	_ = srv.eventLoop.RemoveFileEvent(srv.replFd, ae.TypeFileEventWritable)
+	_ = srv.replFd.Close()
+	srv.replFd = -1
+	srv.replHandshakeBuf = nil
+
+	if srv.replTransferFile != nil {
+		srv.replTransferFile.Close()
+		os.Remove(srv.replTransferFile.Name())
+		srv.replTransferFile = nil
+	}
+
+	srv.replState = replStateConnect
+}
+
+// connectWithMaster starts a non-blocking connection to the master,
+// syncWithMaster is called when the connection is established.
+func connectWithMaster(srv *Server) {
+	fd, err := ConnectTCPServerNonBlock(srv.masterHost, srv.masterPort)
+	if err != nil {
+		log.Warn("unable to connect to MASTER", zap.Error(err))
+
+		return
+	}
+
+	if err := srv.eventLoop.AddFileEvent(fd, ae.TypeFileEventWritable, syncWithMaster, srv); err != nil {
+		log.Error("failed to add file event", zap.Error(err))
+		fd.Close()
+
+		return
+	}
+
+	srv.replFd = fd
+	srv.replState = replStateConnecting
+	srv.replLastIOTime = time.Now()
+
+	log.Info("connecting to MASTER", zap.String("host", srv.masterHost), zap.Uint16("port", srv.masterPort))
+}
+
+// syncWithMaster drives the handshake with the master and receives the snapshot.
+func syncWithMaster(el *ae.EventLoop, fd socket.FD, clientData any) {
+	srv := clientData.(*Server)
+
+	if srv.replState == replStateConnecting {
+		if err := replicationStartHandshake(srv); err != nil {
+			log.Warn("failed to start the handshake with MASTER", zap.Error(err))
+			replicationCancelHandshake(srv)
+		}
+
+		return
+	}
+
+	buf := make([]byte, replReadBufSize)
+	nRead, err := fd.Read(buf)
+	if err != nil {
+		switch errors.Cause(err).(syscall.Errno) {
+		case syscall.EAGAIN, syscall.EINTR:
+			return
+		}
+	}
+
+	if nRead <= 0 {
+		log.Warn("failed to read from MASTER during SYNC", zap.Error(err))
+		replicationCancelHandshake(srv)
+
+		return
+	}
+
+	srv.replLastIOTime = time.Now()
+	srv.replHandshakeBuf = append(srv.replHandshakeBuf, buf[:nRead]...)
+
+	if err := replicationProcessHandshakeBuffer(srv); err != nil {
+		log.Warn("failed to SYNC with MASTER", zap.Error(err))
+		replicationCancelHandshake(srv)
+	}
+}
+
+// replicationStartHandshake is called when the connection is established, it sends PING first.
+func replicationStartHandshake(srv *Server) error {
+	_ = srv.eventLoop.RemoveFileEvent(srv.replFd, ae.TypeFileEventWritable)
+
+	soErr, err := srv.replFd.GetSockOptInt(syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return err
+	}
+
+	if soErr != 0 {
+		return errors.Wrap(syscall.Errno(soErr), "failed to connect")
+	}
+
+	if err := srv.eventLoop.AddFileEvent(srv.replFd, ae.TypeFileEventReadable, syncWithMaster, srv); err != nil {
+		return errors.Wrap(err, "failed to add readable file event")
+	}
+
+	log.Info("MASTER <-> REPLICA sync started")
+
+	return replicationSendHandshakeCommand(srv, replStateReceivePong, "ping")
+}
+
+// replicationSendHandshakeCommand sends a command of the handshake and moves to the next state.
+// The command is small enough to be written at once.
+func replicationSendHandshakeCommand(srv *Server, next replState, args ...string) error {
+	if _, err := srv.replFd.Write(byteutils.S2B(catAppendOnlyGenericCommand(args))); err != nil {
+		return errors.Wrapf(err, "failed to send %s to MASTER", args[0])
+	}
+
+	srv.replState = next
+
+	return nil
+}
+
+// replicationProcessHandshakeBuffer processes the replies of the handshake line by line, and then the snapshot.
+func replicationProcessHandshakeBuffer(srv *Server) error {
+	for srv.replState >= replStateReceivePong && srv.replState <= replStateTransfer {
+		if srv.replTransferFile != nil {
+			return replicationReadSyncPayload(srv)
+		}
+
+		index := bytes.IndexByte(srv.replHandshakeBuf, '\n')
+		if index < 0 {
+			return nil
+		}
+
+		line := strings.TrimSuffix(string(srv.replHandshakeBuf[:index]), "\r")
+		srv.replHandshakeBuf = srv.replHandshakeBuf[index+1:]
+
+		// the master sends newlines to keep the connection alive while preparing the snapshot.
+		if line == "" {
+			continue
+		}
+
+		if err := replicationHandleHandshakeReply(srv, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replicationHandleHandshakeReply(srv *Server, line string) error {
+	switch srv.replState {
+	case replStateReceivePong:
+		// an error is expected if the master requires authentication, which is sent next.
+		if line[0] == '-' && srv.masterAuth == "" {
+			return errors.Errorf("error reply to PING from MASTER: %s", line)
+		}
+
+		if srv.masterAuth != "" {
+			return replicationSendHandshakeCommand(srv, replStateReceiveAuth, "auth", srv.masterAuth)
+		}
+
+		return replicationSendHandshakeCommand(srv, replStateReceivePort,
+			"replconf", "listening-port", strconv.Itoa(int(srv.port)))
+	case replStateReceiveAuth:
+		if line[0] == '-' {
+			return errors.Errorf("unable to AUTH to MASTER: %s", line)
+		}
+
+		return replicationSendHandshakeCommand(srv, replStateReceivePort,
+			"replconf", "listening-port", strconv.Itoa(int(srv.port)))
+	case replStateReceivePort:
+		// not fatal, the master may not understand REPLCONF.
+		if line[0] == '-' {
+			log.Warn("MASTER does not understand REPLCONF listening-port", zap.String("reply", line))
+		}
+
+		// try to continue from where this server left, which is either the last master of this replica,
+		// or the history of this server itself if it was a master.
+		return replicationSendHandshakeCommand(srv, replStateReceivePSync,
+			"psync", srv.replID, strconv.FormatInt(srv.masterReplOffset+1, 10))
+	case replStateReceivePSync:
+		return replicationHandlePSyncReply(srv, line)
+	case replStateTransfer:
+		if line[0] == '-' {
+			return errors.Errorf("MASTER aborted replication: %s", line)
+		}
+
+		if line[0] != '$' {
+			return errors.Errorf("bad protocol from MASTER, the first byte is not '$': %s", line)
+		}
+
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 {
+			return errors.Errorf("bad snapshot size from MASTER: %s", line)
+		}
+
+		tmpFile, err := os.CreateTemp(filepath.Dir(srv.rdbFilename), ReplTempFilePrefix)
+		if err != nil {
+			return errors.Wrap(err, "failed to create temp file for SYNC")
+		}
+
+		srv.replTransferFile = tmpFile
+		srv.replTransferSize = size
+		srv.replTransferRead = 0
+
+		log.Info("MASTER <-> REPLICA sync: receiving snapshot from MASTER", zap.Int64("size", size))
+	}
+
+	return nil
+}
+
+// replicationHandlePSyncReply handles +FULLRESYNC <replid> <offset> and +CONTINUE [<replid>].
+func replicationHandlePSyncReply(srv *Server, line string) error {
+	fields := strings.Fields(line)
+
+	switch fields[0] {
+	case "+FULLRESYNC":
+		if len(fields) != 3 {
+			return errors.Errorf("bad FULLRESYNC reply from MASTER: %s", line)
+		}
+
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.Errorf("bad FULLRESYNC offset from MASTER: %s", line)
+		}
+
+		srv.replTransferReplID = fields[1]
+		srv.replTransferOffset = offset
+		srv.replState = replStateTransfer
+
+		log.Info("full resync from MASTER", zap.String("replid", fields[1]), zap.Int64("offset", offset))
+
+		return nil
+	case "+CONTINUE":
+		// the master changed its replication ID if it was promoted, the old one is kept in replID2,
+		// so that the replicas of this server are still able to continue with the old one.
+		if len(fields) == 2 && fields[1] != srv.replID {
+			srv.replID2 = srv.replID
+			srv.secondReplOffset = srv.masterReplOffset + 1
+			srv.replID = fields[1]
+
+			// the replicas of this server must learn the new replication ID.
+			replicationDisconnectReplicas(srv)
+		}
+
+		log.Info("successful partial resynchronization with MASTER", zap.Int64("offset", srv.masterReplOffset+1))
+
+		replicationCreateMasterClient(srv)
+
+		return nil
+	default:
+		return errors.Errorf("unexpected reply to PSYNC from MASTER: %s", line)
+	}
+}
+
+// replicationReadSyncPayload writes the received snapshot to the temp file,
+// and loads it once it is received completely.
+func replicationReadSyncPayload(srv *Server) error {
+	n := lo.Min([]int64{int64(len(srv.replHandshakeBuf)), srv.replTransferSize - srv.replTransferRead})
+	if _, err := srv.replTransferFile.Write(srv.replHandshakeBuf[:n]); err != nil {
+		return errors.Wrap(err, "failed to write the snapshot received from MASTER")
+	}
+
+	srv.replTransferRead += n
+	srv.replHandshakeBuf = srv.replHandshakeBuf[n:]
+
+	if srv.replTransferRead < srv.replTransferSize {
+		return nil
+	}
+
+	if err := replicationLoadSyncPayload(srv); err != nil {
+		return err
+	}
+
+	replicationCreateMasterClient(srv)
+
+	return nil
+}
+
+// replicationLoadSyncPayload replaces the dataset with the snapshot received from the master.
+func replicationLoadSyncPayload(srv *Server) error {
+	tmpFilename := srv.replTransferFile.Name()
+
+	if err := srv.replTransferFile.Sync(); err != nil {
+		return errors.Wrap(err, "failed to fsync the snapshot received from MASTER")
+	}
+
+	srv.replTransferFile.Close()
+	srv.replTransferFile = nil
+
+	if err := os.Rename(tmpFilename, srv.rdbFilename); err != nil {
+		os.Remove(tmpFilename)
+
+		return errors.Wrapf(err, "failed to rename %s to %s", tmpFilename, srv.rdbFilename)
+	}
+
+	log.Info("MASTER <-> REPLICA sync: flushing old data")
+
+	touchAllWatchedKeys(srv)
+
+	for _, db := range srv.dbs {
+		db.Empty()
+	}
+
+	log.Info("MASTER <-> REPLICA sync: loading DB in memory")
+
+	rdbFile, err := os.Open(srv.rdbFilename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the snapshot received from MASTER")
+	}
+	defer rdbFile.Close()
+
+	if err := rdbLoadDatabases(bufio.NewReader(rdbFile), srv.dbs); err != nil {
+		for _, db := range srv.dbs {
+			db.Empty()
+		}
+
+		return errors.Wrap(err, "failed to load the snapshot received from MASTER")
+	}
+
+	// this server is on the history of the master from now on, and the previous backlog is invalid.
+	srv.replID = srv.replTransferReplID
+	srv.replID2 = replIDNone
+	srv.masterReplOffset = srv.replTransferOffset
+	srv.secondReplOffset = -1
+	srv.replBacklog = newReplBacklog(srv.replBacklogSize, srv.masterReplOffset+1)
+	srv.replCachedMasterDBID = 0
+
+	// the replicas of this server must synchronize again with the new dataset.
+	replicationDisconnectReplicas(srv)
+
+	// the AOF must be rewritten with the new dataset.
+	if srv.aofEnable {
+		srv.aofRewriteScheduled = true
+	}
+
+	return nil
+}
+
+// replicationCreateMasterClient turns the connection of the handshake into the master client, which
+// executes the replication stream like a normal client.
+func replicationCreateMasterClient(srv *Server) {
+	fd := srv.replFd
+	_ = srv.eventLoop.RemoveFileEvent(fd, ae.TypeFileEventReadable)
+
+	master := NewClient(srv, fd)
+	master.flags |= clientFlagMaster
+	master.authenticated = true
+	// the stream continues with the database selected before the disconnection.
+	master.db = srv.dbs[srv.replCachedMasterDBID]
+
+	// the data following the snapshot is the beginning of the replication stream.
+	master.queryLen = len(srv.replHandshakeBuf)
+	master.queryBuf = append(srv.replHandshakeBuf, make([]byte, maxBulk)...)
+
+	srv.replFd = -1
+	srv.replHandshakeBuf = nil
+
+	if err := srv.eventLoop.AddFileEvent(fd, ae.TypeFileEventReadable, readQueryFromClient, master); err != nil {
+		log.Error("failed to add file event", zap.Error(err))
+		fd.Close()
+		srv.replState = replStateConnect
+
+		return
+	}
+
+	srv.clients[fd] = master
+	srv.master = master
+	srv.replState = replStateConnected
+
+	log.Info("MASTER <-> REPLICA sync: finished with success", zap.String("replid", srv.replID))
+
+	replicationSendAck(srv)
+
+	if master.queryLen > 0 {
+		if err := processInputBuffer(master); err != nil {
+			log.Error("failed to process the replication stream", zap.Error(err))
+			master.free()
+		}
+	}
+}
+
+// replicationSendAck sends REPLCONF ACK with the processed offset to the master.
+func replicationSendAck(srv *Server) {
+	master := srv.master
+
+	master.flags |= clientFlagMasterForceReply
+	err := master.addReply(catAppendOnlyGenericCommand(
+		[]string{"replconf", "ack", strconv.FormatInt(srv.masterReplOffset, 10)}))
+	master.flags &^= clientFlagMasterForceReply
+
+	if err != nil {
+		log.Error("failed to send ACK to MASTER", zap.Error(err))
+	}
+}
+
+// replicationCron is called by server cron, it connects to the master, detects timeouts and pings the replicas.
+func replicationCron(srv *Server) {
+	// start a background saving for the waiting replicas as soon as no other background task is running.
+	replicationStartBgSaveForSync(srv)
+
+	now := time.Now()
+	if now.Sub(srv.replCronLastTime) < replCronPeriod {
+		return
+	}
+
+	srv.replCronLastTime = now
+
+	switch {
+	case srv.replState == replStateConnect:
+		connectWithMaster(srv)
+	case srv.replState >= replStateConnecting && srv.replState <= replStateTransfer &&
+		now.Sub(srv.replLastIOTime) > replTimeout:
+		log.Warn("timeout connecting to the MASTER or receiving the snapshot")
+		replicationCancelHandshake(srv)
+	case srv.replState == replStateConnected && now.Sub(srv.master.lastInteraction) > replTimeout:
+		log.Warn("MASTER timeout: no data nor PING received")
+		srv.master.free()
+	case srv.replState == replStateConnected:
+		// acknowledge the processed offset periodically, which is used by WAIT.
+		replicationSendAck(srv)
+	}
+
+	// ping the replicas periodically, so that they are able to detect the timeout of the master.
+	// The replicas of a replica receive the pings of the top master.
+	if srv.masterHost == "" && len(srv.replicas) > 0 && now.Sub(srv.replLastPingTime) >= replPingReplicaPeriod {
+		srv.replLastPingTime = now
+		replicationFeedReplicas(srv, -1, catAppendOnlyGenericCommand([]string{"ping"}))
+	}
+
+	// keep the replicas waiting for the snapshot alive with newlines, which are ignored by them.
+	for _, replica := range srv.replicas {
+		if replica.replState == replicaStateWaitBgSaveStart || replica.replState == replicaStateWaitBgSaveEnd {
+			if err := replica.addReply("\n"); err != nil {
+				log.Error("failed to ping replica", zap.String("replica", replicaName(replica)), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/IfanTsai/metis/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationFeedReplicas(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, _ := newTestServer(t, &config.Config{})
+
+	newReplica := func(state replicaState) *Client {
+		replica := NewClient(srv, -1)
+		replica.flags |= clientFlagReplica
+		replica.replState = state
+
+		return replica
+	}
+
+	online := newReplica(replicaStateOnline)
+	waitBgSaveEnd := newReplica(replicaStateWaitBgSaveEnd)
+	waitBgSaveStart := newReplica(replicaStateWaitBgSaveStart)
+	srv.replicas = []*Client{online, waitBgSaveEnd, waitBgSaveStart}
+
+	set := catAppendOnlyGenericCommand([]string{"set", "key", "value"})
+	ping := catAppendOnlyGenericCommand([]string{"ping"})
+	replicationFeedReplicas(srv, 0, set)
+	replicationFeedReplicas(srv, 0, set)
+	replicationFeedReplicas(srv, -1, ping)
+	replicationFeedReplicas(srv, 1, set)
+
+	expected := catAppendOnlyGenericCommand([]string{"select", "0"}) + set + set + ping +
+		catAppendOnlyGenericCommand([]string{"select", "1"}) + set
+
+	require.Equal(t, expected, reply(online))
+	require.Equal(t, expected, waitBgSaveEnd.replPendingBuf.String())
+	require.Zero(t, waitBgSaveEnd.replayHead.Len())
+	require.Zero(t, waitBgSaveStart.replayHead.Len())
+	require.Zero(t, waitBgSaveStart.replPendingBuf.Len())
+
+}
+
+func TestReplicaSendSnapshot(t *testing.T) {
+	t.Parallel()
+
+	// the synchronization is logged.
+	log.InitLogger(&config.Config{LogLevel: config.LogLevelError})
+
+	srv, reply, _ := newTestServer(t, &config.Config{})
+
+	replica := NewClient(srv, -1)
+	replica.flags |= clientFlagReplica
+	replica.replState = replicaStateWaitBgSaveEnd
+	replica.replPendingBuf.WriteString("pending")
+	srv.replicas = []*Client{replica}
+
+	snapshot := strings.Repeat("snapshot", replSnapshotChunkSize/4)
+	filename := filepath.Join(t.TempDir(), "snapshot.rdb")
+	require.NoError(t, os.WriteFile(filename, []byte(snapshot), 0o600))
+
+	// the snapshot file is removed after it's opened for the replicas.
+	updateReplicasWaitingBgSave(srv, filename, nil)
+	require.NoFileExists(t, filename)
+	require.Equal(t, replicaStateSendBulk, replica.replState)
+
+	// the stream is still accumulated until the end of the snapshot.
+	ping := catAppendOnlyGenericCommand([]string{"ping"})
+	replicationFeedReplicas(srv, -1, ping)
+
+	for replica.replSnapshotFile != nil {
+		require.True(t, replicaSendSnapshotChunk(replica))
+	}
+
+	require.Equal(t, replicaStateOnline, replica.replState)
+	require.Equal(t, "$"+strconv.Itoa(len(snapshot))+"\r\n"+snapshot+"pending"+ping, reply(replica))
+}
+
+func TestWaitCommand(t *testing.T) {
+	t.Parallel()
+
+	srv, reply, _ := newTestServer(t, &config.Config{})
+	srv.masterReplOffset = 100
+
+	replica := NewClient(srv, -1)
+	replica.flags |= clientFlagReplica
+	replica.replState = replicaStateOnline
+	replica.replAckOffset = 50
+	srv.replicas = []*Client{replica}
+
+	client := NewClient(srv, -1)
+	client.replWriteOffset = 100
+
+	// the write is acknowledged by no replica, the client is blocked.
+	client.args = []string{"wait", "1", "0"}
+	require.NoError(t, waitCommand(client))
+	require.Equal(t, blockWait, client.blockType)
+	require.Equal(t, []*Client{client}, srv.clientsWaitingAcks)
+	require.True(t, srv.replGetAckPending)
+	require.Empty(t, reply(client))
+
+	replica.args = []string{"replconf", "ack", "80"}
+	require.NoError(t, replConfCommand(replica))
+	require.Equal(t, blockWait, client.blockType)
+
+	// the client is unblocked by the acknowledgement of the write.
+	replica.args = []string{"replconf", "ack", "100"}
+	require.NoError(t, replConfCommand(replica))
+	require.Equal(t, blockNone, client.blockType)
+	require.Empty(t, srv.clientsWaitingAcks)
+	require.Equal(t, []*Client{client}, srv.unblockedClients)
+	require.Equal(t, ":1\r\n", reply(client))
+	require.Zero(t, replica.replayHead.Len())
+
+	// the replicas already acknowledged the write, the client is not blocked.
+	client.args = []string{"wait", "1", "1000"}
+	require.NoError(t, waitCommand(client))
+	require.Equal(t, blockNone, client.blockType)
+	require.Equal(t, ":1\r\n", reply(client))
+}
@@ -12,6 +12,11 @@ const MaxInlineSize = 1024 * 64
 // https://redis.io/docs/reference/protocol-spec/
 func processInputBuffer(client *Client) error {
 	for client.queryLen > 0 {
+		// the commands of a blocked client are processed after it's unblocked.
+		if client.blockType != blockNone {
+			break
+		}
+
 		if client.cmdType == CommandTypeUnknown {
 			switch client.queryBuf[0] {
 			case '*':
@@ -43,9 +48,19 @@ func processInputBuffer(client *Client) error {
 
 		if ok {
 			if len(client.args) > 0 {
+				// the stream of the master is proxied to the backlog and the replicas as it is.
+				var masterStream string
+				if client.flags&clientFlagMaster != 0 {
+					masterStream = catAppendOnlyGenericCommand(client.args)
+				}
+
 				if err := processCommand(client); err != nil {
 					return err
 				}
+
+				if masterStream != "" {
+					replicationFeedStream(client.srv, masterStream)
+				}
 			} else {
 				client.reset()
 			}
@@ -77,7 +92,7 @@ func processInlineBuffer(client *Client) (bool, error) {
 }
 
 func processBulkBuffer(client *Client) (bool, error) {
-	if client.bulkLen == 0 {
+	if client.bulkLen == -1 {
 		index := client.getCRLFIndexFromQueryBuffer()
 		if index == -1 {
 			if client.queryLen > MaxInlineSize {
@@ -105,10 +120,10 @@ func processBulkBuffer(client *Client) (bool, error) {
 		return false, nil
 	}
 
-	client.args = append(client.args, byteutils.B2S(client.queryBuf[0:client.bulkLen]))
+	client.args = append(client.args, bulkString(client.queryBuf[0:client.bulkLen]))
 	client.moveToNextLineInQueryBuffer(client.bulkLen)
 
-	client.bulkLen = 0
+	client.bulkLen = -1
 
 	return true, nil
 }
@@ -140,7 +155,7 @@ func processMultiBulkBuffer(client *Client) (bool, error) {
 	}
 
 	for client.multiBulkLen > 0 {
-		if client.bulkLen == 0 {
+		if client.bulkLen == -1 {
 			index := client.getCRLFIndexFromQueryBuffer()
 			if index == -1 {
 				if client.queryLen > MaxInlineSize {
@@ -163,7 +178,7 @@ func processMultiBulkBuffer(client *Client) (bool, error) {
 			client.moveToNextLineInQueryBuffer(index)
 		}
 
-		if client.queryLen < client.bulkLen {
+		if client.queryLen < client.bulkLen+2 {
 			return false, nil
 		}
 
@@ -172,8 +187,8 @@ func processMultiBulkBuffer(client *Client) (bool, error) {
 			return false, errors.New("expected CRLF for end of bulk string")
 		}
 
-		client.args[len(client.args)-client.multiBulkLen] = byteutils.B2S(client.queryBuf[:index])
-		client.bulkLen = 0
+		client.args[len(client.args)-client.multiBulkLen] = bulkString(client.queryBuf[:index])
+		client.bulkLen = -1
 		client.multiBulkLen--
 
 		client.moveToNextLineInQueryBuffer(index)
@@ -181,3 +196,12 @@ func processMultiBulkBuffer(client *Client) (bool, error) {
 
 	return true, nil
 }
+
+// bulkString converts the bulk to a string without copying, an empty bulk has no underlying array to refer to.
+func bulkString(bulk []byte) string {
+	if len(bulk) == 0 {
+		return ""
+	}
+
+	return byteutils.B2S(bulk)
+}
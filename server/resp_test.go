@@ -99,6 +99,11 @@ func TestProcessMultiBulkBuffer(t *testing.T) {
 			query:    "*0\r\n",
 			expected: nil,
 		},
+		{
+			name:     "Test for multi bulk string with empty bulk",
+			query:    "*3\r\n$3\r\nget\r\n$0\r\n\r\n$1\r\na\r\n",
+			expected: []string{"get", "", "a"},
+		},
 	}
 
 	for index := range testCases {
@@ -116,7 +121,48 @@ func TestProcessMultiBulkBuffer(t *testing.T) {
 	}
 }
 
+func TestProcessInputBufferPipelined(t *testing.T) {
+	t.Parallel()
+
+	client := NewClient(NewServer(&config.Config{}), -1)
+	readQuery(client, catAppendOnlyGenericCommand([]string{"set", "key1", "value1"})+
+		catAppendOnlyGenericCommand([]string{"set", "key2", "value2"})+
+		"*2\r\n$3\r\nget\r\n$4\r\nke")
+	require.NoError(t, processInputBuffer(client))
+	require.Equal(t, "value1", client.db.Dict.Get("key1"))
+	require.Equal(t, "value2", client.db.Dict.Get("key2"))
+	require.Equal(t, 2, client.replayHead.Len())
+
+	// the rest of the last command arrives later.
+	readQuery(client, "y1\r\n")
+	require.NoError(t, processInputBuffer(client))
+	require.Equal(t, 3, client.replayHead.Len())
+	require.Equal(t, "$6\r\nvalue1\r\n", client.replayHead.Back().Value)
+	require.Zero(t, client.queryLen)
+}
+
+func TestProcessMultiBulkBufferSplitEmptyBulk(t *testing.T) {
+	t.Parallel()
+
+	client := NewClient(NewServer(&config.Config{}), -1)
+	readQuery(client, "*2\r\n$3\r\nget\r\n$0\r\n")
+	ok, err := processMultiBulkBuffer(client)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the end of the empty bulk arrives later.
+	readQuery(client, "\r\n")
+	ok, err = processMultiBulkBuffer(client)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []string{"get", ""}, client.args)
+}
+
 func readQuery(client *Client, query string) {
+	if len(client.queryBuf) < client.queryLen+len(query) {
+		client.queryBuf = append(client.queryBuf, make([]byte, len(query))...)
+	}
+
 	for _, c := range query {
 		client.queryBuf[client.queryLen] = byte(c)
 		client.queryLen++
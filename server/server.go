@@ -2,6 +2,7 @@ package server
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -13,6 +14,7 @@ import (
 	"github.com/IfanTsai/metis/ae"
 	"github.com/IfanTsai/metis/config"
 	"github.com/IfanTsai/metis/database"
+	"github.com/IfanTsai/metis/datastruct"
 	"github.com/IfanTsai/metis/log"
 	"github.com/IfanTsai/metis/socket"
 	"github.com/pkg/errors"
@@ -23,6 +25,7 @@ const (
 	maxBulk               = 1024 * 4
 	checkExpireEntryCount = 100
 	serverCronInterval    = 1
+	bgSaveRetryDelay      = 5 * time.Second // wait a few secs before trying again if the last BGSAVE failed
 )
 
 type TypeBackgroundTask uint8
@@ -47,7 +50,9 @@ type Server struct {
 
 	// AOF persistence
 	aofEnable        bool
-	aofFilename      string
+	aofDirname       string
+	aofFilename      string // the base name of the AOF files in aofDirname
+	aofManifest      *aofManifest
 	aofFsync         config.TypeAppnedFsync
 	aofLastFsyncTime time.Time
 	aofSelectDBID    int
@@ -55,11 +60,75 @@ type Server struct {
 	aofBuf           strings.Builder
 	aofCurrentSize   uint
 
-	aofRewritePercent  uint
-	aofRewriteMinSize  uint
-	aofRewriteBaseSize uint
-	aofRewriteDoneCh   chan string // tmp aof filename
-	aofRewriteBuf      strings.Builder
+	aofRewritePercent   uint
+	aofRewriteMinSize   uint
+	aofRewriteBaseSize  uint
+	aofRewriteDoneCh    chan string // tmp aof filename
+	aofRewriteScheduled bool        // rewrite once the background task in progress terminates
+	aofUseRdbPreamble   bool        // use RDB format for the base of the rewritten AOF
+	aofLoadTruncated    bool        // truncate the last AOF file to the last complete command if it's truncated
+
+	// RDB persistence
+	rdbFilename       string
+	rdbSaveDoneCh     chan error // result of background saving
+	rdbSaveFilename   string     // the file written by the background saving, which may be the snapshot for the replicas
+	dirtyBeforeBgSave int64      // dirty when the background saving started
+	saveParams        []config.SaveParam
+	lastSaveTime      time.Time // time of last successful save
+	lastBgSaveTryTime time.Time // time of last BGSAVE attempt
+	lastBgSaveOK      bool
+
+	// replication (master)
+	replicas         []*Client
+	replSelectDBID   int    // the selected database of the replication stream
+	replID           string // the ID of the replication history of this server
+	replID2          string // the ID of the history before this server was promoted
+	masterReplOffset int64  // the offset of the replication stream
+	secondReplOffset int64  // accept PSYNC with replID2 up to this offset
+	replBacklog      *replBacklog
+	replBacklogSize  int
+
+	clientsWaitingAcks []*Client  // the clients blocked by WAIT
+	replGetAckPending  bool       // send REPLCONF GETACK to the replicas before sleeping
+	unblockedClients   []*Client  // the clients unblocked in this iteration of the event loop
+	readyKeys          []readyKey // the keys pushed in this iteration of the event loop, which clients are blocked by
+	replLastPingTime   time.Time
+	replCronLastTime   time.Time
+
+	// replication (replica)
+	masterHost       string
+	masterPort       uint16
+	masterAuth       string
+	master           *Client // the client of the master after the synchronization
+	replicaReadOnly  bool
+	replState        replState
+	replFd           socket.FD // the connection to the master during the handshake and the transfer
+	replHandshakeBuf []byte
+	replTransferFile *os.File // the temp file of the snapshot received from the master
+	replTransferSize int64
+	replTransferRead int64
+	// the replication ID and the offset of the snapshot being received
+	replTransferReplID string
+	replTransferOffset int64
+	// the database selected by the master before the disconnection, which is restored
+	// when the replication stream continues.
+	replCachedMasterDBID int
+	replLastIOTime       time.Time
+
+	// cluster, nil if cluster mode is disabled
+	cluster *clusterState
+
+	// transaction
+	watchedKeys map[watchedKey][]*Client // the clients watching the keys by WATCH
+
+	// pub/sub
+	pubsubChannels map[string][]*Client // the clients subscribed to the channels
+	pubsubPatterns map[string][]*Client // the clients subscribed to the patterns
+	// the types of the keyspace events published, set by notify-keyspace-events
+	notifyKeyspaceEvents notifyFlag
+
+	// the max size of the sparse representation of the HyperLogLogs, set by hll-sparse-max-bytes
+	hllSparseMaxBytes int
 }
 
 func NewServer(config *config.Config) *Server {
@@ -68,41 +137,96 @@ func NewServer(config *config.Config) *Server {
 		dbNum = config.DatabaseNum
 	}
 
+	rdbFilename := rdbDefaultFilename
+	if config.RdbFilename != "" {
+		rdbFilename = config.RdbFilename
+	}
+
+	aofDirname := AofDefaultDirname
+	if config.AofDirname != "" {
+		aofDirname = config.AofDirname
+	}
+
+	aofFilename := aofDefaultFilename
+	if config.AofFilename != "" {
+		aofFilename = config.AofFilename
+	}
+
 	server := &Server{
 		host:              config.Host,
 		port:              config.Port,
 		clients:           make(map[socket.FD]*Client),
+		watchedKeys:       make(map[watchedKey][]*Client),
+		pubsubChannels:    make(map[string][]*Client),
+		pubsubPatterns:    make(map[string][]*Client),
 		requirePassword:   config.RequirePassword,
 		aofEnable:         config.AofEnable,
-		aofFilename:       config.AofFilename,
+		aofDirname:        aofDirname,
+		aofFilename:       filepath.Base(aofFilename),
 		aofFsync:          config.AofFsync,
 		aofRewritePercent: config.AofRewritePercent,
 		aofRewriteMinSize: config.AofRewriteMinSize,
 		aofRewriteDoneCh:  make(chan string, 1),
+		aofUseRdbPreamble: config.AofUseRdbPreamble,
+		aofLoadTruncated:  config.AofLoadTruncated,
+		rdbFilename:       rdbFilename,
+		rdbSaveDoneCh:     make(chan error, 1),
+		saveParams:        config.SaveParams,
+		lastSaveTime:      time.Now(),
+		lastBgSaveOK:      true,
+		replSelectDBID:    -1,
+		masterHost:        config.MasterHost,
+		masterPort:        config.MasterPort,
+		masterAuth:        config.MasterAuth,
+		replicaReadOnly:   config.ReplicaReadOnly,
+		replFd:            -1,
 	}
 
-	server.backgroundTaskTypeAtomic.Store(uint32(TypeBackgroundTaskNone))
+	server.replID = newReplID()
+	server.replID2 = replIDNone
+	server.secondReplOffset = -1
 
-	if server.aofEnable {
-		appendFile, err := os.OpenFile(server.aofFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal("failed to open append only file", zap.Error(err))
-		}
+	server.replBacklogSize = replDefaultBacklogSize
+	if config.ReplBacklogSize > 0 {
+		server.replBacklogSize = int(config.ReplBacklogSize)
+	}
 
-		fileInfo, err := appendFile.Stat()
-		if err != nil {
-			log.Fatal("failed to get append only file info", zap.Error(err))
-		}
+	server.hllSparseMaxBytes = datastruct.HLLSparseMaxBytes
+	if config.HllSparseMaxBytes > 0 {
+		server.hllSparseMaxBytes = config.HllSparseMaxBytes
+	}
 
-		server.aofCurrentSize = uint(fileInfo.Size())
-		server.aofFile = appendFile
+	if server.masterHost != "" {
+		server.replState = replStateConnect
 	}
 
+	server.backgroundTaskTypeAtomic.Store(uint32(TypeBackgroundTaskNone))
+
 	server.dbs = make([]*database.Databse, dbNum)
 	for i := 0; i < dbNum; i++ {
 		server.dbs[i] = database.NewDatabase(i)
 	}
 
+	notifyKeyspaceEvents, ok := keyspaceEventsStringToFlags(config.NotifyKeyspaceEvents)
+	if !ok {
+		log.Fatal("invalid notify-keyspace-events", zap.String("notify-keyspace-events", config.NotifyKeyspaceEvents))
+	}
+
+	server.notifyKeyspaceEvents = notifyKeyspaceEvents
+
+	if config.ClusterEnabled {
+		clusterConfigFile := clusterDefaultConfigFile
+		if config.ClusterConfigFile != "" {
+			clusterConfigFile = config.ClusterConfigFile
+		}
+
+		clusterInit(server, clusterConfigFile)
+	}
+
+	if server.aofEnable {
+		aofOpenOnServerStart(server, aofFilename)
+	}
+
 	return server
 }
 
@@ -122,7 +246,7 @@ func (s *Server) Run() error {
 		return err
 	}
 
-	if err := eventLoop.AddTimeEvent(ae.TypeTimeEventNormal, serverCronInterval, serverCron, s); err != nil {
+	if _, err := eventLoop.AddTimeEvent(ae.TypeTimeEventNormal, serverCronInterval, serverCron, s); err != nil {
 		return err
 	}
 
@@ -132,7 +256,9 @@ func (s *Server) Run() error {
 	s.eventLoop = eventLoop
 
 	if s.aofEnable {
-		loadAppendOnlyFile(s)
+		loadAppendOnlyFiles(s)
+	} else {
+		rdbLoad(s)
 	}
 
 	return eventLoop.Main()
@@ -203,6 +329,7 @@ func readQueryFromClient(el *ae.EventLoop, fd socket.FD, clientData any) {
 	}
 
 	client.queryLen += nRead
+	client.lastInteraction = time.Now()
 	if err := processInputBuffer(client); err != nil {
 		log.Error("failed to process input buffer", zap.Error(err))
 		client.free()
@@ -213,6 +340,27 @@ func readQueryFromClient(el *ae.EventLoop, fd socket.FD, clientData any) {
 
 func sendReplayToClient(el *ae.EventLoop, fd socket.FD, clientData any) {
 	client := clientData.(*Client)
+
+	// the snapshot for the full resynchronization is read from the file by chunks once the replies
+	// before it are sent, and the writable event is kept until the end of the snapshot.
+	for sendReplayListToClient(client) {
+		if client.replSnapshotFile == nil {
+			if err := el.RemoveFileEvent(client.fd, ae.TypeFileEventWritable); err != nil {
+				log.Error("failed to remove file event", zap.Error(err))
+			}
+
+			return
+		}
+
+		if !replicaSendSnapshotChunk(client) {
+			return
+		}
+	}
+}
+
+// sendReplayListToClient writes the replies, it returns false if the socket isn't writable anymore
+// or the client is freed before all of them are sent.
+func sendReplayListToClient(client *Client) bool {
 	for client.replayHead.Len() > 0 {
 		element := client.replayHead.Front()
 		buf := byteutils.S2B(element.Value.(string))
@@ -226,26 +374,20 @@ func sendReplayToClient(el *ae.EventLoop, fd socket.FD, clientData any) {
 					client.free()
 				}
 
-				return
+				return false
 			}
 
 			client.sentLen += nWritten
-			if client.sentLen == len(buf) {
-				client.sentLen = 0
-				client.replayHead.Remove(element)
-			} else {
-				break
+			if client.sentLen != len(buf) {
+				return false
 			}
 		}
-	}
-
-	if client.replayHead.Len() == 0 {
-		if err := el.RemoveFileEvent(client.fd, ae.TypeFileEventWritable); err != nil {
-			log.Error("failed to remove file event", zap.Error(err))
 
-			return
-		}
+		client.sentLen = 0
+		client.replayHead.Remove(element)
 	}
+
+	return true
 }
 
 func serverCron(el *ae.EventLoop, id int64, clientData any) {
@@ -253,6 +395,28 @@ func serverCron(el *ae.EventLoop, id int64, clientData any) {
 
 	databasesCron(srv)
 
+	// if a save point is reached, start a background saving.
+	if srv.backgroundTaskTypeAtomic.Load() == uint32(TypeBackgroundTaskNone) {
+		now := time.Now()
+		for _, param := range srv.saveParams {
+			// save when the given amount of changes, the given amount of seconds and if the latest BGSAVE
+			// was successful or if a BGSAVE was attempted not less than bgSaveRetryDelay ago.
+			if srv.dirty >= param.Changes &&
+				now.Sub(srv.lastSaveTime) > time.Duration(param.Seconds)*time.Second &&
+				(srv.lastBgSaveOK || now.Sub(srv.lastBgSaveTryTime) > bgSaveRetryDelay) {
+				log.Info("changes in seconds, saving...",
+					zap.Int64("changes", param.Changes), zap.Int64("seconds", param.Seconds))
+				rdbSaveBackground(srv)
+
+				break
+			}
+		}
+	}
+
+	if srv.backgroundTaskTypeAtomic.Load() == uint32(TypeBackgroundTaskNone) && srv.aofRewriteScheduled {
+		rewriteAppendOnlyFileBackground(srv)
+	}
+
 	if srv.backgroundTaskTypeAtomic.Load() == uint32(TypeBackgroundTaskNone) &&
 		srv.aofRewritePercent > 0 && srv.aofCurrentSize > srv.aofRewriteMinSize {
 		base := srv.aofRewriteBaseSize
@@ -269,6 +433,16 @@ func serverCron(el *ae.EventLoop, id int64, clientData any) {
 	if len(srv.aofRewriteDoneCh) > 0 {
 		aofRewriteDoneCallback(srv)
 	}
+
+	if len(srv.rdbSaveDoneCh) > 0 {
+		rdbSaveDoneCallback(srv)
+	}
+
+	replicationCron(srv)
+
+	if srv.cluster != nil {
+		clusterCron(srv)
+	}
 }
 
 func databasesCron(srv *Server) {
@@ -288,8 +462,11 @@ func databasesCron(srv *Server) {
 			}
 
 			if when < time.Now().UnixMilli() {
-				db.Dict.Delete(entry.Key)
-				db.Expire.Delete(entry.Key)
+				key := entry.Key.(string)
+				db.Dict.Delete(key)
+				db.Expire.Delete(key)
+				touchWatchedKey(srv, db.ID, key)
+				notifyKeyspaceEvent(srv, notifyExpired, "expired", key, db.ID)
 			}
 		}
 	}
@@ -297,6 +474,21 @@ func databasesCron(srv *Server) {
 
 func beforeSleepProc(el *ae.EventLoop, srv *Server) ae.BeforeSleepProc {
 	return func(el *ae.EventLoop) {
+		// serve the clients blocked by the keys which were pushed.
+		handleClientsBlockedOnKeys(srv)
+
+		// process the commands received while the clients were blocked.
+		processUnblockedClients(srv)
+
+		// ask the replicas for an acknowledgement if there are clients blocked by WAIT.
+		if srv.replGetAckPending {
+			replicationRequestAckFromReplicas(srv)
+		}
+
+		if srv.cluster != nil {
+			clusterBeforeSleep(srv)
+		}
+
 		// write the AOF buffer on disk.
 		flushAppendOnlyFile(srv)
 	}
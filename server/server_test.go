@@ -0,0 +1,38 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IfanTsai/metis/config"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer creates a server with the AOF buffer enabled to check the propagation. It returns the function
+// to take the replies queued to a client, and the function to execute a command by a client and take its replies.
+func newTestServer(t *testing.T, cfg *config.Config) (*Server, func(c *Client) string, func(c *Client, args ...string) string) {
+	t.Helper()
+
+	srv := NewServer(cfg)
+	srv.aofEnable = true
+
+	reply := func(c *Client) string {
+		var sb strings.Builder
+		for e := c.replayHead.Front(); e != nil; e = e.Next() {
+			sb.WriteString(e.Value.(string))
+		}
+
+		c.replayHead.Init()
+
+		return sb.String()
+	}
+
+	execute := func(c *Client, args ...string) string {
+		c.args = args
+		require.NoError(t, processCommand(c))
+
+		return reply(c)
+	}
+
+	return srv, reply, execute
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"net"
 	"syscall"
 
 	"github.com/IfanTsai/metis/socket"
+	"github.com/pkg/errors"
 )
 
 func CreateTCPServer(ip string, port uint16) (socket.FD, error) {
@@ -32,3 +34,50 @@ func CreateTCPServer(ip string, port uint16) (socket.FD, error) {
 
 	return fd, nil
 }
+
+// ConnectTCPServerNonBlock connects to the host in non-blocking mode, the connection
+// is established when the socket becomes writable.
+func ConnectTCPServerNonBlock(host string, port uint16) (socket.FD, error) {
+	ip, err := resolveIPv4(host)
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := socket.Socket(syscall.AF_INET, syscall.SOCK_STREAM)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := fd.SetNonBlock(); err != nil {
+		fd.Close()
+
+		return -1, errors.Wrap(err, "failed to set non block")
+	}
+
+	if err := fd.Connect(ip, port); err != nil && errors.Cause(err) != syscall.EINPROGRESS {
+		fd.Close()
+
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+func resolveIPv4(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %s", host)
+	}
+
+	for _, ip := range ips {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.String(), nil
+		}
+	}
+
+	return "", errors.Errorf("no ipv4 address for %s", host)
+}
@@ -0,0 +1,146 @@
+package server
+
+import "strconv"
+
+// stringMatch reports whether the string matches the glob-style pattern, which supports
+// '*', '?', '[...]' with ranges and '^' for negation, and '\' to escape the next character.
+// The bytes are matched one by one, and a mismatch after a star retries from the next byte
+// of the string, so that the time is bounded by the product of the lengths.
+func stringMatch(pattern, str string, nocase bool) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0 // the pattern after the last star and the string where it started to match
+
+	for s < len(str) {
+		if p < len(pattern) && pattern[p] == '*' {
+			// consecutive stars are the same as one.
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+
+			starP, starS = p, s
+
+			continue
+		}
+
+		if p < len(pattern) {
+			if next, ok := stringMatchByte(pattern, p, str[s], nocase); ok {
+				p, s = next, s+1
+
+				continue
+			}
+		}
+
+		// let the last star match one more byte.
+		if starP < 0 {
+			return false
+		}
+
+		starS++
+		p, s = starP, starS
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// stringMatchByte matches c with the pattern element at p except the star, it returns the position
+// of the next pattern element.
+func stringMatchByte(pattern string, p int, c byte, nocase bool) (int, bool) {
+	equal := func(a, b byte) bool {
+		if nocase {
+			return toLowerByte(a) == toLowerByte(b)
+		}
+
+		return a == b
+	}
+
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		p++
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+
+		matched := false
+		for p < len(pattern) && pattern[p] != ']' {
+			switch {
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				p++
+				matched = matched || equal(pattern[p], c)
+			case p+2 < len(pattern) && pattern[p+1] == '-':
+				start, end := pattern[p], pattern[p+2]
+				if start > end {
+					start, end = end, start
+				}
+
+				if nocase {
+					start, end, c = toLowerByte(start), toLowerByte(end), toLowerByte(c)
+				}
+
+				matched = matched || (c >= start && c <= end)
+				p += 2
+			default:
+				matched = matched || equal(pattern[p], c)
+			}
+
+			p++
+		}
+
+		// skip the closing bracket, the pattern may end without it.
+		if p < len(pattern) {
+			p++
+		}
+
+		return p, matched != not
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+
+		fallthrough
+	default:
+		return p + 1, equal(pattern[p], c)
+	}
+}
+
+func toLowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
+}
+
+// parseStrictInt parses the string as a signed 64 bit integer only in its canonical form, which is
+// the one formatted by strconv.FormatInt: no '+' sign, no spaces and no leading zeros, nor "-0".
+func parseStrictInt(str string) (int64, bool) {
+	if str == "0" {
+		return 0, true
+	}
+
+	digits := str
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+
+	if len(digits) == 0 || digits[0] < '1' || digits[0] > '9' {
+		return 0, false
+	}
+
+	for i := 1; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+	}
+
+	// the digits are valid, so the only error is out of range.
+	num, err := strconv.ParseInt(str, 10, 64)
+
+	return num, err == nil
+}
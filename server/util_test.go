@@ -0,0 +1,78 @@
+package server
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringMatch(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		pattern string
+		str     string
+		nocase  bool
+		matched bool
+	}{
+		{pattern: "*", str: "", matched: true},
+		{pattern: "news.*", str: "news.tech", matched: true},
+		{pattern: "news.*", str: "new.tech", matched: false},
+		{pattern: "h?llo", str: "hello", matched: true},
+		{pattern: "h?llo", str: "hllo", matched: false},
+		{pattern: "h*llo", str: "heeeello", matched: true},
+		{pattern: "h**llo", str: "hllo", matched: true},
+		{pattern: "h[ae]llo", str: "hallo", matched: true},
+		{pattern: "h[ae]llo", str: "hillo", matched: false},
+		{pattern: "h[^e]llo", str: "hallo", matched: true},
+		{pattern: "h[^e]llo", str: "hello", matched: false},
+		{pattern: "h[a-b]llo", str: "hbllo", matched: true},
+		{pattern: "h[b-a]llo", str: "hallo", matched: true},
+		{pattern: "h[a-b]llo", str: "hcllo", matched: false},
+		{pattern: `h\*llo`, str: "h*llo", matched: true},
+		{pattern: `h\*llo`, str: "hello", matched: false},
+		{pattern: `h[\]]llo`, str: "h]llo", matched: true},
+		{pattern: "HELLO", str: "hello", matched: false},
+		{pattern: "HE[L]LO", str: "hello", nocase: true, matched: true},
+		{pattern: "a*b*c", str: "aXXbYYc", matched: true},
+		{pattern: "a*b*c", str: "aXXbYY", matched: false},
+		{pattern: "h[ab", str: "ha", matched: true},
+		{pattern: "h[ab", str: "hax", matched: false},
+		{pattern: "*llo*", str: "hello world", matched: true},
+		// the stars don't take exponential time to fail.
+		{pattern: strings.Repeat("a*", 30) + "b", str: strings.Repeat("a", 100), matched: false},
+	}
+
+	for index := range testCases {
+		testCase := testCases[index]
+		require.Equal(t, testCase.matched, stringMatch(testCase.pattern, testCase.str, testCase.nocase),
+			"pattern: %s, str: %s", testCase.pattern, testCase.str)
+	}
+}
+
+func TestParseStrictInt(t *testing.T) {
+	t.Parallel()
+
+	for str, expected := range map[string]int64{
+		"0":                    0,
+		"1":                    1,
+		"-1":                   -1,
+		"1024":                 1024,
+		"9223372036854775807":  math.MaxInt64,
+		"-9223372036854775808": math.MinInt64,
+	} {
+		num, ok := parseStrictInt(str)
+		require.True(t, ok, str)
+		require.Equal(t, expected, num, str)
+	}
+
+	for _, str := range []string{
+		"", "-", "+1", "01", "-0", "-01", " 1", "1 ", "1a", "1.0",
+		"9223372036854775808", "-9223372036854775809", "99999999999999999999999",
+	} {
+		_, ok := parseStrictInt(str)
+		require.False(t, ok, str)
+	}
+}
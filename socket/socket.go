@@ -32,8 +32,13 @@ func (fd FD) Connect(ip string, port uint16) error {
 		return errors.New("invalid ip address")
 	}
 
+	ipv4Addr := ipAddr.To4()
+	if ipv4Addr == nil {
+		return errors.New("not an ipv4 address")
+	}
+
 	addr := &syscall.SockaddrInet4{Port: int(port)}
-	copy(addr.Addr[:], ipAddr)
+	copy(addr.Addr[:], ipv4Addr)
 	if err := syscall.Connect(int(fd), addr); err != nil {
 		return errors.Wrap(err, "failed to connect socket")
 	}
@@ -99,6 +104,29 @@ func (fd FD) SetSockOpt(level, opt, value int) error {
 	return nil
 }
 
+func (fd FD) GetSockOptInt(level, opt int) (int, error) {
+	value, err := syscall.GetsockoptInt(int(fd), level, opt)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get socket option")
+	}
+
+	return value, nil
+}
+
+func (fd FD) GetPeerName() (*syscall.SockaddrInet4, error) {
+	addr, err := syscall.Getpeername(int(fd))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get peer name")
+	}
+
+	peerAddr, ok := addr.(*syscall.SockaddrInet4)
+	if !ok {
+		return nil, errors.New("not an ipv4 address")
+	}
+
+	return peerAddr, nil
+}
+
 func (fd FD) GetSockName() (*syscall.SockaddrInet4, error) {
 	addr, err := syscall.Getsockname(int(fd))
 	if err != nil {